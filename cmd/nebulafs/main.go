@@ -1,16 +1,32 @@
 package main
 
 import (
+	"bufio"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
 
+	"golang.org/x/net/webdav"
+
+	"github.com/tanmaydeobhankar/nebulafs/internal/api"
+	"github.com/tanmaydeobhankar/nebulafs/internal/crypto"
+	"github.com/tanmaydeobhankar/nebulafs/internal/davfs"
 	"github.com/tanmaydeobhankar/nebulafs/internal/files"
+	"github.com/tanmaydeobhankar/nebulafs/internal/keyring"
+	"github.com/tanmaydeobhankar/nebulafs/internal/lockfile"
+	"github.com/tanmaydeobhankar/nebulafs/internal/namespace"
 	"github.com/tanmaydeobhankar/nebulafs/internal/node"
+	"github.com/tanmaydeobhankar/nebulafs/internal/s3gw"
 )
 
 func main() {
@@ -23,37 +39,272 @@ func main() {
 	startPort := startCmd.Int("port", 3000, "Port to listen on")
 	startPeers := startCmd.String("bootstrap", "", "Comma-separated bootstrap peers")
 	startStorage := startCmd.String("storage", "./storage", "Storage directory foundation")
+	startBackend := startCmd.String("store-backend", "disk", "Chunk store backend: disk or pack")
+	startScrubInterval := startCmd.Duration("scrub-interval", 0, "Interval between background integrity scrubs (0 disables)")
+	startScrubRate := startCmd.Int64("scrub-rate", 10*1024*1024, "Maximum scrub read rate in bytes per second (0 = unlimited)")
+	startAtRest := addAtRestFlags(startCmd)
+	startCipher := startCmd.String("cipher", "aes-256-gcm", "Cipher for new chunks: aes-256-gcm or xchacha20-poly1305")
+	startRepairInterval := startCmd.Duration("repair-interval", 10*time.Minute, "Interval between re-replication checks (0 disables)")
+	startBanDuration := startCmd.Duration("ban-duration", node.DefaultBanDuration, "How long misbehaving peers are banned")
+	startMessageRate := startCmd.Int("message-rate", node.DefaultMessageRate, "Messages per second accepted from one peer before it counts as flooding")
+	startAuditInterval := startCmd.Duration("audit-interval", 30*time.Minute, "Interval between proof-of-storage challenges to replica holders (0 disables)")
+	startRepairReplicas := startCmd.Int("replicas", node.DefaultRepairReplicas, "Replicas to maintain for chunks this node is responsible for")
+	startCold := startCmd.String("cold-storage", "", "Cold tier: a directory or s3://bucket/prefix?endpoint=URL&region=R")
+	startDemoteAfter := startCmd.Duration("demote-after", 24*time.Hour, "Move chunks not accessed for this long to the cold tier")
+	startAPI := startCmd.String("api", api.DefaultAddress, "Control API address, unix:/path or host:port with a token in <storage>/state/api.token (empty disables)")
+	startAPIRoot := startCmd.String("api-root", homeDir(), "Directory the control API may read uploads from and write downloads to")
+	startGateway := startCmd.String("gateway", "", "Serve files read-only over HTTP at /nebula/<root>?key= on this address")
+	startAcceptDeletes := startCmd.Bool("accept-deletes", false, "Drop unpinned chunks when a peer asks (requests are not authenticated)")
 
 	uploadCmd := flag.NewFlagSet("upload", flag.ExitOnError)
 	uploadPath := uploadCmd.String("file", "", "Path to file to upload")
 	uploadPort := uploadCmd.Int("port", 3001, "Port to use for temporary node")
 	uploadPeers := uploadCmd.String("bootstrap", "", "Bootstrap peers")
+	uploadReplicas := uploadCmd.Int("replicas", 3, "Number of peers that must confirm each chunk")
+	uploadResume := uploadCmd.Bool("resume", false, "Continue an interrupted upload of the same file (needs encryption at rest)")
+	uploadAPI := uploadCmd.String("api", api.DefaultAddress, "Control API of a running daemon to use instead of a temporary node")
+	uploadAs := uploadCmd.String("as", "", "Record the upload as the next version of this path (needs a daemon with encryption at rest)")
+	uploadTo := uploadCmd.String("to", "", "Comma-separated recipient keys (hex X25519) to share the file with")
+	uploadConvergent := uploadCmd.Bool("convergent", false, "Encrypt deterministically so unchanged chunks of a new version are reused")
+	uploadPad := uploadCmd.Bool("pad", false, "Pad the last chunk so stored sizes don't reveal the exact file size")
+	uploadCipher := uploadCmd.String("cipher", "", "Cipher for the chunks: aes-256-gcm or xchacha20-poly1305 (default: the node's)")
+	uploadShares := uploadCmd.Int("key-shares", 0, "Also split the key into this many share files (Shamir)")
+	uploadThreshold := uploadCmd.Int("key-threshold", 2, "Number of key shares needed to recover the key")
+	uploadKeyring := addKeyringFlags(uploadCmd)
+	uploadAtRest := addAtRestFlags(uploadCmd) // the temporary node journals uploads only when sealed
 
 	downloadCmd := flag.NewFlagSet("download", flag.ExitOnError)
 	downloadMeta := downloadCmd.String("meta", "", "Path to metadata JSON file")
-	downloadKey := downloadCmd.String("key", "", "Encryption key (hex)")
+	downloadRoot := downloadCmd.String("root", "", "Manifest root (instead of --meta)")
+	downloadKey := downloadCmd.String("key", "", "Encryption key (hex); omit to use the keyring or the daemon's recipient entry")
+	downloadPath := downloadCmd.String("path", "", "Versioned path recorded with 'upload --as' (instead of --meta or --root)")
+	downloadVersion := downloadCmd.Int("version", 0, "Version of --path to download (default latest)")
 	downloadOut := downloadCmd.String("out", "", "Output file path")
 	downloadPort := downloadCmd.Int("port", 3002, "Port to use for temporary node")
 	downloadPeers := downloadCmd.String("bootstrap", "", "Bootstrap peers")
+	downloadParallel := downloadCmd.Int("parallel", node.DefaultFetchParallelism, "Number of chunks fetched concurrently")
+	downloadPerPeer := downloadCmd.Int("per-peer", node.DefaultPerPeerLimit, "Maximum concurrent requests per peer")
+	downloadTimeout := downloadCmd.Duration("fetch-timeout", node.DefaultFetchTimeout, "Time to wait on a provider before trying the next")
+	downloadResume := downloadCmd.Bool("resume", false, "Continue from a previous partial download")
+	downloadAPI := downloadCmd.String("api", api.DefaultAddress, "Control API of a running daemon to use instead of a temporary node")
+	downloadTrust := downloadCmd.String("trust", "", "Comma-separated publisher keys (hex Ed25519, see 'stats') whose manifests are accepted")
+	downloadKeyring := addKeyringFlags(downloadCmd)
+
+	fsckCmd := flag.NewFlagSet("fsck", flag.ExitOnError)
+	fsckStorage := fsckCmd.String("storage", "./storage_3000", "Storage directory of the node to check")
+	fsckBackend := fsckCmd.String("store-backend", "disk", "Chunk store backend: disk or pack")
+	fsckPort := fsckCmd.Int("port", 3003, "Port to use for temporary node")
+	fsckPeers := fsckCmd.String("bootstrap", "", "Bootstrap peers to re-fetch corrupt chunks from")
+	fsckRate := fsckCmd.Int64("rate", 0, "Maximum read rate in bytes per second (0 = unlimited)")
+	fsckLast := fsckCmd.Bool("last", false, "Print the last report written by the background scrubber instead of scrubbing")
+	fsckJSON := fsckCmd.Bool("json", false, "Print the report as JSON")
+	fsckAtRest := addAtRestFlags(fsckCmd)
+
+	s3Cmd := flag.NewFlagSet("s3", flag.ExitOnError)
+	s3Listen := s3Cmd.String("listen", "127.0.0.1:9000", "Address to serve the S3 API on")
+	s3Port := s3Cmd.Int("port", 3004, "Port of the gateway's node")
+	s3Peers := s3Cmd.String("bootstrap", "", "Comma-separated bootstrap peers")
+	s3Storage := s3Cmd.String("storage", "./storage", "Storage directory foundation")
+	s3Replicas := s3Cmd.Int("replicas", 3, "Number of peers that must confirm each chunk of an object")
+	s3Region := s3Cmd.String("region", "us-east-1", "Region reported to clients")
+	s3Anonymous := s3Cmd.Bool("anonymous", false, "Accept unsigned requests when NEBULAFS_S3_ACCESS_KEY is not set")
+	s3AtRest := addAtRestFlags(s3Cmd)
+	s3Cipher := s3Cmd.String("cipher", "aes-256-gcm", "Cipher for new chunks: aes-256-gcm or xchacha20-poly1305")
+
+	webdavCmd := flag.NewFlagSet("webdav", flag.ExitOnError)
+	webdavListen := webdavCmd.String("listen", "127.0.0.1:8081", "Address to serve WebDAV on")
+	webdavPort := webdavCmd.Int("port", 3005, "Port of the WebDAV server's node")
+	webdavPeers := webdavCmd.String("bootstrap", "", "Comma-separated bootstrap peers")
+	webdavStorage := webdavCmd.String("storage", "./storage", "Storage directory foundation")
+	webdavReplicas := webdavCmd.Int("replicas", 3, "Number of peers that must confirm each chunk of a written file")
+	webdavAtRest := addAtRestFlags(webdavCmd)
+	webdavCipher := webdavCmd.String("cipher", "aes-256-gcm", "Cipher for new chunks: aes-256-gcm or xchacha20-poly1305")
+
+	mountCmd := flag.NewFlagSet("mount", flag.ExitOnError)
+	mountPort := mountCmd.Int("port", 3006, "Port of the mount's node")
+	mountPeers := mountCmd.String("bootstrap", "", "Comma-separated bootstrap peers")
+	mountStorage := mountCmd.String("storage", "./storage", "Storage directory foundation")
+	mountReplicas := mountCmd.Int("replicas", 3, "Number of peers that must confirm each chunk of a written file")
+	mountAtRest := addAtRestFlags(mountCmd)
+	mountCipher := mountCmd.String("cipher", "aes-256-gcm", "Cipher for new chunks: aes-256-gcm or xchacha20-poly1305")
+
+	shareCmd := flag.NewFlagSet("share", flag.ExitOnError)
+	shareRoot := shareCmd.String("root", "", "Manifest root of the file to share")
+	shareKey := shareCmd.String("key", "", "Encryption key (hex); omit to use the keyring or if the daemon is a recipient")
+	shareTo := shareCmd.String("to", "", "Comma-separated recipient keys (hex X25519) to add")
+	shareRevoke := shareCmd.String("revoke", "", "Comma-separated recipient keys to remove")
+	shareReplicas := shareCmd.Int("replicas", 3, "Number of peers that must confirm the new manifest")
+	shareAPI := shareCmd.String("api", api.DefaultAddress, "Control API address of the daemon")
+	shareKeyring := addKeyringFlags(shareCmd)
+
+	recoverCmd := flag.NewFlagSet("recover-key", flag.ExitOnError)
+	recoverRoot := recoverCmd.String("root", "", "Root to file the recovered key under in the keyring (default: from the share files)")
+	recoverKeyring := addKeyringFlags(recoverCmd)
+
+	rekeyCmd := flag.NewFlagSet("rekey", flag.ExitOnError)
+	rekeyKey := rekeyCmd.String("key", "", "Current encryption key (hex); omit to use the keyring or if the daemon is a recipient")
+	rekeyReplicas := rekeyCmd.Int("replicas", 3, "Number of peers that must confirm each new chunk")
+	rekeyDelete := rekeyCmd.Bool("delete", false, "Delete the old chunks locally and ask peers holding them to drop theirs")
+	rekeyPublish := rekeyCmd.String("publish", "", "Point the daemon's record with this label at the new root")
+	rekeyAPI := rekeyCmd.String("api", api.DefaultAddress, "Control API address of the daemon")
+	rekeyKeyring := addKeyringFlags(rekeyCmd)
+
+	publishCmd := flag.NewFlagSet("publish", flag.ExitOnError)
+	publishAPI := publishCmd.String("api", api.DefaultAddress, "Control API address of the daemon")
+	publishLabel := publishCmd.String("label", node.DefaultLabel, "Label of the record; each label is a separate name")
+
+	// pin, unpin, resolve, history, ls, peers and stats only talk to a
+	// running daemon
+	daemonCmd := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+	daemonAPI := daemonCmd.String("api", api.DefaultAddress, "Control API address of the daemon")
 
 	switch os.Args[1] {
 	case "start":
 		startCmd.Parse(os.Args[2:])
-		runNode(*startPort, *startPeers, *startStorage)
+		config := newConfig(*startPort, *startPeers, *startStorage)
+		config.Cipher = parseCipher(*startCipher)
+		config.StoreBackend = *startBackend
+		config.ScrubInterval = *startScrubInterval
+		config.ScrubRate = *startScrubRate
+		config.MasterKey = startAtRest.masterKey(config.StorageDir)
+		config.RepairInterval = *startRepairInterval
+		config.RepairReplicas = *startRepairReplicas
+		config.AuditInterval = *startAuditInterval
+		config.BanDuration = *startBanDuration
+		config.MessageRate = *startMessageRate
+		config.ColdStorage = *startCold
+		config.DemoteAfter = *startDemoteAfter
+		config.AcceptDeletes = *startAcceptDeletes
+		runNode(config, apiServer{address: *startAPI, root: *startAPIRoot}, *startGateway)
 	case "upload":
 		uploadCmd.Parse(os.Args[2:])
 		if *uploadPath == "" {
 			uploadCmd.PrintDefaults()
 			os.Exit(1)
 		}
-		runUpload(*uploadPort, *uploadPeers, *uploadPath)
+		opts := node.UploadOptions{
+			Replicas:   *uploadReplicas,
+			Resume:     *uploadResume,
+			Convergent: *uploadConvergent,
+			Pad:        *uploadPad,
+			Cipher:     parseCipher(*uploadCipher),
+			Recipients: splitList(*uploadTo),
+		}
+		split := keySplit{shares: *uploadShares, threshold: *uploadThreshold}
+		if split.shares > 0 && (split.threshold < 2 || split.threshold > split.shares || split.shares > 255) {
+			log.Fatalf("Need 2 <= --key-threshold <= --key-shares <= 255")
+		}
+		config := newConfig(*uploadPort, *uploadPeers, "./storage")
+		config.MasterKey = uploadAtRest.masterKey(config.StorageDir)
+		runUpload(*uploadAPI, config, *uploadPath, *uploadAs, opts, split, uploadKeyring.open())
 	case "download":
 		downloadCmd.Parse(os.Args[2:])
-		if *downloadMeta == "" || *downloadKey == "" || *downloadOut == "" {
+		sources := 0
+		for _, s := range []string{*downloadMeta, *downloadRoot, *downloadPath} {
+			if s != "" {
+				sources++
+			}
+		}
+		if sources != 1 || *downloadOut == "" {
 			downloadCmd.PrintDefaults()
 			os.Exit(1)
 		}
-		runDownload(*downloadPort, *downloadMeta, *downloadKey, *downloadOut, *downloadPeers)
+		if *downloadPath != "" {
+			*downloadRoot, *downloadKey = resolveVersion(*downloadAPI, *downloadPath, *downloadVersion)
+		}
+		config := newConfig(*downloadPort, *downloadPeers, "./storage")
+		config.FetchParallelism = *downloadParallel
+		config.PerPeerLimit = *downloadPerPeer
+		config.FetchTimeout = *downloadTimeout
+		req := api.GetRequest{
+			Root:   *downloadRoot,
+			Key:    *downloadKey,
+			Output: *downloadOut,
+			Resume: *downloadResume,
+			Trust:  splitList(*downloadTrust),
+		}
+		var ring *keyring.Keyring
+		if req.Key == "" {
+			ring = downloadKeyring.open()
+		}
+		runDownload(*downloadAPI, config, *downloadMeta, req, ring)
+	case "fsck":
+		fsckCmd.Parse(os.Args[2:])
+		runFsck(*fsckPort, *fsckPeers, *fsckStorage, *fsckBackend, *fsckRate, *fsckLast, *fsckJSON, fsckAtRest.masterKey(*fsckStorage))
+	case "s3":
+		s3Cmd.Parse(os.Args[2:])
+		config := newConfig(*s3Port, *s3Peers, *s3Storage)
+		config.Cipher = parseCipher(*s3Cipher)
+		*s3AtRest.enabled = true // the object index holds file keys
+		config.MasterKey = s3AtRest.masterKey(config.StorageDir)
+		runS3Gateway(config, *s3Listen, s3gw.Config{
+			AccessKey: os.Getenv("NEBULAFS_S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("NEBULAFS_S3_SECRET_KEY"),
+			Anonymous: *s3Anonymous,
+			Region:    *s3Region,
+			Replicas:  *s3Replicas,
+			TempDir:   filepath.Join(config.StorageDir, "s3tmp"),
+		})
+	case "webdav":
+		webdavCmd.Parse(os.Args[2:])
+		config := newConfig(*webdavPort, *webdavPeers, *webdavStorage)
+		config.Cipher = parseCipher(*webdavCipher)
+		*webdavAtRest.enabled = true // the directory index holds file keys
+		config.MasterKey = webdavAtRest.masterKey(config.StorageDir)
+		runWebDAV(config, *webdavListen, *webdavReplicas)
+	case "mount":
+		mountCmd.Parse(os.Args[2:])
+		if mountCmd.NArg() != 1 {
+			fmt.Println("Usage: nebulafs mount [options] <mountpoint>")
+			mountCmd.PrintDefaults()
+			os.Exit(1)
+		}
+		config := newConfig(*mountPort, *mountPeers, *mountStorage)
+		config.Cipher = parseCipher(*mountCipher)
+		*mountAtRest.enabled = true // the directory index holds file keys
+		config.MasterKey = mountAtRest.masterKey(config.StorageDir)
+		runMount(config, mountCmd.Arg(0), *mountReplicas)
+	case "share":
+		shareCmd.Parse(os.Args[2:])
+		if *shareRoot == "" || (*shareTo == "" && *shareRevoke == "") {
+			shareCmd.PrintDefaults()
+			os.Exit(1)
+		}
+		runShare(*shareAPI, api.ShareRequest{
+			Root:     *shareRoot,
+			Key:      *shareKey,
+			Add:      splitList(*shareTo),
+			Revoke:   splitList(*shareRevoke),
+			Replicas: *shareReplicas,
+		}, shareKeyring.open())
+	case "recover-key":
+		recoverCmd.Parse(os.Args[2:])
+		runRecoverKey(recoverCmd.Args(), *recoverRoot, recoverKeyring.open())
+	case "rekey":
+		rekeyCmd.Parse(os.Args[2:])
+		if rekeyCmd.NArg() != 1 {
+			fmt.Println("Usage: nebulafs rekey [options] <root>")
+			rekeyCmd.PrintDefaults()
+			os.Exit(1)
+		}
+		runRekey(*rekeyAPI, api.RekeyRequest{
+			Root:     rekeyCmd.Arg(0),
+			Key:      *rekeyKey,
+			Replicas: *rekeyReplicas,
+			Delete:   *rekeyDelete,
+			Label:    *rekeyPublish,
+		}, rekeyKeyring.open())
+	case "publish":
+		publishCmd.Parse(os.Args[2:])
+		if publishCmd.NArg() != 1 {
+			fmt.Println("Usage: nebulafs publish [options] <root>")
+			publishCmd.PrintDefaults()
+			os.Exit(1)
+		}
+		runPublish(*publishAPI, api.PublishRequest{Root: publishCmd.Arg(0), Label: *publishLabel})
+	case "pin", "unpin", "resolve", "history", "ls", "peers", "stats", "audit", "reputation":
+		daemonCmd.Parse(os.Args[2:])
+		runDaemonCommand(*daemonAPI, os.Args[1], daemonCmd.Args())
 	default:
 		printUsage()
 		os.Exit(1)
@@ -66,20 +317,157 @@ func printUsage() {
 	fmt.Println("  start     Start a storage node")
 	fmt.Println("  upload    Upload a file")
 	fmt.Println("  download  Download a file")
+	fmt.Println("  fsck      Verify stored chunks and repair corrupt ones")
+	fmt.Println("  s3        Serve an S3-compatible API backed by a node")
+	fmt.Println("  webdav    Serve an encrypted directory tree over WebDAV")
+	fmt.Println("  mount     Mount the encrypted directory tree with FUSE (Linux)")
+	fmt.Println("  pin       Keep a root's chunks on the daemon (pin <root>)")
+	fmt.Println("  unpin     Remove a root from the daemon's pin set")
+	fmt.Println("  share     Give recipients access to a root, or revoke it")
+	fmt.Println("  rekey     Re-encrypt a root under a fresh key (rekey <root>)")
+	fmt.Println("  recover-key  Recombine key share files (recover-key <share>...)")
+	fmt.Println("  publish   Point a signed name at a root (publish <root>)")
+	fmt.Println("  resolve   Look up the latest root of a name (resolve <name>)")
+	fmt.Println("  history   List the versions of a path uploaded with --as")
+	fmt.Println("  ls        List pinned files on the daemon")
+	fmt.Println("  peers     List the daemon's peers")
+	fmt.Println("  stats     Show daemon statistics")
+	fmt.Println("  reputation  Show peer scores and bans")
+	fmt.Println("  audit     Challenge replica holders to prove they store their chunks")
+}
+
+// atRestFlags selects how the node master key is unlocked
+type atRestFlags struct {
+	enabled        *bool
+	keyFile        *string
+	passphraseFile *string
+}
+
+func addAtRestFlags(fs *flag.FlagSet) atRestFlags {
+	return atRestFlags{
+		enabled:        fs.Bool("encrypt-at-rest", false, "Encrypt stored chunks and node state (passphrase from $NEBULAFS_PASSPHRASE unless a file is given)"),
+		keyFile:        fs.String("key-file", "", "File holding the node master key as hex (implies --encrypt-at-rest)"),
+		passphraseFile: fs.String("passphrase-file", "", "File holding the master key passphrase (implies --encrypt-at-rest)"),
+	}
+}
+
+// masterKey returns nil when encryption at rest is off
+func (f atRestFlags) masterKey(storageDir string) []byte {
+	if *f.keyFile != "" {
+		key, err := node.LoadKeyFile(*f.keyFile)
+		if err != nil {
+			log.Fatalf("Failed to load key file: %v", err)
+		}
+		return key
+	}
+	if !*f.enabled && *f.passphraseFile == "" {
+		return nil
+	}
+
+	passphrase := []byte(os.Getenv("NEBULAFS_PASSPHRASE"))
+	if *f.passphraseFile != "" {
+		data, err := os.ReadFile(*f.passphraseFile)
+		if err != nil {
+			log.Fatalf("Failed to read passphrase file: %v", err)
+		}
+		passphrase = []byte(strings.TrimRight(string(data), "\r\n"))
+	}
+
+	key, err := node.UnlockMasterKey(storageDir, passphrase)
+	if err != nil {
+		log.Fatalf("Failed to unlock master key: %v", err)
+	}
+	return key
+}
+
+// keyringFlags locate the local keyring of file keys
+type keyringFlags struct {
+	path           *string
+	passphraseFile *string
+}
+
+func addKeyringFlags(fs *flag.FlagSet) keyringFlags {
+	return keyringFlags{
+		path:           fs.String("keyring", keyring.DefaultPath(), "Keyring file holding file keys by root"),
+		passphraseFile: fs.String("keyring-passphrase-file", "", "File holding the keyring passphrase (default $NEBULAFS_KEYRING_PASSPHRASE)"),
+	}
+}
+
+// open unlocks the keyring, or returns nil when no passphrase is set
+func (f keyringFlags) open() *keyring.Keyring {
+	passphrase := []byte(os.Getenv("NEBULAFS_KEYRING_PASSPHRASE"))
+	if *f.passphraseFile != "" {
+		data, err := os.ReadFile(*f.passphraseFile)
+		if err != nil {
+			log.Fatalf("Failed to read keyring passphrase file: %v", err)
+		}
+		passphrase = []byte(strings.TrimRight(string(data), "\r\n"))
+	}
+	if len(passphrase) == 0 {
+		return nil
+	}
+
+	ring, err := keyring.Open(*f.path, passphrase)
+	if err != nil {
+		log.Fatalf("Failed to open keyring %s: %v", *f.path, err)
+	}
+	return ring
+}
+
+// parseCipher maps a --cipher value to a suite; empty means the default
+func parseCipher(name string) crypto.Suite {
+	if name == "" {
+		return crypto.SuiteLegacy // zero: let the node pick
+	}
+	suite, err := crypto.ParseSuite(name)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return suite
 }
 
-func runNode(port int, peers string, storageBase string) *node.Node {
+// splitList splits a comma-separated flag value, dropping empty items
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func newConfig(port int, peers string, storageBase string) node.NodeConfig {
 	bootstrapList := []string{}
 	if peers != "" {
 		bootstrapList = strings.Split(peers, ",")
 	}
 
-	config := node.NodeConfig{
+	return node.NodeConfig{
 		Port:           port,
 		BootstrapPeers: bootstrapList,
 		StorageDir:     fmt.Sprintf("%s_%d", storageBase, port),
 	}
+}
+
+// apiServer configures the control API of a daemon; an empty address
+// disables it
+type apiServer struct {
+	address string
+	root    string
+}
 
+func homeDir() string {
+	home, _ := os.UserHomeDir()
+	return home
+}
+
+// runNode creates and starts a node. For the start command it serves the
+// control API described by apiConf and the HTTP gateway on gatewayAddr, and
+// blocks.
+func runNode(config node.NodeConfig, apiConf apiServer, gatewayAddr string) *node.Node {
+	port := config.Port
+	lockStorage(config.StorageDir)
 	n, err := node.NewNode(config)
 	if err != nil {
 		log.Fatalf("Failed to create node: %v", err)
@@ -88,6 +476,32 @@ func runNode(port int, peers string, storageBase string) *node.Node {
 	// Only block if running as 'start' command, otherwise return node
 	if len(os.Args) > 1 && os.Args[1] == "start" {
 		log.Printf("Starting NebulaFS node on port %d...", port)
+		if apiConf.address != "" {
+			opts := api.ServerOptions{Root: apiConf.root}
+			if !strings.HasPrefix(apiConf.address, "unix:") {
+				tokenFile := node.StatePath(config.StorageDir, "api.token")
+				if opts.Token, err = api.LoadToken(tokenFile); err != nil {
+					log.Fatalf("Failed to load API token: %v", err)
+				}
+				log.Printf("Control API token in %s (clients read it from $%s)", tokenFile, api.TokenEnv)
+			}
+			go func() {
+				// Another local node may already own the address; keep running without
+				if err := api.ListenAndServe(apiConf.address, n, opts); err != nil {
+					log.Printf("Control API disabled: %v", err)
+				}
+			}()
+			log.Printf("Control API on %s", apiConf.address)
+		}
+		if gatewayAddr != "" {
+			go func() {
+				if err := api.ListenAndServeGateway(gatewayAddr, n); err != nil {
+					log.Fatalf("Gateway error: %v", err)
+				}
+			}()
+			log.Printf("HTTP gateway on http://%s/nebula/", gatewayAddr)
+		}
+		closeOnSignal(n)
 		if err := n.Start(); err != nil {
 			log.Fatalf("Node error: %v", err)
 		}
@@ -98,53 +512,570 @@ func runNode(port int, peers string, storageBase string) *node.Node {
 	return n
 }
 
-func runUpload(port int, peers string, path string) {
-	n := runNode(port, peers, "./storage")
+// storageLock keeps other nebulafs processes off this one's storage dir
+// until it exits
+var storageLock *lockfile.Lock
 
-	if peers != "" {
-		fmt.Println("Waiting for bootstrap...")
-		time.Sleep(1 * time.Second)
+func lockStorage(dir string) {
+	if dir == "" {
+		return
+	}
+	var err error
+	storageLock, err = node.LockStorage(dir)
+	if errors.Is(err, lockfile.ErrLocked) {
+		log.Fatalf("%s is in use by another nebulafs process; stop it first", dir)
 	}
-
-	fmt.Println("Uploading...")
-	meta, key, err := n.UploadFile(path)
 	if err != nil {
+		log.Fatalf("Failed to lock %s: %v", dir, err)
+	}
+}
+
+// closeOnSignal flushes the node's chunk store and exits on SIGINT or SIGTERM
+func closeOnSignal(n *node.Node) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		if err := n.Close(); err != nil {
+			log.Printf("Failed to close chunk store: %v", err)
+		}
+		os.Exit(0)
+	}()
+}
+
+// keySplit asks for the file key to be split into share files; shares is 0
+// when not splitting
+type keySplit struct {
+	shares    int
+	threshold int
+}
+
+func runUpload(apiAddr string, config node.NodeConfig, path string, as string, opts node.UploadOptions, split keySplit, ring *keyring.Keyring) {
+	var result node.AddResult
+	var err error
+	if daemon, dialErr := api.Dial(apiAddr); dialErr == nil {
+		fmt.Printf("Uploading through daemon at %s...\n", apiAddr)
+		absPath, _ := filepath.Abs(path)
+		var cipherName string
+		if opts.Cipher != crypto.SuiteLegacy {
+			cipherName = opts.Cipher.String()
+		}
+		result, err = daemon.Add(api.AddRequest{
+			Path:       absPath,
+			Replicas:   opts.Replicas,
+			Resume:     opts.Resume,
+			As:         as,
+			Convergent: opts.Convergent,
+			Recipients: opts.Recipients,
+			Pad:        opts.Pad,
+			Cipher:     cipherName,
+		})
+	} else if as != "" {
+		// Version history is kept by the daemon
+		log.Fatalf("No daemon at %s (start one with 'nebulafs start'): %v", apiAddr, dialErr)
+	} else if opts.Resume && config.MasterKey == nil {
+		// Only sealed nodes keep an upload journal, which holds the file key
+		log.Fatalf("--resume needs --encrypt-at-rest, --key-file or --passphrase-file, on this upload and the one it continues")
+	} else {
+		n := runNode(config, apiServer{}, "")
+
+		if len(config.BootstrapPeers) > 0 {
+			fmt.Println("Waiting for bootstrap...")
+			time.Sleep(1 * time.Second)
+		}
+
+		fmt.Println("Uploading...")
+		result, err = n.Add(path, opts)
+		n.Close()
+	}
+
+	// A replication shortfall still stores the file locally, so its root and
+	// key are kept before exiting non-zero
+	var replErr *node.ReplicationError
+	if err != nil && !(errors.As(err, &replErr) && result.Root != "") {
 		log.Fatalf("Upload failed: %v", err)
 	}
 
-	// Save metadata to valid JSON to copy-paste
+	// Save metadata to valid JSON to copy-paste. Name, size and type are
+	// sealed inside it, so the file name comes from the local path.
+	meta := result.Metadata
+	name := filepath.Base(path)
 	metaJson, _ := json.MarshalIndent(meta, "", "  ")
-	fmt.Printf("\n=== File Uploaded Successfully ===\n")
+	if replErr != nil {
+		fmt.Printf("\n=== Upload Incomplete ===\n")
+	} else {
+		fmt.Printf("\n=== File Uploaded Successfully ===\n")
+	}
 	fmt.Printf("File ID: %s\n", meta.ID)
-	fmt.Printf("Key: %s\n", key)
+	fmt.Printf("Root: %s\n", result.Root)
+	if ring != nil {
+		err := ring.Put(keyring.Entry{Root: result.Root, FileID: meta.ID, Name: name, Key: result.Key})
+		if err != nil {
+			log.Fatalf("Failed to save key to keyring: %v", err)
+		}
+		fmt.Printf("Key: saved to keyring %s\n", ring.Path())
+	} else {
+		fmt.Printf("Key: %s\n", result.Key)
+	}
+	if result.Version > 0 {
+		fmt.Printf("Version: %d of %s (parent %s)\n", result.Version, as, meta.Parent)
+	}
+	if split.shares > 0 {
+		writeKeyShares(name, result.Root, result.Key, split)
+	}
 	fmt.Printf("Metadata:\n%s\n", string(metaJson))
 
 	// Save meta to file for convenience
-	os.WriteFile(meta.Name+".meta.json", metaJson, 0644)
-	fmt.Printf("Metadata saved to %s.meta.json\n", meta.Name)
+	os.WriteFile(name+".meta.json", metaJson, 0644)
+	fmt.Printf("Metadata saved to %s.meta.json\n", name)
+
+	if replErr != nil {
+		for _, c := range replErr.Short {
+			fmt.Printf("Chunk %s: %d/%d replicas %v\n", c.Hash, len(c.Peers), replErr.Wanted, c.Peers)
+		}
+		log.Fatalf("Upload failed: %v", err)
+	}
+}
+
+// writeKeyShares splits the key and writes each share to its own file,
+// to be handed to different people or printed as QR codes
+func writeKeyShares(name, root, keyHex string, split keySplit) {
+	key, err := hex.DecodeString(keyHex)
+	if err != nil {
+		log.Fatalf("Invalid key: %v", err)
+	}
+	shares, err := crypto.SplitSecret(key, split.shares, split.threshold)
+	if err != nil {
+		log.Fatalf("Failed to split key: %v", err)
+	}
+	for _, s := range shares {
+		path := fmt.Sprintf("%s.key-share-%d.txt", name, s.X)
+		text := fmt.Sprintf("# nebulafs key share %d of %d, any %d recover the key\n# file: %s\n# root: %s\n%s\n",
+			s.X, len(shares), s.Threshold, name, root, s)
+		if err := os.WriteFile(path, []byte(text), 0600); err != nil {
+			log.Fatalf("Failed to write key share: %v", err)
+		}
+	}
+	fmt.Printf("Key split into %d shares (%s.key-share-N.txt), any %d recover it with 'nebulafs recover-key'\n",
+		len(shares), name, split.threshold)
 }
 
-func runDownload(port int, metaPath string, key string, out string, peers string) {
-	n := runNode(port, peers, "./storage")
+// runRecoverKey combines key shares read from files, or from stdin one per
+// line, and files the key in the keyring or prints it
+func runRecoverKey(paths []string, root string, ring *keyring.Keyring) {
+	var lines []string
+	if len(paths) == 0 {
+		fmt.Println("Paste key shares, one per line, then end input (Ctrl-D):")
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+	}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Fatalf("Failed to read share: %v", err)
+		}
+		lines = append(lines, strings.Split(string(data), "\n")...)
+	}
 
-	if peers != "" {
-		fmt.Println("Waiting for bootstrap...")
-		time.Sleep(1 * time.Second)
+	var shares []crypto.Share
+	name := ""
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "# root: "):
+			if root == "" {
+				root = strings.TrimPrefix(line, "# root: ")
+			}
+		case strings.HasPrefix(line, "# file: "):
+			name = strings.TrimPrefix(line, "# file: ")
+		case strings.HasPrefix(line, "#"):
+		default:
+			s, err := crypto.ParseShare(line)
+			if err != nil {
+				log.Fatalf("Invalid share %q: %v", line, err)
+			}
+			shares = append(shares, s)
+		}
 	}
 
-	metaBytes, err := os.ReadFile(metaPath)
+	key, err := crypto.CombineShares(shares)
 	if err != nil {
-		log.Fatalf("Failed to read metadata: %v", err)
+		log.Fatalf("Cannot recover key: %v", err)
+	}
+	keyHex := hex.EncodeToString(key)
+	if ring != nil && root != "" {
+		entry, _ := ring.Get(root)
+		entry.Root, entry.Key = root, keyHex
+		if entry.Name == "" {
+			entry.Name = name
+		}
+		if err := ring.Put(entry); err != nil {
+			log.Fatalf("Failed to save key to keyring: %v", err)
+		}
+		fmt.Printf("Key for %s saved to keyring %s\n", root, ring.Path())
+		return
 	}
+	fmt.Printf("Key: %s\n", keyHex)
+}
 
-	var meta files.FileMetadata
-	if err := json.Unmarshal(metaBytes, &meta); err != nil {
-		log.Fatalf("Invalid metadata: %v", err)
+// resolveVersion looks up the root and key of a version of a path in the
+// daemon's history; version 0 is the latest
+func resolveVersion(apiAddr string, path string, version int) (string, string) {
+	daemon, err := api.Dial(apiAddr)
+	if err != nil {
+		log.Fatalf("No daemon at %s (start one with 'nebulafs start'): %v", apiAddr, err)
+	}
+	versions, err := daemon.History(path)
+	if err != nil {
+		log.Fatalf("history failed: %v", err)
 	}
+	if version == 0 {
+		version = len(versions)
+	}
+	if version < 1 || version > len(versions) {
+		log.Fatalf("%s has versions 1 to %d", path, len(versions))
+	}
+	v := versions[version-1]
+	return v.Root, v.Key
+}
 
-	fmt.Println("Downloading...")
-	if err := n.DownloadFile(meta, key, out); err != nil {
+// runDownload fetches req.Root, or the file described by metaPath, through a
+// running daemon if there is one and a temporary node otherwise
+func runDownload(apiAddr string, config node.NodeConfig, metaPath string, req api.GetRequest, ring *keyring.Keyring) {
+	if metaPath != "" {
+		metaBytes, err := os.ReadFile(metaPath)
+		if err != nil {
+			log.Fatalf("Failed to read metadata: %v", err)
+		}
+
+		var meta files.FileMetadata
+		if err := json.Unmarshal(metaBytes, &meta); err != nil {
+			log.Fatalf("Invalid metadata: %v", err)
+		}
+		req.Metadata = &meta
+	}
+
+	// Without a key or a keyring entry the daemon unwraps its recipient entry
+	if req.Key == "" && ring != nil {
+		var e keyring.Entry
+		var ok bool
+		if req.Metadata != nil {
+			e, ok = ring.FindFile(req.Metadata.ID)
+		} else {
+			e, ok = ring.Get(req.Root)
+		}
+		if ok {
+			req.Key = e.Key
+		}
+	}
+
+	var err error
+	if daemon, dialErr := api.Dial(apiAddr); dialErr == nil {
+		fmt.Printf("Downloading through daemon at %s...\n", apiAddr)
+		if req.Output, err = filepath.Abs(req.Output); err != nil {
+			log.Fatalf("Invalid output path: %v", err)
+		}
+		err = daemon.Get(req)
+	} else {
+		n := runNode(config, apiServer{}, "")
+
+		if len(config.BootstrapPeers) > 0 {
+			fmt.Println("Waiting for bootstrap...")
+			time.Sleep(1 * time.Second)
+		}
+
+		fmt.Println("Downloading...")
+		opts := node.DownloadOptions{Resume: req.Resume, Trust: req.Trust}
+		if req.Metadata != nil {
+			err = n.DownloadFile(*req.Metadata, req.Key, req.Output, opts)
+		} else {
+			err = n.Get(req.Root, req.Key, req.Output, opts)
+		}
+		n.Close()
+	}
+	if err != nil {
 		log.Fatalf("Download failed: %v", err)
 	}
-	fmt.Printf("File downloaded to: %s\n", out)
+	fmt.Printf("File downloaded to: %s\n", req.Output)
+}
+
+// runS3Gateway runs a node with the S3 API in front of it
+func runS3Gateway(config node.NodeConfig, listen string, gwConfig s3gw.Config) {
+	if gwConfig.AccessKey == "" && !gwConfig.Anonymous {
+		log.Fatalf("Set NEBULAFS_S3_ACCESS_KEY and NEBULAFS_S3_SECRET_KEY, or pass --anonymous to accept unsigned requests")
+	}
+	n := runNode(config, apiServer{}, "")
+	closeOnSignal(n)
+	gw, err := s3gw.NewServer(n, gwConfig)
+	if err != nil {
+		log.Fatalf("Failed to start S3 gateway: %v", err)
+	}
+
+	if gwConfig.AccessKey == "" {
+		log.Printf("Anonymous access: accepting unsigned requests")
+	}
+	log.Printf("S3 gateway on http://%s (path-style)", listen)
+	log.Fatal(http.ListenAndServe(listen, gw))
+}
+
+// openNamespace opens the directory tree kept in the node's state, sealed
+// with a key derived from the master key
+func openNamespace(n *node.Node, masterKey []byte) *namespace.Namespace {
+	nsKey, err := namespace.DeriveKey(masterKey)
+	if err != nil {
+		log.Fatalf("Failed to derive namespace key: %v", err)
+	}
+	ns, err := namespace.Open(n, nsKey)
+	if err != nil {
+		log.Fatalf("Failed to open namespace: %v", err)
+	}
+	return ns
+}
+
+// runWebDAV runs a node with a WebDAV server over its namespace
+func runWebDAV(config node.NodeConfig, listen string, replicas int) {
+	n := runNode(config, apiServer{}, "")
+	closeOnSignal(n)
+	ns := openNamespace(n, config.MasterKey)
+	fs, err := davfs.New(n, ns, replicas, filepath.Join(config.StorageDir, "davtmp"))
+	if err != nil {
+		log.Fatalf("Failed to start WebDAV: %v", err)
+	}
+
+	handler := &webdav.Handler{
+		FileSystem: fs,
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				log.Printf("WebDAV %s %s: %v", r.Method, r.URL.Path, err)
+			}
+		},
+	}
+	// The tree is served unlocked, so even on loopback other local users
+	// must not reach it without the password
+	passwordFile := node.StatePath(config.StorageDir, "webdav.password")
+	password, err := api.LoadToken(passwordFile)
+	if err != nil {
+		log.Fatalf("Failed to load WebDAV password: %v", err)
+	}
+	log.Printf("WebDAV on http://%s/ as user %q, password in %s", listen, davfs.DefaultUser, passwordFile)
+	log.Fatal(http.ListenAndServe(listen, davfs.RequireAuth(handler, davfs.DefaultUser, password)))
+}
+
+// runDaemonCommand runs one of the commands that only make sense against a
+// running daemon
+func runDaemonCommand(apiAddr string, command string, args []string) {
+	daemon, err := api.Dial(apiAddr)
+	if err != nil {
+		log.Fatalf("No daemon at %s (start one with 'nebulafs start'): %v", apiAddr, err)
+	}
+
+	switch command {
+	case "pin", "unpin":
+		if len(args) != 1 {
+			log.Fatalf("Usage: nebulafs %s [--api ADDR] <root>", command)
+		}
+		if command == "pin" {
+			err = daemon.Pin(args[0])
+		} else {
+			err = daemon.Unpin(args[0])
+		}
+		if err != nil {
+			log.Fatalf("%s failed: %v", command, err)
+		}
+		fmt.Printf("%s: %s\n", command, args[0])
+	case "resolve":
+		if len(args) != 1 {
+			log.Fatalf("Usage: nebulafs resolve [--api ADDR] <name>")
+		}
+		record, err := daemon.Resolve(args[0])
+		if err != nil {
+			log.Fatalf("resolve failed: %v", err)
+		}
+		fmt.Printf("Root: %s\nSeq: %d\n", record.Root, record.Seq)
+	case "history":
+		if len(args) != 1 {
+			log.Fatalf("Usage: nebulafs history [--api ADDR] <path>")
+		}
+		versions, err := daemon.History(args[0])
+		if err != nil {
+			log.Fatalf("history failed: %v", err)
+		}
+		for _, v := range versions {
+			fmt.Printf("v%-3d %s  %10d  %d/%d chunks reused  %s\n",
+				v.Version, v.Root, v.Size, v.Reused, v.Chunks, v.Added.Format(time.RFC3339))
+		}
+	case "ls":
+		pins, err := daemon.List()
+		if err != nil {
+			log.Fatalf("ls failed: %v", err)
+		}
+		for _, p := range pins {
+			fmt.Printf("%s  %10d  %s\n", p.Root, p.Size, p.Name)
+		}
+	case "peers":
+		peers, err := daemon.Peers()
+		if err != nil {
+			log.Fatalf("peers failed: %v", err)
+		}
+		for _, p := range peers {
+			fmt.Printf("%s  %s  %.2f\n", p.ID, p.Address, p.Score)
+		}
+	case "stats":
+		stats, err := daemon.Stats()
+		if err != nil {
+			log.Fatalf("stats failed: %v", err)
+		}
+		data, _ := json.MarshalIndent(stats, "", "  ")
+		fmt.Println(string(data))
+	case "reputation":
+		list, err := daemon.Reputation()
+		if err != nil {
+			log.Fatalf("reputation failed: %v", err)
+		}
+		for _, p := range list {
+			status := ""
+			if !p.BannedUntil.IsZero() {
+				status = "banned until " + p.BannedUntil.Format(time.RFC3339)
+			}
+			fmt.Printf("%-21s  %.2f  ok %d  timeouts %d  corrupt %d  violations %d  flooded %d  %s\n",
+				p.Address, p.Score, p.Successes, p.Timeouts, p.Corrupt, p.Violations, p.Flooded, status)
+		}
+	case "audit":
+		report, err := daemon.Audit()
+		if err != nil {
+			log.Fatalf("audit failed: %v", err)
+		}
+		data, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(data))
+	}
+}
+
+// runShare writes a manifest with an updated recipient list through the
+// daemon, which can unwrap the file key with its own recipient entry
+func runShare(apiAddr string, req api.ShareRequest, ring *keyring.Keyring) {
+	daemon, err := api.Dial(apiAddr)
+	if err != nil {
+		log.Fatalf("No daemon at %s (start one with 'nebulafs start'): %v", apiAddr, err)
+	}
+	var entry keyring.Entry
+	var known bool
+	if ring != nil {
+		if entry, known = ring.Get(req.Root); known && req.Key == "" {
+			req.Key = entry.Key
+		}
+	}
+	root, err := daemon.Share(req)
+	if err != nil {
+		log.Fatalf("share failed: %v", err)
+	}
+	fmt.Printf("Root: %s\n", root)
+	// The new manifest keeps the file key, so the keyring can open it too
+	if known {
+		entry.Root = root
+		entry.Added = time.Time{}
+		if err := ring.Put(entry); err != nil {
+			log.Fatalf("Failed to save key to keyring: %v", err)
+		}
+	}
+	if len(req.Revoke) > 0 {
+		fmt.Println("Revoked recipients can still read the old root; re-upload the file under a new key to lock them out.")
+	}
+}
+
+// runRekey replaces a file with a copy under a new key and moves its
+// keyring entry over
+func runRekey(apiAddr string, req api.RekeyRequest, ring *keyring.Keyring) {
+	daemon, err := api.Dial(apiAddr)
+	if err != nil {
+		log.Fatalf("No daemon at %s (start one with 'nebulafs start'): %v", apiAddr, err)
+	}
+	var entry keyring.Entry
+	var known bool
+	if ring != nil {
+		if entry, known = ring.Get(req.Root); known && req.Key == "" {
+			req.Key = entry.Key
+		}
+	}
+	result, err := daemon.Rekey(req)
+	if err != nil {
+		log.Fatalf("rekey failed: %v", err)
+	}
+
+	fmt.Printf("Old root: %s (unpinned)\n", result.OldRoot)
+	fmt.Printf("Root: %s\n", result.Root)
+	if ring != nil {
+		entry.Root, entry.Key, entry.Added = result.Root, result.Key, time.Time{}
+		if err := ring.Put(entry); err != nil {
+			log.Fatalf("Failed to save key to keyring: %v", err)
+		}
+		fmt.Printf("Key: saved to keyring %s\n", ring.Path())
+	} else {
+		fmt.Printf("Key: %s\n", result.Key)
+	}
+	if req.Delete {
+		fmt.Printf("Deleted %d old chunks locally, sent %d delete requests to peers\n", result.Deleted, result.Requested)
+	}
+	if req.Label != "" {
+		fmt.Printf("Record %q now points at the new root\n", req.Label)
+	}
+}
+
+// runPublish publishes a record through the daemon, which holds the
+// signing identity
+func runPublish(apiAddr string, req api.PublishRequest) {
+	daemon, err := api.Dial(apiAddr)
+	if err != nil {
+		log.Fatalf("No daemon at %s (start one with 'nebulafs start'): %v", apiAddr, err)
+	}
+	result, err := daemon.Publish(req)
+	if err != nil {
+		log.Fatalf("publish failed: %v", err)
+	}
+	fmt.Printf("Name: %s\nSeq: %d\nStored on %d peers\n", result.Record.Name, result.Record.Seq, result.Peers)
+}
+
+func runFsck(port int, peers string, storageDir string, backend string, rate int64, last bool, asJSON bool, masterKey []byte) {
+	var report node.ScrubReport
+	if last {
+		var err error
+		if report, err = node.LastScrubReport(storageDir, masterKey); err != nil {
+			log.Fatalf("No scrub report available: %v", err)
+		}
+	} else {
+		config := newConfig(port, peers, "")
+		config.StorageDir = storageDir
+		config.StoreBackend = backend
+		config.MasterKey = masterKey
+		if asJSON {
+			config.Log = os.Stderr // keep stdout to the report
+		}
+		n := runNode(config, apiServer{}, "")
+
+		if peers != "" {
+			time.Sleep(1 * time.Second)
+		}
+		report = n.Scrub(rate)
+		n.Close()
+	}
+
+	if asJSON {
+		data, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(data))
+	} else {
+		fmt.Printf("Checked %d chunks (%d bytes) in %dms\n", report.Checked, report.Bytes, report.DurationMs)
+		for _, c := range report.Corrupt {
+			fmt.Printf("  %s: %s %s\n", c.Hash, c.Status, c.Error)
+		}
+		if len(report.Corrupt) == 0 {
+			fmt.Println("No corruption found")
+		}
+	}
+
+	if !report.Healthy() {
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestMain runs the CLI itself when re-executed by a test
+func TestMain(m *testing.M) {
+	if os.Getenv("NEBULAFS_RUN_MAIN") == "1" {
+		os.Args = append([]string{"nebulafs"}, strings.Fields(os.Getenv("NEBULAFS_ARGS"))...)
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func runCLI(t *testing.T, dir string, args ...string) (string, error) {
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "NEBULAFS_RUN_MAIN=1", "NEBULAFS_ARGS="+strings.Join(args, " "))
+	out, err := cmd.CombinedOutput()
+	return string(out), err
+}
+
+func TestUploadResumeNeedsEncryption(t *testing.T) {
+	tmpDir := t.TempDir()
+	file := filepath.Join(tmpDir, "doc.txt")
+	os.WriteFile(file, []byte("resume me"), 0644)
+	noDaemon := "unix:" + filepath.Join(tmpDir, "none.sock")
+
+	out, err := runCLI(t, tmpDir, "upload", "--file", file, "--resume", "--api", noDaemon)
+	if err == nil {
+		t.Fatalf("Resuming without encryption at rest should fail:\n%s", out)
+	}
+	if !strings.Contains(out, "--resume needs --encrypt-at-rest") {
+		t.Errorf("Expected a message about encryption at rest, got:\n%s", out)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "storage")); !os.IsNotExist(err) {
+		t.Errorf("The upload started a node before refusing")
+	}
+}
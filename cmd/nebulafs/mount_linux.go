@@ -0,0 +1,42 @@
+//go:build linux
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/tanmaydeobhankar/nebulafs/internal/fusefs"
+	"github.com/tanmaydeobhankar/nebulafs/internal/node"
+)
+
+// runMount runs a node and mounts its namespace at dir until interrupted
+func runMount(config node.NodeConfig, dir string, replicas int) {
+	n := runNode(config, apiServer{}, "")
+	ns := openNamespace(n, config.MasterKey)
+	fsys, err := fusefs.New(n, ns, replicas, filepath.Join(config.StorageDir, "fusetmp"))
+	if err != nil {
+		log.Fatalf("Failed to start mount: %v", err)
+	}
+	server, err := fsys.Mount(dir)
+	if err != nil {
+		log.Fatalf("Failed to mount %s: %v", dir, err)
+	}
+	log.Printf("Mounted on %s", dir)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		if err := server.Unmount(); err != nil {
+			log.Printf("Unmount failed (files still open?): %v", err)
+		}
+	}()
+	server.Wait()
+	if err := n.Close(); err != nil {
+		log.Printf("Failed to close chunk store: %v", err)
+	}
+}
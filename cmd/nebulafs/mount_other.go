@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"log"
+
+	"github.com/tanmaydeobhankar/nebulafs/internal/node"
+)
+
+func runMount(config node.NodeConfig, dir string, replicas int) {
+	log.Fatalf("mount is only supported on Linux")
+}
@@ -2,4 +2,11 @@ module github.com/tanmaydeobhankar/nebulafs
 
 go 1.25.5
 
-require github.com/gorilla/websocket v1.5.3 // indirect
+require (
+	github.com/gorilla/websocket v1.5.3
+	github.com/hanwen/go-fuse/v2 v2.9.0
+	golang.org/x/crypto v0.45.0
+	golang.org/x/net v0.47.0
+)
+
+require golang.org/x/sys v0.38.0 // indirect
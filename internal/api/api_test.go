@@ -0,0 +1,239 @@
+package api
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tanmaydeobhankar/nebulafs/internal/node"
+	"github.com/tanmaydeobhankar/nebulafs/internal/p2p"
+	"github.com/tanmaydeobhankar/nebulafs/internal/storage"
+)
+
+// newMemoryNode starts a node backed by a MemoryStore on net
+func newMemoryNode(t *testing.T, net *p2p.MemoryNetwork, port int, storageDir string, bootstrap ...string) *node.Node {
+	n, err := node.NewNode(node.NodeConfig{
+		Port:           port,
+		BootstrapPeers: bootstrap,
+		StorageDir:     storageDir,
+		Store:          storage.NewMemoryStore(),
+		Transport:      net.NewTransport(fmt.Sprintf("127.0.0.1:%d", port)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go n.Start()
+	return n
+}
+
+func TestControlAPI(t *testing.T) {
+	tmpDir := t.TempDir()
+	n := newMemoryNode(t, p2p.NewMemoryNetwork(1), 8100, filepath.Join(tmpDir, "node"))
+
+	socket := filepath.Join(tmpDir, "api.sock")
+	l, err := Listen("unix:" + socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go http.Serve(l, NewServer(n, ServerOptions{Root: tmpDir}))
+	defer l.Close()
+
+	client, err := Dial("unix:" + socket)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+
+	content := []byte("Served by the daemon")
+	inputFile := filepath.Join(tmpDir, "doc.txt")
+	os.WriteFile(inputFile, content, 0644)
+
+	// No peers: replication shortfalls come back as a ReplicationError,
+	// along with the root and key of the locally stored file
+	short, err := client.Add(AddRequest{Path: inputFile, Replicas: 1})
+	var replErr *node.ReplicationError
+	if !errors.As(err, &replErr) || replErr.Wanted != 1 {
+		t.Fatalf("Expected a ReplicationError, got %v", err)
+	}
+	if short.Root == "" || short.Key == "" || len(replErr.Short) != 2 {
+		t.Errorf("Expected the root, key and chunk plus manifest shortfall, got %+v (%v)", short, err)
+	}
+
+	result, err := client.Add(AddRequest{Path: inputFile})
+	if err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	if result.Root == "" || len(result.Metadata.Chunks) != 1 || result.Metadata.Chunks[0].Content != nil {
+		t.Errorf("Unexpected add result: %+v", result)
+	}
+
+	outputFile := filepath.Join(tmpDir, "out.txt")
+	if err := client.Get(GetRequest{Root: result.Root, Key: result.Key, Output: outputFile}); err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if got, _ := os.ReadFile(outputFile); !bytes.Equal(got, content) {
+		t.Errorf("Content mismatch after get")
+	}
+
+	// The short upload stays pinned too, so it can be replicated later
+	pins, err := client.List()
+	if err != nil || len(pins) != 2 {
+		t.Fatalf("Unexpected pin set: %+v (%v)", pins, err)
+	}
+	for _, p := range pins {
+		if (p.Root != result.Root && p.Root != short.Root) || p.Name != "doc.txt" {
+			t.Fatalf("Unexpected pin set: %+v", pins)
+		}
+	}
+	if err := client.Unpin(result.Root); err != nil {
+		t.Fatalf("Unpin failed: %v", err)
+	}
+	if err := client.Unpin(result.Root); err == nil {
+		t.Errorf("Unpinning twice should fail")
+	}
+	if err := client.Pin(result.Root); err != nil {
+		t.Fatalf("Pin failed: %v", err)
+	}
+
+	stats, err := client.Stats()
+	if err != nil {
+		t.Fatalf("Stats failed: %v", err)
+	}
+	if stats.Pins != 2 || stats.Chunks != 4 { // two uploads of one chunk, each with a manifest
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+	if _, err := client.Peers(); err != nil {
+		t.Errorf("Peers failed: %v", err)
+	}
+
+	// Files outside the root are off limits, also through symlinks
+	if err := client.Get(GetRequest{Root: result.Root, Key: result.Key, Output: filepath.Join(t.TempDir(), "x")}); err == nil {
+		t.Error("Get wrote outside the API root")
+	}
+	os.Symlink(os.TempDir(), filepath.Join(tmpDir, "escape"))
+	if _, err := client.Add(AddRequest{Path: filepath.Join(tmpDir, "escape", "anything")}); err == nil {
+		t.Error("Add read through a symlink out of the API root")
+	}
+	if _, err := client.Add(AddRequest{Path: "doc.txt"}); err == nil {
+		t.Error("Add accepted a relative path")
+	}
+}
+
+func TestControlAPIRequestChecks(t *testing.T) {
+	tmpDir := t.TempDir()
+	n := newMemoryNode(t, p2p.NewMemoryNetwork(1), 8101, filepath.Join(tmpDir, "node"))
+	server := httptest.NewServer(NewServer(n, ServerOptions{Root: tmpDir, Token: "secret"}))
+	defer server.Close()
+
+	// A cross-site form post can only send simple content types
+	req, _ := http.NewRequest(http.MethodPost, server.URL+"/v1/add", strings.NewReader(`{"path":"/etc/passwd"}`))
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("Authorization", "Bearer secret")
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("Expected 415 for a text/plain body, got %v %v", resp.Status, err)
+	}
+
+	if _, err := NewClient(strings.TrimPrefix(server.URL, "http://")).Stats(); err == nil {
+		t.Error("Request without the token succeeded")
+	}
+	t.Setenv(TokenEnv, "secret")
+	if _, err := NewClient(strings.TrimPrefix(server.URL, "http://")).Stats(); err != nil {
+		t.Errorf("Request with the token failed: %v", err)
+	}
+
+	if err := ListenAndServe("127.0.0.1:0", n, ServerOptions{Root: tmpDir}); err == nil {
+		t.Error("TCP control API started without a token")
+	}
+}
+
+func TestGateway(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	net := p2p.NewMemoryNetwork(2)
+	owner := newMemoryNode(t, net, 8200, "")
+	newMemoryNode(t, net, 8201, "", "127.0.0.1:8200")
+	time.Sleep(20 * time.Millisecond)
+
+	content := make([]byte, 2*1024*1024+100)
+	rand.Read(content)
+	inputFile := filepath.Join(tmpDir, "notes.txt")
+	os.WriteFile(inputFile, content, 0644)
+	result, err := owner.Add(inputFile, node.UploadOptions{Replicas: 1})
+	if err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+
+	// The gateway node holds nothing and fetches on demand
+	gw := newMemoryNode(t, net, 8202, "", "127.0.0.1:8200", "127.0.0.1:8201")
+	time.Sleep(20 * time.Millisecond)
+	server := httptest.NewServer(NewGateway(gw))
+	defer server.Close()
+	url := server.URL + "/nebula/" + result.Root + "?key=" + result.Key
+
+	get := func(url string, header ...string) (*http.Response, []byte) {
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, body
+	}
+
+	resp, body := get(url)
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, content) {
+		t.Fatalf("Full GET: status %d, %d bytes", resp.StatusCode, len(body))
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/plain; charset=utf-8" {
+		t.Errorf("Unexpected Content-Type %q", ct)
+	}
+	if resp.ContentLength != int64(len(content)) {
+		t.Errorf("Unexpected Content-Length %d", resp.ContentLength)
+	}
+	etag := resp.Header.Get("ETag")
+	if resp.Header.Get("X-Content-Type-Options") != "nosniff" || resp.Header.Get("Content-Security-Policy") != "sandbox" {
+		t.Errorf("Missing nosniff or sandbox headers: %v", resp.Header)
+	}
+
+	// A range spanning the first chunk boundary
+	resp, body = get(url, "Range", "bytes=1048570-1048589")
+	if resp.StatusCode != http.StatusPartialContent || !bytes.Equal(body, content[1048570:1048590]) {
+		t.Errorf("Range GET: status %d, body mismatch", resp.StatusCode)
+	}
+
+	if resp, _ = get(url, "If-None-Match", etag); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("Conditional GET: status %d", resp.StatusCode)
+	}
+
+	wrongKey := server.URL + "/nebula/" + result.Root + "?key=" + fmt.Sprintf("%064x", 1)
+	if resp, _ = get(wrongKey); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Wrong key: status %d", resp.StatusCode)
+	}
+	if resp, _ = get(wrongKey, "If-None-Match", etag); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Wrong key with a matching ETag: status %d", resp.StatusCode)
+	}
+
+	// Active content is downloaded, not rendered
+	page := filepath.Join(tmpDir, "page.html")
+	os.WriteFile(page, []byte("<script>alert(1)</script>"), 0644)
+	html, err := owner.Add(page, node.UploadOptions{Replicas: 1})
+	if err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	resp, _ = get(server.URL + "/nebula/" + html.Root + "?key=" + html.Key)
+	if cd := resp.Header.Get("Content-Disposition"); !strings.HasPrefix(cd, "attachment") {
+		t.Errorf("Expected HTML served as an attachment, got %q", cd)
+	}
+}
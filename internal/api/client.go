@@ -0,0 +1,196 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tanmaydeobhankar/nebulafs/internal/node"
+)
+
+// Client talks to a daemon's control API
+type Client struct {
+	base  string
+	token string
+	http  *http.Client
+}
+
+// NewClient creates a client for a daemon listening on address (host:port
+// or unix:/path/to/socket). The token of a TCP daemon is taken from the
+// NEBULAFS_API_TOKEN environment variable.
+func NewClient(address string) *Client {
+	if path, ok := strings.CutPrefix(address, "unix:"); ok {
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		}
+		return &Client{base: "http://nebulafs", http: &http.Client{Transport: transport}}
+	}
+	return &Client{base: "http://" + address, token: os.Getenv(TokenEnv), http: &http.Client{}}
+}
+
+// Dial returns a client if a daemon answers at address within a second
+func Dial(address string) (*Client, error) {
+	c := NewClient(address)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := c.do(ctx, http.MethodGet, "/v1/stats", nil, nil); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Add uploads a file readable by the daemon
+func (c *Client) Add(req AddRequest) (node.AddResult, error) {
+	var result node.AddResult
+	err := c.do(context.Background(), http.MethodPost, "/v1/add", req, &result)
+	return result, err
+}
+
+// Get downloads a file to a path writable by the daemon
+func (c *Client) Get(req GetRequest) error {
+	return c.do(context.Background(), http.MethodPost, "/v1/get", req, nil)
+}
+
+// Pin fetches a root onto the daemon and keeps it there
+func (c *Client) Pin(root string) error {
+	return c.do(context.Background(), http.MethodPost, "/v1/pin/"+root, nil, nil)
+}
+
+// Unpin removes a root from the daemon's pin set
+func (c *Client) Unpin(root string) error {
+	return c.do(context.Background(), http.MethodDelete, "/v1/pin/"+root, nil, nil)
+}
+
+// Share writes a manifest with recipients added or revoked and returns its root
+func (c *Client) Share(req ShareRequest) (string, error) {
+	var resp struct {
+		Root string `json:"root"`
+	}
+	err := c.do(context.Background(), http.MethodPost, "/v1/share", req, &resp)
+	return resp.Root, err
+}
+
+// Rekey re-encrypts a file under a fresh key
+func (c *Client) Rekey(req RekeyRequest) (node.RekeyResult, error) {
+	var result node.RekeyResult
+	err := c.do(context.Background(), http.MethodPost, "/v1/rekey", req, &result)
+	return result, err
+}
+
+// Publish points one of the daemon's records at a root
+func (c *Client) Publish(req PublishRequest) (node.PublishResult, error) {
+	var result node.PublishResult
+	err := c.do(context.Background(), http.MethodPost, "/v1/publish", req, &result)
+	return result, err
+}
+
+// Resolve returns the latest valid record for name
+func (c *Client) Resolve(name string) (node.Record, error) {
+	var record node.Record
+	err := c.do(context.Background(), http.MethodGet, "/v1/resolve/"+name, nil, &record)
+	return record, err
+}
+
+// History lists the versions of a logical path, oldest first
+func (c *Client) History(path string) ([]node.Version, error) {
+	var versions []node.Version
+	err := c.do(context.Background(), http.MethodGet, "/v1/history?path="+url.QueryEscape(path), nil, &versions)
+	return versions, err
+}
+
+// List returns the daemon's pinned files
+func (c *Client) List() ([]node.PinnedFile, error) {
+	var pins []node.PinnedFile
+	err := c.do(context.Background(), http.MethodGet, "/v1/ls", nil, &pins)
+	return pins, err
+}
+
+// Peers returns the daemon's routing table
+func (c *Client) Peers() ([]Peer, error) {
+	var peers []Peer
+	err := c.do(context.Background(), http.MethodGet, "/v1/peers", nil, &peers)
+	return peers, err
+}
+
+// Stats returns a snapshot of the daemon
+func (c *Client) Stats() (node.NodeStats, error) {
+	var stats node.NodeStats
+	err := c.do(context.Background(), http.MethodGet, "/v1/stats", nil, &stats)
+	return stats, err
+}
+
+// Reputation returns the daemon's record of every peer it has seen
+func (c *Client) Reputation() ([]node.PeerReputation, error) {
+	var list []node.PeerReputation
+	err := c.do(context.Background(), http.MethodGet, "/v1/reputation", nil, &list)
+	return list, err
+}
+
+// Audit has the daemon challenge the holders of its replicated chunks
+func (c *Client) Audit() (node.AuditReport, error) {
+	var report node.AuditReport
+	err := c.do(context.Background(), http.MethodPost, "/v1/audit", nil, &report)
+	return report, err
+}
+
+// do sends req as JSON and decodes the response into resp. Error responses
+// are turned back into errors, including *node.ReplicationError, whose
+// partial result is still decoded into resp.
+func (c *Client) do(ctx context.Context, method, path string, req, resp interface{}) error {
+	var body io.Reader
+	if req != nil {
+		data, err := json.Marshal(req)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, method, c.base+path, body)
+	if err != nil {
+		return err
+	}
+	if method != http.MethodGet {
+		httpReq.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	httpResp, err := c.http.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode >= 300 {
+		var e errorResponse
+		if err := json.NewDecoder(httpResp.Body).Decode(&e); err != nil || e.Error == "" {
+			return fmt.Errorf("daemon returned %s", httpResp.Status)
+		}
+		if e.Replication != nil {
+			if resp != nil && len(e.Result) > 0 {
+				if err := json.Unmarshal(e.Result, resp); err != nil {
+					return err
+				}
+			}
+			return e.Replication
+		}
+		return fmt.Errorf("daemon: %s", e.Error)
+	}
+	if resp == nil {
+		return nil
+	}
+	return json.NewDecoder(httpResp.Body).Decode(resp)
+}
@@ -0,0 +1,119 @@
+package api
+
+import (
+	"errors"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/tanmaydeobhankar/nebulafs/internal/files"
+	"github.com/tanmaydeobhankar/nebulafs/internal/node"
+)
+
+// Gateway serves files read-only over plain HTTP:
+//
+//	GET /nebula/<root>?key=<hex key>
+//
+// Range requests and conditional requests are supported; the ETag is the
+// manifest root, which covers the hash of every chunk. Only passive types
+// (plain text, images, audio, video) are shown inline, and every response is
+// sandboxed.
+type Gateway struct {
+	node *node.Node
+	mux  *http.ServeMux
+}
+
+// NewGateway creates the HTTP gateway for n
+func NewGateway(n *node.Node) *Gateway {
+	g := &Gateway{node: n, mux: http.NewServeMux()}
+	g.mux.HandleFunc("GET /nebula/{root}", g.handleFile) // also answers HEAD
+	return g
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.mux.ServeHTTP(w, r)
+}
+
+// ListenAndServeGateway serves the gateway for n on address
+func ListenAndServeGateway(address string, n *node.Node) error {
+	l, err := Listen(address)
+	if err != nil {
+		return err
+	}
+	return http.Serve(l, NewGateway(n))
+}
+
+// inlineType reports whether content of type may be shown in the browser.
+// Anything that can run script, such as HTML, SVG or XML, is served as a
+// download instead, since the uploader chose the type.
+func inlineType(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case mediaType == "text/plain":
+		return true
+	case mediaType == "image/svg+xml":
+		return false
+	case strings.HasPrefix(mediaType, "image/"), strings.HasPrefix(mediaType, "audio/"), strings.HasPrefix(mediaType, "video/"):
+		return true
+	}
+	return false
+}
+
+func (g *Gateway) handleFile(w http.ResponseWriter, r *http.Request) {
+	// Files are served from the gateway's origin; don't let them run as
+	// part of it
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox")
+
+	root := r.PathValue("root")
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		http.Error(w, "missing key", http.StatusBadRequest)
+		return
+	}
+
+	meta, err := g.node.GetManifest(root)
+	if err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	reader, err := g.node.OpenFile(meta, key)
+	if errors.Is(err, files.ErrWrongKey) {
+		http.Error(w, "cannot decrypt: wrong key or unavailable data", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The root never changes content, so once the key is known to open it
+	// a matching ETag needs no chunk reads
+	etag := `"` + root + `"`
+	if match := r.Header.Get("If-None-Match"); match == etag || match == "*" {
+		w.Header().Set("ETag", etag)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if err := reader.Verify(); err != nil {
+		http.Error(w, "cannot decrypt: wrong key or unavailable data", http.StatusForbidden)
+		return
+	}
+
+	meta = reader.Metadata()
+	contentType := mime.TypeByExtension(meta.Type)
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	disposition := "attachment"
+	if inlineType(contentType) {
+		disposition = "inline"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": meta.Name}))
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, immutable")
+
+	http.ServeContent(w, r, meta.Name, meta.ModTime, reader)
+}
@@ -0,0 +1,479 @@
+// Package api is the local HTTP/JSON control API of a running node, used by
+// the CLI to add and fetch files through a daemon with a warm routing table.
+package api
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/tanmaydeobhankar/nebulafs/internal/crypto"
+	"github.com/tanmaydeobhankar/nebulafs/internal/files"
+	"github.com/tanmaydeobhankar/nebulafs/internal/node"
+)
+
+// DefaultAddress is where the control API listens unless configured
+// otherwise: a Unix socket only its owner can connect to. TCP addresses
+// (host:port) need a token, see ServerOptions.
+var DefaultAddress = defaultAddress()
+
+// TokenEnv is the environment variable clients read the token of a TCP
+// control API from
+const TokenEnv = "NEBULAFS_API_TOKEN"
+
+func defaultAddress() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "unix:" + filepath.Join(os.TempDir(), fmt.Sprintf("nebulafs-%d.sock", os.Getuid()))
+	}
+	return "unix:" + filepath.Join(home, ".nebulafs", "api.sock")
+}
+
+// ServerOptions restrict what callers of the control API can do
+type ServerOptions struct {
+	// Root is the directory the daemon reads uploads from and writes
+	// downloads to; paths outside it are refused
+	Root string
+	// Token, if set, must be sent as "Authorization: Bearer <token>"
+	Token string
+}
+
+// AddRequest asks the daemon to upload a file it can read
+type AddRequest struct {
+	Path     string `json:"path"`
+	Replicas int    `json:"replicas"`
+	Resume   bool   `json:"resume"`
+	// As records the upload as the next version of this logical path
+	As         string   `json:"as,omitempty"`
+	Convergent bool     `json:"convergent,omitempty"`
+	Recipients []string `json:"recipients,omitempty"` // hex X25519 public keys
+	Pad        bool     `json:"pad,omitempty"`
+	Cipher     string   `json:"cipher,omitempty"` // aes-256-gcm or xchacha20-poly1305; empty for the daemon's default
+}
+
+// GetRequest asks the daemon to download a file, identified either by its
+// manifest root or by full metadata, to a path it can write. Without a key
+// the daemon unwraps its own entry among the file's recipients.
+type GetRequest struct {
+	Root     string              `json:"root,omitempty"`
+	Metadata *files.FileMetadata `json:"metadata,omitempty"`
+	Key      string              `json:"key,omitempty"`
+	Output   string              `json:"output"`
+	Resume   bool                `json:"resume"`
+	Trust    []string            `json:"trust,omitempty"` // hex Ed25519 publisher keys
+}
+
+// ShareRequest asks the daemon to write a manifest for Root with recipients
+// added or revoked. Key may be empty if the daemon is a recipient itself.
+type ShareRequest struct {
+	Root     string   `json:"root"`
+	Key      string   `json:"key,omitempty"`
+	Add      []string `json:"add,omitempty"`
+	Revoke   []string `json:"revoke,omitempty"`
+	Replicas int      `json:"replicas"`
+}
+
+// RekeyRequest asks the daemon to re-encrypt Root under a fresh key. Key
+// may be empty if the daemon is a recipient itself.
+type RekeyRequest struct {
+	Root     string `json:"root"`
+	Key      string `json:"key,omitempty"`
+	Replicas int    `json:"replicas"`
+	Delete   bool   `json:"delete,omitempty"`
+	Label    string `json:"label,omitempty"` // record to point at the new root
+}
+
+// PublishRequest asks the daemon to point one of its records at a root
+type PublishRequest struct {
+	Root  string `json:"root"`
+	Label string `json:"label,omitempty"`
+}
+
+// Peer is a routing table entry
+type Peer struct {
+	ID      string  `json:"id"`
+	Address string  `json:"address"`
+	Score   float64 `json:"score"`
+}
+
+type errorResponse struct {
+	Error       string                 `json:"error"`
+	Replication *node.ReplicationError `json:"replication,omitempty"`
+	// Result is what was stored despite a replication shortfall
+	Result json.RawMessage `json:"result,omitempty"`
+}
+
+// Server serves the control API for one node
+type Server struct {
+	node *node.Node
+	opts ServerOptions
+	mux  *http.ServeMux
+}
+
+// NewServer creates the control API handler for n
+func NewServer(n *node.Node, opts ServerOptions) *Server {
+	s := &Server{node: n, opts: opts, mux: http.NewServeMux()}
+	s.mux.HandleFunc("POST /v1/add", s.handleAdd)
+	s.mux.HandleFunc("POST /v1/get", s.handleGet)
+	s.mux.HandleFunc("POST /v1/pin/{root}", s.handlePin)
+	s.mux.HandleFunc("DELETE /v1/pin/{root}", s.handleUnpin)
+	s.mux.HandleFunc("POST /v1/share", s.handleShare)
+	s.mux.HandleFunc("POST /v1/rekey", s.handleRekey)
+	s.mux.HandleFunc("POST /v1/publish", s.handlePublish)
+	s.mux.HandleFunc("GET /v1/resolve/{name}", s.handleResolve)
+	s.mux.HandleFunc("GET /v1/history", s.handleHistory)
+	s.mux.HandleFunc("GET /v1/ls", s.handleList)
+	s.mux.HandleFunc("GET /v1/peers", s.handlePeers)
+	s.mux.HandleFunc("GET /v1/stats", s.handleStats)
+	s.mux.HandleFunc("GET /v1/reputation", s.handleReputation)
+	s.mux.HandleFunc("POST /v1/audit", s.handleAudit)
+	return s
+}
+
+// ServeHTTP checks the token and refuses requests with a body that isn't
+// JSON, which a web page could otherwise send without a CORS preflight
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.opts.Token != "" {
+		token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.opts.Token)) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("missing or wrong token"))
+			return
+		}
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+			writeError(w, http.StatusUnsupportedMediaType, errors.New("requests must be application/json"))
+			return
+		}
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// Listen opens the listener for address, removing a stale Unix socket left
+// behind by a previous daemon. Sockets are created in a directory only the
+// owner can enter and are readable by the owner only.
+func Listen(address string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(address, "unix:"); ok {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use", path)
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return nil, err
+		}
+		os.Remove(path)
+		l, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Chmod(path, 0600); err != nil {
+			l.Close()
+			return nil, err
+		}
+		return l, nil
+	}
+	return net.Listen("tcp", address)
+}
+
+// ListenAndServe serves the control API for n until the listener fails. A
+// TCP address can be reached by every local user, so it needs a token.
+func ListenAndServe(address string, n *node.Node, opts ServerOptions) error {
+	if !strings.HasPrefix(address, "unix:") && opts.Token == "" {
+		return errors.New("a control API on TCP needs a token")
+	}
+	l, err := Listen(address)
+	if err != nil {
+		return err
+	}
+	return http.Serve(l, NewServer(n, opts))
+}
+
+// LoadToken reads the token in path, creating a random one readable only
+// by the owner on first use
+func LoadToken(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		return strings.TrimSpace(string(data)), nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(raw)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, []byte(token+"\n"), 0600); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// allowed checks that path is absolute and, following symlinks, inside the
+// root. The file itself may not exist yet.
+func (s *Server) allowed(path string) error {
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("%s is not an absolute path", path)
+	}
+	if s.opts.Root == "" {
+		return errors.New("no file access is configured for the control API")
+	}
+	root, err := filepath.EvalSymlinks(s.opts.Root)
+	if err != nil {
+		return err
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Dir(filepath.Clean(path)))
+	if err != nil {
+		return err
+	}
+	resolved := filepath.Join(dir, filepath.Base(path))
+	if target, err := filepath.EvalSymlinks(resolved); err == nil {
+		resolved = target
+	}
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%s is outside %s", path, s.opts.Root)
+	}
+	return nil
+}
+
+func (s *Server) handleAdd(w http.ResponseWriter, r *http.Request) {
+	var req AddRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	if req.Path == "" {
+		writeError(w, http.StatusBadRequest, errors.New("path is required"))
+		return
+	}
+	if err := s.allowed(req.Path); err != nil {
+		writeError(w, http.StatusForbidden, err)
+		return
+	}
+
+	opts := node.UploadOptions{
+		Replicas:   req.Replicas,
+		Resume:     req.Resume,
+		Convergent: req.Convergent,
+		Recipients: req.Recipients,
+		Pad:        req.Pad,
+	}
+	if req.Cipher != "" {
+		suite, err := crypto.ParseSuite(req.Cipher)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		opts.Cipher = suite
+	}
+	var result node.AddResult
+	var err error
+	if req.As != "" {
+		result, err = s.node.AddVersion(req.Path, req.As, opts)
+	} else {
+		result, err = s.node.Add(req.Path, opts)
+	}
+	var replErr *node.ReplicationError
+	if errors.As(err, &replErr) && result.Root != "" {
+		data, _ := json.Marshal(result)
+		writeJSON(w, statusFor(err), errorResponse{Error: err.Error(), Replication: replErr, Result: data})
+		return
+	}
+	if err != nil {
+		writeError(w, statusFor(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (s *Server) handleGet(w http.ResponseWriter, r *http.Request) {
+	var req GetRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	if req.Output == "" || (req.Root == "") == (req.Metadata == nil) {
+		writeError(w, http.StatusBadRequest, errors.New("output and exactly one of root or metadata are required"))
+		return
+	}
+	if err := s.allowed(req.Output); err != nil {
+		writeError(w, http.StatusForbidden, err)
+		return
+	}
+
+	opts := node.DownloadOptions{Resume: req.Resume, Trust: req.Trust}
+	var err error
+	if req.Metadata != nil {
+		err = s.node.DownloadFile(*req.Metadata, req.Key, req.Output, opts)
+	} else {
+		err = s.node.Get(req.Root, req.Key, req.Output, opts)
+	}
+	if err != nil {
+		writeError(w, statusFor(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"output": req.Output})
+}
+
+func (s *Server) handlePin(w http.ResponseWriter, r *http.Request) {
+	if err := s.node.Pin(r.PathValue("root")); err != nil {
+		writeError(w, statusFor(err), err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleUnpin(w http.ResponseWriter, r *http.Request) {
+	if err := s.node.Unpin(r.PathValue("root")); err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleShare(w http.ResponseWriter, r *http.Request) {
+	var req ShareRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	if req.Root == "" {
+		writeError(w, http.StatusBadRequest, errors.New("root is required"))
+		return
+	}
+
+	root, err := s.node.Share(req.Root, req.Key, req.Add, req.Revoke, req.Replicas)
+	if err != nil {
+		writeError(w, statusFor(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"root": root})
+}
+
+func (s *Server) handleRekey(w http.ResponseWriter, r *http.Request) {
+	var req RekeyRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	if req.Root == "" {
+		writeError(w, http.StatusBadRequest, errors.New("root is required"))
+		return
+	}
+
+	result, err := s.node.Rekey(req.Root, req.Key, node.RekeyOptions{
+		Replicas: req.Replicas,
+		Delete:   req.Delete,
+		Label:    req.Label,
+	})
+	if err != nil {
+		writeError(w, statusFor(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (s *Server) handlePublish(w http.ResponseWriter, r *http.Request) {
+	var req PublishRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	if req.Root == "" {
+		writeError(w, http.StatusBadRequest, errors.New("root is required"))
+		return
+	}
+
+	result, err := s.node.Publish(req.Root, req.Label)
+	if err != nil {
+		writeError(w, statusFor(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (s *Server) handleResolve(w http.ResponseWriter, r *http.Request) {
+	record, err := s.node.Resolve(r.PathValue("name"))
+	if err != nil {
+		writeError(w, statusFor(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, record)
+}
+
+// handleHistory lists the versions of the logical path given as ?path=
+func (s *Server) handleHistory(w http.ResponseWriter, r *http.Request) {
+	versions, err := s.node.History(r.URL.Query().Get("path"))
+	if err != nil {
+		writeError(w, statusFor(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, versions)
+}
+
+func (s *Server) handleList(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.node.Pins())
+}
+
+func (s *Server) handlePeers(w http.ResponseWriter, r *http.Request) {
+	peers := []Peer{}
+	for _, c := range s.node.Peers() {
+		peers = append(peers, Peer{ID: c.ID.Hex(), Address: c.Address, Score: s.node.PeerScore(c.Address)})
+	}
+	writeJSON(w, http.StatusOK, peers)
+}
+
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.node.Stats())
+}
+
+func (s *Server) handleReputation(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.node.Reputation())
+}
+
+func (s *Server) handleAudit(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.node.Audit())
+}
+
+// statusFor maps node errors to HTTP status codes
+func statusFor(err error) int {
+	var replErr *node.ReplicationError
+	if errors.As(err, &replErr) {
+		return http.StatusBadGateway
+	}
+	if errors.Is(err, node.ErrRecordNotFound) || errors.Is(err, node.ErrNoHistory) {
+		return http.StatusNotFound
+	}
+	if errors.Is(err, node.ErrUntrusted) {
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
+
+func decode(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %v", err))
+		return false
+	}
+	return true
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	resp := errorResponse{Error: err.Error()}
+	errors.As(err, &resp.Replication)
+	writeJSON(w, status, resp)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -17,6 +17,9 @@ func HashSHA1(data []byte) string {
 	return hex.EncodeToString(h.Sum(nil))
 }
 
+// AESOverhead is what EncryptAES256 adds to the plaintext: nonce and GCM tag
+const AESOverhead = 12 + 16
+
 // EncryptAWS256 encrypts data using AES-256-GCM
 // key must be 32 bytes
 func EncryptAES256(data, key []byte) ([]byte, error) {
@@ -42,7 +45,35 @@ func EncryptAES256(data, key []byte) ([]byte, error) {
 	return gcm.Seal(nonce, nonce, data, nil), nil
 }
 
-// DecryptAES256 decrypts data using AES-256-GCM
+// EncryptAES256Convergent is EncryptAES256 with the nonce derived from the
+// key and the plaintext instead of drawn at random: the same data under the
+// same key always gives the same ciphertext. That reveals when two
+// ciphertexts hold equal plaintexts, in exchange for deduplication.
+// DecryptAES256 decrypts the result.
+func EncryptAES256Convergent(data, key []byte) ([]byte, error) {
+	if len(key) != 32 {
+		return nil, errors.New("key must be 32 bytes for AES-256")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce, err := convergentNonce(key, data, gcm.NonceSize())
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, data, nil), nil
+}
+
+// DecryptAES256 decrypts data using AES-256-GCM. It only reads the
+// headerless format; Decrypt handles every suite.
 func DecryptAES256(data, key []byte) ([]byte, error) {
 	if len(key) != 32 {
 		return nil, errors.New("key must be 32 bytes for AES-256")
@@ -2,7 +2,9 @@ package crypto
 
 import (
 	"bytes"
+	"crypto/ecdh"
 	"crypto/rand"
+	"strings"
 	"testing"
 )
 
@@ -36,3 +38,144 @@ func TestHashSHA1(t *testing.T) {
 		t.Errorf("Hash mismatch. Expected %s, got %s", expected, hash)
 	}
 }
+
+func TestConvergentEncryption(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	a, _ := EncryptAES256Convergent([]byte("same chunk"), key)
+	b, _ := EncryptAES256Convergent([]byte("same chunk"), key)
+	c, _ := EncryptAES256Convergent([]byte("other chunk"), key)
+	if !bytes.Equal(a, b) || bytes.Equal(a, c) {
+		t.Errorf("Convergent ciphertexts should match exactly for equal plaintexts")
+	}
+
+	decrypted, err := DecryptAES256(a, key)
+	if err != nil || string(decrypted) != "same chunk" {
+		t.Errorf("Decryption failed: %v", err)
+	}
+}
+
+func TestWrapKey(t *testing.T) {
+	alice, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	bob, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	fileKey := make([]byte, 32)
+	rand.Read(fileKey)
+
+	wrapped, err := WrapKey(fileKey, alice.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := UnwrapKey([]WrappedKey{wrapped}, alice)
+	if err != nil || !bytes.Equal(got, fileKey) {
+		t.Fatalf("Unwrap failed: %v", err)
+	}
+	if _, err := UnwrapKey([]WrappedKey{wrapped}, bob); err != ErrNotRecipient {
+		t.Errorf("Expected ErrNotRecipient for another key, got %v", err)
+	}
+
+	// An entry claiming to be for bob but sealed for alice doesn't open
+	wrapped.Recipient = bob.PublicKey().Bytes()
+	if _, err := UnwrapKey([]WrappedKey{wrapped}, bob); err == nil {
+		t.Errorf("Unwrapped an entry sealed for someone else")
+	}
+}
+
+func TestShamirShares(t *testing.T) {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+
+	shares, err := SplitSecret(secret, 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pick := range [][]int{{0, 1, 2}, {4, 2, 0}, {1, 3, 4, 0}} {
+		var subset []Share
+		for _, i := range pick {
+			parsed, err := ParseShare(strings.ToLower(shares[i].String()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			subset = append(subset, parsed)
+		}
+		got, err := CombineShares(subset)
+		if err != nil || !bytes.Equal(got, secret) {
+			t.Errorf("Shares %v recovered %x, %v", pick, got, err)
+		}
+	}
+
+	if _, err := CombineShares(shares[:2]); err == nil {
+		t.Errorf("Two of three shares recovered the secret")
+	}
+	if _, err := CombineShares([]Share{shares[0], shares[0], shares[1]}); err == nil {
+		t.Errorf("Duplicate shares counted twice")
+	}
+	other, _ := SplitSecret(secret, 5, 3)
+	if _, err := CombineShares([]Share{shares[0], shares[1], other[2]}); err == nil {
+		t.Errorf("Shares of different splits combined")
+	}
+
+	text := shares[0].String()
+	typo := text[:20] + "0" + text[21:]
+	if text[20] == '0' {
+		typo = text[:20] + "1" + text[21:]
+	}
+	if _, err := ParseShare(typo); err == nil {
+		t.Errorf("Mistyped share accepted")
+	}
+
+	// Thresholds outside 2-255 and index 0 are refused even with a valid
+	// checksum, rather than panicking or recovering a zero key
+	for _, bad := range []Share{
+		{Group: shares[0].Group, Threshold: -1, X: 1, Y: shares[0].Y},
+		{Group: shares[0].Group, Threshold: 0, X: 1, Y: shares[0].Y},
+		{Group: shares[0].Group, Threshold: 256, X: 1, Y: shares[0].Y},
+		{Group: shares[0].Group, Threshold: 2, X: 0, Y: shares[0].Y},
+	} {
+		if _, err := ParseShare(bad.String()); err == nil {
+			t.Errorf("Share with threshold %d and index %d accepted", bad.Threshold, bad.X)
+		}
+	}
+	if _, err := CombineShares([]Share{{Group: shares[0].Group, Threshold: 0, X: 1, Y: shares[0].Y}}); err == nil {
+		t.Errorf("Combined shares with threshold 0")
+	}
+}
+
+func TestCipherSuites(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	data := []byte("suite agnostic chunk")
+
+	for _, s := range []Suite{SuiteLegacy, SuiteAES256GCM, SuiteXChaCha20Poly1305} {
+		sealed, err := Encrypt(s, data, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(sealed) != len(data)+s.Overhead() {
+			t.Errorf("%v: ciphertext is %d bytes, overhead says %d", s, len(sealed), len(data)+s.Overhead())
+		}
+		if got, err := Decrypt(sealed, key); err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%v: Decrypt gave %q, %v", s, got, err)
+		}
+
+		a, _ := EncryptConvergent(s, data, key)
+		b, _ := EncryptConvergent(s, data, key)
+		if !bytes.Equal(a, b) {
+			t.Errorf("%v: convergent encryption is not deterministic", s)
+		}
+	}
+
+	// The header is authenticated: relabelling the suite fails
+	sealed, _ := Encrypt(SuiteAES256GCM, data, key)
+	sealed[3] = byte(SuiteXChaCha20Poly1305)
+	if _, err := Decrypt(sealed, key); err == nil {
+		t.Errorf("Decrypt accepted a modified header")
+	}
+
+	if s, err := ParseSuite("xchacha20-poly1305"); err != nil || s != SuiteXChaCha20Poly1305 {
+		t.Errorf("ParseSuite gave %v, %v", s, err)
+	}
+	if _, err := ParseSuite("rot13"); err == nil {
+		t.Errorf("ParseSuite accepted an unknown cipher")
+	}
+}
@@ -0,0 +1,46 @@
+package crypto
+
+import (
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// scrypt cost parameters for passphrase-derived keys
+const (
+	ScryptN = 1 << 15
+	ScryptR = 8
+	ScryptP = 1
+)
+
+// DeriveKey stretches a passphrase into a 32-byte key using scrypt with the
+// default cost parameters
+func DeriveKey(passphrase, salt []byte) ([]byte, error) {
+	return DeriveKeyScrypt(passphrase, salt, ScryptN, ScryptR, ScryptP)
+}
+
+// DeriveKeyScrypt is DeriveKey with explicit cost parameters, for keys
+// wrapped under parameters recorded next to them
+func DeriveKeyScrypt(passphrase, salt []byte, n, r, p int) ([]byte, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	return scrypt.Key(passphrase, salt, n, r, p, 32)
+}
+
+// SubKey derives an independent 32-byte key for a given purpose from a
+// master key using HKDF-SHA256
+func SubKey(master []byte, purpose string) ([]byte, error) {
+	return hkdf.Key(sha256.New, master, nil, "nebulafs "+purpose, 32)
+}
+
+// KeyedHash computes a hex encoded HMAC-SHA256 of data
+func KeyedHash(key []byte, data string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return hex.EncodeToString(mac.Sum(nil))
+}
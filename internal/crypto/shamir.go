@@ -0,0 +1,192 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// sharePrefix starts the text form of a share. The text only uses
+// characters of the QR alphanumeric set, so it fits compact QR codes.
+const sharePrefix = "NEBULAFS-SHARE"
+
+// Share is one of the pieces SplitSecret cuts a secret into. Any Threshold
+// shares of the same group recover the secret; fewer reveal nothing.
+type Share struct {
+	Group     []byte // random, identifies shares from the same split
+	Threshold int
+	X         byte // evaluation point, 1-255
+	Y         []byte
+}
+
+// SplitSecret splits secret into n shares, any t of which recover it, with
+// Shamir's scheme over GF(256): each byte is the constant term of a random
+// polynomial of degree t-1, and share x holds the polynomials at x.
+func SplitSecret(secret []byte, n, t int) ([]Share, error) {
+	if t < 2 || t > n || n > 255 {
+		return nil, fmt.Errorf("need 2 <= threshold <= shares <= 255, got %d of %d", t, n)
+	}
+	if len(secret) == 0 {
+		return nil, errors.New("empty secret")
+	}
+	group := make([]byte, 4)
+	if _, err := rand.Read(group); err != nil {
+		return nil, err
+	}
+
+	shares := make([]Share, n)
+	for i := range shares {
+		shares[i] = Share{Group: group, Threshold: t, X: byte(i + 1), Y: make([]byte, len(secret))}
+	}
+	coeffs := make([]byte, t)
+	for b, s := range secret {
+		coeffs[0] = s
+		if _, err := rand.Read(coeffs[1:]); err != nil {
+			return nil, err
+		}
+		for i := range shares {
+			shares[i].Y[b] = evalPoly(coeffs, shares[i].X)
+		}
+	}
+	return shares, nil
+}
+
+// CombineShares recovers the secret from at least Threshold shares of one
+// group by Lagrange interpolation at zero
+func CombineShares(shares []Share) ([]byte, error) {
+	if len(shares) == 0 {
+		return nil, errors.New("no shares")
+	}
+	first := shares[0]
+	if first.Threshold < 2 || first.Threshold > 255 {
+		return nil, fmt.Errorf("invalid share threshold %d", first.Threshold)
+	}
+	var used []Share
+	seen := make(map[byte]bool)
+	for _, s := range shares {
+		if !bytes.Equal(s.Group, first.Group) || s.Threshold != first.Threshold || len(s.Y) != len(first.Y) {
+			return nil, errors.New("shares come from different splits")
+		}
+		if s.X == 0 {
+			return nil, errors.New("invalid share index 0")
+		}
+		if !seen[s.X] {
+			seen[s.X] = true
+			used = append(used, s)
+		}
+	}
+	if len(used) < first.Threshold {
+		return nil, fmt.Errorf("need %d distinct shares, have %d", first.Threshold, len(used))
+	}
+	used = used[:first.Threshold]
+
+	secret := make([]byte, len(first.Y))
+	for i, si := range used {
+		// Lagrange basis polynomial for si at 0: prod x_j / (x_j - x_i)
+		basis := byte(1)
+		for j, sj := range used {
+			if i != j {
+				basis = gfMul(basis, gfDiv(sj.X, sj.X^si.X))
+			}
+		}
+		for b := range secret {
+			secret[b] ^= gfMul(si.Y[b], basis)
+		}
+	}
+	return secret, nil
+}
+
+// String encodes the share as NEBULAFS-SHARE:1:<group>:<t>:<x>:<y>:<check>
+// in upper-case hex, where check covers everything before it
+func (s Share) String() string {
+	body := fmt.Sprintf("%s:1:%X:%d:%d:%X", sharePrefix, s.Group, s.Threshold, s.X, s.Y)
+	sum := sha256.Sum256([]byte(body))
+	return fmt.Sprintf("%s:%X", body, sum[:2])
+}
+
+// ParseShare decodes the text form of a share, ignoring case and
+// surrounding space
+func ParseShare(text string) (Share, error) {
+	text = strings.ToUpper(strings.TrimSpace(text))
+	cut := strings.LastIndexByte(text, ':')
+	if cut < 0 || !strings.HasPrefix(text, sharePrefix+":") {
+		return Share{}, errors.New("not a nebulafs share")
+	}
+	body := text[:cut]
+	sum := sha256.Sum256([]byte(body))
+	if text[cut+1:] != fmt.Sprintf("%X", sum[:2]) {
+		return Share{}, errors.New("share checksum mismatch (typo?)")
+	}
+
+	fields := strings.Split(body, ":")
+	if len(fields) != 6 || fields[1] != "1" {
+		return Share{}, errors.New("unsupported share format")
+	}
+	group, err := hex.DecodeString(fields[2])
+	if err != nil {
+		return Share{}, fmt.Errorf("invalid share group: %v", err)
+	}
+	t, err := strconv.Atoi(fields[3])
+	if err != nil {
+		return Share{}, fmt.Errorf("invalid share threshold: %v", err)
+	}
+	if t < 2 || t > 255 {
+		return Share{}, fmt.Errorf("invalid share threshold %d, need 2-255", t)
+	}
+	x, err := strconv.ParseUint(fields[4], 10, 8)
+	if err != nil || x == 0 {
+		return Share{}, fmt.Errorf("invalid share index %q", fields[4])
+	}
+	y, err := hex.DecodeString(fields[5])
+	if err != nil {
+		return Share{}, fmt.Errorf("invalid share data: %v", err)
+	}
+	return Share{Group: group, Threshold: t, X: byte(x), Y: y}, nil
+}
+
+// evalPoly evaluates the polynomial with coefficients c (lowest first) at x
+func evalPoly(c []byte, x byte) byte {
+	var y byte
+	for i := len(c) - 1; i >= 0; i-- {
+		y = gfMul(y, x) ^ c[i]
+	}
+	return y
+}
+
+// GF(256) with the AES polynomial x^8+x^4+x^3+x+1, using log tables for
+// the generator 3
+var gfExp, gfLog = func() ([510]byte, [256]byte) {
+	var exp [510]byte
+	var log [256]byte
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		exp[i], exp[i+255] = x, x
+		log[x] = byte(i)
+		// multiply by 3: x*2 ^ x
+		x2 := x << 1
+		if x&0x80 != 0 {
+			x2 ^= 0x1b
+		}
+		x ^= x2
+	}
+	return exp, log
+}()
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfDiv(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+255-int(gfLog[b])]
+}
@@ -0,0 +1,191 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Suite identifies the cipher of a ciphertext. Ciphertexts of every suite
+// but SuiteLegacy start with a header naming it:
+//
+//	"NC" | format version (1) | suite | nonce | sealed data and tag
+//
+// The header is authenticated as additional data, so it can't be swapped.
+type Suite byte
+
+const (
+	// SuiteLegacy is the headerless nonce || AES-256-GCM format of
+	// EncryptAES256, used by chunks written before suites existed
+	SuiteLegacy Suite = 0
+	// SuiteAES256GCM is AES-256-GCM with a 12-byte nonce
+	SuiteAES256GCM Suite = 1
+	// SuiteXChaCha20Poly1305 has a 24-byte nonce, safe to draw at random
+	// for any number of messages, and is fast without AES hardware
+	SuiteXChaCha20Poly1305 Suite = 2
+)
+
+// DefaultSuite is used for new chunks unless another is chosen
+const DefaultSuite = SuiteAES256GCM
+
+const (
+	headerMagic0  = 'N'
+	headerMagic1  = 'C'
+	headerVersion = 1
+	headerLen     = 4
+)
+
+// ParseSuite parses a suite name as printed by String
+func ParseSuite(name string) (Suite, error) {
+	switch name {
+	case "", "aes-256-gcm":
+		return SuiteAES256GCM, nil
+	case "xchacha20-poly1305":
+		return SuiteXChaCha20Poly1305, nil
+	}
+	return 0, fmt.Errorf("unknown cipher %q (aes-256-gcm or xchacha20-poly1305)", name)
+}
+
+func (s Suite) String() string {
+	switch s {
+	case SuiteLegacy:
+		return "aes-256-gcm (legacy)"
+	case SuiteAES256GCM:
+		return "aes-256-gcm"
+	case SuiteXChaCha20Poly1305:
+		return "xchacha20-poly1305"
+	}
+	return fmt.Sprintf("suite %d", byte(s))
+}
+
+// aead returns the cipher of the suite under key
+func (s Suite) aead(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, errors.New("key must be 32 bytes")
+	}
+	switch s {
+	case SuiteLegacy, SuiteAES256GCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case SuiteXChaCha20Poly1305:
+		return chacha20poly1305.NewX(key)
+	}
+	return nil, fmt.Errorf("unknown cipher suite %d", byte(s))
+}
+
+// Overhead is the number of bytes Encrypt adds to the plaintext
+func (s Suite) Overhead() int {
+	switch s {
+	case SuiteLegacy:
+		return AESOverhead
+	case SuiteXChaCha20Poly1305:
+		return headerLen + chacha20poly1305.NonceSizeX + chacha20poly1305.Overhead
+	}
+	return headerLen + AESOverhead
+}
+
+// PlaintextLen returns the plaintext length of a ciphertext of the suite
+func (s Suite) PlaintextLen(ciphertextLen int) int {
+	return ciphertextLen - s.Overhead()
+}
+
+func (s Suite) header() []byte {
+	return []byte{headerMagic0, headerMagic1, headerVersion, byte(s)}
+}
+
+// Encrypt seals data under key with a random nonce
+func Encrypt(s Suite, data, key []byte) ([]byte, error) {
+	if s == SuiteLegacy {
+		return EncryptAES256(data, key)
+	}
+	aead, err := s.aead(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return s.seal(aead, nonce, data), nil
+}
+
+// EncryptConvergent is Encrypt with the nonce derived from the key and the
+// plaintext, as EncryptAES256Convergent does for the legacy format
+func EncryptConvergent(s Suite, data, key []byte) ([]byte, error) {
+	if s == SuiteLegacy {
+		return EncryptAES256Convergent(data, key)
+	}
+	aead, err := s.aead(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := convergentNonce(key, data, aead.NonceSize())
+	if err != nil {
+		return nil, err
+	}
+	return s.seal(aead, nonce, data), nil
+}
+
+func (s Suite) seal(aead cipher.AEAD, nonce, data []byte) []byte {
+	header := s.header()
+	out := append(header, nonce...)
+	return aead.Seal(out, nonce, data, header)
+}
+
+// Decrypt opens a ciphertext of any suite. Data without a valid header, or
+// whose header turns out not to be one, is read as the legacy format.
+func Decrypt(data, key []byte) ([]byte, error) {
+	s, ok := headerSuite(data)
+	if !ok {
+		return DecryptAES256(data, key)
+	}
+	aead, err := s.aead(key)
+	if err != nil {
+		return nil, err
+	}
+	body := data[headerLen:]
+	if len(body) < aead.NonceSize() {
+		return nil, errors.New("malformed ciphertext")
+	}
+	nonce, sealed := body[:aead.NonceSize()], body[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, sealed, data[:headerLen])
+	if err != nil {
+		// A legacy nonce can start like a header
+		if legacy, legacyErr := DecryptAES256(data, key); legacyErr == nil {
+			return legacy, nil
+		}
+		return nil, err
+	}
+	return plain, nil
+}
+
+func headerSuite(data []byte) (Suite, bool) {
+	if len(data) < headerLen || data[0] != headerMagic0 || data[1] != headerMagic1 || data[2] != headerVersion {
+		return SuiteLegacy, false
+	}
+	s := Suite(data[3])
+	if s != SuiteAES256GCM && s != SuiteXChaCha20Poly1305 {
+		return SuiteLegacy, false
+	}
+	return s, true
+}
+
+// convergentNonce derives a nonce of size bytes from the key and data
+func convergentNonce(key, data []byte, size int) ([]byte, error) {
+	nonceKey, err := SubKey(key, "convergent nonce")
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, nonceKey)
+	mac.Write(data)
+	return mac.Sum(nil)[:size], nil
+}
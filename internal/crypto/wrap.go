@@ -0,0 +1,93 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// ErrNotRecipient is returned by UnwrapKey when no entry is wrapped for
+// the given private key
+var ErrNotRecipient = errors.New("key not wrapped for this recipient")
+
+// WrappedKey is a file key sealed for one X25519 public key. The wrapping
+// key comes from an ephemeral key exchange, so only the recipient can
+// derive it.
+type WrappedKey struct {
+	Recipient []byte `json:"recipient"` // X25519 public key
+	Ephemeral []byte `json:"ephemeral"` // X25519 public key of the sender's one-off key
+	Wrapped   []byte `json:"wrapped"`   // EncryptAES256 of the file key
+}
+
+// ParseRecipient decodes a hex X25519 public key
+func ParseRecipient(hexKey string) (*ecdh.PublicKey, error) {
+	b, err := hex.DecodeString(hexKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid recipient key: %v", err)
+	}
+	return ecdh.X25519().NewPublicKey(b)
+}
+
+// wrappingKey derives the AES key shared by the ephemeral and recipient keys
+func wrappingKey(shared, ephemeral, recipient []byte) ([]byte, error) {
+	salt := append(append([]byte{}, ephemeral...), recipient...)
+	return hkdf.Key(sha256.New, shared, salt, "nebulafs key wrap", 32)
+}
+
+// WrapKey seals fileKey for recipient
+func WrapKey(fileKey []byte, recipient *ecdh.PublicKey) (WrappedKey, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return WrappedKey{}, err
+	}
+	shared, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return WrappedKey{}, err
+	}
+	kek, err := wrappingKey(shared, ephemeral.PublicKey().Bytes(), recipient.Bytes())
+	if err != nil {
+		return WrappedKey{}, err
+	}
+	wrapped, err := EncryptAES256(fileKey, kek)
+	if err != nil {
+		return WrappedKey{}, err
+	}
+	return WrappedKey{
+		Recipient: recipient.Bytes(),
+		Ephemeral: ephemeral.PublicKey().Bytes(),
+		Wrapped:   wrapped,
+	}, nil
+}
+
+// UnwrapKey finds the entry for priv among wrapped and recovers the file key
+func UnwrapKey(wrapped []WrappedKey, priv *ecdh.PrivateKey) ([]byte, error) {
+	self := priv.PublicKey().Bytes()
+	for _, w := range wrapped {
+		if !bytes.Equal(w.Recipient, self) {
+			continue
+		}
+		ephemeral, err := ecdh.X25519().NewPublicKey(w.Ephemeral)
+		if err != nil {
+			return nil, err
+		}
+		shared, err := priv.ECDH(ephemeral)
+		if err != nil {
+			return nil, err
+		}
+		kek, err := wrappingKey(shared, w.Ephemeral, self)
+		if err != nil {
+			return nil, err
+		}
+		key, err := DecryptAES256(w.Wrapped, kek)
+		if err != nil {
+			return nil, errors.New("corrupt wrapped key")
+		}
+		return key, nil
+	}
+	return nil, ErrNotRecipient
+}
@@ -0,0 +1,335 @@
+// Package davfs exposes a namespace of stored files as a WebDAV file
+// system. Reads go through the node's chunk fetch path; writes are staged
+// in a temp file and uploaded through the chunking and encryption pipeline
+// when the file is closed.
+package davfs
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/net/webdav"
+
+	"github.com/tanmaydeobhankar/nebulafs/internal/namespace"
+	"github.com/tanmaydeobhankar/nebulafs/internal/node"
+)
+
+// DefaultUser is the user name WebDAV clients log in as
+const DefaultUser = "nebulafs"
+
+// RequireAuth wraps h so that every request must carry HTTP basic auth for
+// user and password, which WebDAV clients support where bearer tokens
+// aren't
+func RequireAuth(h http.Handler, user, password string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, p, ok := r.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(u), []byte(user))&subtle.ConstantTimeCompare([]byte(p), []byte(password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="nebulafs", charset="UTF-8"`)
+			http.Error(w, "missing or wrong credentials", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// FS implements webdav.FileSystem
+type FS struct {
+	node     *node.Node
+	ns       *namespace.Namespace
+	replicas int
+	tempDir  string
+}
+
+// New creates a file system over ns. New files are uploaded requiring
+// replicas confirmed copies per chunk and staged in tempDir.
+func New(n *node.Node, ns *namespace.Namespace, replicas int, tempDir string) (*FS, error) {
+	if err := os.MkdirAll(tempDir, 0700); err != nil {
+		return nil, err
+	}
+	return &FS{node: n, ns: ns, replicas: replicas, tempDir: tempDir}, nil
+}
+
+func (fs *FS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return fs.ns.Mkdir(name)
+}
+
+func (fs *FS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	e, err := fs.ns.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return fileInfo{name: path.Base(namespace.Clean(name)), entry: e}, nil
+}
+
+func (fs *FS) RemoveAll(ctx context.Context, name string) error {
+	removed, err := fs.ns.RemoveAll(name)
+	for _, e := range removed {
+		fs.node.Unpin(e.Root)
+	}
+	return err
+}
+
+func (fs *FS) Rename(ctx context.Context, oldName, newName string) error {
+	replaced, err := fs.ns.Rename(oldName, newName)
+	if replaced != nil {
+		fs.node.Unpin(replaced.Root)
+	}
+	return err
+}
+
+// commit uploads the local file at localPath and points name at the new
+// version, unpinning the one it replaces
+func (fs *FS) commit(name, localPath string) error {
+	result, err := fs.node.Add(localPath, node.UploadOptions{Replicas: fs.replicas})
+	if err != nil {
+		return err
+	}
+	old, err := fs.ns.Put(name, namespace.Entry{
+		Root:     result.Root,
+		Key:      result.Key,
+		Size:     result.Metadata.Size,
+		Modified: time.Now(),
+	})
+	if err != nil {
+		fs.node.Unpin(result.Root)
+		return err
+	}
+	if old != nil && old.Root != result.Root {
+		fs.node.Unpin(old.Root)
+	}
+	return nil
+}
+
+func (fs *FS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	name = namespace.Clean(name)
+	write := flag&(os.O_WRONLY|os.O_RDWR) != 0
+
+	e, err := fs.ns.Stat(name)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		if flag&os.O_CREATE == 0 {
+			return nil, err
+		}
+		parent, err := fs.ns.Stat(path.Dir(name))
+		if err != nil || !parent.Dir {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		return fs.newWriteFile(name, namespace.Entry{}, false)
+	case err != nil:
+		return nil, err
+	case flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	}
+
+	if e.Dir {
+		if write {
+			return nil, &os.PathError{Op: "open", Path: name, Err: errors.New("is a directory")}
+		}
+		return &dirFile{fs: fs, name: name, entry: e}, nil
+	}
+	if write {
+		return fs.newWriteFile(name, e, flag&os.O_TRUNC == 0)
+	}
+	return &readFile{fs: fs, name: name, entry: e}, nil
+}
+
+// fileInfo describes a namespace entry
+type fileInfo struct {
+	name  string
+	entry namespace.Entry
+}
+
+func (fi fileInfo) Name() string       { return fi.name }
+func (fi fileInfo) Size() int64        { return fi.entry.Size }
+func (fi fileInfo) ModTime() time.Time { return fi.entry.Modified }
+func (fi fileInfo) IsDir() bool        { return fi.entry.Dir }
+func (fi fileInfo) Sys() interface{}   { return nil }
+
+func (fi fileInfo) Mode() os.FileMode {
+	if fi.entry.Dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+// ETag implements webdav.ETager: a file's manifest root identifies its
+// content exactly
+func (fi fileInfo) ETag(ctx context.Context) (string, error) {
+	if fi.entry.Dir {
+		return "", webdav.ErrNotImplemented
+	}
+	return `"` + fi.entry.Root + `"`, nil
+}
+
+// dirFile is an open directory
+type dirFile struct {
+	fs    *FS
+	name  string
+	entry namespace.Entry
+	read  int // entries already returned by Readdir
+}
+
+func (d *dirFile) Close() error                                 { return nil }
+func (d *dirFile) Read(p []byte) (int, error)                   { return 0, errors.New("is a directory") }
+func (d *dirFile) Write(p []byte) (int, error)                  { return 0, errors.New("is a directory") }
+func (d *dirFile) Seek(offset int64, whence int) (int64, error) { return 0, nil }
+
+func (d *dirFile) Stat() (os.FileInfo, error) {
+	return fileInfo{name: path.Base(d.name), entry: d.entry}, nil
+}
+
+func (d *dirFile) Readdir(count int) ([]os.FileInfo, error) {
+	names, err := d.fs.ns.List(d.name)
+	if err != nil {
+		return nil, err
+	}
+	names = names[min(d.read, len(names)):]
+	if count > 0 {
+		if len(names) == 0 {
+			return nil, io.EOF
+		}
+		names = names[:min(count, len(names))]
+	}
+
+	var infos []os.FileInfo
+	for _, name := range names {
+		e, err := d.fs.ns.Stat(path.Join(d.name, name))
+		if err != nil {
+			continue // removed meanwhile
+		}
+		infos = append(infos, fileInfo{name: name, entry: e})
+	}
+	d.read += len(names)
+	return infos, nil
+}
+
+// readFile is a stored file opened for reading; chunks are fetched on the
+// first read, so listing and stat never touch the network
+type readFile struct {
+	fs     *FS
+	name   string
+	entry  namespace.Entry
+	reader *node.FileReader
+	pos    int64
+}
+
+func (f *readFile) Close() error                       { return nil }
+func (f *readFile) Write(p []byte) (int, error)        { return 0, os.ErrPermission }
+func (f *readFile) Readdir(int) ([]os.FileInfo, error) { return nil, errors.New("not a directory") }
+
+func (f *readFile) Stat() (os.FileInfo, error) {
+	return fileInfo{name: path.Base(f.name), entry: f.entry}, nil
+}
+
+func (f *readFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += f.entry.Size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+func (f *readFile) Read(p []byte) (int, error) {
+	if f.reader == nil {
+		meta, err := f.fs.node.GetManifest(f.entry.Root)
+		if err != nil {
+			return 0, err
+		}
+		if f.reader, err = f.fs.node.OpenFile(meta, f.entry.Key); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := f.reader.Seek(f.pos, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := f.reader.Read(p)
+	f.pos += int64(n)
+	return n, err
+}
+
+// writeFile stages writes in a temp file named after the target, so the
+// stored file keeps its name and type, and commits it on Close
+type writeFile struct {
+	*os.File
+	fs    *FS
+	name  string
+	dir   string
+	dirty bool
+}
+
+func (fs *FS) newWriteFile(name string, existing namespace.Entry, keep bool) (*writeFile, error) {
+	dir, err := os.MkdirTemp(fs.tempDir, "dav-")
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Create(filepath.Join(dir, path.Base(name)))
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	// New and truncated files are committed even if nothing is written
+	w := &writeFile{File: f, fs: fs, name: name, dir: dir, dirty: true}
+
+	// Opened without O_TRUNC: start from the current content
+	if keep && existing.Root != "" {
+		w.dirty = false
+		src := &readFile{fs: fs, name: name, entry: existing}
+		if _, err := io.Copy(f, src); err != nil {
+			w.discard()
+			return nil, err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			w.discard()
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+func (w *writeFile) Write(p []byte) (int, error) {
+	w.dirty = true
+	return w.File.Write(p)
+}
+
+func (w *writeFile) Readdir(int) ([]os.FileInfo, error) {
+	return nil, errors.New("not a directory")
+}
+
+func (w *writeFile) Stat() (os.FileInfo, error) {
+	info, err := w.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return fileInfo{name: path.Base(w.name), entry: namespace.Entry{Size: info.Size(), Modified: info.ModTime()}}, nil
+}
+
+// Close uploads the staged file and points the namespace entry at it
+func (w *writeFile) Close() error {
+	defer w.discard()
+	if err := w.File.Close(); err != nil {
+		return err
+	}
+	if !w.dirty {
+		return nil
+	}
+
+	return w.fs.commit(w.name, w.File.Name())
+}
+
+func (w *writeFile) discard() {
+	w.File.Close()
+	os.RemoveAll(w.dir)
+}
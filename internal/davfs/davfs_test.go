@@ -0,0 +1,114 @@
+package davfs
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/webdav"
+
+	"github.com/tanmaydeobhankar/nebulafs/internal/namespace"
+	"github.com/tanmaydeobhankar/nebulafs/internal/node"
+	"github.com/tanmaydeobhankar/nebulafs/internal/p2p"
+	"github.com/tanmaydeobhankar/nebulafs/internal/storage"
+)
+
+func TestWebDAV(t *testing.T) {
+	tmpDir := t.TempDir()
+	n, err := node.NewNode(node.NodeConfig{
+		Port:       8400,
+		StorageDir: filepath.Join(tmpDir, "node"),
+		Store:      storage.NewMemoryStore(),
+		Transport:  p2p.NewMemoryNetwork(1).NewTransport("127.0.0.1:8400"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go n.Start()
+
+	ns, err := namespace.Open(n, bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err := New(n, ns, 0, filepath.Join(tmpDir, "davtmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(RequireAuth(&webdav.Handler{FileSystem: fs, LockSystem: webdav.NewMemLS()}, DefaultUser, "secret"))
+	defer ts.Close()
+
+	do := func(method, path string, body string, header ...string) (*http.Response, string) {
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		req.SetBasicAuth(DefaultUser, "secret")
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp, string(data)
+	}
+
+	for _, password := range []string{"", "wrong"} {
+		req, _ := http.NewRequest("PROPFIND", ts.URL+"/", nil)
+		if password != "" {
+			req.SetBasicAuth(DefaultUser, password)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") == "" {
+			t.Errorf("Request with password %q: %d", password, resp.StatusCode)
+		}
+	}
+
+	if resp, _ := do("MKCOL", "/docs", ""); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("MKCOL: %d", resp.StatusCode)
+	}
+	if resp, _ := do("PUT", "/docs/report.txt", "first draft"); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("PUT: %d", resp.StatusCode)
+	}
+	first, _ := ns.Stat("/docs/report.txt")
+	if resp, _ := do("PUT", "/docs/report.txt", "final version"); resp.StatusCode >= 300 {
+		t.Fatalf("PUT overwrite: %d", resp.StatusCode)
+	}
+
+	resp, body := do("GET", "/docs/report.txt", "")
+	if body != "final version" || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+		t.Errorf("GET: %q %s", body, resp.Header.Get("Content-Type"))
+	}
+	if _, body = do("GET", "/docs/report.txt", "", "Range", "bytes=6-"); body != "version" {
+		t.Errorf("Range GET: %q", body)
+	}
+	if pins := n.Pins(); len(pins) != 1 || pins[0].Root == first.Root {
+		t.Errorf("Overwritten version still pinned: %+v", pins)
+	}
+
+	resp, body = do("PROPFIND", "/docs/", "", "Depth", "1")
+	if resp.StatusCode != http.StatusMultiStatus || !strings.Contains(body, "report.txt") {
+		t.Errorf("PROPFIND: %d %s", resp.StatusCode, body)
+	}
+
+	if resp, _ = do("MOVE", "/docs/report.txt", "", "Destination", ts.URL+"/report-final.txt"); resp.StatusCode != http.StatusCreated {
+		t.Errorf("MOVE: %d", resp.StatusCode)
+	}
+	if _, body = do("GET", "/report-final.txt", ""); body != "final version" {
+		t.Errorf("GET after MOVE: %q", body)
+	}
+
+	if resp, _ = do("DELETE", "/report-final.txt", ""); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("DELETE: %d", resp.StatusCode)
+	}
+	if len(n.Pins()) != 0 {
+		t.Errorf("Deleted file still pinned")
+	}
+}
@@ -66,3 +66,8 @@ func (dht *DHT) HandleFindValue(sender Contact, key string) ([]byte, []Contact)
 func (dht *DHT) AddNode(c Contact) {
 	dht.RoutingTable.AddContact(c)
 }
+
+// RemoveNode forgets a node that has left the network
+func (dht *DHT) RemoveNode(address string) {
+	dht.RoutingTable.RemoveAddress(address)
+}
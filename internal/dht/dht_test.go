@@ -34,3 +34,17 @@ func TestRoutingTable(t *testing.T) {
 		lastDist = dist
 	}
 }
+
+func TestRemoveAddress(t *testing.T) {
+	rt := NewRoutingTable(Contact{ID: NewID("self"), Address: "127.0.0.1:3000"})
+	rt.AddContact(Contact{ID: NewID("a"), Address: "127.0.0.1:4000"})
+	rt.AddContact(Contact{ID: NewID("b"), Address: "127.0.0.1:4001"})
+
+	if !rt.RemoveAddress("127.0.0.1:4000") {
+		t.Fatal("Expected contact to be removed")
+	}
+	contacts := rt.FindClosestContacts(NewID("x"), K)
+	if len(contacts) != 1 || contacts[0].Address != "127.0.0.1:4001" {
+		t.Errorf("Unexpected contacts after removal: %v", contacts)
+	}
+}
@@ -55,6 +55,25 @@ func (rt *RoutingTable) AddContact(c Contact) {
 	}
 }
 
+// RemoveAddress drops every contact reachable at address, e.g. after the
+// peer stopped answering
+func (rt *RoutingTable) RemoveAddress(address string) bool {
+	rt.Mutex.Lock()
+	defer rt.Mutex.Unlock()
+
+	removed := false
+	for _, bucket := range rt.Buckets {
+		for i := 0; i < len(bucket.Contacts); i++ {
+			if bucket.Contacts[i].Address == address {
+				bucket.Contacts = append(bucket.Contacts[:i], bucket.Contacts[i+1:]...)
+				i--
+				removed = true
+			}
+		}
+	}
+	return removed
+}
+
 // FindClosestContacts finds the K closest contacts to a target ID
 func (rt *RoutingTable) FindClosestContacts(target ID, count int) []Contact {
 	rt.Mutex.RLock()
@@ -78,6 +97,18 @@ func (rt *RoutingTable) FindClosestContacts(target ID, count int) []Contact {
 	return allContacts
 }
 
+// Contacts returns every contact in the routing table
+func (rt *RoutingTable) Contacts() []Contact {
+	rt.Mutex.RLock()
+	defer rt.Mutex.RUnlock()
+
+	var all []Contact
+	for _, b := range rt.Buckets {
+		all = append(all, b.Contacts...)
+	}
+	return all
+}
+
 // bucketIndex calculates the index of the bucket for a given ID
 func (rt *RoutingTable) bucketIndex(id ID) int {
 	dist := rt.Self.ID.XOR(id)
@@ -3,6 +3,7 @@ package dht
 import (
 	"crypto/sha1"
 	"encoding/hex"
+	"fmt"
 	"math/big"
 )
 
@@ -30,6 +31,20 @@ func NewID(data string) ID {
 	return ID(hash)
 }
 
+// ParseID decodes the hex form produced by Hex
+func ParseID(s string) (ID, error) {
+	var id ID
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return id, err
+	}
+	if len(b) != IDLength {
+		return id, fmt.Errorf("id must be %d bytes, got %d", IDLength, len(b))
+	}
+	copy(id[:], b)
+	return id, nil
+}
+
 // Hex returns the hex string representation of the ID
 func (id ID) Hex() string {
 	return hex.EncodeToString(id[:])
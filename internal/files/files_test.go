@@ -2,6 +2,7 @@ package files
 
 import (
 	"bytes"
+	"encoding/json"
 	"os"
 	"testing"
 )
@@ -44,3 +45,40 @@ func TestProcessAndReassemble(t *testing.T) {
 		t.Errorf("Content mismatch. Expected '%s', got '%s'", originalContent, reassembled)
 	}
 }
+
+func TestSealedMetadata(t *testing.T) {
+	key := make([]byte, 32)
+	meta := FileMetadata{ID: "id", Name: "secret.txt", Size: 42, Type: ".txt"}
+	if err := meta.Seal(key); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(meta)
+	if bytes.Contains(data, []byte("secret")) || bytes.Contains(data, []byte(`"size"`)) {
+		t.Errorf("Sealed metadata leaks private fields: %s", data)
+	}
+
+	var parsed FileMetadata
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Name != "" {
+		t.Errorf("Private fields readable without the key")
+	}
+	if err := parsed.Unseal(make([]byte, 32)); err != nil || parsed.Name != "secret.txt" || parsed.Size != 42 {
+		t.Errorf("Unseal gave %+v, %v", parsed, err)
+	}
+	wrong := []byte("0123456789abcdef0123456789abcdef")
+	if err := parsed.Unseal(wrong); err != ErrWrongKey {
+		t.Errorf("Expected ErrWrongKey, got %v", err)
+	}
+
+	// Manifests from before sealing keep their plaintext fields
+	var legacy FileMetadata
+	json.Unmarshal([]byte(`{"id":"old","name":"a.txt","size":5,"type":".txt","chunks":[]}`), &legacy)
+	if err := legacy.Unseal(key); err != nil || legacy.Name != "a.txt" || legacy.Size != 5 {
+		t.Errorf("Legacy metadata read as %+v, %v", legacy, err)
+	}
+	if data, _ := json.Marshal(legacy); !bytes.Contains(data, []byte(`"name":"a.txt"`)) {
+		t.Errorf("Legacy metadata lost its name when rewritten: %s", data)
+	}
+}
@@ -0,0 +1,86 @@
+package files
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/tanmaydeobhankar/nebulafs/internal/crypto"
+)
+
+// NewManifest packs the chunk references of a file into a content-addressed
+// chunk. Its hash is the file's root: the single ID needed (with the key) to
+// fetch the file back.
+func NewManifest(meta FileMetadata) (Chunk, error) {
+	data, err := json.Marshal(meta.StripContent())
+	if err != nil {
+		return Chunk{}, err
+	}
+	return Chunk{
+		Size:    len(data),
+		Hash:    crypto.HashSHA1(data),
+		Content: data,
+	}, nil
+}
+
+var (
+	// ErrUnsigned is returned by VerifySignature for metadata without one
+	ErrUnsigned = errors.New("metadata is not signed")
+	// ErrBadSignature means the metadata was changed after signing
+	ErrBadSignature = errors.New("metadata signature does not match")
+)
+
+// signedBytes is what the signature covers: the serialized metadata with
+// chunk references only and no signature
+func (m FileMetadata) signedBytes() ([]byte, error) {
+	m = m.StripContent()
+	m.Signature = nil
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte("nebulafs manifest\x00"), data...), nil
+}
+
+// Sign sets Publisher to the public half of key and signs the metadata.
+// Any later change (e.g. to Recipients) needs a new signature.
+func (m *FileMetadata) Sign(key ed25519.PrivateKey) error {
+	m.Publisher = key.Public().(ed25519.PublicKey)
+	data, err := m.signedBytes()
+	if err != nil {
+		return err
+	}
+	m.Signature = ed25519.Sign(key, data)
+	return nil
+}
+
+// VerifySignature checks that Publisher signed the metadata as it is
+func (m FileMetadata) VerifySignature() error {
+	if len(m.Signature) == 0 {
+		return ErrUnsigned
+	}
+	if len(m.Publisher) != ed25519.PublicKeySize {
+		return errors.New("invalid publisher key")
+	}
+	data, err := m.signedBytes()
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(m.Publisher, data, m.Signature) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// ParseManifest verifies a manifest chunk and decodes its metadata
+func ParseManifest(chunk Chunk) (FileMetadata, error) {
+	if crypto.HashSHA1(chunk.Content) != chunk.Hash {
+		return FileMetadata{}, fmt.Errorf("manifest %s: hash mismatch", chunk.Hash)
+	}
+	var meta FileMetadata
+	if err := json.Unmarshal(chunk.Content, &meta); err != nil {
+		return FileMetadata{}, fmt.Errorf("manifest %s: %v", chunk.Hash, err)
+	}
+	return meta, nil
+}
@@ -10,8 +10,46 @@ import (
 	"github.com/tanmaydeobhankar/nebulafs/internal/crypto"
 )
 
+// ProcessOptions controls how ProcessFileWith encrypts a file
+type ProcessOptions struct {
+	// Key is the 32-byte file key; a random one is generated when nil
+	Key []byte
+	// Convergent derives each chunk's nonce from its content, so unchanged
+	// chunks encrypted under the same key keep their hash
+	Convergent bool
+	// Parent is the manifest root of the version this file replaces
+	Parent string
+	// Pad fills the last chunk with zeros up to PaddedSize, so stored
+	// chunk sizes only reveal the file size roughly
+	Pad bool
+	// Cipher is the suite chunks are encrypted with; zero means
+	// crypto.DefaultSuite
+	Cipher crypto.Suite
+}
+
+// minPadding is the smallest padded size of a last chunk
+const minPadding = 4096
+
+// PaddedSize rounds n up to a power of two of at least 4 KiB, capped at
+// ChunkSize
+func PaddedSize(n int) int {
+	size := minPadding
+	for size < n && size < ChunkSize {
+		size *= 2
+	}
+	if n > size {
+		return n
+	}
+	return size
+}
+
 // ProcessFile splits a file into encrypted chunks and returns metadata
 func ProcessFile(path string) (FileMetadata, []Chunk, []byte, error) {
+	return ProcessFileWith(path, ProcessOptions{})
+}
+
+// ProcessFileWith is ProcessFile with a choice of key and encryption mode
+func ProcessFileWith(path string, opts ProcessOptions) (FileMetadata, []Chunk, []byte, error) {
 	file, err := os.Open(path)
 	if err != nil {
 		return FileMetadata{}, nil, nil, err
@@ -24,12 +62,26 @@ func ProcessFile(path string) (FileMetadata, []Chunk, []byte, error) {
 	}
 
 	// Generate encryption key
-	key := make([]byte, 32)
-	if _, err := rand.Read(key); err != nil {
-		return FileMetadata{}, nil, nil, err
+	key := opts.Key
+	if key == nil {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return FileMetadata{}, nil, nil, err
+		}
+	}
+	suite := opts.Cipher
+	if suite == crypto.SuiteLegacy {
+		suite = crypto.DefaultSuite
+	}
+	encrypt := func(data, key []byte) ([]byte, error) {
+		if opts.Convergent {
+			return crypto.EncryptConvergent(suite, data, key)
+		}
+		return crypto.Encrypt(suite, data, key)
 	}
 
 	var chunks []Chunk
+	var last []byte // plaintext of the last chunk, kept for padding
 	buffer := make([]byte, ChunkSize)
 	index := 0
 
@@ -43,9 +95,12 @@ func ProcessFile(path string) (FileMetadata, []Chunk, []byte, error) {
 		}
 
 		data := buffer[:n]
+		if opts.Pad {
+			last = append(last[:0], data...)
+		}
 
 		// Encrypt
-		encryptedData, err := crypto.EncryptAES256(data, key)
+		encryptedData, err := encrypt(data, key)
 		if err != nil {
 			return FileMetadata{}, nil, nil, err
 		}
@@ -63,6 +118,24 @@ func ProcessFile(path string) (FileMetadata, []Chunk, []byte, error) {
 		index++
 	}
 
+	// Re-encrypt the last chunk padded; an empty file gets one chunk of
+	// padding so it looks like any other small file
+	if opts.Pad {
+		padded := make([]byte, PaddedSize(len(last)))
+		copy(padded, last)
+		encryptedData, err := encrypt(padded, key)
+		if err != nil {
+			return FileMetadata{}, nil, nil, err
+		}
+		chunk := Chunk{Size: len(encryptedData), Hash: crypto.HashSHA1(encryptedData), Content: encryptedData}
+		if len(chunks) == 0 {
+			chunks = append(chunks, chunk)
+		} else {
+			chunk.Index = chunks[len(chunks)-1].Index
+			chunks[len(chunks)-1] = chunk
+		}
+	}
+
 	// Calculate ID for the file itself (hash of the name + size + time?)
 	// Or just a random ID. Let's use a random ID for now or hash of the first chunk hash?
 	// Let's use SHA1 of the file name + size for determinism in this simple example,
@@ -74,8 +147,14 @@ func ProcessFile(path string) (FileMetadata, []Chunk, []byte, error) {
 		Name:      filepath.Base(path),
 		Size:      stat.Size(),
 		Type:      filepath.Ext(path),
+		ModTime:   stat.ModTime(),
 		Chunks:    chunks, // Note: In a real system, we might only store Hash references here to save RAM
 		Encrypted: true,
+		Parent:    opts.Parent,
+		Cipher:    suite,
+	}
+	if err := metadata.Seal(key); err != nil {
+		return FileMetadata{}, nil, nil, err
 	}
 
 	return metadata, chunks, key, nil
@@ -17,13 +17,7 @@ func ReassembleFile(chunks []Chunk, key []byte) ([]byte, error) {
 	var assembledData []byte
 
 	for _, chunk := range chunks {
-		// Verify Hash?
-		if crypto.HashSHA1(chunk.Content) != chunk.Hash {
-			return nil, errors.New("chunk hash mismatch - data corruption")
-		}
-
-		// Decrypt
-		decrypted, err := crypto.DecryptAES256(chunk.Content, key)
+		decrypted, err := DecryptChunk(chunk, key)
 		if err != nil {
 			return nil, err
 		}
@@ -33,3 +27,12 @@ func ReassembleFile(chunks []Chunk, key []byte) ([]byte, error) {
 
 	return assembledData, nil
 }
+
+// DecryptChunk verifies a chunk against its hash and decrypts it
+func DecryptChunk(chunk Chunk, key []byte) ([]byte, error) {
+	if crypto.HashSHA1(chunk.Content) != chunk.Hash {
+		return nil, errors.New("chunk hash mismatch - data corruption")
+	}
+
+	return crypto.Decrypt(chunk.Content, key)
+}
@@ -3,10 +3,22 @@ package files
 import (
 	"crypto/sha1"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/tanmaydeobhankar/nebulafs/internal/crypto"
 )
 
 const ChunkSize = 1024 * 1024 // 1MB
 
+// ErrWrongKey is returned by Unseal when the key doesn't open the metadata
+var ErrWrongKey = errors.New("cannot decrypt metadata: wrong key")
+
+// MetadataVersion is the manifest format with a sealed private part.
+// Version 0 manifests carry name, size and type in the clear.
+const MetadataVersion = 2
+
 type Chunk struct {
 	Index   int    `json:"index"`
 	Size    int    `json:"size"`
@@ -14,14 +26,130 @@ type Chunk struct {
 	Content []byte `json:"content"`
 }
 
-// metadata represents the structure of a file in the system
+// metadata represents the structure of a file in the system. Only the
+// fields needed to locate and verify chunks are public; the rest is sealed
+// with the file key into Private and filled in by Unseal.
 type FileMetadata struct {
+	Version   int     `json:"version,omitempty"`
 	ID        string  `json:"id"`
-	Name      string  `json:"name"`
-	Size      int64   `json:"size"`
-	Type      string  `json:"type"`
 	Chunks    []Chunk `json:"chunks"`
 	Encrypted bool    `json:"encrypted"`
+	Parent    string  `json:"parent,omitempty"` // manifest root of the previous version
+
+	// Cipher is the suite of the chunks, needed to know their plaintext
+	// sizes before fetching them; legacy manifests have none
+	Cipher crypto.Suite `json:"cipher,omitempty"`
+
+	// Recipients hold the file key wrapped for each reader's public key
+	Recipients []crypto.WrappedKey `json:"recipients,omitempty"`
+
+	// Private is the sealed privateMetadata
+	Private []byte `json:"private,omitempty"`
+
+	// Publisher is the Ed25519 key that signed everything but Signature
+	Publisher []byte `json:"publisher,omitempty"`
+	Signature []byte `json:"signature,omitempty"`
+
+	Name    string    `json:"-"`
+	Size    int64     `json:"-"`
+	Type    string    `json:"-"`
+	ModTime time.Time `json:"-"`
+}
+
+// privateMetadata is the part of the metadata only key holders can read
+type privateMetadata struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	Type    string    `json:"type"`
+	ModTime time.Time `json:"mtime"`
+}
+
+// legacyFields are the plaintext fields of version 0 metadata
+type legacyFields struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	Type string `json:"type"`
+}
+
+// Seal encrypts name, size, type and mtime into Private. The plaintext
+// fields stay set in memory but are no longer serialized.
+func (m *FileMetadata) Seal(key []byte) error {
+	metaKey, err := crypto.SubKey(key, "metadata")
+	if err != nil {
+		return err
+	}
+	plain, err := json.Marshal(privateMetadata{Name: m.Name, Size: m.Size, Type: m.Type, ModTime: m.ModTime})
+	if err != nil {
+		return err
+	}
+	if m.Private, err = crypto.EncryptAES256(plain, metaKey); err != nil {
+		return err
+	}
+	m.Version = MetadataVersion
+	return nil
+}
+
+// Unseal decrypts Private into the plaintext fields. Version 0 metadata has
+// nothing to decrypt and is left as is.
+func (m *FileMetadata) Unseal(key []byte) error {
+	if len(m.Private) == 0 {
+		return nil
+	}
+	metaKey, err := crypto.SubKey(key, "metadata")
+	if err != nil {
+		return err
+	}
+	plain, err := crypto.DecryptAES256(m.Private, metaKey)
+	if err != nil {
+		return ErrWrongKey
+	}
+	var p privateMetadata
+	if err := json.Unmarshal(plain, &p); err != nil {
+		return err
+	}
+	m.Name, m.Size, m.Type, m.ModTime = p.Name, p.Size, p.Type, p.ModTime
+	return nil
+}
+
+// MarshalJSON writes the plaintext fields only for version 0 metadata, so
+// old manifests survive being rewritten (e.g. by Share)
+func (m FileMetadata) MarshalJSON() ([]byte, error) {
+	type plain FileMetadata
+	if len(m.Private) > 0 {
+		return json.Marshal(plain(m))
+	}
+	return json.Marshal(struct {
+		plain
+		legacyFields
+	}{plain(m), legacyFields{m.Name, m.Size, m.Type}})
+}
+
+// UnmarshalJSON reads both sealed and version 0 metadata
+func (m *FileMetadata) UnmarshalJSON(data []byte) error {
+	type plain FileMetadata
+	var v struct {
+		plain
+		legacyFields
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*m = FileMetadata(v.plain)
+	if len(m.Private) == 0 {
+		m.Name, m.Size, m.Type = v.legacyFields.Name, v.legacyFields.Size, v.legacyFields.Type
+	}
+	return nil
+}
+
+// StripContent returns a copy of the metadata whose chunk list only holds
+// references (index, size, hash), without the chunk data
+func (m FileMetadata) StripContent() FileMetadata {
+	refs := make([]Chunk, len(m.Chunks))
+	for i, c := range m.Chunks {
+		refs[i] = Chunk{Index: c.Index, Size: c.Size, Hash: c.Hash}
+	}
+	m.Chunks = refs
+	return m
 }
 
 // hash calc using SHA1
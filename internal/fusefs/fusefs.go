@@ -0,0 +1,402 @@
+//go:build linux
+
+// Package fusefs mounts a namespace of stored files as a local file system.
+// Reads fetch only the chunks covering the requested range; fetched chunks
+// land in the node's store, which doubles as the local cache. Writes are
+// buffered in a temp file and committed as a new version of the file when
+// the last handle is closed.
+package fusefs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/tanmaydeobhankar/nebulafs/internal/namespace"
+	"github.com/tanmaydeobhankar/nebulafs/internal/node"
+)
+
+// attrTimeout is how long the kernel may cache names and attributes. The
+// namespace only changes through this mount, so a short timeout is enough.
+const attrTimeout = time.Second
+
+// FS is the state shared by all inodes of a mount
+type FS struct {
+	node     *node.Node
+	ns       *namespace.Namespace
+	replicas int
+	tempDir  string
+
+	// Files being written, by namespace path. They are visible to lookups
+	// before their first commit.
+	open  map[string]*writeHandle
+	mutex sync.Mutex
+}
+
+// New creates a file system over ns. Written files are uploaded requiring
+// replicas confirmed copies per chunk and staged in tempDir.
+func New(n *node.Node, ns *namespace.Namespace, replicas int, tempDir string) (*FS, error) {
+	if err := os.MkdirAll(tempDir, 0700); err != nil {
+		return nil, err
+	}
+	return &FS{
+		node:     n,
+		ns:       ns,
+		replicas: replicas,
+		tempDir:  tempDir,
+		open:     make(map[string]*writeHandle),
+	}, nil
+}
+
+// Mount mounts the file system at dir. The caller waits on the returned
+// server and unmounts it when done.
+func (fsys *FS) Mount(dir string) (*fuse.Server, error) {
+	timeout := attrTimeout
+	return fs.Mount(dir, &inode{fs: fsys}, &fs.Options{
+		MountOptions: fuse.MountOptions{
+			FsName: "nebulafs",
+			Name:   "nebulafs",
+			// Lets root mount without fusermount installed
+			DirectMount: os.Geteuid() == 0,
+		},
+		EntryTimeout: &timeout,
+		AttrTimeout:  &timeout,
+	})
+}
+
+// toErrno maps namespace and node errors to the errno the kernel expects
+func toErrno(err error) syscall.Errno {
+	var errno syscall.Errno
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &errno):
+		return errno
+	case errors.Is(err, os.ErrNotExist):
+		return syscall.ENOENT
+	case errors.Is(err, os.ErrExist):
+		return syscall.EEXIST
+	case errors.Is(err, os.ErrPermission):
+		return syscall.EPERM
+	case errors.Is(err, os.ErrInvalid):
+		return syscall.EINVAL
+	}
+	return syscall.EIO
+}
+
+// inode is a file or directory. It holds no state of its own: everything is
+// looked up in the namespace by path, so renames need no bookkeeping.
+type inode struct {
+	fs.Inode
+	fs *FS
+}
+
+var (
+	_ fs.NodeLookuper  = (*inode)(nil)
+	_ fs.NodeGetattrer = (*inode)(nil)
+	_ fs.NodeSetattrer = (*inode)(nil)
+	_ fs.NodeReaddirer = (*inode)(nil)
+	_ fs.NodeMkdirer   = (*inode)(nil)
+	_ fs.NodeCreater   = (*inode)(nil)
+	_ fs.NodeOpener    = (*inode)(nil)
+	_ fs.NodeUnlinker  = (*inode)(nil)
+	_ fs.NodeRmdirer   = (*inode)(nil)
+	_ fs.NodeRenamer   = (*inode)(nil)
+)
+
+// path returns the namespace path of the inode
+func (in *inode) path() string {
+	return namespace.Clean(in.Path(nil))
+}
+
+func (in *inode) child(name string) string {
+	return path.Join(in.path(), name)
+}
+
+// stat returns the entry at p, preferring a file being written there
+func (fsys *FS) stat(p string) (namespace.Entry, error) {
+	fsys.mutex.Lock()
+	w := fsys.open[p]
+	fsys.mutex.Unlock()
+	if w != nil && w.wait() == nil {
+		return w.entry()
+	}
+	return fsys.ns.Stat(p)
+}
+
+// commit uploads the local file at localPath and points p at the new
+// version, unpinning the one it replaces
+func (fsys *FS) commit(p, localPath string) error {
+	result, err := fsys.node.Add(localPath, node.UploadOptions{Replicas: fsys.replicas})
+	if err != nil {
+		return err
+	}
+	old, err := fsys.ns.Put(p, namespace.Entry{
+		Root:     result.Root,
+		Key:      result.Key,
+		Size:     result.Metadata.Size,
+		Modified: time.Now(),
+	})
+	if err != nil {
+		fsys.node.Unpin(result.Root)
+		return err
+	}
+	if old != nil && old.Root != result.Root {
+		fsys.node.Unpin(old.Root)
+	}
+	return nil
+}
+
+func setAttr(out *fuse.Attr, e namespace.Entry) {
+	if e.Dir {
+		out.Mode = syscall.S_IFDIR | 0755
+		out.Nlink = 2
+	} else {
+		out.Mode = syscall.S_IFREG | 0644
+		out.Nlink = 1
+		out.Size = uint64(e.Size)
+		out.Blocks = (out.Size + 511) / 512
+	}
+	out.SetTimes(nil, &e.Modified, &e.Modified)
+	out.Owner = *fuse.CurrentOwner()
+}
+
+func (in *inode) newChild(ctx context.Context, e namespace.Entry, out *fuse.EntryOut) *fs.Inode {
+	mode := uint32(syscall.S_IFREG)
+	if e.Dir {
+		mode = syscall.S_IFDIR
+	}
+	setAttr(&out.Attr, e)
+	out.SetEntryTimeout(attrTimeout)
+	out.SetAttrTimeout(attrTimeout)
+	return in.NewInode(ctx, &inode{fs: in.fs}, fs.StableAttr{Mode: mode})
+}
+
+func (in *inode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	e, err := in.fs.stat(in.child(name))
+	if err != nil {
+		return nil, toErrno(err)
+	}
+	return in.newChild(ctx, e, out), 0
+}
+
+func (in *inode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	e, err := in.fs.stat(in.path())
+	if err != nil {
+		return toErrno(err)
+	}
+	setAttr(&out.Attr, e)
+	out.SetTimeout(attrTimeout)
+	return 0
+}
+
+// Setattr supports truncation; mode, owner and time changes are accepted
+// and ignored since the namespace doesn't record them
+func (in *inode) Setattr(ctx context.Context, f fs.FileHandle, attr *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	if size, ok := attr.GetSize(); ok {
+		w, isWrite := f.(*writeHandle)
+		if !isWrite {
+			// truncate(2) without an open file: commit right away
+			var errno syscall.Errno
+			if w, errno = in.fs.openWrite(in.path(), size == 0); errno != 0 {
+				return errno
+			}
+			defer w.Release(ctx)
+		}
+		if errno := w.truncate(int64(size)); errno != 0 {
+			return errno
+		}
+	}
+	return in.Getattr(ctx, f, out)
+}
+
+func (in *inode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	dir := in.path()
+	names, err := in.fs.ns.List(dir)
+	if err != nil {
+		return nil, toErrno(err)
+	}
+
+	// Include new files that haven't been committed yet
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		seen[name] = true
+	}
+	in.fs.mutex.Lock()
+	for p := range in.fs.open {
+		if path.Dir(p) == dir && !seen[path.Base(p)] {
+			names = append(names, path.Base(p))
+		}
+	}
+	in.fs.mutex.Unlock()
+
+	entries := make([]fuse.DirEntry, 0, len(names))
+	for _, name := range names {
+		e, err := in.fs.stat(path.Join(dir, name))
+		if err != nil {
+			continue // removed meanwhile
+		}
+		mode := uint32(syscall.S_IFREG)
+		if e.Dir {
+			mode = syscall.S_IFDIR
+		}
+		entries = append(entries, fuse.DirEntry{Name: name, Mode: mode})
+	}
+	return fs.NewListDirStream(entries), 0
+}
+
+func (in *inode) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	p := in.child(name)
+	if err := in.fs.ns.Mkdir(p); err != nil {
+		return nil, toErrno(err)
+	}
+	e, err := in.fs.ns.Stat(p)
+	if err != nil {
+		return nil, toErrno(err)
+	}
+	return in.newChild(ctx, e, out), 0
+}
+
+func (in *inode) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (*fs.Inode, fs.FileHandle, uint32, syscall.Errno) {
+	p := in.child(name)
+	if e, err := in.fs.stat(p); err == nil {
+		if flags&syscall.O_EXCL != 0 {
+			return nil, nil, 0, syscall.EEXIST
+		}
+		if e.Dir {
+			return nil, nil, 0, syscall.EISDIR
+		}
+	}
+	w, errno := in.fs.openWrite(p, true)
+	if errno != 0 {
+		return nil, nil, 0, errno
+	}
+	e, _ := w.entry()
+	return in.newChild(ctx, e, out), w, 0, 0
+}
+
+func (in *inode) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	p := in.path()
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR) != 0 {
+		w, errno := in.fs.openWrite(p, flags&syscall.O_TRUNC != 0)
+		return w, 0, errno
+	}
+
+	// Readers of a file being written see the staged content
+	in.fs.mutex.Lock()
+	w := in.fs.open[p]
+	if w != nil {
+		w.refs++
+	}
+	in.fs.mutex.Unlock()
+	if w != nil {
+		if err := w.wait(); err != nil {
+			return nil, 0, toErrno(err)
+		}
+		return w, fuse.FOPEN_DIRECT_IO, 0
+	}
+
+	e, err := in.fs.ns.Stat(p)
+	if err != nil {
+		return nil, 0, toErrno(err)
+	}
+	if e.Dir {
+		return nil, 0, syscall.EISDIR
+	}
+	// Stored versions never change, so the kernel may keep cached pages
+	return &readHandle{fs: in.fs, entry: e}, fuse.FOPEN_KEEP_CACHE, 0
+}
+
+func (in *inode) Unlink(ctx context.Context, name string) syscall.Errno {
+	p := in.child(name)
+	e, err := in.fs.ns.Stat(p)
+	if err != nil {
+		return toErrno(err)
+	}
+	if e.Dir {
+		return syscall.EISDIR
+	}
+	return in.fs.remove(p)
+}
+
+func (in *inode) Rmdir(ctx context.Context, name string) syscall.Errno {
+	p := in.child(name)
+	e, err := in.fs.ns.Stat(p)
+	if err != nil {
+		return toErrno(err)
+	}
+	if !e.Dir {
+		return syscall.ENOTDIR
+	}
+	if names, _ := in.fs.ns.List(p); len(names) > 0 {
+		return syscall.ENOTEMPTY
+	}
+	return in.fs.remove(p)
+}
+
+func (fsys *FS) remove(p string) syscall.Errno {
+	removed, err := fsys.ns.RemoveAll(p)
+	for _, e := range removed {
+		fsys.node.Unpin(e.Root)
+	}
+	return toErrno(err)
+}
+
+func (in *inode) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	if flags != 0 {
+		return syscall.EINVAL // RENAME_EXCHANGE and RENAME_NOREPLACE
+	}
+	parent, ok := newParent.(*inode)
+	if !ok {
+		return syscall.EXDEV
+	}
+	oldPath, newPath := in.child(name), parent.child(newName)
+
+	// A file open for writing moves with its handle: what was written so
+	// far is committed under the old name first, later writes land under
+	// the new one. The kernel releases handles after close returns, so
+	// this is also the common case of renaming a file just written.
+	in.fs.mutex.Lock()
+	w := in.fs.open[oldPath]
+	_, busy := in.fs.open[newPath]
+	in.fs.mutex.Unlock()
+	if busy {
+		return syscall.EBUSY
+	}
+	if w != nil {
+		if err := w.wait(); err != nil {
+			return toErrno(err)
+		}
+		if errno := w.commit(); errno != 0 {
+			return errno
+		}
+	}
+
+	in.fs.mutex.Lock()
+	defer in.fs.mutex.Unlock()
+	if cur := in.fs.open[oldPath]; (cur != nil && cur != w) || in.fs.open[newPath] != nil {
+		return syscall.EBUSY // opened for writing meanwhile
+	}
+	replaced, err := in.fs.ns.Rename(oldPath, newPath)
+	if replaced != nil {
+		in.fs.node.Unpin(replaced.Root)
+	}
+	if err != nil {
+		return toErrno(err)
+	}
+	if w = in.fs.open[oldPath]; w != nil {
+		w.mutex.Lock()
+		w.path = newPath
+		w.mutex.Unlock()
+		delete(in.fs.open, oldPath)
+		in.fs.open[newPath] = w
+	}
+	return 0
+}
@@ -0,0 +1,122 @@
+//go:build linux
+
+package fusefs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tanmaydeobhankar/nebulafs/internal/files"
+	"github.com/tanmaydeobhankar/nebulafs/internal/namespace"
+	"github.com/tanmaydeobhankar/nebulafs/internal/node"
+	"github.com/tanmaydeobhankar/nebulafs/internal/p2p"
+	"github.com/tanmaydeobhankar/nebulafs/internal/storage"
+)
+
+func TestMount(t *testing.T) {
+	tmpDir := t.TempDir()
+	n, err := node.NewNode(node.NodeConfig{
+		Port:       8500,
+		StorageDir: filepath.Join(tmpDir, "node"),
+		Store:      storage.NewMemoryStore(),
+		Transport:  p2p.NewMemoryNetwork(1).NewTransport("127.0.0.1:8500"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go n.Start()
+
+	ns, err := namespace.Open(n, bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys, err := New(n, ns, 0, filepath.Join(tmpDir, "fusetmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mnt := filepath.Join(tmpDir, "mnt")
+	os.Mkdir(mnt, 0755)
+	server, err := fsys.Mount(mnt)
+	if err != nil {
+		t.Skipf("FUSE not available: %v", err)
+	}
+	defer server.Unmount()
+
+	if err := os.MkdirAll(filepath.Join(mnt, "docs/2024"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// Larger than a chunk so reads span a boundary
+	content := make([]byte, files.ChunkSize+3000)
+	rand.Read(content)
+	path := filepath.Join(mnt, "docs/2024/report.bin")
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	e, err := ns.Stat("/docs/2024/report.bin")
+	if err != nil || e.Size != int64(len(content)) || e.Root == "" {
+		t.Fatalf("File not committed to the namespace: %+v %v", e, err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part := make([]byte, 2000)
+	if _, err := f.ReadAt(part, files.ChunkSize-1000); err != nil || !bytes.Equal(part, content[files.ChunkSize-1000:files.ChunkSize+1000]) {
+		t.Errorf("Range read across a chunk boundary failed: %v", err)
+	}
+	f.Close()
+
+	// Appending commits a new version and releases the old one
+	f, _ = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	f.Write([]byte("tail"))
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil || !bytes.Equal(got, append(content, "tail"...)) {
+		t.Errorf("Appended content mismatch (%d bytes, %v)", len(got), err)
+	}
+	pins := n.Pins()
+	if len(pins) != 1 || pins[0].Root == e.Root {
+		t.Errorf("Expected only the new version to be pinned, got %+v", pins)
+	}
+
+	if err := os.Rename(path, filepath.Join(mnt, "report.bin")); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	entries, _ := os.ReadDir(mnt)
+	if len(entries) != 2 || entries[0].Name() != "docs" || !entries[0].IsDir() || entries[1].Name() != "report.bin" {
+		t.Errorf("Unexpected listing %v", entries)
+	}
+	if err := os.Remove(filepath.Join(mnt, "docs")); err == nil {
+		t.Errorf("Removing a non-empty directory succeeded")
+	}
+	if err := os.Remove(filepath.Join(mnt, "report.bin")); err != nil {
+		t.Fatal(err)
+	}
+	if pins := n.Pins(); len(pins) != 0 {
+		t.Errorf("Deleted file still pinned: %+v", pins)
+	}
+
+	// A file renamed while open for writing keeps taking writes
+	f, err = os.Create(filepath.Join(mnt, "draft.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("first "))
+	if err := os.Rename(filepath.Join(mnt, "draft.txt"), filepath.Join(mnt, "final.txt")); err != nil {
+		t.Fatalf("Rename of an open file failed: %v", err)
+	}
+	f.Write([]byte("second"))
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if got, err := os.ReadFile(filepath.Join(mnt, "final.txt")); err != nil || string(got) != "first second" {
+		t.Errorf("Renamed file holds %q (%v)", got, err)
+	}
+}
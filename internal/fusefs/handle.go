@@ -0,0 +1,265 @@
+//go:build linux
+
+package fusefs
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/tanmaydeobhankar/nebulafs/internal/namespace"
+	"github.com/tanmaydeobhankar/nebulafs/internal/node"
+)
+
+// readHandle reads a stored version of a file. The manifest and chunks are
+// fetched on the first read, so opening a file never touches the network.
+type readHandle struct {
+	fs     *FS
+	entry  namespace.Entry
+	reader *node.FileReader
+	mutex  sync.Mutex
+}
+
+var _ fs.FileReader = (*readHandle)(nil)
+
+func (h *readHandle) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.reader == nil {
+		meta, err := h.fs.node.GetManifest(h.entry.Root)
+		if err != nil {
+			return nil, toErrno(err)
+		}
+		if h.reader, err = h.fs.node.OpenFile(meta, h.entry.Key); err != nil {
+			return nil, toErrno(err)
+		}
+	}
+	if _, err := h.reader.Seek(off, io.SeekStart); err != nil {
+		return nil, toErrno(err)
+	}
+	// FileReader stops at chunk boundaries; keep going to fill dest
+	n, err := io.ReadFull(h.reader, dest)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, toErrno(err)
+	}
+	return fuse.ReadResultData(dest[:n]), 0
+}
+
+// writeHandle buffers writes to one path in a temp file named after the
+// target, so the stored file keeps its name and type. Every open of the
+// path for writing shares the handle; the content is committed as a new
+// version when the last one is released.
+type writeHandle struct {
+	fs    *FS
+	path  string // changed by Rename under both fs.mutex and mutex
+	dir   string
+	file  *os.File
+	refs  int // open handles, guarded by fs.mutex
+	dirty bool
+	mutex sync.Mutex
+
+	ready   chan struct{} // closed once the stored content is copied in
+	loadErr error         // why copying failed, set before ready is closed
+}
+
+var (
+	_ fs.FileReader   = (*writeHandle)(nil)
+	_ fs.FileWriter   = (*writeHandle)(nil)
+	_ fs.FileFlusher  = (*writeHandle)(nil)
+	_ fs.FileFsyncer  = (*writeHandle)(nil)
+	_ fs.FileReleaser = (*writeHandle)(nil)
+)
+
+// openWrite returns the write handle for p, creating it from the current
+// content unless trunc is set
+func (fsys *FS) openWrite(p string, trunc bool) (*writeHandle, syscall.Errno) {
+	fsys.mutex.Lock()
+	if w := fsys.open[p]; w != nil {
+		w.refs++
+		fsys.mutex.Unlock()
+		if err := w.wait(); err != nil {
+			return nil, toErrno(err)
+		}
+		if trunc {
+			return w, w.truncate(0)
+		}
+		return w, 0
+	}
+
+	w, existing, errno := fsys.newWriteHandle(p)
+	if errno != 0 {
+		fsys.mutex.Unlock()
+		return nil, errno
+	}
+	// Registered before the copy so other opens of p wait on the handle;
+	// the copy may fetch the whole file, so the mount isn't held up by it
+	fsys.open[p] = w
+	fsys.mutex.Unlock()
+
+	if !trunc && existing.Root != "" {
+		w.dirty = false
+		src := &readHandle{fs: fsys, entry: existing}
+		w.loadErr = w.copyFrom(src, existing.Size)
+	}
+	if w.loadErr != nil {
+		fsys.mutex.Lock()
+		delete(fsys.open, p)
+		fsys.mutex.Unlock()
+		close(w.ready)
+		w.discard()
+		return nil, toErrno(w.loadErr)
+	}
+	close(w.ready)
+	return w, 0
+}
+
+// newWriteHandle stages an empty temp file for p and returns the entry it
+// replaces, if any; callers hold fsys.mutex
+func (fsys *FS) newWriteHandle(p string) (*writeHandle, namespace.Entry, syscall.Errno) {
+	existing, err := fsys.ns.Stat(p)
+	switch {
+	case err == nil && existing.Dir:
+		return nil, existing, syscall.EISDIR
+	case err != nil && !os.IsNotExist(err):
+		return nil, existing, toErrno(err)
+	case err != nil:
+		parent, err := fsys.ns.Stat(path.Dir(p))
+		if err != nil || !parent.Dir {
+			return nil, existing, syscall.ENOENT
+		}
+	}
+
+	dir, err := os.MkdirTemp(fsys.tempDir, "fuse-")
+	if err != nil {
+		return nil, existing, toErrno(err)
+	}
+	f, err := os.Create(filepath.Join(dir, path.Base(p)))
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, existing, toErrno(err)
+	}
+	// New and truncated files are committed even if nothing is written
+	w := &writeHandle{fs: fsys, path: p, dir: dir, file: f, refs: 1, dirty: true, ready: make(chan struct{})}
+	return w, existing, 0
+}
+
+// wait blocks until the handle holds the stored content it was opened with
+func (w *writeHandle) wait() error {
+	<-w.ready
+	return w.loadErr
+}
+
+// copyFrom fills the buffer with the stored content
+func (w *writeHandle) copyFrom(src *readHandle, size int64) error {
+	buf := make([]byte, 1<<20)
+	for off := int64(0); off < size; {
+		result, errno := src.Read(context.Background(), buf, off)
+		if errno != 0 {
+			return errno
+		}
+		data, _ := result.Bytes(nil)
+		if len(data) == 0 {
+			return io.ErrUnexpectedEOF
+		}
+		if _, err := w.file.WriteAt(data, off); err != nil {
+			return err
+		}
+		off += int64(len(data))
+	}
+	return nil
+}
+
+// entry describes the buffered content as a namespace entry
+func (w *writeHandle) entry() (namespace.Entry, error) {
+	info, err := w.file.Stat()
+	if err != nil {
+		return namespace.Entry{}, err
+	}
+	return namespace.Entry{Size: info.Size(), Modified: info.ModTime()}, nil
+}
+
+func (w *writeHandle) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	n, err := w.file.ReadAt(dest, off)
+	if err != nil && err != io.EOF {
+		return nil, toErrno(err)
+	}
+	return fuse.ReadResultData(dest[:n]), 0
+}
+
+func (w *writeHandle) Write(ctx context.Context, data []byte, off int64) (uint32, syscall.Errno) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.dirty = true
+	n, err := w.file.WriteAt(data, off)
+	return uint32(n), toErrno(err)
+}
+
+func (w *writeHandle) truncate(size int64) syscall.Errno {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.dirty = true
+	return toErrno(w.file.Truncate(size))
+}
+
+// commit uploads the buffered content and points the namespace at it
+func (w *writeHandle) commit() syscall.Errno {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if !w.dirty {
+		return 0
+	}
+	if err := w.file.Sync(); err != nil {
+		return toErrno(err)
+	}
+	if err := w.fs.commit(w.path, w.file.Name()); err != nil {
+		return toErrno(err)
+	}
+	w.dirty = false
+	return 0
+}
+
+// Flush runs on every close(2). Committing here rather than in Release
+// lets close report upload failures to the writer.
+func (w *writeHandle) Flush(ctx context.Context) syscall.Errno {
+	return w.commit()
+}
+
+func (w *writeHandle) Fsync(ctx context.Context, flags uint32) syscall.Errno {
+	return w.commit()
+}
+
+func (w *writeHandle) Release(ctx context.Context) syscall.Errno {
+	w.fs.mutex.Lock()
+	w.refs--
+	last := w.refs == 0
+	if last {
+		delete(w.fs.open, w.path)
+	}
+	w.fs.mutex.Unlock()
+	if !last {
+		return 0
+	}
+
+	errno := w.commit()
+	w.discard()
+	return errno
+}
+
+func (w *writeHandle) discard() {
+	w.file.Close()
+	os.RemoveAll(w.dir)
+}
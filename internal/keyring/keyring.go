@@ -0,0 +1,257 @@
+// Package keyring keeps file keys in a local file sealed with a
+// passphrase, so they don't have to be copied around as hex.
+package keyring
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tanmaydeobhankar/nebulafs/internal/crypto"
+	"github.com/tanmaydeobhankar/nebulafs/internal/lockfile"
+)
+
+// ErrWrongPassphrase is returned by Open when the keyring can't be decrypted
+var ErrWrongPassphrase = errors.New("wrong keyring passphrase")
+
+// Entry is the key of one stored file
+type Entry struct {
+	Root   string    `json:"root"`
+	FileID string    `json:"file_id"`
+	Name   string    `json:"name"`
+	Key    string    `json:"key"` // hex
+	Added  time.Time `json:"added"`
+}
+
+// sealedFile is the on-disk form: the entries encrypted with a key derived
+// from the passphrase
+type sealedFile struct {
+	KDF    string `json:"kdf"`
+	Salt   []byte `json:"salt"`
+	N      int    `json:"n"`
+	R      int    `json:"r"`
+	P      int    `json:"p"`
+	Sealed []byte `json:"sealed"`
+}
+
+// Keyring is an open keyring file. It holds a lock on the file until
+// Close, so processes that share a keyring take turns instead of
+// overwriting each other's entries.
+type Keyring struct {
+	path    string
+	lock    *lockfile.Lock
+	file    sealedFile
+	key     []byte
+	entries map[string]Entry // by root
+	mutex   sync.Mutex
+}
+
+// DefaultPath is ~/.nebulafs/keyring.json
+func DefaultPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "keyring.json"
+	}
+	return filepath.Join(home, ".nebulafs", "keyring.json")
+}
+
+// Open locks and unlocks the keyring at path, creating an empty one on first
+// use. It waits while another process has the keyring open.
+func Open(path string, passphrase []byte) (*Keyring, error) {
+	lock, err := lockfile.Acquire(path + ".lock")
+	if err != nil {
+		return nil, err
+	}
+	k, err := open(path, passphrase)
+	if err != nil {
+		lock.Release()
+		return nil, err
+	}
+	k.lock = lock
+	return k, nil
+}
+
+func open(path string, passphrase []byte) (*Keyring, error) {
+	k := &Keyring{path: path, entries: make(map[string]Entry)}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		k.file = sealedFile{KDF: "scrypt", Salt: salt, N: crypto.ScryptN, R: crypto.ScryptR, P: crypto.ScryptP}
+		if k.key, err = crypto.DeriveKey(passphrase, salt); err != nil {
+			return nil, err
+		}
+		return k, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &k.file); err != nil {
+		return nil, fmt.Errorf("invalid keyring file: %v", err)
+	}
+	if k.file.KDF != "scrypt" {
+		return nil, fmt.Errorf("unsupported kdf %q", k.file.KDF)
+	}
+	if k.key, err = crypto.DeriveKeyScrypt(passphrase, k.file.Salt, k.file.N, k.file.R, k.file.P); err != nil {
+		return nil, err
+	}
+	if k.entries, err = k.unseal(k.file); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// unseal decrypts the entries of file with the keyring key
+func (k *Keyring) unseal(file sealedFile) (map[string]Entry, error) {
+	plain, err := crypto.DecryptAES256(file.Sealed, k.key)
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	entries := make(map[string]Entry)
+	if err := json.Unmarshal(plain, &entries); err != nil {
+		return nil, fmt.Errorf("invalid keyring contents: %v", err)
+	}
+	return entries, nil
+}
+
+// Close gives up the lock taken by Open; Put has already written every
+// change
+func (k *Keyring) Close() error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if k.lock == nil {
+		return nil
+	}
+	err := k.lock.Release()
+	k.lock = nil
+	return err
+}
+
+// Path returns the keyring file location
+func (k *Keyring) Path() string {
+	return k.path
+}
+
+// Get returns the entry for a manifest root
+func (k *Keyring) Get(root string) (Entry, bool) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	e, ok := k.entries[root]
+	return e, ok
+}
+
+// FindFile returns an entry for a file ID, for metadata without a root
+func (k *Keyring) FindFile(fileID string) (Entry, bool) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	for _, e := range k.entries {
+		if e.FileID == fileID {
+			return e, true
+		}
+	}
+	return Entry{}, false
+}
+
+// List returns every entry, oldest first
+func (k *Keyring) List() []Entry {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	list := make([]Entry, 0, len(k.entries))
+	for _, e := range k.entries {
+		list = append(list, e)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Added.Before(list[j].Added) })
+	return list
+}
+
+// Put stores an entry and writes the keyring
+func (k *Keyring) Put(e Entry) error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	if e.Added.IsZero() {
+		e.Added = time.Now()
+	}
+	k.entries[e.Root] = e
+	return k.save()
+}
+
+// save seals and atomically replaces the keyring file; callers hold the
+// mutex. Entries another writer added since Open are kept.
+func (k *Keyring) save() error {
+	if err := k.merge(); err != nil {
+		return err
+	}
+	plain, err := json.Marshal(k.entries)
+	if err != nil {
+		return err
+	}
+	if k.file.Sealed, err = crypto.EncryptAES256(plain, k.key); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(k.file, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(k.path), 0700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(k.path), filepath.Base(k.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), k.path)
+}
+
+// merge re-reads the keyring file and adds the entries it has that this
+// keyring doesn't
+func (k *Keyring) merge() error {
+	data, err := os.ReadFile(k.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var file sealedFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("invalid keyring file: %v", err)
+	}
+	if !bytes.Equal(file.Salt, k.file.Salt) {
+		return errors.New("keyring file was replaced while open")
+	}
+	entries, err := k.unseal(file)
+	if err != nil {
+		return err
+	}
+	for root, e := range entries {
+		if _, ok := k.entries[root]; !ok {
+			k.entries[root] = e
+		}
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package keyring
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/tanmaydeobhankar/nebulafs/internal/crypto"
+)
+
+func TestKeyring(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keyring.json")
+
+	k, err := Open(path, []byte("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Put(Entry{Root: "root1", FileID: "file1", Name: "a.txt", Key: "00ff"}); err != nil {
+		t.Fatal(err)
+	}
+	k.Put(Entry{Root: "root2", FileID: "file2", Name: "b.txt", Key: "abcd"})
+
+	data, _ := os.ReadFile(path)
+	if strings.Contains(string(data), "abcd") || strings.Contains(string(data), "a.txt") {
+		t.Errorf("Keyring file holds keys or names in the clear")
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0600 {
+		t.Errorf("Keyring file mode %v", info.Mode().Perm())
+	}
+
+	k.Close()
+
+	if _, err := Open(path, []byte("wrong")); err != ErrWrongPassphrase {
+		t.Errorf("Expected ErrWrongPassphrase, got %v", err)
+	}
+
+	k, err = Open(path, []byte("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, ok := k.Get("root1"); !ok || e.Key != "00ff" {
+		t.Errorf("Get returned %+v, %v", e, ok)
+	}
+	if e, ok := k.FindFile("file2"); !ok || e.Root != "root2" {
+		t.Errorf("FindFile returned %+v, %v", e, ok)
+	}
+	if list := k.List(); len(list) != 2 || list[0].Root != "root1" {
+		t.Errorf("Unexpected list %+v", list)
+	}
+	k.Close()
+
+	// A keyring sealed under other scrypt parameters opens with those
+	cheapPath := filepath.Join(t.TempDir(), "keyring.json")
+	cheap := &Keyring{
+		path:    cheapPath,
+		file:    sealedFile{KDF: "scrypt", Salt: []byte("0123456789abcdef"), N: 1 << 10, R: 8, P: 1},
+		entries: map[string]Entry{"root3": {Root: "root3", Key: "beef"}},
+	}
+	cheap.key, _ = crypto.DeriveKeyScrypt([]byte("cheap"), cheap.file.Salt, 1<<10, 8, 1)
+	if err := cheap.save(); err != nil {
+		t.Fatal(err)
+	}
+	k, err = Open(cheapPath, []byte("cheap"))
+	if err != nil {
+		t.Fatalf("Failed to open keyring with recorded parameters: %v", err)
+	}
+	if e, ok := k.Get("root3"); !ok || e.Key != "beef" {
+		t.Errorf("Get returned %+v, %v", e, ok)
+	}
+	k.Close()
+}
+
+func TestKeyringConcurrentWriters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keyring.json")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			k, err := Open(path, []byte("correct horse"))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer k.Close()
+			if err := k.Put(Entry{Root: fmt.Sprintf("root%d", i), Key: "00ff"}); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	k, err := Open(path, []byte("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k.Close()
+	if list := k.List(); len(list) != 4 {
+		t.Errorf("Expected every writer's entry to survive, got %+v", list)
+	}
+	if leftovers, _ := filepath.Glob(path + ".*.tmp"); len(leftovers) != 0 {
+		t.Errorf("Temporary files left behind: %v", leftovers)
+	}
+}
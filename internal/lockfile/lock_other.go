@@ -0,0 +1,15 @@
+//go:build !unix
+
+package lockfile
+
+import "os"
+
+// lock is a no-op where flock isn't available; callers still get the file
+// created and kept open
+func lock(file *os.File) error {
+	return nil
+}
+
+func tryLock(file *os.File) error {
+	return nil
+}
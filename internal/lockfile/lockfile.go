@@ -0,0 +1,49 @@
+// Package lockfile takes advisory locks on files shared between processes,
+// such as the keyring and a node's storage dir.
+package lockfile
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// ErrLocked is returned by TryAcquire when another process holds the lock
+var ErrLocked = errors.New("locked by another process")
+
+// Lock is a held lock; Release gives it up
+type Lock struct {
+	file *os.File
+}
+
+// Acquire locks path, creating it if needed, and waits while another process
+// holds it. The lock is given up by Release or when the process exits.
+func Acquire(path string) (*Lock, error) {
+	return acquire(path, lock)
+}
+
+// TryAcquire is Acquire without the wait: it fails with ErrLocked while
+// another process holds the lock
+func TryAcquire(path string) (*Lock, error) {
+	return acquire(path, tryLock)
+}
+
+func acquire(path string, lock func(*os.File) error) (*Lock, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := lock(file); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &Lock{file: file}, nil
+}
+
+// Release gives up the lock
+func (l *Lock) Release() error {
+	return l.file.Close()
+}
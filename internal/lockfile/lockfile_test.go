@@ -0,0 +1,60 @@
+//go:build unix
+
+package lockfile
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAcquireWaitsForRelease(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "lock")
+
+	held, err := Acquire(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acquired := make(chan *Lock)
+	go func() {
+		l, err := Acquire(path)
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- l
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("Lock acquired while held")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	held.Release()
+	select {
+	case l := <-acquired:
+		l.Release()
+	case <-time.After(time.Second):
+		t.Fatal("Lock not acquired after release")
+	}
+}
+
+func TestTryAcquireFailsWhileHeld(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lock")
+
+	held, err := TryAcquire(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := TryAcquire(path); err != ErrLocked {
+		t.Errorf("Expected ErrLocked while held, got %v", err)
+	}
+	held.Release()
+
+	l, err := TryAcquire(path)
+	if err != nil {
+		t.Fatalf("TryAcquire after release: %v", err)
+	}
+	l.Release()
+}
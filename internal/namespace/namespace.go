@@ -0,0 +1,242 @@
+// Package namespace keeps a directory tree of stored files: each path maps
+// to the manifest root and key of a file. The tree is persisted as a
+// single encrypted blob, so paths and file keys never touch disk in the
+// clear.
+package namespace
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tanmaydeobhankar/nebulafs/internal/crypto"
+)
+
+const stateFile = "namespace.json"
+
+// State persists named blobs; *node.Node implements it with its state dir
+type State interface {
+	LoadState(name string) ([]byte, error)
+	SaveState(name string, data []byte) error
+}
+
+// Entry is a file or directory in the tree
+type Entry struct {
+	Dir      bool      `json:"dir,omitempty"`
+	Root     string    `json:"root,omitempty"` // manifest root of a file
+	Key      string    `json:"key,omitempty"`  // file key, hex
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// Namespace is the directory tree. Paths are slash separated and cleaned;
+// "/" is the root directory.
+type Namespace struct {
+	state   State
+	key     []byte
+	entries map[string]*Entry
+	mutex   sync.RWMutex
+}
+
+// DeriveKey derives the namespace key from a node master key
+func DeriveKey(masterKey []byte) ([]byte, error) {
+	return crypto.SubKey(masterKey, "namespace")
+}
+
+// Open loads the namespace sealed with key (32 bytes) from state, or
+// starts an empty one
+func Open(state State, key []byte) (*Namespace, error) {
+	ns := &Namespace{
+		state:   state,
+		key:     key,
+		entries: map[string]*Entry{"/": {Dir: true, Modified: time.Now()}},
+	}
+
+	sealed, err := state.LoadState(stateFile)
+	if os.IsNotExist(err) {
+		return ns, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	data, err := crypto.DecryptAES256(sealed, key)
+	if err != nil {
+		return nil, errors.New("cannot decrypt namespace: wrong key")
+	}
+	if err := json.Unmarshal(data, &ns.entries); err != nil {
+		return nil, err
+	}
+	if ns.entries["/"] == nil {
+		ns.entries["/"] = &Entry{Dir: true, Modified: time.Now()}
+	}
+	return ns, nil
+}
+
+// save seals and writes the tree; callers hold the write lock
+func (ns *Namespace) save() error {
+	data, err := json.Marshal(ns.entries)
+	if err != nil {
+		return err
+	}
+	sealed, err := crypto.EncryptAES256(data, ns.key)
+	if err != nil {
+		return err
+	}
+	return ns.state.SaveState(stateFile, sealed)
+}
+
+// Clean normalises a path to the form used as a key in the tree
+func Clean(p string) string {
+	return path.Clean("/" + p)
+}
+
+func pathError(op, p string, err error) error {
+	return &os.PathError{Op: op, Path: p, Err: err}
+}
+
+// Stat returns the entry at p
+func (ns *Namespace) Stat(p string) (Entry, error) {
+	ns.mutex.RLock()
+	defer ns.mutex.RUnlock()
+
+	e, ok := ns.entries[Clean(p)]
+	if !ok {
+		return Entry{}, pathError("stat", p, os.ErrNotExist)
+	}
+	return *e, nil
+}
+
+// List returns the names of the direct children of directory p, sorted
+func (ns *Namespace) List(p string) ([]string, error) {
+	ns.mutex.RLock()
+	defer ns.mutex.RUnlock()
+
+	dir := Clean(p)
+	if e, ok := ns.entries[dir]; !ok || !e.Dir {
+		return nil, pathError("readdir", p, os.ErrNotExist)
+	}
+
+	var names []string
+	for name := range ns.entries {
+		if name != dir && path.Dir(name) == dir {
+			names = append(names, path.Base(name))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Mkdir creates directory p; its parent must exist
+func (ns *Namespace) Mkdir(p string) error {
+	ns.mutex.Lock()
+	defer ns.mutex.Unlock()
+
+	p = Clean(p)
+	if _, ok := ns.entries[p]; ok {
+		return pathError("mkdir", p, os.ErrExist)
+	}
+	if err := ns.checkParent("mkdir", p); err != nil {
+		return err
+	}
+	ns.entries[p] = &Entry{Dir: true, Modified: time.Now()}
+	return ns.save()
+}
+
+// Put creates or replaces the file at p. It returns the entry it replaced,
+// if any, so the caller can release the old root.
+func (ns *Namespace) Put(p string, e Entry) (*Entry, error) {
+	ns.mutex.Lock()
+	defer ns.mutex.Unlock()
+
+	p = Clean(p)
+	old := ns.entries[p]
+	if old != nil && old.Dir {
+		return nil, pathError("put", p, errors.New("is a directory"))
+	}
+	if err := ns.checkParent("put", p); err != nil {
+		return nil, err
+	}
+	e.Dir = false
+	ns.entries[p] = &e
+	return old, ns.save()
+}
+
+// RemoveAll removes p and everything below it and returns the removed
+// file entries. Removing a missing path is not an error.
+func (ns *Namespace) RemoveAll(p string) ([]Entry, error) {
+	ns.mutex.Lock()
+	defer ns.mutex.Unlock()
+
+	p = Clean(p)
+	if p == "/" {
+		return nil, pathError("remove", p, os.ErrPermission)
+	}
+
+	var removed []Entry
+	for name, e := range ns.entries {
+		if name == p || strings.HasPrefix(name, p+"/") {
+			if !e.Dir {
+				removed = append(removed, *e)
+			}
+			delete(ns.entries, name)
+		}
+	}
+	return removed, ns.save()
+}
+
+// Rename moves a file or directory tree. An existing file at newPath is
+// replaced and returned; an existing directory is an error.
+func (ns *Namespace) Rename(oldPath, newPath string) (*Entry, error) {
+	ns.mutex.Lock()
+	defer ns.mutex.Unlock()
+
+	oldPath, newPath = Clean(oldPath), Clean(newPath)
+	src, ok := ns.entries[oldPath]
+	if !ok {
+		return nil, pathError("rename", oldPath, os.ErrNotExist)
+	}
+	if oldPath == "/" || strings.HasPrefix(newPath, oldPath+"/") {
+		return nil, pathError("rename", newPath, os.ErrInvalid)
+	}
+	if oldPath == newPath {
+		return nil, nil
+	}
+	if err := ns.checkParent("rename", newPath); err != nil {
+		return nil, err
+	}
+
+	replaced := ns.entries[newPath]
+	if replaced != nil && (replaced.Dir || src.Dir) {
+		return nil, pathError("rename", newPath, os.ErrExist)
+	}
+
+	moved := make(map[string]*Entry)
+	for name, e := range ns.entries {
+		if name == oldPath || strings.HasPrefix(name, oldPath+"/") {
+			moved[newPath+strings.TrimPrefix(name, oldPath)] = e
+			delete(ns.entries, name)
+		}
+	}
+	for name, e := range moved {
+		ns.entries[name] = e
+	}
+	return replaced, ns.save()
+}
+
+// checkParent makes sure the parent of p is an existing directory; callers
+// hold the lock
+func (ns *Namespace) checkParent(op, p string) error {
+	parent, ok := ns.entries[path.Dir(p)]
+	if !ok {
+		return pathError(op, p, os.ErrNotExist)
+	}
+	if !parent.Dir {
+		return pathError(op, p, errors.New("parent is not a directory"))
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package namespace
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+// memState is an in-memory State
+type memState map[string][]byte
+
+func (m memState) LoadState(name string) ([]byte, error) {
+	data, ok := m[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return data, nil
+}
+
+func (m memState) SaveState(name string, data []byte) error {
+	m[name] = data
+	return nil
+}
+
+func TestNamespace(t *testing.T) {
+	state := memState{}
+	key := bytes.Repeat([]byte{7}, 32)
+
+	ns, err := Open(state, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ns.Mkdir("/docs"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ns.Put("/docs/a.txt", Entry{Root: "r1", Key: "k1", Size: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ns.Put("/missing/b.txt", Entry{Root: "r2"}); !os.IsNotExist(err) {
+		t.Errorf("Put without a parent directory: %v", err)
+	}
+	if bytes.Contains(state[stateFile], []byte("a.txt")) {
+		t.Errorf("Namespace stored in the clear")
+	}
+
+	if _, err := ns.Rename("/docs", "/archive"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopen from the sealed state
+	ns, err = Open(state, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, err := ns.Stat("/archive/a.txt"); err != nil || e.Root != "r1" {
+		t.Errorf("Renamed file lost: %+v %v", e, err)
+	}
+	if names, _ := ns.List("/"); len(names) != 1 || names[0] != "archive" {
+		t.Errorf("Unexpected root listing %v", names)
+	}
+
+	removed, err := ns.RemoveAll("/archive")
+	if err != nil || len(removed) != 1 || removed[0].Root != "r1" {
+		t.Errorf("RemoveAll returned %+v %v", removed, err)
+	}
+
+	if _, err := Open(state, bytes.Repeat([]byte{8}, 32)); err == nil {
+		t.Errorf("Opened the namespace with the wrong key")
+	}
+}
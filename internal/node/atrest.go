@@ -0,0 +1,187 @@
+package node
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/tanmaydeobhankar/nebulafs/internal/crypto"
+	"github.com/tanmaydeobhankar/nebulafs/internal/lockfile"
+)
+
+const masterKeyFile = "masterkey.json"
+
+// wrappedMasterKey is the on-disk form of a passphrase protected master key.
+// The master key itself is random; the passphrase only wraps it, so changing
+// the passphrase doesn't require re-encrypting the store.
+type wrappedMasterKey struct {
+	KDF     string `json:"kdf"`
+	Salt    []byte `json:"salt"`
+	N       int    `json:"n"`
+	R       int    `json:"r"`
+	P       int    `json:"p"`
+	Wrapped []byte `json:"wrapped"`
+}
+
+// UnlockMasterKey unwraps the node master key with a passphrase. On first
+// use a new random master key is generated and wrapped into the state dir.
+func UnlockMasterKey(storageDir string, passphrase []byte) ([]byte, error) {
+	path := statePath(storageDir, masterKeyFile)
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return createMasterKey(storageDir, passphrase)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var w wrappedMasterKey
+	if err := json.Unmarshal(data, &w); err != nil {
+		return nil, fmt.Errorf("invalid master key file: %v", err)
+	}
+	if w.KDF != "scrypt" {
+		return nil, fmt.Errorf("unsupported kdf %q", w.KDF)
+	}
+
+	kek, err := crypto.DeriveKeyScrypt(passphrase, w.Salt, w.N, w.R, w.P)
+	if err != nil {
+		return nil, err
+	}
+	key, err := crypto.DecryptAES256(w.Wrapped, kek)
+	if err != nil {
+		return nil, errors.New("wrong passphrase")
+	}
+	return key, nil
+}
+
+func createMasterKey(storageDir string, passphrase []byte) ([]byte, error) {
+	key := make([]byte, 32)
+	salt := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	kek, err := crypto.DeriveKey(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := crypto.EncryptAES256(key, kek)
+	if err != nil {
+		return nil, err
+	}
+
+	data, _ := json.MarshalIndent(wrappedMasterKey{
+		KDF:     "scrypt",
+		Salt:    salt,
+		N:       crypto.ScryptN,
+		R:       crypto.ScryptR,
+		P:       crypto.ScryptP,
+		Wrapped: wrapped,
+	}, "", "  ")
+	if err := writeState(storageDir, nil, masterKeyFile, data); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// LoadKeyFile reads a master key stored as 64 hex characters
+func LoadKeyFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("key file must contain 32 bytes as hex")
+	}
+	return key, nil
+}
+
+func statePath(storageDir, name string) string {
+	return filepath.Join(storageDir, stateDirName, name)
+}
+
+// LockStorage takes the lock that keeps a second process, such as fsck
+// while a daemon runs, from opening the chunks and state in storageDir. It
+// fails with lockfile.ErrLocked rather than waiting if the lock is held.
+func LockStorage(storageDir string) (*lockfile.Lock, error) {
+	return lockfile.TryAcquire(statePath(storageDir, "lock"))
+}
+
+// StatePath returns where a file named name belongs in the state directory
+// of the node keeping its data in storageDir, out of the way of the chunks
+func StatePath(storageDir, name string) string {
+	return statePath(storageDir, name)
+}
+
+// writeState atomically replaces a file in the node state directory,
+// sealing it first when a state key is given
+func writeState(storageDir string, key []byte, name string, data []byte) error {
+	if key != nil {
+		var err error
+		if data, err = crypto.EncryptAES256(data, key); err != nil {
+			return err
+		}
+	}
+
+	path := statePath(storageDir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// readState reads a file written by writeState
+func readState(storageDir string, key []byte, name string) ([]byte, error) {
+	data, err := os.ReadFile(statePath(storageDir, name))
+	if err != nil || key == nil {
+		return data, err
+	}
+	return crypto.DecryptAES256(data, key)
+}
+
+// removeState deletes a state file; a missing file is not an error
+func removeState(storageDir, name string) error {
+	err := os.Remove(statePath(storageDir, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// stateKey derives the key used to seal node state files
+func stateKey(masterKey []byte) ([]byte, error) {
+	if masterKey == nil {
+		return nil, nil
+	}
+	return crypto.SubKey(masterKey, "node state")
+}
+
+// SaveState writes a named file to the node state dir, sealed when
+// encryption at rest is on. It is a no-op for nodes without a StorageDir.
+func (n *Node) SaveState(name string, data []byte) error {
+	if n.Config.StorageDir == "" {
+		return nil
+	}
+	return writeState(n.Config.StorageDir, n.stateKey, name, data)
+}
+
+// LoadState reads a file written by SaveState
+func (n *Node) LoadState(name string) ([]byte, error) {
+	if n.Config.StorageDir == "" {
+		return nil, os.ErrNotExist
+	}
+	return readState(n.Config.StorageDir, n.stateKey, name)
+}
@@ -0,0 +1,406 @@
+package node
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tanmaydeobhankar/nebulafs/internal/files"
+	"github.com/tanmaydeobhankar/nebulafs/internal/p2p"
+	"github.com/tanmaydeobhankar/nebulafs/internal/storage"
+)
+
+// DefaultAuditChallenges is how many challenges are precomputed per chunk
+// when NodeConfig.AuditChallenges is unset
+const DefaultAuditChallenges = 4
+
+const auditFile = "audit.json"
+
+// PeerAudit is the audit record of one peer
+type PeerAudit struct {
+	Address     string    `json:"address"`
+	Passed      int       `json:"passed"`
+	Failed      int       `json:"failed"`
+	LastFailure time.Time `json:"last_failure,omitempty"`
+}
+
+// AuditReport summarises one audit pass
+type AuditReport struct {
+	Chunks   int         `json:"chunks"`   // chunks audited
+	Passed   int         `json:"passed"`   // proofs accepted
+	Failed   int         `json:"failed"`   // holders that lost or never kept a chunk
+	Skipped  int         `json:"skipped"`  // chunks out of challenges and not held locally
+	Repaired int         `json:"repaired"` // copies pushed to replace failed holders
+	Peers    []PeerAudit `json:"peers"`
+}
+
+// challenge is a nonce and the proof a holder of the chunk must return
+type challenge struct {
+	Nonce  []byte `json:"nonce"`
+	Answer []byte `json:"answer"`
+}
+
+// auditedChunk is a chunk this node replicated: who confirmed it and the
+// answers still unused. Each challenge is asked once, of every holder at
+// the same time, so a holder can't replay another's proof later.
+type auditedChunk struct {
+	Holders    []string    `json:"holders"`
+	Challenges []challenge `json:"challenges"`
+}
+
+// auditState is kept in memory and saved by flushAudits once per upload,
+// repair or audit pass rather than on every change
+type auditState struct {
+	Chunks map[string]*auditedChunk `json:"chunks"`
+	Peers  map[string]*PeerAudit    `json:"peers"`
+
+	dirty bool
+}
+
+// storageProof is the answer to a challenge: HMAC-SHA256 of the chunk
+// content keyed with the nonce. Only a node with the whole chunk can
+// compute it.
+func storageProof(nonce, content []byte) []byte {
+	mac := hmac.New(sha256.New, nonce)
+	mac.Write(content)
+	return mac.Sum(nil)
+}
+
+func (n *Node) newChallenges(chunk files.Chunk) []challenge {
+	count := n.Config.AuditChallenges
+	if count <= 0 {
+		count = DefaultAuditChallenges
+	}
+	challenges := make([]challenge, 0, count)
+	for i := 0; i < count; i++ {
+		nonce := make([]byte, 16)
+		if _, err := rand.Read(nonce); err != nil {
+			break
+		}
+		challenges = append(challenges, challenge{Nonce: nonce, Answer: storageProof(nonce, chunk.Content)})
+	}
+	return challenges
+}
+
+// recordReplicas remembers that peers confirmed chunk, precomputing
+// challenges while the content is at hand
+func (n *Node) recordReplicas(chunk files.Chunk, peers []string) {
+	if len(peers) == 0 {
+		return
+	}
+	n.auditMutex.Lock()
+	defer n.auditMutex.Unlock()
+
+	state := n.loadAudits()
+	entry := state.Chunks[chunk.Hash]
+	if entry == nil {
+		entry = &auditedChunk{}
+		state.Chunks[chunk.Hash] = entry
+	}
+	for _, p := range peers {
+		if !containsString(entry.Holders, p) {
+			entry.Holders = append(entry.Holders, p)
+		}
+	}
+	if len(entry.Challenges) == 0 {
+		entry.Challenges = n.newChallenges(chunk)
+	}
+	state.dirty = true
+}
+
+// forgetAudits stops auditing hashes, e.g. after asking holders to drop them
+func (n *Node) forgetAudits(hashes []string) {
+	n.auditMutex.Lock()
+	defer n.auditMutex.Unlock()
+
+	state := n.loadAudits()
+	for _, h := range hashes {
+		delete(state.Chunks, h)
+	}
+	n.saveAudits(state)
+}
+
+// Audit challenges every recorded holder of every chunk this node
+// replicated. A holder that can't prove possession is recorded as failed,
+// dropped from the chunk's holders and replaced by a new copy, taken from
+// the local store or fetched from the remaining holders.
+func (n *Node) Audit() AuditReport {
+	var report AuditReport
+	defer n.flushAudits()
+
+	n.auditMutex.Lock()
+	hashes := make([]string, 0, len(n.loadAudits().Chunks))
+	for h := range n.audits.Chunks {
+		hashes = append(hashes, h)
+	}
+	n.auditMutex.Unlock()
+	sort.Strings(hashes)
+
+	for _, hash := range hashes {
+		holders, ch, ok := n.nextChallenge(hash)
+		if !ok {
+			report.Skipped++
+			continue
+		}
+		if len(holders) == 0 {
+			continue
+		}
+		report.Chunks++
+
+		passed := make([]bool, len(holders))
+		wrong := make([]bool, len(holders))
+		var wg sync.WaitGroup
+		for i, addr := range holders {
+			wg.Add(1)
+			go func(i int, addr string) {
+				defer wg.Done()
+				passed[i], wrong[i] = n.challengePeer(addr, hash, ch)
+			}(i, addr)
+		}
+		wg.Wait()
+
+		var kept, failed []string
+		for i, addr := range holders {
+			if passed[i] {
+				kept = append(kept, addr)
+			} else {
+				failed = append(failed, addr)
+			}
+			// A timeout was already reported by request, and a holder that
+			// admits it lost the chunk isn't lying about it
+			if wrong[i] {
+				n.report(addr, eventCorrupt)
+			}
+		}
+		report.Passed += len(kept)
+		report.Failed += len(failed)
+		n.recordAudit(hash, kept, failed)
+
+		if len(failed) > 0 {
+			n.logf("[%d] Audit: %d of %d holders failed to prove chunk %s\n",
+				n.Config.Port, len(failed), len(holders), shortHash(hash))
+			report.Repaired += n.replaceHolders(hash, kept, failed)
+		}
+	}
+
+	report.Peers = n.PeerAudits()
+	return report
+}
+
+// nextChallenge takes an unused challenge for hash, making new ones from
+// the local copy when they run out
+func (n *Node) nextChallenge(hash string) ([]string, challenge, bool) {
+	n.auditMutex.Lock()
+	defer n.auditMutex.Unlock()
+
+	entry := n.loadAudits().Chunks[hash]
+	if entry == nil {
+		return nil, challenge{}, false
+	}
+	if len(entry.Challenges) == 0 {
+		chunk, err := storage.PeekChunk(n.Store, hash)
+		if err != nil {
+			return nil, challenge{}, false
+		}
+		entry.Challenges = n.newChallenges(chunk)
+		if len(entry.Challenges) == 0 {
+			return nil, challenge{}, false
+		}
+	}
+	ch := entry.Challenges[0]
+	entry.Challenges = entry.Challenges[1:]
+	n.audits.dirty = true
+	return append([]string(nil), entry.Holders...), ch, true
+}
+
+// challengePeer asks addr to prove it holds hash. wrong is set when addr
+// answered with a proof that doesn't check out, as opposed to not answering
+// or saying it doesn't have the chunk.
+func (n *Node) challengePeer(addr, hash string, ch challenge) (passed, wrong bool) {
+	payload, _ := json.Marshal(p2p.ChallengePayload{Hash: hash, Nonce: ch.Nonce})
+	msg := p2p.Message{
+		Type:    p2p.MsgChallenge,
+		Sender:  n.DHT.ID.Hex(),
+		Payload: payload,
+	}
+	reply, err := n.request(addr, msg, p2p.MsgProof, hash, n.Config.FetchTimeout)
+	if err != nil {
+		return false, false
+	}
+	var proof p2p.ProofPayload
+	if err := json.Unmarshal(reply, &proof); err != nil {
+		n.report(addr, eventViolation)
+		return false, false
+	}
+	if !proof.Has {
+		return false, false
+	}
+	if !bytes.Equal(proof.Nonce, ch.Nonce) || !hmac.Equal(proof.Proof, ch.Answer) {
+		return false, true
+	}
+	return true, false
+}
+
+// recordAudit updates the holders of hash and the peers' records
+func (n *Node) recordAudit(hash string, kept, failed []string) {
+	n.auditMutex.Lock()
+	defer n.auditMutex.Unlock()
+
+	state := n.loadAudits()
+	peer := func(addr string) *PeerAudit {
+		p := state.Peers[addr]
+		if p == nil {
+			p = &PeerAudit{Address: addr}
+			state.Peers[addr] = p
+		}
+		return p
+	}
+	for _, addr := range kept {
+		peer(addr).Passed++
+	}
+	for _, addr := range failed {
+		p := peer(addr)
+		p.Failed++
+		p.LastFailure = time.Now()
+	}
+	if entry := state.Chunks[hash]; entry != nil {
+		var holders []string
+		for _, h := range entry.Holders {
+			if !containsString(failed, h) {
+				holders = append(holders, h)
+			}
+		}
+		entry.Holders = holders
+	}
+	state.dirty = true
+}
+
+// replaceHolders pushes a new copy of hash for each failed holder to peers
+// that are neither holders nor failed, and returns how many were confirmed
+func (n *Node) replaceHolders(hash string, holders, failed []string) int {
+	chunk, err := storage.PeekChunk(n.Store, hash)
+	if err != nil {
+		if chunk, err = n.fetchChunk(hash); err != nil {
+			n.logf("[%d] Audit: cannot repair chunk %s: %v\n", n.Config.Port, shortHash(hash), err)
+			return 0
+		}
+	}
+	skip := make(map[string]bool, len(holders)+len(failed))
+	for _, h := range append(holders, failed...) {
+		skip[h] = true
+	}
+	return len(n.replicateChunk(chunk, len(failed), skip))
+}
+
+// PeerAudits returns the audit record of every challenged peer, worst first
+func (n *Node) PeerAudits() []PeerAudit {
+	n.auditMutex.Lock()
+	state := n.loadAudits()
+	list := make([]PeerAudit, 0, len(state.Peers))
+	for _, p := range state.Peers {
+		list = append(list, *p)
+	}
+	n.auditMutex.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Failed != list[j].Failed {
+			return list[i].Failed > list[j].Failed
+		}
+		return list[i].Address < list[j].Address
+	})
+	return list
+}
+
+// handleChallenge proves possession of a chunk, or says it's missing
+func (n *Node) handleChallenge(p *p2p.Peer, msg p2p.Message) {
+	var req p2p.ChallengePayload
+	if err := json.Unmarshal(msg.Payload, &req); err != nil {
+		return
+	}
+	resp := p2p.ProofPayload{Hash: req.Hash, Nonce: req.Nonce}
+	if chunk, err := storage.PeekChunk(n.Store, req.Hash); err == nil {
+		resp.Has = true
+		resp.Proof = storageProof(req.Nonce, chunk.Content)
+	}
+	payload, _ := json.Marshal(resp)
+	n.Transport.SendMessage(p.Address, p2p.Message{
+		Type:    p2p.MsgProof,
+		Sender:  n.DHT.ID.Hex(),
+		Payload: payload,
+	})
+}
+
+// loadAudits reads the audit state; callers hold auditMutex. Without a
+// state dir it lives in memory only.
+func (n *Node) loadAudits() *auditState {
+	if n.audits != nil {
+		return n.audits
+	}
+	n.audits = &auditState{}
+	data, err := n.LoadState(auditFile)
+	if err != nil && !os.IsNotExist(err) {
+		n.logf("[%d] Cannot read audit state: %v\n", n.Config.Port, err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, n.audits); err != nil {
+			n.logf("[%d] Invalid audit state: %v\n", n.Config.Port, err)
+		}
+	}
+	if n.audits.Chunks == nil {
+		n.audits.Chunks = make(map[string]*auditedChunk)
+	}
+	if n.audits.Peers == nil {
+		n.audits.Peers = make(map[string]*PeerAudit)
+	}
+	return n.audits
+}
+
+func (n *Node) saveAudits(state *auditState) {
+	data, err := json.Marshal(state)
+	if err == nil {
+		err = n.SaveState(auditFile, data)
+	}
+	if err != nil {
+		n.logf("[%d] Cannot save audit state: %v\n", n.Config.Port, err)
+		return
+	}
+	state.dirty = false
+}
+
+// flushAudits saves the audit state if it changed since it was last saved
+func (n *Node) flushAudits() {
+	n.auditMutex.Lock()
+	defer n.auditMutex.Unlock()
+	if n.audits != nil && n.audits.dirty {
+		n.saveAudits(n.audits)
+	}
+}
+
+// auditLoop runs Audit every AuditInterval
+func (n *Node) auditLoop() {
+	ticker := time.NewTicker(n.Config.AuditInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		report := n.Audit()
+		if report.Failed > 0 {
+			n.logf("[%d] Audit: %d of %d proofs failed, %d copies replaced\n",
+				n.Config.Port, report.Failed, report.Passed+report.Failed, report.Repaired)
+		}
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,301 @@
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tanmaydeobhankar/nebulafs/internal/dht"
+	"github.com/tanmaydeobhankar/nebulafs/internal/files"
+	"github.com/tanmaydeobhankar/nebulafs/internal/p2p"
+)
+
+// Defaults for the chunk fetch scheduler
+const (
+	DefaultFetchParallelism = 8
+	DefaultPerPeerLimit     = 4
+	DefaultFetchTimeout     = 2 * time.Second
+
+	// providersPerChunk is how many of the closest peers are tried per chunk
+	providersPerChunk = 5
+)
+
+// peerStats tracks request latency and in-flight requests per peer so the
+// fetcher can prefer fast peers and cap per-peer concurrency
+type peerStats struct {
+	latency  map[string]time.Duration // EWMA of successful fetches
+	inflight map[string]int
+	limit    int
+	cond     *sync.Cond
+	mutex    sync.Mutex
+}
+
+func newPeerStats(limit int) *peerStats {
+	s := &peerStats{
+		latency:  make(map[string]time.Duration),
+		inflight: make(map[string]int),
+		limit:    limit,
+	}
+	s.cond = sync.NewCond(&s.mutex)
+	return s
+}
+
+// rank orders contacts fastest first, with latencies divided by the
+// peers' weight in (0, 1]. Unknown peers sit between measured fast and slow
+// ones so they get a chance to be measured.
+func (s *peerStats) rank(contacts []dht.Contact, unknown time.Duration, weight func(string) float64) {
+	cost := make(map[string]float64, len(contacts))
+	s.mutex.Lock()
+	for _, c := range contacts {
+		l, ok := s.latency[c.Address]
+		if !ok {
+			l = unknown
+		}
+		cost[c.Address] = float64(l)
+	}
+	s.mutex.Unlock()
+
+	for addr := range cost {
+		cost[addr] /= weight(addr)
+	}
+	sort.SliceStable(contacts, func(i, j int) bool {
+		return cost[contacts[i].Address] < cost[contacts[j].Address]
+	})
+}
+
+// acquire takes a request slot on addr, waiting while the peer is at its limit
+func (s *peerStats) acquire(addr string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for s.inflight[addr] >= s.limit {
+		s.cond.Wait()
+	}
+	s.inflight[addr]++
+}
+
+// tryAcquire takes a request slot on addr only if one is free
+func (s *peerStats) tryAcquire(addr string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.inflight[addr] >= s.limit {
+		return false
+	}
+	s.inflight[addr]++
+	return true
+}
+
+func (s *peerStats) release(addr string) {
+	s.mutex.Lock()
+	s.inflight[addr]--
+	s.mutex.Unlock()
+	s.cond.Broadcast()
+}
+
+// observe folds a request duration into the peer's latency estimate
+func (s *peerStats) observe(addr string, d time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if old, ok := s.latency[addr]; ok {
+		s.latency[addr] = (old*3 + d) / 4
+		return
+	}
+	s.latency[addr] = d
+}
+
+// waitForChunk returns a channel closed once hash has been written to the
+// local store by the STORE_CHUNK handler, and a func to stop waiting
+func (n *Node) waitForChunk(hash string) (<-chan struct{}, func()) {
+	ch := make(chan struct{})
+
+	n.waitMutex.Lock()
+	n.waiters[hash] = append(n.waiters[hash], ch)
+	n.waitMutex.Unlock()
+
+	cancel := func() {
+		n.waitMutex.Lock()
+		defer n.waitMutex.Unlock()
+		list := n.waiters[hash]
+		for i, c := range list {
+			if c == ch {
+				n.waiters[hash] = append(list[:i], list[i+1:]...)
+				break
+			}
+		}
+		if len(n.waiters[hash]) == 0 {
+			delete(n.waiters, hash)
+		}
+	}
+	return ch, cancel
+}
+
+// chunkArrived wakes everyone waiting for hash
+func (n *Node) chunkArrived(hash string) {
+	n.waitMutex.Lock()
+	list := n.waiters[hash]
+	delete(n.waiters, hash)
+	n.waitMutex.Unlock()
+
+	for _, ch := range list {
+		close(ch)
+	}
+}
+
+// fetchChunk asks the closest unbanned peers for a chunk one at a time,
+// fastest and most reputable first, moving on to the next provider when a
+// request times out
+func (n *Node) fetchChunk(hash string) (files.Chunk, error) {
+	arrived, cancel := n.waitForChunk(hash)
+	defer cancel()
+
+	// It may have landed between the caller's check and registering
+	if chunk, err := n.Store.ReadChunk(hash); err == nil {
+		return chunk, nil
+	}
+
+	contacts := n.peersOnly(n.DHT.RoutingTable.FindClosestContacts(dht.NewID(hash), providersPerChunk))
+	n.peerStats.rank(contacts, n.Config.FetchTimeout/2, n.reputation.score)
+
+	reqPayload, _ := json.Marshal(p2p.ChunkRequestPayload{Hash: hash})
+	reqMsg := p2p.Message{
+		Type:    p2p.MsgRequestChunk,
+		Sender:  n.DHT.ID.Hex(),
+		Payload: reqPayload,
+	}
+
+	for _, contact := range n.orderByAvailability(contacts) {
+		n.peerStats.acquire(contact.Address)
+		start := time.Now()
+		if err := n.Transport.SendMessage(contact.Address, reqMsg); err != nil {
+			n.peerStats.release(contact.Address)
+			n.DHT.RemoveNode(contact.Address)
+			continue
+		}
+
+		select {
+		case <-arrived:
+			n.peerStats.observe(contact.Address, time.Since(start))
+			n.peerStats.release(contact.Address)
+			n.report(contact.Address, eventSuccess)
+			return n.Store.ReadChunk(hash)
+		case <-time.After(n.Config.FetchTimeout):
+			n.peerStats.observe(contact.Address, n.Config.FetchTimeout)
+			n.peerStats.release(contact.Address)
+			n.report(contact.Address, eventTimeout)
+			n.logf("[%d] Chunk %s: %s timed out, trying next provider\n", n.Config.Port, shortHash(hash), contact.Address)
+		}
+	}
+
+	return files.Chunk{}, fmt.Errorf("chunk %s missing", hash)
+}
+
+// orderByAvailability moves peers that are at their concurrency limit behind
+// those with free slots, keeping the latency order otherwise
+func (n *Node) orderByAvailability(contacts []dht.Contact) []dht.Contact {
+	var free, busy []dht.Contact
+	for _, c := range contacts {
+		if n.peerStats.tryAcquire(c.Address) {
+			n.peerStats.release(c.Address)
+			free = append(free, c)
+		} else {
+			busy = append(busy, c)
+		}
+	}
+	return append(free, busy...)
+}
+
+type fetchResult struct {
+	pos   int
+	chunk files.Chunk
+	err   error
+}
+
+// fetchChunks retrieves chunks with a bounded worker pool and hands them to
+// emit strictly in order. At most 2*parallelism chunks are buffered waiting
+// for an earlier one.
+func (n *Node) fetchChunks(chunks []files.Chunk, emit func(files.Chunk) error) error {
+	parallelism := n.Config.FetchParallelism
+
+	jobs := make(chan int)
+	results := make(chan fetchResult)
+	window := make(chan struct{}, 2*parallelism)
+	done := make(chan struct{})
+	defer close(done)
+
+	var wg sync.WaitGroup
+	for w := 0; w < parallelism; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for pos := range jobs {
+				meta := chunks[pos]
+				chunk, err := n.Store.ReadChunk(meta.Hash)
+				if err != nil {
+					n.logf("Chunk %s missing locally. Requesting from network...\n", shortHash(meta.Hash))
+					chunk, err = n.fetchChunk(meta.Hash)
+				}
+				chunk.Index = meta.Index
+
+				select {
+				case results <- fetchResult{pos: pos, chunk: chunk, err: err}:
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	go func() {
+		defer close(jobs)
+		for pos := range chunks {
+			select {
+			case window <- struct{}{}:
+			case <-done:
+				return
+			}
+			select {
+			case jobs <- pos:
+			case <-done:
+				return
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// Reorder buffer
+	pending := make(map[int]files.Chunk)
+	next := 0
+	for res := range results {
+		if res.err != nil {
+			n.logf("Failed to retrieve chunk %s\n", shortHash(chunks[res.pos].Hash))
+			return res.err
+		}
+		pending[res.pos] = res.chunk
+
+		for {
+			chunk, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			if err := emit(chunk); err != nil {
+				return err
+			}
+			<-window
+			next++
+		}
+
+		if next == len(chunks) {
+			return nil
+		}
+	}
+
+	if next != len(chunks) {
+		return fmt.Errorf("fetched %d of %d chunks", next, len(chunks))
+	}
+	return nil
+}
@@ -1,128 +1,337 @@
 package node
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
-	"time"
+	"path/filepath"
+	"sort"
 
-	"github.com/tanmaydeobhankar/nebulafs/internal/dht"
+	"github.com/tanmaydeobhankar/nebulafs/internal/crypto"
 	"github.com/tanmaydeobhankar/nebulafs/internal/files"
-	"github.com/tanmaydeobhankar/nebulafs/internal/p2p"
+	"github.com/tanmaydeobhankar/nebulafs/internal/storage"
 )
 
-// UploadFile processes a file and stores its chunks
-func (n *Node) UploadFile(path string) (files.FileMetadata, string, error) {
-	fmt.Printf("Processing file: %s\n", path)
+// ErrResumeNeedsEncryption is returned for a resumed upload on a node without
+// encryption at rest, which keeps no upload journal
+var ErrResumeNeedsEncryption = errors.New("resuming uploads needs encryption at rest: the upload journal holds the file key")
 
-	// 1. Chunk and Encrypt
-	metadata, chunks, key, err := files.ProcessFile(path)
+// UploadOptions controls how an upload is distributed
+type UploadOptions struct {
+	// Replicas is the number of peers that must acknowledge each chunk.
+	// 0 keeps the file on this node only.
+	Replicas int
+	// Resume continues an interrupted upload of the same unchanged file,
+	// reusing its chunks and key and skipping peers that already confirmed.
+	Resume bool
+	// Parent is the manifest root of the previous version of the file. It is
+	// recorded in the new manifest, and chunks the parent already has are
+	// not replicated again.
+	Parent string
+	// Key reuses an existing file key (hex) instead of generating one
+	Key string
+	// Convergent derives chunk nonces from their content, so chunks that
+	// didn't change since the parent (encrypted under the same Key) keep
+	// their hash
+	Convergent bool
+	// Recipients are hex X25519 public keys to wrap the file key for in the
+	// manifest. This node is added, so it can read the file back without
+	// the raw key.
+	Recipients []string
+	// Pad hides the exact file size by padding the last chunk
+	Pad bool
+	// Cipher is the suite for the chunks; zero means NodeConfig.Cipher
+	Cipher crypto.Suite
+}
+
+// DownloadOptions controls how a download is written
+type DownloadOptions struct {
+	// Resume continues from the verified prefix of a previous partial
+	// download of the same file to the same output path
+	Resume bool
+	// Trust lists the publisher keys (hex Ed25519) whose manifests are
+	// accepted; when empty any validly signed or unsigned manifest is
+	Trust []string
+}
+
+// UploadFile processes a file and stores its chunks. If some chunks can't
+// reach opts.Replicas confirmed copies, the metadata and key are still
+// returned together with a *ReplicationError.
+//
+// With encryption at rest on, progress is journaled in the node state dir
+// and the journal outlives only an upload that stopped short of its
+// replicas, for opts.Resume to pick up. The journal holds the file key, so
+// without encryption at rest there is none and opts.Resume is refused.
+func (n *Node) UploadFile(path string, opts UploadOptions) (metadata files.FileMetadata, keyHex string, err error) {
+	n.logf("Processing file: %s\n", path)
+	defer n.flushAudits()
+
+	journaled := n.stateKey != nil
+	if opts.Resume && !journaled {
+		return files.FileMetadata{}, "", ErrResumeNeedsEncryption
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return files.FileMetadata{}, "", err
+	}
+	absPath, err := filepath.Abs(path)
 	if err != nil {
 		return files.FileMetadata{}, "", err
 	}
+	journalFile := journalName("upload", absPath)
+	defer func() {
+		var short *ReplicationError
+		if journaled && !errors.As(err, &short) {
+			n.removeJournal(journalFile)
+		}
+	}()
 
-	fmt.Printf("File split into %d chunks. ID: %s\n", len(chunks), metadata.ID)
+	var journal uploadJournal
+	var chunks []files.Chunk
 
-	// 2. Distribute Chunks
-	for _, chunk := range chunks {
-		// A. Store Locally (Always)
-		if err := n.Store.WriteChunk(chunk); err != nil {
-			fmt.Printf("Error writing chunk locally: %v\n", err)
-			continue
+	if opts.Resume && n.loadJournal(journalFile, &journal) &&
+		journal.Size == info.Size() && journal.ModTime == info.ModTime().UnixNano() {
+		// 1. Reuse the chunks stored by the interrupted upload
+		metadata = journal.Metadata
+		key, err := hexDecode(journal.Key)
+		if err == nil {
+			err = metadata.Unseal(key)
+		}
+		if err != nil {
+			return files.FileMetadata{}, "", fmt.Errorf("resuming upload: %v", err)
+		}
+		for _, ref := range journal.Metadata.Chunks {
+			chunk, err := n.Store.ReadChunk(ref.Hash)
+			if err != nil {
+				return files.FileMetadata{}, "", fmt.Errorf("resuming upload: chunk %s: %v", shortHash(ref.Hash), err)
+			}
+			chunk.Index = ref.Index
+			chunks = append(chunks, chunk)
+		}
+		metadata.Chunks = chunks
+		n.logf("Resuming upload of %d chunks. ID: %s\n", len(chunks), metadata.ID)
+	} else {
+		// 1. Chunk and Encrypt
+		processOpts := files.ProcessOptions{Convergent: opts.Convergent, Parent: opts.Parent, Pad: opts.Pad, Cipher: opts.Cipher}
+		if processOpts.Cipher == crypto.SuiteLegacy {
+			processOpts.Cipher = n.Config.Cipher
+		}
+		if opts.Key != "" {
+			if processOpts.Key, err = hexDecode(opts.Key); err != nil {
+				return files.FileMetadata{}, "", err
+			}
 		}
+		var key []byte
+		metadata, chunks, key, err = files.ProcessFileWith(path, processOpts)
+		if err != nil {
+			return files.FileMetadata{}, "", err
+		}
+		n.logf("File split into %d chunks. ID: %s\n", len(chunks), metadata.ID)
 
-		// B. Publish to Network (DHT)
-		// Find closest nodes to the chunk hash
-		chunkID := dht.NewID(chunk.Hash)
-		contacts := n.DHT.RoutingTable.FindClosestContacts(chunkID, 3)
+		recipients, err := n.withSelf(opts.Recipients)
+		if err != nil {
+			return files.FileMetadata{}, "", err
+		}
+		if err := wrapFor(&metadata, key, recipients); err != nil {
+			return files.FileMetadata{}, "", err
+		}
+		if err := n.signManifest(&metadata); err != nil {
+			return files.FileMetadata{}, "", err
+		}
 
-		// Create Payload
-		payload, _ := json.Marshal(chunk)
-		msg := p2p.Message{
-			Type:    p2p.MsgStoreChunk,
-			Sender:  n.DHT.ID.Hex(),
-			Payload: payload,
+		// Store Locally (Always), with a single sync where the store allows
+		if err := storage.WriteChunks(n.Store, chunks); err != nil {
+			return files.FileMetadata{}, "", fmt.Errorf("writing chunks locally: %v", err)
 		}
 
-		fmt.Printf("Replicating chunk %s to %d peers...\n", chunk.Hash[:8], len(contacts))
-		for _, contact := range contacts {
-			if contact.Address == n.Transport.(*p2p.WebSocketTransport).Address {
-				continue // Don't send to self
+		journal = uploadJournal{
+			Path:     absPath,
+			Size:     info.Size(),
+			ModTime:  info.ModTime().UnixNano(),
+			Metadata: metadata.StripContent(),
+			Key:      fmt.Sprintf("%x", key),
+		}
+		if journaled {
+			if err := n.saveJournal(journalFile, journal); err != nil {
+				return files.FileMetadata{}, "", fmt.Errorf("writing upload journal: %v", err)
 			}
-			go n.Transport.SendMessage(contact.Address, msg)
+		}
+	}
+	if journal.Peers == nil {
+		journal.Peers = make(map[string][]string)
+	}
+
+	// Chunks shared with the parent version were replicated with it
+	reused := n.parentChunks(metadata.Parent)
+
+	// 2. Replicate to the closest peers until enough have acknowledged
+	var short []ChunkReplication
+	for _, chunk := range chunks {
+		if opts.Replicas <= 0 {
+			break
+		}
+		if reused[chunk.Hash] {
+			continue
+		}
+
+		peers := journal.Peers[chunk.Hash]
+		if len(peers) < opts.Replicas {
+			skip := make(map[string]bool, len(peers))
+			for _, p := range peers {
+				skip[p] = true
+			}
+			n.logf("Replicating chunk %s to %d peers...\n", chunk.Hash[:8], opts.Replicas-len(peers))
+			peers = append(peers, n.replicateChunk(chunk, opts.Replicas-len(peers), skip)...)
+
+			journal.Peers[chunk.Hash] = peers
+			if journaled {
+				if err := n.saveJournal(journalFile, journal); err != nil {
+					return files.FileMetadata{}, "", fmt.Errorf("writing upload journal: %v", err)
+				}
+			}
+		}
+		if len(peers) < opts.Replicas {
+			short = append(short, ChunkReplication{Hash: chunk.Hash, Peers: peers})
 		}
 	}
 
-	return metadata, fmt.Sprintf("%x", key), nil
+	if len(short) > 0 {
+		return metadata, journal.Key, &ReplicationError{Wanted: opts.Replicas, Short: short}
+	}
+	return metadata, journal.Key, nil
 }
 
-// DownloadFile retrieves chunks and reconstructs the file
-func (n *Node) DownloadFile(metadata files.FileMetadata, keyHex string, outputPath string) error {
-	fmt.Printf("Downloading file: %s (ID: %s)\n", metadata.Name, metadata.ID)
+// parentChunks returns the chunk hashes of the manifest at root, or nil if
+// there is no parent or its manifest can't be loaded
+func (n *Node) parentChunks(root string) map[string]bool {
+	if root == "" {
+		return nil
+	}
+	parent, err := n.GetManifest(root)
+	if err != nil {
+		return nil
+	}
+	hashes := make(map[string]bool, len(parent.Chunks))
+	for _, c := range parent.Chunks {
+		hashes[c.Hash] = true
+	}
+	return hashes
+}
 
-	key, err := hexDecode(keyHex)
+// DownloadFile retrieves chunks in parallel and writes the decrypted file in
+// order. Data goes to outputPath+".part" and is renamed into place only once
+// every chunk has been verified and the size matches the metadata. With an
+// empty keyHex the key is unwrapped from the manifest's recipients. Padding
+// after the file size is dropped. The manifest signature is checked
+// against opts.Trust before anything is fetched.
+//
+// When the node has a state dir, the number of chunks written so far is
+// journaled and the partial file is kept on failure so opts.Resume can
+// continue from it.
+func (n *Node) DownloadFile(metadata files.FileMetadata, keyHex string, outputPath string, opts DownloadOptions) error {
+	if err := checkPublisher(metadata, opts.Trust); err != nil {
+		return err
+	}
+	key, err := n.fileKey(metadata, keyHex)
 	if err != nil {
-		return fmt.Errorf("invalid key: %v", err)
+		return err
+	}
+	if err := metadata.Unseal(key); err != nil {
+		return err
 	}
+	n.logf("Downloading file: %s (ID: %s)\n", metadata.Name, metadata.ID)
 
-	var gatheredChunks []files.Chunk
+	chunks := make([]files.Chunk, len(metadata.Chunks))
+	copy(chunks, metadata.Chunks)
+	sort.Slice(chunks, func(i, j int) bool {
+		return chunks[i].Index < chunks[j].Index
+	})
 
-	for _, chunkMeta := range metadata.Chunks {
-		// 1. Check Local
-		chunk, err := n.Store.ReadChunk(chunkMeta.Hash)
-		if err == nil {
-			chunk.Index = chunkMeta.Index
-			gatheredChunks = append(gatheredChunks, chunk)
-			continue
-		}
+	absPath, err := filepath.Abs(outputPath)
+	if err != nil {
+		return err
+	}
+	partPath := outputPath + ".part"
+	journalFile := journalName("download", metadata.ID+"\x00"+absPath)
 
-		// 2. If not local, Ask Network
-		fmt.Printf("Chunk %s missing locally. Requesting from network...\n", chunkMeta.Hash[:8])
+	journal := downloadJournal{FileID: metadata.ID, Output: absPath}
+	var resumed downloadJournal
+	if opts.Resume && n.loadJournal(journalFile, &resumed) &&
+		resumed.FileID == metadata.ID && resumed.Output == absPath && resumed.Written <= len(chunks) {
+		if info, err := os.Stat(partPath); err == nil && info.Size() >= resumed.Offset {
+			journal = resumed
+		}
+	}
 
-		// Find probable providers (closest peers to chunk Hash)
-		chunkID := dht.NewID(chunkMeta.Hash)
-		contacts := n.DHT.RoutingTable.FindClosestContacts(chunkID, 5)
+	out, err := os.OpenFile(partPath, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	// Drop anything past the last journaled chunk
+	if err := out.Truncate(journal.Offset); err == nil {
+		_, err = out.Seek(journal.Offset, 0)
+	}
+	if err != nil {
+		out.Close()
+		return err
+	}
+	if journal.Written > 0 {
+		n.logf("Resuming download after %d of %d chunks\n", journal.Written, len(chunks))
+	}
 
-		reqPayload, _ := json.Marshal(p2p.ChunkRequestPayload{Hash: chunkMeta.Hash})
-		reqMsg := p2p.Message{
-			Type:    p2p.MsgRequestChunk,
-			Sender:  n.DHT.ID.Hex(),
-			Payload: reqPayload,
+	offset := journal.Offset
+	err = n.fetchChunks(chunks[journal.Written:], func(chunk files.Chunk) error {
+		data, err := files.DecryptChunk(chunk, key)
+		if err != nil {
+			return err
 		}
-
-		// Send Request to all
-		for _, contact := range contacts {
-			go n.Transport.SendMessage(contact.Address, reqMsg)
+		if rest := metadata.Size - offset; int64(len(data)) > rest && rest >= 0 {
+			data = data[:rest]
 		}
-
-		// Wait for chunk to appear in storage (Handling incoming MsgStoreChunk saves to disk)
-		// Polling for now is simple
-		found := false
-		for i := 0; i < 10; i++ {
-			time.Sleep(500 * time.Millisecond)
-			if n.Store.HasChunk(chunkMeta.Hash) {
-				chunk, _ := n.Store.ReadChunk(chunkMeta.Hash)
-				chunk.Index = chunkMeta.Index
-				gatheredChunks = append(gatheredChunks, chunk)
-				found = true
-				break
-			}
+		if _, err := out.Write(data); err != nil {
+			return err
 		}
-
-		if !found {
-			fmt.Printf("Failed to retrieve chunk %s\n", chunkMeta.Hash[:8])
-			return fmt.Errorf("chunk %s missing", chunkMeta.Hash)
+		offset += int64(len(data))
+		if n.Config.StorageDir == "" {
+			return nil
+		}
+		// The journal must never claim more than is durably on disk
+		if err := out.Sync(); err != nil {
+			return err
+		}
+		journal.Written++
+		journal.Offset += int64(len(data))
+		return n.saveJournal(journalFile, journal)
+	})
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		if info, statErr := os.Stat(partPath); statErr != nil {
+			err = statErr
+		} else if info.Size() != metadata.Size {
+			err = fmt.Errorf("downloaded %d bytes, expected %d", info.Size(), metadata.Size)
+			os.Remove(partPath) // not resumable, the chunks themselves are wrong
+			n.removeJournal(journalFile)
+			return err
 		}
 	}
-
-	// 3. Reassemble
-	data, err := files.ReassembleFile(gatheredChunks, key)
 	if err != nil {
+		if n.Config.StorageDir == "" {
+			os.Remove(partPath)
+		}
 		return err
 	}
 
-	// 4. Save
-	return os.WriteFile(outputPath, data, 0644)
+	if err := os.Rename(partPath, outputPath); err != nil {
+		return err
+	}
+	n.removeJournal(journalFile)
+	return nil
 }
 
 func hexDecode(s string) ([]byte, error) {
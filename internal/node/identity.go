@@ -0,0 +1,80 @@
+package node
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/tanmaydeobhankar/nebulafs/internal/files"
+)
+
+// ErrUntrusted is returned when a manifest isn't signed by a trusted key
+var ErrUntrusted = errors.New("manifest not signed by a trusted publisher")
+
+const identityFile = "identity.key"
+
+// Identity returns the node's Ed25519 signing key, creating it on first use.
+// The seed is kept in the state dir, so it is sealed when encryption at rest
+// is on; without a StorageDir the key only lives as long as the node.
+func (n *Node) Identity() (ed25519.PrivateKey, error) {
+	n.identityMutex.Lock()
+	defer n.identityMutex.Unlock()
+
+	if n.identity != nil {
+		return n.identity, nil
+	}
+
+	seed, err := n.LoadState(identityFile)
+	switch {
+	case os.IsNotExist(err):
+		seed = make([]byte, ed25519.SeedSize)
+		if _, err := rand.Read(seed); err != nil {
+			return nil, err
+		}
+		if err := n.SaveState(identityFile, seed); err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, err
+	case len(seed) != ed25519.SeedSize:
+		return nil, fmt.Errorf("invalid identity key: %d bytes", len(seed))
+	}
+
+	n.identity = ed25519.NewKeyFromSeed(seed)
+	return n.identity, nil
+}
+
+// signManifest signs meta with the node identity
+func (n *Node) signManifest(meta *files.FileMetadata) error {
+	key, err := n.Identity()
+	if err != nil {
+		return err
+	}
+	return meta.Sign(key)
+}
+
+// checkPublisher verifies the signature of meta. With a trust list (hex
+// Ed25519 public keys) it must be signed by one of them; without one,
+// unsigned metadata is accepted but a broken signature is not.
+func checkPublisher(meta files.FileMetadata, trust []string) error {
+	err := meta.VerifySignature()
+	if len(trust) == 0 {
+		if err == files.ErrUnsigned {
+			return nil
+		}
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUntrusted, err)
+	}
+	for _, t := range trust {
+		if pub, err := hex.DecodeString(t); err == nil && bytes.Equal(pub, meta.Publisher) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: signed by %x", ErrUntrusted, meta.Publisher)
+}
@@ -0,0 +1,57 @@
+package node
+
+import (
+	"encoding/json"
+	"path/filepath"
+
+	"github.com/tanmaydeobhankar/nebulafs/internal/crypto"
+	"github.com/tanmaydeobhankar/nebulafs/internal/files"
+)
+
+// uploadJournal records upload progress so an interrupted upload can resume
+// with the same chunks and key instead of re-encrypting from scratch.
+// It holds the file key, so it is only written when encryption at rest
+// seals it along with other state.
+type uploadJournal struct {
+	Path     string              `json:"path"`
+	Size     int64               `json:"size"`
+	ModTime  int64               `json:"mod_time"`
+	Metadata files.FileMetadata  `json:"metadata"` // chunk references only
+	Key      string              `json:"key"`
+	Peers    map[string][]string `json:"peers"` // chunk hash -> confirmed peers
+}
+
+// downloadJournal records how many chunks have been verified and written
+// in order to the partial output file
+type downloadJournal struct {
+	FileID  string `json:"file_id"`
+	Output  string `json:"output"`
+	Written int    `json:"written"` // chunks written
+	Offset  int64  `json:"offset"`  // bytes written
+}
+
+func journalName(kind, id string) string {
+	return filepath.Join("journal", kind+"-"+crypto.HashSHA1([]byte(id))+".json")
+}
+
+func (n *Node) loadJournal(name string, v interface{}) bool {
+	data, err := n.LoadState(name)
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(data, v) == nil
+}
+
+func (n *Node) saveJournal(name string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return n.SaveState(name, data)
+}
+
+func (n *Node) removeJournal(name string) {
+	if n.Config.StorageDir != "" {
+		removeState(n.Config.StorageDir, name)
+	}
+}
@@ -0,0 +1,242 @@
+package node
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/tanmaydeobhankar/nebulafs/internal/dht"
+	"github.com/tanmaydeobhankar/nebulafs/internal/files"
+)
+
+const pinsFile = "pins.json"
+
+// AddResult is what a client needs to get a file back
+type AddResult struct {
+	Root     string             `json:"root"`
+	Key      string             `json:"key"`
+	Metadata files.FileMetadata `json:"metadata"`          // chunk references only
+	Version  int                `json:"version,omitempty"` // set by AddVersion
+}
+
+// PinnedFile is an entry in the pin set
+type PinnedFile struct {
+	Root   string    `json:"root"`
+	Name   string    `json:"name"`
+	Size   int64     `json:"size"`
+	Type   string    `json:"type"`
+	Pinned time.Time `json:"pinned"`
+}
+
+// NodeStats is a snapshot of the node for the control API
+type NodeStats struct {
+	ID      string `json:"id"`
+	Address string `json:"address"`
+	Peers   int    `json:"peers"`
+	Chunks  int    `json:"chunks"`
+	Pins    int    `json:"pins"`
+	Uptime  int64  `json:"uptime_seconds"`
+
+	// RecipientKey is the hex X25519 public key others share files with
+	RecipientKey string `json:"recipient_key"`
+	// PublisherKey is the hex Ed25519 key this node signs manifests with
+	PublisherKey string `json:"publisher_key"`
+}
+
+// Add uploads a file, stores its manifest alongside the chunks and pins the
+// resulting root. Replication shortfalls of the chunks or the manifest are
+// returned as a *ReplicationError together with the result, since the file
+// is still stored locally and can't be found again without its root and key.
+func (n *Node) Add(path string, opts UploadOptions) (AddResult, error) {
+	meta, keyHex, err := n.UploadFile(path, opts)
+	var replErr *ReplicationError
+	if err != nil && !errors.As(err, &replErr) {
+		return AddResult{}, err
+	}
+
+	root, err := n.PutManifest(meta, opts.Replicas)
+	var manifestErr *ReplicationError
+	if errors.As(err, &manifestErr) {
+		if replErr == nil {
+			replErr = manifestErr
+		} else {
+			replErr.Short = append(replErr.Short, manifestErr.Short...)
+		}
+	} else if err != nil {
+		return AddResult{}, err
+	}
+	if err := n.addPin(root, meta); err != nil {
+		return AddResult{}, err
+	}
+
+	result := AddResult{Root: root, Key: keyHex, Metadata: meta.StripContent()}
+	if replErr != nil {
+		return result, replErr
+	}
+	return result, nil
+}
+
+// Get downloads the file behind a manifest root
+func (n *Node) Get(root, keyHex, outputPath string, opts DownloadOptions) error {
+	meta, err := n.GetManifest(root)
+	if err != nil {
+		return err
+	}
+	return n.DownloadFile(meta, keyHex, outputPath, opts)
+}
+
+// PutManifest stores the manifest for meta locally, replicates it like a
+// chunk and returns its root
+func (n *Node) PutManifest(meta files.FileMetadata, replicas int) (string, error) {
+	defer n.flushAudits()
+	chunk, err := files.NewManifest(meta)
+	if err != nil {
+		return "", err
+	}
+	if err := n.Store.WriteChunk(chunk); err != nil {
+		return "", fmt.Errorf("writing manifest locally: %v", err)
+	}
+	if peers := n.replicateChunk(chunk, replicas, nil); len(peers) < replicas {
+		return chunk.Hash, &ReplicationError{
+			Wanted: replicas,
+			Short:  []ChunkReplication{{Hash: chunk.Hash, Peers: peers}},
+		}
+	}
+	return chunk.Hash, nil
+}
+
+// GetManifest loads a manifest from the local store or the network
+func (n *Node) GetManifest(root string) (files.FileMetadata, error) {
+	chunk, err := n.Store.ReadChunk(root)
+	if err != nil {
+		if chunk, err = n.fetchChunk(root); err != nil {
+			return files.FileMetadata{}, err
+		}
+	}
+	return files.ParseManifest(chunk)
+}
+
+// Pin fetches every chunk of root into the local store and records it in
+// the pin set
+func (n *Node) Pin(root string) error {
+	meta, err := n.GetManifest(root)
+	if err != nil {
+		return err
+	}
+	if err := n.fetchChunks(meta.Chunks, func(files.Chunk) error { return nil }); err != nil {
+		return err
+	}
+	return n.addPin(root, meta)
+}
+
+// Unpin removes root from the pin set. Its chunks stay in the store.
+func (n *Node) Unpin(root string) error {
+	n.pinMutex.Lock()
+	defer n.pinMutex.Unlock()
+
+	pins := n.loadPins()
+	if _, ok := pins[root]; !ok {
+		return fmt.Errorf("%s is not pinned", root)
+	}
+	delete(pins, root)
+	return n.savePins(pins)
+}
+
+// Pins lists the pin set, oldest first
+func (n *Node) Pins() []PinnedFile {
+	n.pinMutex.Lock()
+	pins := n.loadPins()
+	list := make([]PinnedFile, 0, len(pins))
+	for _, p := range pins {
+		list = append(list, p)
+	}
+	n.pinMutex.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Pinned.Before(list[j].Pinned)
+	})
+	return list
+}
+
+// Peers returns the contacts in the routing table
+func (n *Node) Peers() []dht.Contact {
+	return n.DHT.RoutingTable.Contacts()
+}
+
+// Stats summarises the node
+func (n *Node) Stats() NodeStats {
+	hashes, _ := n.Store.ListChunks()
+	n.pinMutex.Lock()
+	pins := len(n.loadPins())
+	n.pinMutex.Unlock()
+
+	stats := NodeStats{
+		ID:      n.DHT.ID.Hex(),
+		Address: n.DHT.RoutingTable.Self.Address,
+		Peers:   len(n.Peers()),
+		Chunks:  len(hashes),
+		Pins:    pins,
+		Uptime:  int64(time.Since(n.started).Seconds()),
+	}
+	if priv, err := n.RecipientKey(); err == nil {
+		stats.RecipientKey = hex.EncodeToString(priv.PublicKey().Bytes())
+	}
+	if key, err := n.Identity(); err == nil {
+		stats.PublisherKey = hex.EncodeToString(key.Public().(ed25519.PublicKey))
+	}
+	return stats
+}
+
+func (n *Node) addPin(root string, meta files.FileMetadata) error {
+	n.pinMutex.Lock()
+	defer n.pinMutex.Unlock()
+
+	pins := n.loadPins()
+	if _, ok := pins[root]; ok {
+		return nil
+	}
+	pins[root] = PinnedFile{
+		Root:   root,
+		Name:   meta.Name,
+		Size:   meta.Size,
+		Type:   meta.Type,
+		Pinned: time.Now(),
+	}
+	return n.savePins(pins)
+}
+
+// loadPins reads the pin set; callers hold pinMutex. Without a state dir the
+// pin set lives in memory only.
+func (n *Node) loadPins() map[string]PinnedFile {
+	if n.pins != nil {
+		return n.pins
+	}
+	n.pins = make(map[string]PinnedFile)
+	data, err := n.LoadState(pinsFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			n.logf("[%d] Cannot read pin set: %v\n", n.Config.Port, err)
+		}
+		return n.pins
+	}
+	if err := json.Unmarshal(data, &n.pins); err != nil {
+		n.logf("[%d] Invalid pin set: %v\n", n.Config.Port, err)
+	}
+	if n.pins == nil {
+		n.pins = make(map[string]PinnedFile)
+	}
+	return n.pins
+}
+
+func (n *Node) savePins(pins map[string]PinnedFile) error {
+	data, err := json.MarshalIndent(pins, "", "  ")
+	if err != nil {
+		return err
+	}
+	return n.SaveState(pinsFile, data)
+}
@@ -1,64 +1,249 @@
 package node
 
 import (
+	"crypto/ed25519"
 	"encoding/json"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/tanmaydeobhankar/nebulafs/internal/crypto"
 	"github.com/tanmaydeobhankar/nebulafs/internal/dht"
 	"github.com/tanmaydeobhankar/nebulafs/internal/files"
 	"github.com/tanmaydeobhankar/nebulafs/internal/p2p"
 	"github.com/tanmaydeobhankar/nebulafs/internal/storage"
 )
 
+// stateDirName is the subdirectory of StorageDir holding node state files,
+// kept apart from the chunks themselves
+const stateDirName = "state"
+
 // Node represents the full NebulaFS node
 type Node struct {
-	DHT       *dht.DHT
-	Store     storage.Store
-	Transport p2p.Transport
-	Config    NodeConfig
+	DHT        *dht.DHT
+	Store      storage.Store
+	Quarantine storage.Store // corrupt chunks moved aside by the scrubber
+	Transport  p2p.Transport
+	Config     NodeConfig
+
+	stateKey []byte               // seals state files when encryption at rest is on
+	tiers    *storage.TieredStore // set when a cold tier is configured
+	pack     *storage.PackStore   // set with the pack backend, for compaction
+
+	peerStats  *peerStats
+	reputation *reputation
+	waiters    map[string][]chan struct{} // chunk hash -> fetches waiting for it
+	waitMutex  sync.Mutex
+	replies    map[replyKey]chan json.RawMessage
+	replyMutex sync.Mutex
+	pins       map[string]PinnedFile // loaded on first use
+	pinMutex   sync.Mutex
+	started    time.Time
+
+	identity      ed25519.PrivateKey // loaded on first use
+	identityMutex sync.Mutex
+	publishMutex  sync.Mutex           // serialises sequence numbers of published records
+	records       *recordTable         // who stored each record in DHT.Storage, guarded by DHT.Mutex
+	history       map[string][]Version // logical path -> versions, loaded on first use
+	historyMutex  sync.Mutex
+	audits        *auditState // replica holders and peer records, loaded on first use
+	auditMutex    sync.Mutex
 }
 
 type NodeConfig struct {
 	Port           int
 	BootstrapPeers []string
 	StorageDir     string
+	StoreBackend   string // "disk" (default) or "pack"
+
+	// Optional injected implementations (e.g. MemoryStore / MemoryTransport
+	// in tests). An injected transport must be reachable at 127.0.0.1:Port.
+	Store     storage.Store
+	Transport p2p.Transport
+
+	// ColdStorage enables tiering: a directory or an s3://bucket/prefix?endpoint=...
+	// URL that chunks not accessed within DemoteAfter are moved to
+	ColdStorage string
+	DemoteAfter time.Duration
+
+	// MasterKey enables encryption at rest for chunks and state files
+	MasterKey []byte
+
+	// Download scheduling; zero values fall back to the defaults in fetch.go
+	FetchParallelism int           // chunks fetched concurrently
+	PerPeerLimit     int           // concurrent requests per peer
+	FetchTimeout     time.Duration // per-provider timeout before trying the next
+	AckTimeout       time.Duration // wait for a STORE_ACK before trying a further peer
+
+	// Self-healing; disabled when RepairInterval is 0
+	RepairInterval time.Duration
+	RepairReplicas int // replicas to maintain among the K closest peers
+
+	// Background scrubbing; disabled when ScrubInterval is 0
+	ScrubInterval time.Duration
+	ScrubRate     int64 // bytes per second, 0 = unlimited
+
+	// Peer reputation; zero values fall back to the defaults in
+	// reputation.go
+	BanThreshold    float64       // penalty at which a peer is banned
+	BanDuration     time.Duration // how long a ban lasts
+	PenaltyHalfLife time.Duration // penalties halve over this period
+	MessageRate     int           // messages per second accepted from one peer
+
+	// Proof-of-storage audits of replica holders; disabled when
+	// AuditInterval is 0
+	AuditInterval   time.Duration
+	AuditChallenges int // challenges precomputed per chunk, 0 = DefaultAuditChallenges
+
+	// Cipher is the suite new chunks are encrypted with; zero means
+	// crypto.DefaultSuite
+	Cipher crypto.Suite
+
+	// AcceptDeletes honours DELETE_CHUNK requests for unpinned chunks.
+	// Requests aren't authenticated, so any peer could use them to drop
+	// this node's replicas; off by default.
+	AcceptDeletes bool
+
+	// Log receives progress messages; nil means stdout
+	Log io.Writer
 }
 
 func NewNode(config NodeConfig) (*Node, error) {
-	store, err := storage.NewDiskStore(config.StorageDir)
+	store := config.Store
+	pack, _ := store.(*storage.PackStore)
+	if store == nil {
+		var err error
+		if store, err = openStore(config); err != nil {
+			return nil, err
+		}
+		pack, _ = store.(*storage.PackStore)
+		if config.ColdStorage != "" {
+			if store, err = openTieredStore(store, config.ColdStorage); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var quarantine storage.Store = storage.NewMemoryStore()
+	if config.StorageDir != "" {
+		var err error
+		if quarantine, err = storage.NewDiskStore(filepath.Join(config.StorageDir, "quarantine")); err != nil {
+			return nil, err
+		}
+	}
+
+	tiers, _ := store.(*storage.TieredStore)
+
+	if config.FetchParallelism <= 0 {
+		config.FetchParallelism = DefaultFetchParallelism
+	}
+	if config.PerPeerLimit <= 0 {
+		config.PerPeerLimit = DefaultPerPeerLimit
+	}
+	if config.FetchTimeout <= 0 {
+		config.FetchTimeout = DefaultFetchTimeout
+	}
+	if config.AckTimeout <= 0 {
+		config.AckTimeout = DefaultAckTimeout
+	}
+	if config.RepairReplicas <= 0 {
+		config.RepairReplicas = DefaultRepairReplicas
+	}
+	if config.Log == nil {
+		config.Log = os.Stdout
+	}
+
+	sealKey, err := stateKey(config.MasterKey)
 	if err != nil {
 		return nil, err
 	}
+	if config.MasterKey != nil {
+		if store, err = storage.NewEncryptedStore(store, config.MasterKey); err != nil {
+			return nil, err
+		}
+		if quarantine, err = storage.NewEncryptedStore(quarantine, config.MasterKey); err != nil {
+			return nil, err
+		}
+	}
 
 	address := fmt.Sprintf("127.0.0.1:%d", config.Port) // Using IP for consistent dial
-	transport := p2p.NewWebSocketTransport(address)
+	transport := config.Transport
+	if transport == nil {
+		transport = p2p.NewWebSocketTransport(address)
+	}
 
 	id := dht.NewID(address)
 	dhtNode := dht.NewDHT(id, address)
 
 	n := &Node{
-		DHT:       dhtNode,
-		Store:     store,
-		Transport: transport,
-		Config:    config,
+		DHT:        dhtNode,
+		Store:      store,
+		Quarantine: quarantine,
+		Transport:  transport,
+		Config:     config,
+		stateKey:   sealKey,
+		tiers:      tiers,
+		pack:       pack,
+		peerStats:  newPeerStats(config.PerPeerLimit),
+		reputation: newReputation(config),
+		waiters:    make(map[string][]chan struct{}),
+		replies:    make(map[replyKey]chan json.RawMessage),
+		records:    newRecordTable(),
+		started:    time.Now(),
 	}
 
-	n.registerHandlers(transport)
+	n.registerHandlers(screenedTransport{Transport: transport, node: n})
 	return n, nil
 }
 
+// openStore creates the chunk store selected by config.StoreBackend
+func openStore(config NodeConfig) (storage.Store, error) {
+	switch config.StoreBackend {
+	case "", "disk":
+		return storage.NewDiskStore(config.StorageDir)
+	case "pack":
+		return storage.NewPackStore(config.StorageDir)
+	default:
+		return nil, fmt.Errorf("unknown store backend %q", config.StoreBackend)
+	}
+}
+
+// openTieredStore puts a cold tier (directory or S3 URL) behind the hot store
+func openTieredStore(hot storage.Store, cold string) (storage.Store, error) {
+	var coldStore storage.Store
+	if strings.HasPrefix(cold, "s3://") {
+		s3conf, err := storage.ParseS3URL(cold, os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"))
+		if err != nil {
+			return nil, err
+		}
+		if coldStore, err = storage.NewS3Store(s3conf); err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		if coldStore, err = storage.NewDiskStore(cold); err != nil {
+			return nil, err
+		}
+	}
+	return storage.NewTieredStore(hot, coldStore)
+}
+
 func (n *Node) Start() error {
 	go func() {
-		fmt.Printf("Node %s listening on %d\n", n.DHT.ID.Hex()[:8], n.Config.Port) // Transport address might be just :port
+		n.logf("Node %s listening on %d\n", n.DHT.ID.Hex()[:8], n.Config.Port) // Transport address might be just :port
 		// We need to pass the actual listen address
 		if err := n.Transport.Listen(fmt.Sprintf(":%d", n.Config.Port)); err != nil {
-			fmt.Println("Transport error:", err)
+			n.logf("Transport error: %v\n", err)
 		}
 	}()
 
 	// Connect to bootstrap peers
 	if len(n.Config.BootstrapPeers) > 0 {
-		fmt.Printf("Bootstrapping to %v...\n", n.Config.BootstrapPeers)
+		n.logf("Bootstrapping to %v...\n", n.Config.BootstrapPeers)
 		for _, peerAddr := range n.Config.BootstrapPeers {
 			// In real Kademlia:
 			// 1. Ping bootstrap
@@ -70,26 +255,98 @@ func (n *Node) Start() error {
 				Sender: n.DHT.ID.Hex(),
 			}
 			if err := n.Transport.SendMessage(peerAddr, msg); err != nil {
-				fmt.Printf("Failed to bootstrap to %s: %v\n", peerAddr, err)
+				n.logf("Failed to bootstrap to %s: %v\n", peerAddr, err)
 			}
 		}
 	}
 
+	if n.Config.ScrubInterval > 0 {
+		go n.scrubLoop()
+	}
+	if n.Config.RepairInterval > 0 {
+		go n.repairLoop()
+	}
+	if n.Config.AuditInterval > 0 {
+		go n.auditLoop()
+	}
+	if n.tiers != nil && n.Config.DemoteAfter > 0 {
+		go n.demoteLoop()
+	}
+	go n.republishLoop()
+
 	select {}
 }
 
-func (n *Node) registerHandlers(t *p2p.WebSocketTransport) {
-	// ... handlers ...
-	// Since Transport interface doesn't expose RegisterHandler (it was on concrete type),
-	// we passed *p2p.WebSocketTransport here.
+// minDemoteInterval bounds how often demoteLoop scans the hot tier, however
+// short DemoteAfter is
+const minDemoteInterval = time.Second
+
+// demoteLoop periodically moves chunks not accessed within DemoteAfter to
+// the cold tier
+func (n *Node) demoteLoop() {
+	ticker := time.NewTicker(max(n.Config.DemoteAfter/2, minDemoteInterval))
+	defer ticker.Stop()
 
+	for range ticker.C {
+		moved, err := n.tiers.Demote(n.Config.DemoteAfter)
+		if err != nil {
+			n.logf("[%d] Demotion error: %v\n", n.Config.Port, err)
+		}
+		if moved > 0 {
+			n.logf("[%d] Demoted %d chunks to cold storage\n", n.Config.Port, moved)
+			n.compactStore()
+		}
+	}
+}
+
+// compactStore rewrites the packfile once deletes have left most of it dead
+func (n *Node) compactStore() {
+	if n.pack == nil || !n.pack.NeedsCompaction() {
+		return
+	}
+	if err := n.pack.Compact(); err != nil {
+		n.logf("[%d] Compaction error: %v\n", n.Config.Port, err)
+	}
+}
+
+// logf writes a progress message to Config.Log
+func (n *Node) logf(format string, args ...any) {
+	fmt.Fprintf(n.Config.Log, format, args...)
+}
+
+// Close flushes the chunk store. The node must not be used afterwards.
+func (n *Node) Close() error {
+	if n.pack != nil {
+		return n.pack.Close()
+	}
+	return nil
+}
+
+// sendAck tells a peer whether its STORE_CHUNK was persisted
+func (n *Node) sendAck(address string, hash string, storeErr error) {
+	ack := p2p.StoreAckPayload{Hash: hash, OK: storeErr == nil}
+	if storeErr != nil {
+		ack.Error = storeErr.Error()
+	}
+	payload, _ := json.Marshal(ack)
+	n.Transport.SendMessage(address, p2p.Message{
+		Type:    p2p.MsgStoreAck,
+		Sender:  n.DHT.ID.Hex(),
+		Payload: payload,
+	})
+}
+
+func (n *Node) registerHandlers(t p2p.Transport) {
 	// DHT PING
 	t.RegisterHandler(p2p.MsgDHTPing, func(p *p2p.Peer, msg p2p.Message) {
 		// Update table
-		senderID := dht.NewID(msg.Sender)
+		senderID, err := dht.ParseID(msg.Sender)
+		if err != nil {
+			return
+		}
 		contact := dht.Contact{ID: senderID, Address: p.Address}
 		n.DHT.AddNode(contact)
-		fmt.Printf("[%d] Received PING from %s\n", n.Config.Port, msg.Sender[:8])
+		n.logf("[%d] Received PING from %s\n", n.Config.Port, msg.Sender[:8])
 
 		// Reply with PONG
 		pong := p2p.Message{
@@ -101,20 +358,101 @@ func (n *Node) registerHandlers(t *p2p.WebSocketTransport) {
 
 	// DHT PONG
 	t.RegisterHandler(p2p.MsgDHTPong, func(p *p2p.Peer, msg p2p.Message) {
-		senderID := dht.NewID(msg.Sender)
+		senderID, err := dht.ParseID(msg.Sender)
+		if err != nil {
+			return
+		}
 		contact := dht.Contact{ID: senderID, Address: p.Address}
 		n.DHT.AddNode(contact)
-		fmt.Printf("[%d] Received PONG from %s\n", n.Config.Port, msg.Sender[:8])
+		n.logf("[%d] Received PONG from %s\n", n.Config.Port, msg.Sender[:8])
 	})
 
 	// STORE CHUNK (Replica)
 	t.RegisterHandler(p2p.MsgStoreChunk, func(p *p2p.Peer, msg p2p.Message) {
 		var chunk files.Chunk
 		if err := json.Unmarshal(msg.Payload, &chunk); err != nil {
+			n.report(p.Address, eventViolation)
+			return
+		}
+		if crypto.HashSHA1(chunk.Content) != chunk.Hash {
+			n.logf("[%d] Rejected corrupt chunk %s from %s\n", n.Config.Port, shortHash(chunk.Hash), p.Address)
+			n.report(p.Address, eventCorrupt)
+			n.sendAck(p.Address, chunk.Hash, fmt.Errorf("hash mismatch"))
+			return
+		}
+		n.logf("[%d] Received Chunk %s for replication\n", n.Config.Port, chunk.Hash[:8])
+		if err := n.Store.WriteChunk(chunk); err != nil {
+			n.logf("[%d] Failed to store chunk %s: %v\n", n.Config.Port, shortHash(chunk.Hash), err)
+			n.sendAck(p.Address, chunk.Hash, err)
+			return
+		}
+		n.chunkArrived(chunk.Hash)
+		n.sendAck(p.Address, chunk.Hash, nil)
+	})
+
+	// STORE ACK
+	t.RegisterHandler(p2p.MsgStoreAck, func(p *p2p.Peer, msg p2p.Message) {
+		var ack p2p.StoreAckPayload
+		if err := json.Unmarshal(msg.Payload, &ack); err != nil {
+			return
+		}
+		n.replyReceived(p2p.MsgStoreAck, ack.Hash, p.Address, msg.Payload)
+	})
+
+	// HAS CHUNK
+	t.RegisterHandler(p2p.MsgHasChunk, func(p *p2p.Peer, msg p2p.Message) {
+		var req p2p.ChunkRequestPayload
+		if err := json.Unmarshal(msg.Payload, &req); err != nil {
+			return
+		}
+		payload, _ := json.Marshal(p2p.HasChunkPayload{Hash: req.Hash, Has: n.Store.HasChunk(req.Hash)})
+		n.Transport.SendMessage(p.Address, p2p.Message{
+			Type:    p2p.MsgHasChunkResp,
+			Sender:  n.DHT.ID.Hex(),
+			Payload: payload,
+		})
+	})
+
+	t.RegisterHandler(p2p.MsgHasChunkResp, func(p *p2p.Peer, msg p2p.Message) {
+		var resp p2p.HasChunkPayload
+		if err := json.Unmarshal(msg.Payload, &resp); err != nil {
+			return
+		}
+		n.replyReceived(p2p.MsgHasChunkResp, resp.Hash, p.Address, msg.Payload)
+	})
+
+	// Advisory deletes of replaced chunks
+	t.RegisterHandler(p2p.MsgDeleteChunk, n.handleDeleteChunk)
+
+	// Proof-of-storage audits
+	t.RegisterHandler(p2p.MsgChallenge, n.handleChallenge)
+
+	t.RegisterHandler(p2p.MsgProof, func(p *p2p.Peer, msg p2p.Message) {
+		var resp p2p.ProofPayload
+		if err := json.Unmarshal(msg.Payload, &resp); err != nil {
+			return
+		}
+		n.replyReceived(p2p.MsgProof, resp.Hash, p.Address, msg.Payload)
+	})
+
+	// Signed records
+	t.RegisterHandler(p2p.MsgDHTStore, n.handleRecordStore)
+	t.RegisterHandler(p2p.MsgDHTFindValue, n.handleFindValue)
+
+	t.RegisterHandler(p2p.MsgDHTStoreAck, func(p *p2p.Peer, msg p2p.Message) {
+		var ack p2p.StoreAckPayload
+		if err := json.Unmarshal(msg.Payload, &ack); err != nil {
+			return
+		}
+		n.replyReceived(p2p.MsgDHTStoreAck, ack.Hash, p.Address, msg.Payload)
+	})
+
+	t.RegisterHandler(p2p.MsgDHTValue, func(p *p2p.Peer, msg p2p.Message) {
+		var resp p2p.DHTPayload
+		if err := json.Unmarshal(msg.Payload, &resp); err != nil {
 			return
 		}
-		fmt.Printf("[%d] Received Chunk %s for replication\n", n.Config.Port, chunk.Hash[:8])
-		n.Store.WriteChunk(chunk)
+		n.replyReceived(p2p.MsgDHTValue, resp.Key, p.Address, msg.Payload)
 	})
 
 	// REQUEST CHUNK
@@ -124,7 +462,7 @@ func (n *Node) registerHandlers(t *p2p.WebSocketTransport) {
 			return
 		}
 
-		fmt.Printf("[%d] Received Request for Chunk %s\n", n.Config.Port, req.Hash[:8])
+		n.logf("[%d] Received Request for Chunk %s\n", n.Config.Port, req.Hash[:8])
 
 		// Check local storage
 		chunk, err := n.Store.ReadChunk(req.Hash)
@@ -1,12 +1,42 @@
 package node
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/tanmaydeobhankar/nebulafs/internal/crypto"
+	"github.com/tanmaydeobhankar/nebulafs/internal/dht"
+	"github.com/tanmaydeobhankar/nebulafs/internal/files"
+	"github.com/tanmaydeobhankar/nebulafs/internal/p2p"
+	"github.com/tanmaydeobhankar/nebulafs/internal/storage"
 )
 
+// newMemoryNode creates a node backed by a MemoryStore and a transport on net
+func newMemoryNode(t *testing.T, net *p2p.MemoryNetwork, port int, bootstrap ...string) *Node {
+	address := fmt.Sprintf("127.0.0.1:%d", port)
+	n, err := NewNode(NodeConfig{
+		Port:           port,
+		BootstrapPeers: bootstrap,
+		Store:          storage.NewMemoryStore(),
+		Transport:      net.NewTransport(address),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go n.Start()
+	return n
+}
+
 func TestNodeFileUploadDownload(t *testing.T) {
 	// Setup Temp Dirs
 	tmpDir, _ := os.MkdirTemp("", "nebulafs_node_test")
@@ -15,45 +45,57 @@ func TestNodeFileUploadDownload(t *testing.T) {
 	storageDir := filepath.Join(tmpDir, "storage")
 	os.Mkdir(storageDir, 0755)
 
-	// Create Node
-	conf := NodeConfig{
+	// Create Nodes, one on the default disk store and one in memory
+	diskNode, err := NewNode(NodeConfig{
 		Port:       5000,
 		StorageDir: storageDir,
-	}
-	n, err := NewNode(conf)
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer diskNode.Close()
 
-	// Create Input File
-	inputFile := filepath.Join(tmpDir, "input.txt")
-	content := []byte("Hello Distributed World!")
-	os.WriteFile(inputFile, content, 0644)
+	for _, tc := range []struct {
+		name string
+		node *Node
+	}{
+		{"disk", diskNode},
+		{"memory", newMemoryNode(t, p2p.NewMemoryNetwork(1), 5001)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			n := tc.node
 
-	// Test Upload
-	meta, keyHex, err := n.UploadFile(inputFile)
-	if err != nil {
-		t.Fatalf("Upload failed: %v", err)
-	}
+			// Create Input File
+			inputFile := filepath.Join(tmpDir, tc.name+"_input.txt")
+			content := []byte("Hello Distributed World!")
+			os.WriteFile(inputFile, content, 0644)
 
-	// Check if chunks exist in storage
-	for _, c := range meta.Chunks {
-		if !n.Store.HasChunk(c.Hash) {
-			t.Errorf("Chunk %s missing from storage", c.Hash)
-		}
-	}
+			// Test Upload
+			meta, keyHex, err := n.UploadFile(inputFile, UploadOptions{})
+			if err != nil {
+				t.Fatalf("Upload failed: %v", err)
+			}
 
-	// Test Download
-	outputFile := filepath.Join(tmpDir, "output.txt")
-	err = n.DownloadFile(meta, keyHex, outputFile)
-	if err != nil {
-		t.Fatalf("Download failed: %v", err)
-	}
+			// Check if chunks exist in storage
+			for _, c := range meta.Chunks {
+				if !n.Store.HasChunk(c.Hash) {
+					t.Errorf("Chunk %s missing from storage", c.Hash)
+				}
+			}
 
-	// Verify Content
-	readContent, _ := os.ReadFile(outputFile)
-	if string(readContent) != string(content) {
-		t.Errorf("Content mismatch")
+			// Test Download
+			outputFile := filepath.Join(tmpDir, tc.name+"_output.txt")
+			err = n.DownloadFile(meta, keyHex, outputFile, DownloadOptions{})
+			if err != nil {
+				t.Fatalf("Download failed: %v", err)
+			}
+
+			// Verify Content
+			readContent, _ := os.ReadFile(outputFile)
+			if string(readContent) != string(content) {
+				t.Errorf("Content mismatch")
+			}
+		})
 	}
 }
 
@@ -88,7 +130,7 @@ func TestDistributedTransfer(t *testing.T) {
 	// Upload from Node 2 (Should replicate to Node 1 via DHT closest logic)
 	// Since hashes are random, it might NOT always pick Node 1 if there were many nodes.
 	// But with 2 nodes, Node 1 is definitely in the "closest 3".
-	meta, keyHex, err := node2.UploadFile(inputFile)
+	meta, keyHex, err := node2.UploadFile(inputFile, UploadOptions{Replicas: 1})
 	if err != nil {
 		t.Fatalf("Upload failed: %v", err)
 	}
@@ -113,7 +155,7 @@ func TestDistributedTransfer(t *testing.T) {
 
 	// Download on Node 3 (Should fetch from Node 1 or Node 2)
 	outputFile := filepath.Join(tmpDir, "retrieved.txt")
-	err = node3.DownloadFile(meta, keyHex, outputFile)
+	err = node3.DownloadFile(meta, keyHex, outputFile, DownloadOptions{})
 	if err != nil {
 		t.Fatalf("Download failed: %v", err)
 	}
@@ -124,3 +166,1061 @@ func TestDistributedTransfer(t *testing.T) {
 		t.Errorf("Content mismatch on Node 3")
 	}
 }
+
+func TestParallelFetchFromOnePeer(t *testing.T) {
+	tmpDir, _ := os.MkdirTemp("", "nebulafs_onepeer_test")
+	defer os.RemoveAll(tmpDir)
+
+	// Over websockets, so concurrent requests share one real connection
+	holder, err := NewNode(NodeConfig{Port: 6011, StorageDir: filepath.Join(tmpDir, "holder")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go holder.Start()
+	time.Sleep(200 * time.Millisecond)
+
+	inputFile := filepath.Join(tmpDir, "big.bin")
+	content := make([]byte, 6*files.ChunkSize)
+	rand.Read(content)
+	os.WriteFile(inputFile, content, 0644)
+	meta, keyHex, err := holder.UploadFile(inputFile, UploadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fetcher, err := NewNode(NodeConfig{
+		Port:             6012,
+		StorageDir:       filepath.Join(tmpDir, "fetcher"),
+		BootstrapPeers:   []string{"127.0.0.1:6011"},
+		FetchParallelism: 6,
+		PerPeerLimit:     4,
+		FetchTimeout:     10 * time.Second, // chunks are slow to seal under the race detector
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go fetcher.Start()
+	time.Sleep(200 * time.Millisecond)
+
+	outputFile := filepath.Join(tmpDir, "retrieved.bin")
+	if err := fetcher.DownloadFile(meta, keyHex, outputFile, DownloadOptions{}); err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	if got, _ := os.ReadFile(outputFile); !bytes.Equal(got, content) {
+		t.Errorf("Content mismatch")
+	}
+}
+
+func TestSimulatedNetwork(t *testing.T) {
+	tmpDir, _ := os.MkdirTemp("", "nebulafs_sim_test")
+	defer os.RemoveAll(tmpDir)
+
+	net := p2p.NewMemoryNetwork(42)
+	net.Latency = time.Millisecond
+	net.Jitter = time.Millisecond
+
+	const numNodes = 100
+	nodes := []*Node{newMemoryNode(t, net, 7000)}
+	for i := 1; i < numNodes; i++ {
+		nodes = append(nodes, newMemoryNode(t, net, 7000+i, "127.0.0.1:7000"))
+	}
+	time.Sleep(100 * time.Millisecond) // Let PINGs settle
+
+	if got := len(nodes[0].DHT.RoutingTable.FindClosestContacts(nodes[0].DHT.ID, numNodes)); got < 20 {
+		t.Fatalf("Bootstrap node only learned %d contacts", got)
+	}
+
+	inputFile := filepath.Join(tmpDir, "sim.txt")
+	content := []byte("Data replicated across a simulated galaxy")
+	os.WriteFile(inputFile, content, 0644)
+
+	meta, keyHex, err := nodes[17].UploadFile(inputFile, UploadOptions{Replicas: 1})
+	if err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	outputFile := filepath.Join(tmpDir, "sim_out.txt")
+	if err := nodes[83].DownloadFile(meta, keyHex, outputFile, DownloadOptions{}); err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	retrieved, _ := os.ReadFile(outputFile)
+	if string(retrieved) != string(content) {
+		t.Errorf("Content mismatch on simulated node")
+	}
+
+	// A partitioned node can no longer reach the bootstrap node
+	net.Partition([]string{"127.0.0.1:7099"})
+	defer net.Heal()
+	if err := nodes[99].Transport.SendMessage("127.0.0.1:7000", p2p.Message{Type: p2p.MsgDHTPing}); err == nil {
+		t.Errorf("Expected partition to block delivery")
+	}
+}
+
+func TestScrubRepairsCorruptChunk(t *testing.T) {
+	tmpDir, _ := os.MkdirTemp("", "nebulafs_scrub_test")
+	defer os.RemoveAll(tmpDir)
+
+	net := p2p.NewMemoryNetwork(3)
+	newMemoryNode(t, net, 7200) // holds the replica
+	owner := newMemoryNode(t, net, 7201, "127.0.0.1:7200")
+	time.Sleep(20 * time.Millisecond)
+
+	inputFile := filepath.Join(tmpDir, "scrub.txt")
+	os.WriteFile(inputFile, []byte("Bits that will rot"), 0644)
+	meta, _, err := owner.UploadFile(inputFile, UploadOptions{Replicas: 1})
+	if err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	// Flip the stored bytes behind the store's back
+	hash := meta.Chunks[0].Hash
+	chunk, _ := owner.Store.ReadChunk(hash)
+	chunk.Content[0] ^= 0xFF
+	owner.Store.WriteChunk(chunk)
+
+	report := owner.Scrub(0)
+	if report.Checked != 1 || len(report.Corrupt) != 1 {
+		t.Fatalf("Expected 1 corrupt chunk out of 1, got %+v", report)
+	}
+	if report.Corrupt[0].Status != ScrubRepaired {
+		t.Errorf("Expected chunk to be repaired, got %s (%s)", report.Corrupt[0].Status, report.Corrupt[0].Error)
+	}
+	if !owner.Quarantine.HasChunk(hash) {
+		t.Errorf("Corrupt copy was not quarantined")
+	}
+
+	if report := owner.Scrub(0); len(report.Corrupt) != 0 {
+		t.Errorf("Store still corrupt after repair: %+v", report.Corrupt)
+	}
+}
+
+func TestUnlockMasterKey(t *testing.T) {
+	tmpDir, _ := os.MkdirTemp("", "nebulafs_atrest_test")
+	defer os.RemoveAll(tmpDir)
+
+	key, err := UnlockMasterKey(tmpDir, []byte("correct horse"))
+	if err != nil {
+		t.Fatalf("Failed to create master key: %v", err)
+	}
+
+	again, err := UnlockMasterKey(tmpDir, []byte("correct horse"))
+	if err != nil || string(again) != string(key) {
+		t.Fatalf("Failed to unlock master key: %v", err)
+	}
+
+	if _, err := UnlockMasterKey(tmpDir, []byte("battery staple")); err == nil {
+		t.Errorf("Expected wrong passphrase to be rejected")
+	}
+
+	// Keys wrapped under other scrypt parameters unlock with those
+	otherDir := t.TempDir()
+	salt := []byte("0123456789abcdef")
+	kek, _ := crypto.DeriveKeyScrypt([]byte("cheap"), salt, 1<<10, 8, 1)
+	wrapped, _ := crypto.EncryptAES256(key, kek)
+	data, _ := json.Marshal(wrappedMasterKey{KDF: "scrypt", Salt: salt, N: 1 << 10, R: 8, P: 1, Wrapped: wrapped})
+	writeState(otherDir, nil, masterKeyFile, data)
+	if unlocked, err := UnlockMasterKey(otherDir, []byte("cheap")); err != nil || !bytes.Equal(unlocked, key) {
+		t.Errorf("Failed to unlock key wrapped with recorded parameters: %v", err)
+	}
+
+	// State written by an encrypted node is unreadable without the key
+	n, err := NewNode(NodeConfig{Port: 7300, StorageDir: tmpDir, MasterKey: key, Transport: p2p.NewMemoryNetwork(1).NewTransport("127.0.0.1:7300")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.SaveState("probe.json", []byte(`{"secret":true}`))
+	if raw, _ := os.ReadFile(statePath(tmpDir, "probe.json")); bytes.Contains(raw, []byte("secret")) {
+		t.Errorf("State file stored in the clear")
+	}
+	if data, err := n.LoadState("probe.json"); err != nil || string(data) != `{"secret":true}` {
+		t.Errorf("Failed to read back sealed state: %v", err)
+	}
+
+	// A sealed blob that no longer opens is quarantined by the scrubber
+	n.Store.WriteChunk(files.Chunk{Hash: crypto.HashSHA1([]byte("rot")), Content: []byte("rot")})
+	inner := n.Store.(*storage.EncryptedStore).Inner
+	names, _ := inner.ListChunks()
+	blob, _ := inner.ReadChunk(names[0])
+	blob.Content[0] ^= 0xFF
+	inner.WriteChunk(blob)
+	report := n.Scrub(0)
+	if len(report.Corrupt) != 1 || report.Corrupt[0].Status != ScrubLost || report.Healthy() {
+		t.Fatalf("Expected the unreadable blob to be quarantined, got %+v", report)
+	}
+	if inner.HasChunk(names[0]) || !n.Quarantine.HasChunk(report.Corrupt[0].Hash) {
+		t.Errorf("Unreadable blob was not moved to quarantine")
+	}
+}
+
+func TestParallelDownloadFallsBackToNextProvider(t *testing.T) {
+	tmpDir, _ := os.MkdirTemp("", "nebulafs_parallel_test")
+	defer os.RemoveAll(tmpDir)
+
+	net := p2p.NewMemoryNetwork(5)
+	net.Latency = time.Millisecond
+	holder1 := newMemoryNode(t, net, 7400)
+	newMemoryNode(t, net, 7401, "127.0.0.1:7400")
+	uploader := newMemoryNode(t, net, 7402, "127.0.0.1:7400", "127.0.0.1:7401")
+	time.Sleep(20 * time.Millisecond)
+
+	// Several chunks so the worker pool and reorder buffer get exercised
+	content := make([]byte, 3*1024*1024+12345)
+	rand.Read(content)
+	inputFile := filepath.Join(tmpDir, "big.bin")
+	os.WriteFile(inputFile, content, 0644)
+
+	meta, keyHex, err := uploader.UploadFile(inputFile, UploadOptions{Replicas: 2})
+	if err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	downloader := newMemoryNode(t, net, 7403, "127.0.0.1:7400", "127.0.0.1:7401")
+	time.Sleep(20 * time.Millisecond)
+
+	// One provider disappears; every chunk must come from the other
+	holder1.Transport.Close()
+
+	outputFile := filepath.Join(tmpDir, "big_out.bin")
+	if err := downloader.DownloadFile(meta, keyHex, outputFile, DownloadOptions{}); err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	retrieved, _ := os.ReadFile(outputFile)
+	if !bytes.Equal(retrieved, content) {
+		t.Errorf("Content mismatch after parallel download")
+	}
+}
+
+func TestUploadRequiresConfirmedReplicas(t *testing.T) {
+	tmpDir, _ := os.MkdirTemp("", "nebulafs_replicas_test")
+	defer os.RemoveAll(tmpDir)
+
+	net := p2p.NewMemoryNetwork(9)
+	gone := newMemoryNode(t, net, 7500)
+	peer := newMemoryNode(t, net, 7501)
+	uploader := newMemoryNode(t, net, 7502, "127.0.0.1:7500", "127.0.0.1:7501")
+	time.Sleep(20 * time.Millisecond)
+	gone.Transport.Close()
+
+	inputFile := filepath.Join(tmpDir, "replicated.txt")
+	os.WriteFile(inputFile, []byte("Needs two copies"), 0644)
+
+	// Only one live peer: two replicas can't be met
+	meta, _, err := uploader.UploadFile(inputFile, UploadOptions{Replicas: 2})
+	replErr, ok := err.(*ReplicationError)
+	if !ok {
+		t.Fatalf("Expected a ReplicationError, got %v", err)
+	}
+	if len(replErr.Short) != len(meta.Chunks) || len(replErr.Short[0].Peers) != 1 {
+		t.Errorf("Unexpected shortfall report: %+v", replErr.Short)
+	}
+
+	// The live peer acknowledged, so one replica succeeds
+	meta, _, err = uploader.UploadFile(inputFile, UploadOptions{Replicas: 1})
+	if err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+	if !peer.Store.HasChunk(meta.Chunks[0].Hash) {
+		t.Errorf("Acknowledged peer does not hold the chunk")
+	}
+}
+
+func TestRepairRestoresReplicaCount(t *testing.T) {
+	tmpDir, _ := os.MkdirTemp("", "nebulafs_repair_test")
+	defer os.RemoveAll(tmpDir)
+
+	// Small full mesh so every node knows every other
+	net := p2p.NewMemoryNetwork(11)
+	var nodes []*Node
+	var addrs []string
+	for i := 0; i < 5; i++ {
+		nodes = append(nodes, newMemoryNode(t, net, 7600+i, addrs...))
+		addrs = append(addrs, fmt.Sprintf("127.0.0.1:%d", 7600+i))
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, n := range nodes {
+		n.Config.RepairReplicas = 2
+		n.Config.AckTimeout = 100 * time.Millisecond
+	}
+
+	inputFile := filepath.Join(tmpDir, "precious.txt")
+	os.WriteFile(inputFile, []byte("Must survive churn"), 0644)
+	meta, _, err := nodes[0].UploadFile(inputFile, UploadOptions{Replicas: 2})
+	if err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+	hash := meta.Chunks[0].Hash
+
+	holders := func() []*Node {
+		var out []*Node
+		for _, n := range nodes[1:] {
+			if n.Store.HasChunk(hash) {
+				out = append(out, n)
+			}
+		}
+		return out
+	}
+
+	// One replica holder leaves the network
+	lost := holders()[0]
+	lost.Transport.Close()
+	lost.Store.DeleteChunk(hash)
+
+	repaired := 0
+	for _, n := range nodes {
+		if n != lost {
+			repaired += n.Repair().NewReplicas
+		}
+	}
+	if repaired == 0 {
+		t.Fatal("No node repaired the chunk")
+	}
+	if got := len(holders()); got < 2 {
+		t.Errorf("Expected at least 2 peers holding the chunk after repair, got %d", got)
+	}
+}
+
+func TestResumeTransfers(t *testing.T) {
+	tmpDir, _ := os.MkdirTemp("", "nebulafs_resume_test")
+	defer os.RemoveAll(tmpDir)
+
+	net := p2p.NewMemoryNetwork(13)
+	plain := newMemoryNode(t, net, 7700)
+	masterKey := make([]byte, 32)
+	rand.Read(masterKey)
+	n, err := NewNode(NodeConfig{
+		Port:           7701,
+		BootstrapPeers: []string{"127.0.0.1:7700"},
+		StorageDir:     filepath.Join(tmpDir, "node"),
+		Store:          storage.NewMemoryStore(),
+		Transport:      net.NewTransport("127.0.0.1:7701"),
+		AckTimeout:     time.Second, // generous enough for the race detector
+		MasterKey:      masterKey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go n.Start()
+	time.Sleep(20 * time.Millisecond)
+
+	content := make([]byte, 2*1024*1024+777)
+	rand.Read(content)
+	inputFile := filepath.Join(tmpDir, "resume.bin")
+	os.WriteFile(inputFile, content, 0644)
+
+	// The journal holds the file key, so only sealed state may keep one
+	if _, _, err := plain.UploadFile(inputFile, UploadOptions{Resume: true}); err != ErrResumeNeedsEncryption {
+		t.Errorf("Expected resuming without encryption at rest to be refused, got %v", err)
+	}
+
+	// Upload: only one peer, so the first attempt stops short
+	meta, keyHex, err := n.UploadFile(inputFile, UploadOptions{Replicas: 2})
+	if _, ok := err.(*ReplicationError); !ok {
+		t.Fatalf("Expected a ReplicationError, got %v", err)
+	}
+	journals, _ := filepath.Glob(filepath.Join(tmpDir, "node", stateDirName, "journal", "upload-*"))
+	if len(journals) != 1 {
+		t.Fatalf("Expected the short upload to be journaled, got %v", journals)
+	}
+	if raw, _ := os.ReadFile(journals[0]); bytes.Contains(raw, []byte(keyHex)) {
+		t.Errorf("Upload journal holds the file key in the clear")
+	}
+	newMemoryNode(t, net, 7702, "127.0.0.1:7701")
+	time.Sleep(20 * time.Millisecond)
+
+	resumed, resumedKey, err := n.UploadFile(inputFile, UploadOptions{Replicas: 2, Resume: true})
+	if err != nil {
+		t.Fatalf("Resumed upload failed: %v", err)
+	}
+	if resumed.ID != meta.ID || resumedKey != keyHex || resumed.Chunks[0].Hash != meta.Chunks[0].Hash {
+		t.Errorf("Resumed upload did not reuse the journaled chunks and key")
+	}
+
+	// Download: chunk 1 is unavailable, so only chunk 0 is written
+	missing, _ := n.Store.ReadChunk(meta.Chunks[1].Hash)
+	n.Store.DeleteChunk(missing.Hash)
+	n.Config.FetchTimeout = 50 * time.Millisecond
+	n.Config.FetchParallelism = 1 // chunk 0 must be emitted before chunk 1 fails
+	for _, peer := range n.DHT.RoutingTable.FindClosestContacts(n.DHT.ID, 10) {
+		n.DHT.RemoveNode(peer.Address)
+	}
+
+	outputFile := filepath.Join(tmpDir, "resume_out.bin")
+	if err := n.DownloadFile(meta, keyHex, outputFile, DownloadOptions{}); err == nil {
+		t.Fatal("Expected download to fail with a chunk missing")
+	}
+	if _, err := os.Stat(outputFile); !os.IsNotExist(err) {
+		t.Errorf("Output file exists before the download completed")
+	}
+	if info, err := os.Stat(outputFile + ".part"); err != nil || info.Size() != files.ChunkSize {
+		t.Fatalf("Expected one chunk in the partial file: %v", err)
+	}
+
+	// With chunk 0 gone, resuming can only succeed by skipping it
+	n.Store.WriteChunk(missing)
+	n.Store.DeleteChunk(meta.Chunks[0].Hash)
+	if err := n.DownloadFile(meta, keyHex, outputFile, DownloadOptions{Resume: true}); err != nil {
+		t.Fatalf("Resumed download failed: %v", err)
+	}
+	retrieved, _ := os.ReadFile(outputFile)
+	if !bytes.Equal(retrieved, content) {
+		t.Errorf("Content mismatch after resumed download")
+	}
+	if entries, _ := os.ReadDir(filepath.Join(tmpDir, "node", stateDirName, "journal")); len(entries) != 0 {
+		t.Errorf("Journals left behind after completed transfers: %d", len(entries))
+	}
+}
+
+func TestSignedRecords(t *testing.T) {
+	tmpDir, _ := os.MkdirTemp("", "nebulafs_records_test")
+	defer os.RemoveAll(tmpDir)
+
+	net := p2p.NewMemoryNetwork(17)
+	newMemoryNode(t, net, 7900)
+	newMemoryNode(t, net, 7901, "127.0.0.1:7900")
+	// The publisher keeps records.json, so it can republish from it
+	publisher, err := NewNode(NodeConfig{
+		Port:           7902,
+		BootstrapPeers: []string{"127.0.0.1:7900", "127.0.0.1:7901"},
+		StorageDir:     filepath.Join(tmpDir, "publisher"),
+		Store:          storage.NewMemoryStore(),
+		Transport:      net.NewTransport("127.0.0.1:7902"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go publisher.Start()
+	resolver := newMemoryNode(t, net, 7903, "127.0.0.1:7900", "127.0.0.1:7901")
+	time.Sleep(20 * time.Millisecond)
+
+	var roots []string
+	for i, content := range []string{"report v1", "report v2"} {
+		path := filepath.Join(tmpDir, fmt.Sprintf("report%d.txt", i))
+		os.WriteFile(path, []byte(content), 0644)
+		result, err := publisher.Add(path, UploadOptions{Replicas: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		roots = append(roots, result.Root)
+	}
+
+	first, err := publisher.Publish(roots[0], "")
+	if err != nil || first.Record.Seq != 1 || first.Peers != 2 {
+		t.Fatalf("Publish: %+v %v", first, err)
+	}
+	second, err := publisher.Publish(roots[1], "")
+	if err != nil || second.Record.Seq != 2 || second.Record.Name != first.Record.Name {
+		t.Fatalf("Republish: %+v %v", second, err)
+	}
+
+	record, err := resolver.Resolve(first.Record.Name)
+	if err != nil || record.Root != roots[1] || record.Seq != 2 {
+		t.Errorf("Resolve returned %+v (%v), want root %s", record, err, roots[1])
+	}
+
+	// A replayed older record and a forged one are both refused
+	if err := resolver.acceptRecord(first.Record, ""); err == nil {
+		t.Errorf("Stale record accepted")
+	}
+	forged := second.Record
+	forged.Seq = 3
+	forged.Root = roots[0]
+	if err := resolver.acceptRecord(forged, ""); err == nil {
+		t.Errorf("Forged record accepted")
+	}
+
+	if _, err := resolver.Resolve(RecordName(forged.PublicKey, "other")); err != ErrRecordNotFound {
+		t.Errorf("Expected ErrRecordNotFound, got %v", err)
+	}
+
+	// A peer can only have so many records held, the oldest record makes
+	// way when the table is full, and records not stored again expire
+	signed := func() Record {
+		pub, key, _ := ed25519.GenerateKey(nil)
+		rec := Record{Name: RecordName(pub, DefaultLabel), PublicKey: pub, Label: DefaultLabel, Root: roots[0], Seq: 1}
+		rec.Signature = ed25519.Sign(key, rec.signedBytes())
+		return rec
+	}
+	holder := newMemoryNode(t, net, 7904)
+	holder.records.perPeer, holder.records.max = 2, 3
+	evicted := signed()
+	for _, rec := range []Record{evicted, signed()} {
+		if err := holder.acceptRecord(rec, "10.0.0.1:4000"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := holder.acceptRecord(signed(), "10.0.0.1:4000"); err == nil {
+		t.Errorf("Record over the per-peer limit accepted")
+	}
+	for i := 0; i < 2; i++ {
+		if err := holder.acceptRecord(signed(), "10.0.0.2:4000"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := holder.localRecord(evicted.Name); ok || len(holder.DHT.Storage) != 3 {
+		t.Errorf("Holding %d records, oldest kept %v; want 3 without the oldest", len(holder.DHT.Storage), ok)
+	}
+	if expired := holder.expireRecords(time.Now().Add(recordTTL + time.Minute)); expired != 3 {
+		t.Errorf("Expired %d records, want 3", expired)
+	}
+
+	// The publisher stores its own records again from records.json
+	publisher.expireRecords(time.Now().Add(recordTTL + time.Minute))
+	publisher.republish()
+	if _, ok := publisher.localRecord(second.Record.Name); !ok {
+		t.Errorf("Published record not restored by republish")
+	}
+}
+
+func TestVersionHistory(t *testing.T) {
+	tmpDir, _ := os.MkdirTemp("", "nebulafs_versions_test")
+	defer os.RemoveAll(tmpDir)
+
+	net := p2p.NewMemoryNetwork(19)
+	plain := newMemoryNode(t, net, 8000)
+	masterKey := make([]byte, 32)
+	rand.Read(masterKey)
+	n, err := NewNode(NodeConfig{
+		Port:           8001,
+		BootstrapPeers: []string{"127.0.0.1:8000"},
+		StorageDir:     filepath.Join(tmpDir, "node"),
+		Store:          storage.NewMemoryStore(),
+		Transport:      net.NewTransport("127.0.0.1:8001"),
+		MasterKey:      masterKey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go n.Start()
+	time.Sleep(20 * time.Millisecond)
+
+	// Two chunks; the second version only changes the tail
+	v1 := make([]byte, files.ChunkSize+100)
+	rand.Read(v1)
+	v2 := append(append([]byte{}, v1[:files.ChunkSize]...), "new tail"...)
+
+	path := filepath.Join(tmpDir, "doc.bin")
+
+	// The history holds file keys, so only sealed state may keep one
+	os.WriteFile(path, v1, 0644)
+	if _, err := plain.AddVersion(path, "docs/doc.bin", UploadOptions{}); err != ErrVersionsNeedEncryption {
+		t.Errorf("Expected a versioned upload without encryption at rest to be refused, got %v", err)
+	}
+
+	var results []AddResult
+	for _, content := range [][]byte{v1, v2} {
+		os.WriteFile(path, content, 0644)
+		result, err := n.AddVersion(path, "docs/doc.bin", UploadOptions{Replicas: 1, Convergent: true})
+		if err != nil {
+			t.Fatalf("AddVersion failed: %v", err)
+		}
+		results = append(results, result)
+	}
+
+	if results[1].Version != 2 || results[1].Metadata.Parent != results[0].Root {
+		t.Errorf("Second version not linked to the first: %+v", results[1])
+	}
+	if results[1].Key != results[0].Key || results[1].Metadata.Chunks[0].Hash != results[0].Metadata.Chunks[0].Hash {
+		t.Errorf("Unchanged chunk was not reused")
+	}
+
+	history, err := n.History("docs/doc.bin")
+	if err != nil || len(history) != 2 || history[1].Reused != 1 || history[1].Chunks != 2 {
+		t.Fatalf("Unexpected history %+v (%v)", history, err)
+	}
+	if _, err := n.History("other"); err != ErrNoHistory {
+		t.Errorf("Expected ErrNoHistory, got %v", err)
+	}
+
+	// Every version stays retrievable
+	for i, want := range [][]byte{v1, v2} {
+		out := filepath.Join(tmpDir, fmt.Sprintf("v%d.bin", i+1))
+		if err := n.Get(history[i].Root, history[i].Key, out, DownloadOptions{}); err != nil {
+			t.Fatalf("Get v%d failed: %v", i+1, err)
+		}
+		if got, _ := os.ReadFile(out); !bytes.Equal(got, want) {
+			t.Errorf("Version %d content mismatch", i+1)
+		}
+	}
+}
+
+func TestShareWithRecipients(t *testing.T) {
+	tmpDir, _ := os.MkdirTemp("", "nebulafs_share_test")
+	defer os.RemoveAll(tmpDir)
+
+	net := p2p.NewMemoryNetwork(23)
+	owner := newMemoryNode(t, net, 8100)
+	bob := newMemoryNode(t, net, 8101, "127.0.0.1:8100")
+	carol := newMemoryNode(t, net, 8102, "127.0.0.1:8100")
+	time.Sleep(20 * time.Millisecond)
+
+	recipient := func(n *Node) string {
+		return n.Stats().RecipientKey
+	}
+
+	path := filepath.Join(tmpDir, "shared.txt")
+	os.WriteFile(path, []byte("for bob's eyes"), 0644)
+	result, err := owner.Add(path, UploadOptions{Replicas: 1, Recipients: []string{recipient(bob)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(n *Node, root string) error {
+		return n.Get(root, "", filepath.Join(tmpDir, fmt.Sprintf("out_%d.txt", n.Config.Port)), DownloadOptions{})
+	}
+	if err := get(bob, result.Root); err != nil {
+		t.Fatalf("Recipient could not download without a key: %v", err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(tmpDir, "out_8101.txt")); string(got) != "for bob's eyes" {
+		t.Errorf("Recipient got %q", got)
+	}
+	if err := get(carol, result.Root); err == nil {
+		t.Errorf("Non-recipient downloaded without a key")
+	}
+
+	// The owner was added as a recipient, so it can reshare without the raw key
+	shared, err := owner.Share(result.Root, "", []string{recipient(carol)}, []string{recipient(bob)}, 1)
+	if err != nil {
+		t.Fatalf("Share failed: %v", err)
+	}
+	if err := get(carol, shared); err != nil {
+		t.Errorf("New recipient could not download: %v", err)
+	}
+	if err := get(bob, shared); err == nil {
+		t.Errorf("Revoked recipient can still unwrap the new manifest")
+	}
+
+	// Revoking a malformed key or one that isn't a recipient fails, as
+	// does sharing under a key that doesn't open the file
+	for _, revoke := range []string{"not-a-key", recipient(bob)} {
+		if _, err := owner.Share(shared, "", nil, []string{revoke}, 1); err == nil {
+			t.Errorf("Revoking %q succeeded", revoke)
+		}
+	}
+	if _, err := owner.Share(shared, strings.Repeat("ab", 32), []string{recipient(bob)}, nil, 1); err == nil {
+		t.Errorf("Shared under a wrong key")
+	}
+}
+
+func TestSealedPaddedManifest(t *testing.T) {
+	tmpDir, _ := os.MkdirTemp("", "nebulafs_sealed_test")
+	defer os.RemoveAll(tmpDir)
+
+	n := newMemoryNode(t, p2p.NewMemoryNetwork(29), 8200)
+
+	path := filepath.Join(tmpDir, "quarterly-report.pdf")
+	content := make([]byte, files.ChunkSize+1000)
+	rand.Read(content)
+	os.WriteFile(path, content, 0644)
+
+	result, err := n.Add(path, UploadOptions{Pad: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, _ := n.Store.ReadChunk(result.Root)
+	if bytes.Contains(manifest.Content, []byte("quarterly")) || bytes.Contains(manifest.Content, []byte(`"size":`+fmt.Sprint(len(content)))) {
+		t.Errorf("Manifest leaks name or size: %s", manifest.Content)
+	}
+
+	meta, err := n.GetManifest(result.Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := meta.Chunks[len(meta.Chunks)-1]; last.Size != files.PaddedSize(1000)+meta.Cipher.Overhead() {
+		t.Errorf("Last chunk is %d bytes, expected padding", last.Size)
+	}
+
+	out := filepath.Join(tmpDir, "out.pdf")
+	if err := n.Get(result.Root, result.Key, out, DownloadOptions{}); err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	if got, _ := os.ReadFile(out); !bytes.Equal(got, content) {
+		t.Errorf("Downloaded %d bytes, want %d", len(got), len(content))
+	}
+
+	reader, err := n.OpenFile(meta, result.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reader.Metadata().Name != "quarterly-report.pdf" || reader.Size() != int64(len(content)) {
+		t.Errorf("Unsealed metadata %q, %d bytes", reader.Metadata().Name, reader.Size())
+	}
+	reader.Seek(-10, io.SeekEnd)
+	if tail, _ := io.ReadAll(reader); !bytes.Equal(tail, content[len(content)-10:]) {
+		t.Errorf("Reader returned padding past the end")
+	}
+
+	if _, err := n.OpenFile(meta, strings.Repeat("00", 32)); err != files.ErrWrongKey {
+		t.Errorf("Expected ErrWrongKey, got %v", err)
+	}
+}
+
+func TestRekey(t *testing.T) {
+	tmpDir, _ := os.MkdirTemp("", "nebulafs_rekey_test")
+	defer os.RemoveAll(tmpDir)
+
+	net := p2p.NewMemoryNetwork(31)
+	owner := newMemoryNode(t, net, 8300)
+	peer := newMemoryNode(t, net, 8301, "127.0.0.1:8300")
+	peer.Config.AcceptDeletes = true
+	time.Sleep(20 * time.Millisecond)
+
+	path := filepath.Join(tmpDir, "leaked.txt")
+	os.WriteFile(path, []byte("rotate me"), 0644)
+	old, err := owner.Add(path, UploadOptions{Replicas: 1, Pad: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldMeta, _ := owner.GetManifest(old.Root)
+
+	result, err := owner.Rekey(old.Root, old.Key, RekeyOptions{Replicas: 1, Delete: true})
+	if err != nil {
+		t.Fatalf("Rekey failed: %v", err)
+	}
+	if result.Key == old.Key || result.Root == old.Root {
+		t.Fatalf("Rekey kept the old key or root")
+	}
+	if result.Deleted == 0 || result.Requested == 0 {
+		t.Errorf("Expected deletes, got %+v", result)
+	}
+
+	out := filepath.Join(tmpDir, "out.txt")
+	if err := peer.Get(result.Root, result.Key, out, DownloadOptions{}); err != nil {
+		t.Fatalf("Download of new root failed: %v", err)
+	}
+	if got, _ := os.ReadFile(out); string(got) != "rotate me" {
+		t.Errorf("Got %q", got)
+	}
+	meta, _ := owner.GetManifest(result.Root)
+	if !padded(meta) {
+		t.Errorf("Rekeyed file lost its padding")
+	}
+	if _, err := owner.OpenFile(meta, old.Key); err == nil {
+		t.Errorf("Old key opens the new manifest")
+	}
+
+	for _, p := range owner.Pins() {
+		if p.Root == old.Root {
+			t.Errorf("Old root still pinned")
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	for _, c := range oldMeta.Chunks {
+		if owner.Store.HasChunk(c.Hash) || peer.Store.HasChunk(c.Hash) {
+			t.Errorf("Old chunk %s still stored", shortHash(c.Hash))
+		}
+	}
+}
+
+func TestSignedManifestTrust(t *testing.T) {
+	tmpDir, _ := os.MkdirTemp("", "nebulafs_trust_test")
+	defer os.RemoveAll(tmpDir)
+
+	net := p2p.NewMemoryNetwork(37)
+	alice := newMemoryNode(t, net, 8400)
+	mallory := newMemoryNode(t, net, 8401)
+
+	path := filepath.Join(tmpDir, "signed.txt")
+	os.WriteFile(path, []byte("from alice"), 0644)
+	meta, keyHex, err := alice.UploadFile(path, UploadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := meta.VerifySignature(); err != nil {
+		t.Fatalf("Upload not signed: %v", err)
+	}
+
+	out := filepath.Join(tmpDir, "out.txt")
+	trustAlice := DownloadOptions{Trust: []string{alice.Stats().PublisherKey}}
+	if err := alice.DownloadFile(meta, keyHex, out, trustAlice); err != nil {
+		t.Fatalf("Trusted download failed: %v", err)
+	}
+
+	// An edited chunk list breaks the signature
+	tampered := meta.StripContent()
+	tampered.Chunks[0].Hash = strings.Repeat("0", 40)
+	if err := alice.DownloadFile(tampered, keyHex, out, DownloadOptions{}); err != files.ErrBadSignature {
+		t.Errorf("Expected ErrBadSignature, got %v", err)
+	}
+
+	// Re-signing by someone else is valid but not trusted
+	mallory.signManifest(&tampered)
+	if err := alice.DownloadFile(tampered, keyHex, out, trustAlice); !errors.Is(err, ErrUntrusted) {
+		t.Errorf("Expected ErrUntrusted, got %v", err)
+	}
+	unsigned := meta.StripContent()
+	unsigned.Signature = nil
+	if err := alice.DownloadFile(unsigned, keyHex, out, trustAlice); !errors.Is(err, ErrUntrusted) {
+		t.Errorf("Unsigned manifest accepted with a trust list: %v", err)
+	}
+}
+
+func TestXChaChaUpload(t *testing.T) {
+	tmpDir, _ := os.MkdirTemp("", "nebulafs_xchacha_test")
+	defer os.RemoveAll(tmpDir)
+
+	n := newMemoryNode(t, p2p.NewMemoryNetwork(41), 8500)
+	n.Config.Cipher = crypto.SuiteXChaCha20Poly1305
+
+	path := filepath.Join(tmpDir, "chacha.bin")
+	content := make([]byte, files.ChunkSize+77)
+	rand.Read(content)
+	os.WriteFile(path, content, 0644)
+
+	result, err := n.Add(path, UploadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, _ := n.GetManifest(result.Root)
+	if meta.Cipher != crypto.SuiteXChaCha20Poly1305 {
+		t.Errorf("Manifest records cipher %v", meta.Cipher)
+	}
+
+	out := filepath.Join(tmpDir, "out.bin")
+	if err := n.Get(result.Root, result.Key, out, DownloadOptions{}); err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	if got, _ := os.ReadFile(out); !bytes.Equal(got, content) {
+		t.Errorf("Content mismatch")
+	}
+	reader, err := n.OpenFile(meta, result.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := io.ReadAll(reader); !bytes.Equal(got, content) {
+		t.Errorf("Reader content mismatch")
+	}
+}
+
+func TestAuditReplacesDishonestHolder(t *testing.T) {
+	tmpDir, _ := os.MkdirTemp("", "nebulafs_audit_test")
+	defer os.RemoveAll(tmpDir)
+
+	net := p2p.NewMemoryNetwork(23)
+	var nodes []*Node
+	var addrs []string
+	for i := 0; i < 5; i++ {
+		nodes = append(nodes, newMemoryNode(t, net, 7900+i, addrs...))
+		addrs = append(addrs, fmt.Sprintf("127.0.0.1:%d", 7900+i))
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, n := range nodes {
+		n.Config.AckTimeout = 100 * time.Millisecond
+		n.Config.FetchTimeout = 200 * time.Millisecond
+	}
+
+	inputFile := filepath.Join(tmpDir, "kept.txt")
+	os.WriteFile(inputFile, []byte("Acknowledged and then thrown away"), 0644)
+	meta, _, err := nodes[0].UploadFile(inputFile, UploadOptions{Replicas: 2})
+	if err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+	hash := meta.Chunks[0].Hash
+
+	if report := nodes[0].Audit(); report.Failed != 0 || report.Passed < 2 {
+		t.Fatalf("Expected every holder to pass, got %+v", report)
+	}
+
+	// A holder that acknowledged the chunk silently drops it
+	var cheat *Node
+	for _, n := range nodes[1:] {
+		if n.Store.HasChunk(hash) {
+			cheat = n
+			break
+		}
+	}
+	cheat.Store.DeleteChunk(hash)
+	cheatAddr := fmt.Sprintf("127.0.0.1:%d", cheat.Config.Port)
+
+	report := nodes[0].Audit()
+	if report.Failed != 1 || report.Repaired != 1 {
+		t.Fatalf("Expected one failure repaired, got %+v", report)
+	}
+	if report.Peers[0].Address != cheatAddr || report.Peers[0].Failed != 1 {
+		t.Errorf("Expected %s recorded as failed, got %+v", cheatAddr, report.Peers)
+	}
+	// Admitting the chunk is gone is an audit failure, not corruption
+	for _, p := range nodes[0].Reputation() {
+		if p.Address == cheatAddr && p.Corrupt != 0 {
+			t.Errorf("Expected a missing chunk not to count as corrupt, got %+v", p)
+		}
+	}
+
+	holders := 0
+	for _, n := range nodes[1:] {
+		if n.Store.HasChunk(hash) {
+			holders++
+		}
+	}
+	if holders < 2 {
+		t.Errorf("Expected 2 holders after repair, got %d", holders)
+	}
+
+	// The failed holder is no longer challenged for the chunk
+	if report := nodes[0].Audit(); report.Failed != 0 {
+		t.Errorf("Expected a clean audit after repair, got %+v", report)
+	}
+}
+
+func TestReputationBansMisbehavingPeer(t *testing.T) {
+	net := p2p.NewMemoryNetwork(29)
+	victim := newMemoryNode(t, net, 7950)
+	victim.reputation = newReputation(NodeConfig{BanThreshold: 8, BanDuration: 200 * time.Millisecond, MessageRate: 20})
+	attacker := newMemoryNode(t, net, 7951, "127.0.0.1:7950")
+	honest := newMemoryNode(t, net, 7952, "127.0.0.1:7950")
+	time.Sleep(50 * time.Millisecond)
+	attackerAddr, honestAddr := "127.0.0.1:7951", "127.0.0.1:7952"
+
+	// Two chunks that don't match their hash cross the ban threshold
+	payload, _ := json.Marshal(files.Chunk{Hash: strings.Repeat("ab", 20), Content: []byte("not it")})
+	for i := 0; i < 2; i++ {
+		attacker.Transport.SendMessage("127.0.0.1:7950", p2p.Message{
+			Type:    p2p.MsgStoreChunk,
+			Sender:  attacker.DHT.ID.Hex(),
+			Payload: payload,
+		})
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	if !victim.reputation.banned(attackerAddr) {
+		t.Fatalf("Expected %s to be banned, got %+v", attackerAddr, victim.Reputation())
+	}
+	for _, c := range victim.Peers() {
+		if c.Address == attackerAddr {
+			t.Error("Banned peer still in the routing table")
+		}
+	}
+	if got := victim.PeerScore(honestAddr); got != 1 {
+		t.Errorf("Expected a clean score for the honest peer, got %v", got)
+	}
+
+	// Messages from a banned peer are dropped, so it can't rejoin
+	attacker.Transport.SendMessage("127.0.0.1:7950", p2p.Message{Type: p2p.MsgDHTPing, Sender: attacker.DHT.ID.Hex()})
+	time.Sleep(50 * time.Millisecond)
+	for _, c := range victim.Peers() {
+		if c.Address == attackerAddr {
+			t.Error("Banned peer rejoined the routing table")
+		}
+	}
+
+	// The ban wears off
+	time.Sleep(200 * time.Millisecond)
+	if victim.reputation.banned(attackerAddr) {
+		t.Error("Expected the ban to expire")
+	}
+
+	// An honest peer that floods is throttled and penalised
+	for i := 0; i < 100; i++ {
+		honest.Transport.SendMessage("127.0.0.1:7950", p2p.Message{Type: p2p.MsgDHTPing, Sender: honest.DHT.ID.Hex()})
+	}
+	time.Sleep(100 * time.Millisecond)
+	var flooded int
+	for _, p := range victim.Reputation() {
+		if p.Address == honestAddr {
+			flooded = p.Flooded
+		}
+	}
+	if flooded == 0 || victim.PeerScore(honestAddr) >= 1 {
+		t.Errorf("Expected dropped messages and a lower score for the flooding peer, got %d dropped", flooded)
+	}
+
+	// Records of idle peers expire
+	r := victim.reputation
+	r.mutex.Lock()
+	r.expiry = 10 * time.Millisecond
+	r.mutex.Unlock()
+	time.Sleep(20 * time.Millisecond)
+	r.record("127.0.0.1:7953", eventSuccess)
+	if list := victim.Reputation(); len(list) != 1 || list[0].Address != "127.0.0.1:7953" {
+		t.Errorf("Expected only the latest peer to be kept, got %+v", list)
+	}
+}
+
+func TestReputationBanSurvivesReconnect(t *testing.T) {
+	net := p2p.NewMemoryNetwork(31)
+	victim := newMemoryNode(t, net, 7960)
+	victim.reputation = newReputation(NodeConfig{BanThreshold: 8, BanDuration: time.Minute})
+	time.Sleep(20 * time.Millisecond)
+
+	// One remote host connecting from ever new ports, as inbound websocket
+	// peers appear under their ephemeral remote address
+	connect := func(addr string) p2p.Transport {
+		tr := net.NewTransport(addr)
+		tr.Listen("")
+		return tr
+	}
+	first := connect("10.0.0.5:40001")
+	first.SendMessage("127.0.0.1:7960", p2p.Message{Type: p2p.MsgDHTPing, Sender: dht.NewID("10.0.0.5:40001").Hex()})
+	time.Sleep(20 * time.Millisecond)
+
+	second := connect("10.0.0.5:40002")
+	payload, _ := json.Marshal(files.Chunk{Hash: strings.Repeat("ab", 20), Content: []byte("not it")})
+	for i := 0; i < 2; i++ {
+		second.SendMessage("127.0.0.1:7960", p2p.Message{Type: p2p.MsgStoreChunk, Sender: dht.NewID("10.0.0.5:40002").Hex(), Payload: payload})
+	}
+	time.Sleep(20 * time.Millisecond)
+	if !victim.reputation.banned("10.0.0.5:40002") {
+		t.Fatalf("Expected the host to be banned, got %+v", victim.Reputation())
+	}
+
+	// The ban covers the host's earlier connection and any new one
+	third := connect("10.0.0.5:40003")
+	third.SendMessage("127.0.0.1:7960", p2p.Message{Type: p2p.MsgDHTPing, Sender: dht.NewID("10.0.0.5:40003").Hex()})
+	time.Sleep(20 * time.Millisecond)
+	if !victim.reputation.banned("10.0.0.5:40003") {
+		t.Error("Reconnecting from a new port lifted the ban")
+	}
+	for _, c := range victim.Peers() {
+		if strings.HasPrefix(c.Address, "10.0.0.5:") {
+			t.Errorf("Banned host still in the routing table as %s", c.Address)
+		}
+	}
+	if list := victim.Reputation(); len(list) != 1 || list[0].Address != "10.0.0.5" {
+		t.Errorf("Expected one record for the host, got %+v", list)
+	}
+}
+
+func TestPackBackendBatchesAndCompacts(t *testing.T) {
+	tmpDir := t.TempDir()
+	n, err := NewNode(NodeConfig{
+		Port:         7350,
+		StorageDir:   tmpDir,
+		StoreBackend: "pack",
+		Transport:    p2p.NewMemoryNetwork(1).NewTransport("127.0.0.1:7350"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := make([]byte, 3*1024*1024)
+	rand.Read(content)
+	inputFile := filepath.Join(tmpDir, "packed.bin")
+	os.WriteFile(inputFile, content, 0644)
+	meta, _, err := n.UploadFile(inputFile, UploadOptions{})
+	if err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+	var hashes []string
+	for _, c := range meta.Chunks {
+		if !n.Store.HasChunk(c.Hash) {
+			t.Fatalf("Chunk %s missing from the pack", shortHash(c.Hash))
+		}
+		hashes = append(hashes, c.Hash)
+	}
+
+	// Dropping every chunk leaves the pack dead, so it gets compacted
+	if deleted, _ := n.dropChunks(hashes); deleted != len(hashes) {
+		t.Fatalf("Expected %d chunks deleted, got %d", len(hashes), deleted)
+	}
+	if n.pack.NeedsCompaction() {
+		t.Errorf("Pack not compacted after dropping every chunk")
+	}
+	if info, _ := os.Stat(filepath.Join(tmpDir, "chunks.pack")); info.Size() >= int64(len(content)) {
+		t.Errorf("Pack still holds %d bytes", info.Size())
+	}
+	if err := n.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+}
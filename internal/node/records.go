@@ -0,0 +1,451 @@
+package node
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/tanmaydeobhankar/nebulafs/internal/dht"
+	"github.com/tanmaydeobhankar/nebulafs/internal/p2p"
+)
+
+// DefaultLabel names the record published when no label is given
+const DefaultLabel = "default"
+
+const publishedFile = "records.json"
+
+// Bounds on the records held for other publishers. A record expires unless
+// its publisher stores it again, which it does every republish interval.
+const (
+	maxRecords        = 10000 // records held in total, the oldest evicted first
+	maxRecordsPerPeer = 100   // records one peer may have us hold
+	recordTTL         = 24 * time.Hour
+	republishInterval = time.Hour
+)
+
+// ErrRecordNotFound is returned by Resolve when no peer holds a valid record
+var ErrRecordNotFound = errors.New("no valid record found")
+
+// Record is a signed, mutable pointer to a manifest root. Its name is
+// derived from the publisher's key and a label, so only the holder of the
+// key can update it; of several valid records for a name the one with the
+// highest sequence number wins.
+type Record struct {
+	Name      string `json:"name"`
+	PublicKey []byte `json:"public_key"`
+	Label     string `json:"label"`
+	Root      string `json:"root"`
+	Seq       uint64 `json:"seq"`
+	Signature []byte `json:"signature"`
+}
+
+// PublishResult reports a published record and how many peers stored it
+type PublishResult struct {
+	Record Record `json:"record"`
+	Peers  int    `json:"peers"`
+}
+
+// RecordName derives the name of the record published under label with
+// public key pub: the hex SHA-1 of the key and the label
+func RecordName(pub ed25519.PublicKey, label string) string {
+	h := sha1.New()
+	h.Write(pub)
+	h.Write([]byte(label))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// signedBytes is what the signature covers
+func (r Record) signedBytes() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("nebulafs record\x00")
+	buf.WriteString(r.Name)
+	buf.WriteByte(0)
+	buf.WriteString(r.Root)
+	binary.Write(&buf, binary.BigEndian, r.Seq)
+	return buf.Bytes()
+}
+
+// Verify checks that the record is signed by the key its name derives from
+func (r Record) Verify() error {
+	if len(r.PublicKey) != ed25519.PublicKeySize {
+		return errors.New("invalid public key")
+	}
+	if r.Root == "" {
+		return errors.New("record has no root")
+	}
+	if RecordName(r.PublicKey, r.Label) != r.Name {
+		return errors.New("name does not match key and label")
+	}
+	if !ed25519.Verify(r.PublicKey, r.signedBytes(), r.Signature) {
+		return errors.New("bad signature")
+	}
+	return nil
+}
+
+// Publish points the record for label at root, signed with the node
+// identity, and stores it on the K closest peers to its name. The sequence
+// number is one past the highest seen locally or on the network.
+func (n *Node) Publish(root, label string) (PublishResult, error) {
+	if label == "" {
+		label = DefaultLabel
+	}
+	if _, err := n.GetManifest(root); err != nil {
+		return PublishResult{}, fmt.Errorf("cannot load manifest %s: %v", root, err)
+	}
+	key, err := n.Identity()
+	if err != nil {
+		return PublishResult{}, err
+	}
+	pub := key.Public().(ed25519.PublicKey)
+
+	n.publishMutex.Lock()
+	defer n.publishMutex.Unlock()
+
+	rec := Record{Name: RecordName(pub, label), PublicKey: pub, Label: label, Root: root}
+	published := n.loadPublished()
+	if prev, ok := published[label]; ok {
+		rec.Seq = prev.Seq
+	}
+	if prev, err := n.Resolve(rec.Name); err == nil && prev.Seq > rec.Seq {
+		rec.Seq = prev.Seq
+	}
+	rec.Seq++
+	rec.Signature = ed25519.Sign(key, rec.signedBytes())
+
+	if err := n.acceptRecord(rec, ""); err != nil {
+		return PublishResult{}, err
+	}
+	published[label] = rec
+	if err := n.savePublished(published); err != nil {
+		return PublishResult{}, err
+	}
+
+	return PublishResult{Record: rec, Peers: n.storeRecord(rec)}, nil
+}
+
+// storeRecord sends rec to the K closest peers to its name and returns how
+// many accepted it
+func (n *Node) storeRecord(rec Record) int {
+	value, _ := json.Marshal(rec)
+	payload, _ := json.Marshal(p2p.DHTPayload{Key: rec.Name, Value: value})
+	msg := p2p.Message{
+		Type:    p2p.MsgDHTStore,
+		Sender:  n.DHT.ID.Hex(),
+		Payload: payload,
+	}
+
+	var stored int
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for _, c := range n.peersOnly(n.DHT.RoutingTable.FindClosestContacts(dht.NewID(rec.Name), dht.K)) {
+		wg.Add(1)
+		go func(c dht.Contact) {
+			defer wg.Done()
+			reply, err := n.request(c.Address, msg, p2p.MsgDHTStoreAck, rec.Name, n.Config.AckTimeout)
+			if err != nil {
+				return
+			}
+			var ack p2p.StoreAckPayload
+			if json.Unmarshal(reply, &ack) == nil && ack.OK {
+				mutex.Lock()
+				stored++
+				mutex.Unlock()
+			}
+		}(c)
+	}
+	wg.Wait()
+	return stored
+}
+
+// Resolve finds the record with the highest valid sequence number for name
+// among the local DHT storage and the K closest peers
+func (n *Node) Resolve(name string) (Record, error) {
+	if _, err := dht.ParseID(name); err != nil {
+		return Record{}, fmt.Errorf("invalid record name %q", name)
+	}
+
+	var best *Record
+	var mutex sync.Mutex
+	consider := func(value []byte) {
+		var rec Record
+		if json.Unmarshal(value, &rec) != nil || rec.Name != name || rec.Verify() != nil {
+			return
+		}
+		mutex.Lock()
+		if best == nil || rec.Seq > best.Seq {
+			best = &rec
+		}
+		mutex.Unlock()
+	}
+
+	if value, ok := n.localRecord(name); ok {
+		consider(value)
+	}
+
+	payload, _ := json.Marshal(p2p.DHTPayload{Key: name})
+	msg := p2p.Message{
+		Type:    p2p.MsgDHTFindValue,
+		Sender:  n.DHT.ID.Hex(),
+		Payload: payload,
+	}
+	var wg sync.WaitGroup
+	for _, c := range n.peersOnly(n.DHT.RoutingTable.FindClosestContacts(dht.NewID(name), dht.K)) {
+		wg.Add(1)
+		go func(c dht.Contact) {
+			defer wg.Done()
+			reply, err := n.request(c.Address, msg, p2p.MsgDHTValue, name, n.Config.FetchTimeout)
+			if err != nil {
+				return
+			}
+			var resp p2p.DHTPayload
+			if json.Unmarshal(reply, &resp) == nil && len(resp.Value) > 0 {
+				consider(resp.Value)
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	if best == nil {
+		return Record{}, ErrRecordNotFound
+	}
+	// Keep the newest record we have seen so we can answer for it too
+	n.acceptRecord(*best, "")
+	return *best, nil
+}
+
+// acceptRecord stores rec in the local DHT storage if it is valid and newer
+// than the record held for its name. from is the address of the peer that
+// pushed it, or empty for records this node published or resolved itself;
+// a peer may only have us hold so many records.
+func (n *Node) acceptRecord(rec Record, from string) error {
+	if err := rec.Verify(); err != nil {
+		return err
+	}
+	value, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	n.DHT.Mutex.Lock()
+	defer n.DHT.Mutex.Unlock()
+
+	now := time.Now()
+	old, held := n.DHT.Storage[rec.Name]
+	if held {
+		var current Record
+		if json.Unmarshal(old, &current) == nil && current.Seq >= rec.Seq {
+			if current.Seq == rec.Seq && current.Root == rec.Root {
+				n.records.put(rec.Name, from, now) // republished, keep it another TTL
+				return nil
+			}
+			return fmt.Errorf("stale sequence number %d (holding %d)", rec.Seq, current.Seq)
+		}
+	} else {
+		if from != "" && n.records.count[from] >= n.records.perPeer {
+			return fmt.Errorf("peer holds %d records already", n.records.count[from])
+		}
+		for len(n.DHT.Storage) >= n.records.max {
+			name := n.records.oldest()
+			if name == "" {
+				break
+			}
+			n.records.remove(name)
+			delete(n.DHT.Storage, name)
+		}
+	}
+	n.DHT.Storage[rec.Name] = value
+	n.records.put(rec.Name, from, now)
+	return nil
+}
+
+// heldRecord is who had us store a record, and when it last did
+type heldRecord struct {
+	from   string
+	stored time.Time
+}
+
+// recordTable bounds the records in the DHT storage, by peer and in total;
+// guarded by the DHT mutex
+type recordTable struct {
+	held    map[string]heldRecord // record name -> who stored it
+	count   map[string]int        // records held per peer address
+	max     int
+	perPeer int
+	ttl     time.Duration
+}
+
+func newRecordTable() *recordTable {
+	return &recordTable{
+		held:    make(map[string]heldRecord),
+		count:   make(map[string]int),
+		max:     maxRecords,
+		perPeer: maxRecordsPerPeer,
+		ttl:     recordTTL,
+	}
+}
+
+func (t *recordTable) put(name, from string, now time.Time) {
+	t.remove(name)
+	t.held[name] = heldRecord{from: from, stored: now}
+	if from != "" {
+		t.count[from]++
+	}
+}
+
+func (t *recordTable) remove(name string) {
+	h, ok := t.held[name]
+	if !ok {
+		return
+	}
+	delete(t.held, name)
+	if h.from == "" {
+		return
+	}
+	if t.count[h.from]--; t.count[h.from] <= 0 {
+		delete(t.count, h.from)
+	}
+}
+
+// oldest returns the name of the record stored longest ago
+func (t *recordTable) oldest() string {
+	var name string
+	var stored time.Time
+	for k, h := range t.held {
+		if name == "" || h.stored.Before(stored) {
+			name, stored = k, h.stored
+		}
+	}
+	return name
+}
+
+// expireRecords drops the records not stored again within the TTL
+func (n *Node) expireRecords(now time.Time) int {
+	n.DHT.Mutex.Lock()
+	defer n.DHT.Mutex.Unlock()
+
+	var expired int
+	for name, h := range n.records.held {
+		if now.Sub(h.stored) > n.records.ttl {
+			n.records.remove(name)
+			delete(n.DHT.Storage, name)
+			expired++
+		}
+	}
+	return expired
+}
+
+// republishLoop expires stale records and stores the records this node
+// published again, so they outlive the TTL on the peers holding them
+func (n *Node) republishLoop() {
+	ticker := time.NewTicker(republishInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if expired := n.expireRecords(time.Now()); expired > 0 {
+			n.logf("[%d] Expired %d records\n", n.Config.Port, expired)
+		}
+		n.republish()
+	}
+}
+
+// republish stores every record in records.json on the closest peers again
+func (n *Node) republish() {
+	for label, rec := range n.loadPublished() {
+		if err := n.acceptRecord(rec, ""); err != nil {
+			n.logf("[%d] Not republishing record %q: %v\n", n.Config.Port, label, err)
+			continue
+		}
+		n.storeRecord(rec)
+	}
+}
+
+func (n *Node) localRecord(name string) ([]byte, bool) {
+	n.DHT.Mutex.RLock()
+	defer n.DHT.Mutex.RUnlock()
+	value, ok := n.DHT.Storage[name]
+	return value, ok
+}
+
+// loadPublished returns the records this node published, by label
+func (n *Node) loadPublished() map[string]Record {
+	published := make(map[string]Record)
+	if data, err := n.LoadState(publishedFile); err == nil {
+		json.Unmarshal(data, &published)
+	}
+	return published
+}
+
+func (n *Node) savePublished(published map[string]Record) error {
+	data, err := json.MarshalIndent(published, "", "  ")
+	if err != nil {
+		return err
+	}
+	return n.SaveState(publishedFile, data)
+}
+
+// handleRecordStore validates and stores a record pushed by a publisher or
+// resolver and acknowledges it
+func (n *Node) handleRecordStore(p *p2p.Peer, msg p2p.Message) {
+	var req p2p.DHTPayload
+	if err := json.Unmarshal(msg.Payload, &req); err != nil {
+		return
+	}
+	if senderID, err := dht.ParseID(msg.Sender); err == nil {
+		n.DHT.AddNode(dht.Contact{ID: senderID, Address: p.Address})
+	}
+
+	var rec Record
+	err := json.Unmarshal(req.Value, &rec)
+	if err == nil && rec.Name != req.Key {
+		err = errors.New("record name does not match key")
+	}
+	if err == nil {
+		err = n.acceptRecord(rec, p.Address)
+	}
+	if err != nil {
+		n.logf("[%d] Rejected record %s from %s: %v\n", n.Config.Port, shortHash(req.Key), p.Address, err)
+	}
+
+	ack := p2p.StoreAckPayload{Hash: req.Key, OK: err == nil}
+	if err != nil {
+		ack.Error = err.Error()
+	}
+	payload, _ := json.Marshal(ack)
+	n.Transport.SendMessage(p.Address, p2p.Message{
+		Type:    p2p.MsgDHTStoreAck,
+		Sender:  n.DHT.ID.Hex(),
+		Payload: payload,
+	})
+}
+
+// handleFindValue answers with the record held for a key, or with the
+// closest contacts we know of
+func (n *Node) handleFindValue(p *p2p.Peer, msg p2p.Message) {
+	var req p2p.DHTPayload
+	if err := json.Unmarshal(msg.Payload, &req); err != nil {
+		return
+	}
+	senderID, err := dht.ParseID(msg.Sender)
+	if err != nil {
+		return
+	}
+
+	value, contacts := n.DHT.HandleFindValue(dht.Contact{ID: senderID, Address: p.Address}, req.Key)
+	resp := p2p.DHTPayload{Key: req.Key, Value: value}
+	if value == nil {
+		resp.Contacts, _ = json.Marshal(contacts)
+	}
+	payload, _ := json.Marshal(resp)
+	n.Transport.SendMessage(p.Address, p2p.Message{
+		Type:    p2p.MsgDHTValue,
+		Sender:  n.DHT.ID.Hex(),
+		Payload: payload,
+	})
+}
@@ -0,0 +1,191 @@
+package node
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/tanmaydeobhankar/nebulafs/internal/dht"
+	"github.com/tanmaydeobhankar/nebulafs/internal/files"
+	"github.com/tanmaydeobhankar/nebulafs/internal/p2p"
+)
+
+// RekeyOptions controls how Rekey replaces a file
+type RekeyOptions struct {
+	// Replicas is the number of peers that must confirm each new chunk
+	Replicas int
+	// Delete removes the old chunks and manifest from the local store and
+	// asks the peers closest to them to drop their copies
+	Delete bool
+	// Label, if set, points this node's record for the label at the new root
+	Label string
+}
+
+// RekeyResult reports the replacement of a file
+type RekeyResult struct {
+	OldRoot string `json:"old_root"`
+	Root    string `json:"root"`
+	Key     string `json:"key"`
+	// Deleted is the number of old chunks removed from the local store
+	Deleted int `json:"deleted"`
+	// Requested is the number of delete requests sent to peers
+	Requested int `json:"requested"`
+}
+
+// Rekey re-encrypts the file behind root under a fresh key: it downloads
+// the file, uploads it again with the same name, mtime, padding and
+// recipients, and unpins the old root. The old key stays valid for any
+// copy of the old chunks that survives, so opts.Delete matters when the
+// key has leaked; peers treat delete requests as advisory.
+func (n *Node) Rekey(root, keyHex string, opts RekeyOptions) (RekeyResult, error) {
+	meta, err := n.GetManifest(root)
+	if err != nil {
+		return RekeyResult{}, err
+	}
+	key, err := n.fileKey(meta, keyHex)
+	if err != nil {
+		return RekeyResult{}, err
+	}
+	if err := meta.Unseal(key); err != nil {
+		return RekeyResult{}, err
+	}
+
+	tempBase := os.TempDir()
+	if n.Config.StorageDir != "" {
+		tempBase = n.Config.StorageDir
+	}
+	dir, err := os.MkdirTemp(tempBase, "rekey-")
+	if err != nil {
+		return RekeyResult{}, err
+	}
+	defer os.RemoveAll(dir)
+
+	// The upload takes its name and type from the file name
+	name := meta.Name
+	if name == "" {
+		name = "file"
+	}
+	path := filepath.Join(dir, filepath.Base(name))
+	if err := n.DownloadFile(meta, hex.EncodeToString(key), path, DownloadOptions{}); err != nil {
+		return RekeyResult{}, fmt.Errorf("downloading old version: %v", err)
+	}
+	if !meta.ModTime.IsZero() {
+		os.Chtimes(path, meta.ModTime, meta.ModTime)
+	}
+
+	// The file keeps its suite; legacy files carry the zero suite, which
+	// UploadFile replaces with the node's default
+	upload := UploadOptions{Replicas: opts.Replicas, Pad: padded(meta), Cipher: meta.Cipher}
+	for _, w := range meta.Recipients {
+		upload.Recipients = append(upload.Recipients, hex.EncodeToString(w.Recipient))
+	}
+	added, err := n.Add(path, upload)
+	if err != nil {
+		return RekeyResult{}, err
+	}
+	result := RekeyResult{OldRoot: root, Root: added.Root, Key: added.Key}
+
+	n.Unpin(root) // fails only if it wasn't pinned
+	if opts.Delete {
+		old := append([]string{root}, chunkHashes(meta)...)
+		result.Deleted, result.Requested = n.dropChunks(old)
+	}
+	if opts.Label != "" {
+		if _, err := n.Publish(added.Root, opts.Label); err != nil {
+			return result, fmt.Errorf("publishing %s: %v", opts.Label, err)
+		}
+	}
+	return result, nil
+}
+
+// padded reports whether the chunks hold more plaintext than the file
+func padded(meta files.FileMetadata) bool {
+	var total int64
+	for _, c := range meta.Chunks {
+		total += int64(meta.Cipher.PlaintextLen(c.Size))
+	}
+	return total > meta.Size
+}
+
+func chunkHashes(meta files.FileMetadata) []string {
+	hashes := make([]string, len(meta.Chunks))
+	for i, c := range meta.Chunks {
+		hashes[i] = c.Hash
+	}
+	return hashes
+}
+
+// dropChunks deletes hashes from the local store, except chunks of pinned
+// files, and asks the K closest peers to each to do the same. It returns
+// how many chunks were deleted and how many requests were sent.
+func (n *Node) dropChunks(hashes []string) (int, int) {
+	pinned := n.pinnedChunks()
+	var deleted, requested int
+	var dropped []string
+	for _, hash := range hashes {
+		if pinned[hash] {
+			continue
+		}
+		dropped = append(dropped, hash)
+		if n.Store.HasChunk(hash) && n.Store.DeleteChunk(hash) == nil {
+			deleted++
+		}
+
+		payload, _ := json.Marshal(p2p.ChunkRequestPayload{Hash: hash})
+		msg := p2p.Message{
+			Type:    p2p.MsgDeleteChunk,
+			Sender:  n.DHT.ID.Hex(),
+			Payload: payload,
+		}
+		for _, c := range n.peersOnly(n.DHT.RoutingTable.FindClosestContacts(dht.NewID(hash), dht.K)) {
+			if n.Transport.SendMessage(c.Address, msg) == nil {
+				requested++
+			}
+		}
+	}
+	n.forgetAudits(dropped)
+	n.compactStore()
+	return deleted, requested
+}
+
+// pinnedChunks returns the manifests and chunks of every pinned file whose
+// manifest is in the local store
+func (n *Node) pinnedChunks() map[string]bool {
+	hashes := make(map[string]bool)
+	for _, p := range n.Pins() {
+		chunk, err := n.Store.ReadChunk(p.Root)
+		if err != nil {
+			continue
+		}
+		hashes[p.Root] = true
+		if meta, err := files.ParseManifest(chunk); err == nil {
+			for _, c := range meta.Chunks {
+				hashes[c.Hash] = true
+			}
+		}
+	}
+	return hashes
+}
+
+// handleDeleteChunk drops a chunk on request if the node accepts deletes.
+// Chunks of files pinned here are always kept.
+func (n *Node) handleDeleteChunk(p *p2p.Peer, msg p2p.Message) {
+	if !n.Config.AcceptDeletes {
+		return
+	}
+	var req p2p.ChunkRequestPayload
+	if err := json.Unmarshal(msg.Payload, &req); err != nil {
+		return
+	}
+	if !n.Store.HasChunk(req.Hash) || n.pinnedChunks()[req.Hash] {
+		return
+	}
+	if err := n.Store.DeleteChunk(req.Hash); err != nil {
+		n.logf("[%d] Failed to delete chunk %s: %v\n", n.Config.Port, shortHash(req.Hash), err)
+		return
+	}
+	n.logf("[%d] Deleted chunk %s on request of %s\n", n.Config.Port, shortHash(req.Hash), p.Address)
+	n.compactStore()
+}
@@ -0,0 +1,168 @@
+package node
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tanmaydeobhankar/nebulafs/internal/dht"
+	"github.com/tanmaydeobhankar/nebulafs/internal/p2p"
+	"github.com/tanmaydeobhankar/nebulafs/internal/storage"
+)
+
+// DefaultRepairReplicas is the replica count the repair daemon maintains
+// when NodeConfig.RepairReplicas is unset
+const DefaultRepairReplicas = 3
+
+// RepairReport summarises one repair pass
+type RepairReport struct {
+	Checked     int `json:"checked"`      // chunks this node was responsible for
+	Repaired    int `json:"repaired"`     // chunks that received new copies
+	NewReplicas int `json:"new_replicas"` // copies pushed in total
+	Short       int `json:"short"`        // chunks still below target afterwards
+}
+
+// Repair checks every locally held chunk this node is responsible for and
+// pushes copies to the closest peers when fewer than RepairReplicas of the
+// K closest peers still hold it.
+//
+// A node is responsible for a chunk when it is among the K closest nodes to
+// the chunk ID and no closer node holds a copy; the closest holder does the
+// repair so that peers don't all push the same chunk at once.
+func (n *Node) Repair() RepairReport {
+	var report RepairReport
+	defer n.flushAudits()
+
+	hashes, err := n.Store.ListChunks()
+	if err != nil {
+		n.logf("[%d] Repair: cannot list chunks: %v\n", n.Config.Port, err)
+		return report
+	}
+
+	target := n.Config.RepairReplicas
+	self := n.DHT.RoutingTable.Self
+
+	for _, hash := range hashes {
+		if strings.HasPrefix(hash, storage.UnreadablePrefix) {
+			continue // Left to the scrubber
+		}
+		chunkID := dht.NewID(hash)
+		closest := n.peersOnly(n.DHT.RoutingTable.FindClosestContacts(chunkID, dht.K+1))
+		if len(closest) > dht.K {
+			closest = closest[:dht.K]
+		}
+
+		// Among the K closest?
+		if len(closest) == dht.K && !closer(self.ID, closest[len(closest)-1].ID, chunkID) {
+			continue
+		}
+
+		holders := n.queryHolders(hash, closest)
+		if !n.closestHolder(chunkID, holders) {
+			continue
+		}
+
+		report.Checked++
+		if len(holders) >= target {
+			continue
+		}
+
+		chunk, err := storage.PeekChunk(n.Store, hash)
+		if err != nil {
+			continue
+		}
+
+		skip := make(map[string]bool, len(holders))
+		for _, h := range holders {
+			skip[h.Address] = true
+		}
+
+		n.logf("[%d] Repair: chunk %s has %d/%d replicas\n", n.Config.Port, shortHash(hash), len(holders), target)
+		pushed := n.replicateChunk(chunk, target-len(holders), skip)
+		if len(pushed) > 0 {
+			report.Repaired++
+			report.NewReplicas += len(pushed)
+		}
+		if len(holders)+len(pushed) < target {
+			report.Short++
+		}
+	}
+
+	return report
+}
+
+// peersOnly drops our own contact and banned peers from a contact list
+func (n *Node) peersOnly(contacts []dht.Contact) []dht.Contact {
+	var out []dht.Contact
+	for _, c := range contacts {
+		if c.Address != n.DHT.RoutingTable.Self.Address && !n.reputation.banned(c.Address) {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// closestHolder reports whether we are closer to id than every holder
+func (n *Node) closestHolder(id dht.ID, holders []dht.Contact) bool {
+	for _, h := range holders {
+		if closer(h.ID, n.DHT.RoutingTable.Self.ID, id) {
+			return false
+		}
+	}
+	return true
+}
+
+// closer reports whether a is strictly closer to target than b
+func closer(a, b, target dht.ID) bool {
+	return a.XOR(target).Int().Cmp(b.XOR(target).Int()) < 0
+}
+
+// queryHolders asks each contact whether it holds hash and returns those
+// that do. Peers that can't be reached are dropped from the routing table.
+func (n *Node) queryHolders(hash string, contacts []dht.Contact) []dht.Contact {
+	payload, _ := json.Marshal(p2p.ChunkRequestPayload{Hash: hash})
+	msg := p2p.Message{
+		Type:    p2p.MsgHasChunk,
+		Sender:  n.DHT.ID.Hex(),
+		Payload: payload,
+	}
+
+	var holders []dht.Contact
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+
+	for _, c := range contacts {
+		wg.Add(1)
+		go func(c dht.Contact) {
+			defer wg.Done()
+			reply, err := n.request(c.Address, msg, p2p.MsgHasChunkResp, hash, n.Config.AckTimeout)
+			if err != nil {
+				return
+			}
+			var resp p2p.HasChunkPayload
+			if json.Unmarshal(reply, &resp) == nil && resp.Has {
+				mutex.Lock()
+				holders = append(holders, c)
+				mutex.Unlock()
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	return holders
+}
+
+// repairLoop runs Repair every RepairInterval
+func (n *Node) repairLoop() {
+	ticker := time.NewTicker(n.Config.RepairInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		report := n.Repair()
+		if report.Repaired > 0 || report.Short > 0 {
+			n.logf("[%d] Repair: %d chunks repaired with %d new replicas, %d still short\n",
+				n.Config.Port, report.Repaired, report.NewReplicas, report.Short)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tanmaydeobhankar/nebulafs/internal/dht"
+	"github.com/tanmaydeobhankar/nebulafs/internal/files"
+	"github.com/tanmaydeobhankar/nebulafs/internal/p2p"
+)
+
+// DefaultAckTimeout is how long to wait for a STORE_ACK before moving on
+// to a further-away peer
+const DefaultAckTimeout = 3 * time.Second
+
+// ChunkReplication records which peers confirmed a chunk
+type ChunkReplication struct {
+	Hash  string   `json:"hash"`
+	Peers []string `json:"peers"`
+}
+
+// ReplicationError is returned when some chunks could not reach the
+// requested number of confirmed replicas
+type ReplicationError struct {
+	Wanted int                `json:"wanted"`
+	Short  []ChunkReplication `json:"short"`
+}
+
+func (e *ReplicationError) Error() string {
+	var parts []string
+	for _, c := range e.Short {
+		parts = append(parts, fmt.Sprintf("%s (%d/%d)", shortHash(c.Hash), len(c.Peers), e.Wanted))
+	}
+	return fmt.Sprintf("%d chunks short of %d replicas: %s", len(e.Short), e.Wanted, strings.Join(parts, ", "))
+}
+
+// storeWithAck sends a chunk to one peer and waits for its acknowledgement
+func (n *Node) storeWithAck(address string, chunk files.Chunk, msg p2p.Message) bool {
+	payload, err := n.request(address, msg, p2p.MsgStoreAck, chunk.Hash, n.Config.AckTimeout)
+	if err != nil {
+		return false
+	}
+
+	var ack p2p.StoreAckPayload
+	if err := json.Unmarshal(payload, &ack); err != nil {
+		return false
+	}
+	if !ack.OK {
+		n.logf("Peer %s refused chunk %s: %s\n", address, shortHash(chunk.Hash), ack.Error)
+	}
+	return ack.OK
+}
+
+// replicateChunk pushes a chunk to the closest peers until want of them
+// have acknowledged it, moving further away from the chunk ID as peers fail
+// or time out. Banned peers and those in skip are not asked, and peers with
+// a poor reputation only after the others. Confirmed peers are recorded
+// as holders to audit.
+func (n *Node) replicateChunk(chunk files.Chunk, want int, skip map[string]bool) []string {
+	if want <= 0 {
+		return nil
+	}
+
+	contacts := n.byReputation(n.peersOnly(n.DHT.RoutingTable.FindClosestContacts(dht.NewID(chunk.Hash), dht.K)))
+
+	payload, _ := json.Marshal(chunk)
+	msg := p2p.Message{
+		Type:    p2p.MsgStoreChunk,
+		Sender:  n.DHT.ID.Hex(),
+		Payload: payload,
+	}
+
+	var confirmed []string
+	for len(contacts) > 0 && len(confirmed) < want {
+		// Ask just enough of the next-closest peers to fill the gap
+		var round []string
+		for len(contacts) > 0 && len(round) < want-len(confirmed) {
+			c := contacts[0]
+			contacts = contacts[1:]
+			if c.Address == n.DHT.RoutingTable.Self.Address || skip[c.Address] {
+				continue // Don't send to self
+			}
+			round = append(round, c.Address)
+		}
+
+		var wg sync.WaitGroup
+		var mutex sync.Mutex
+		for _, addr := range round {
+			wg.Add(1)
+			go func(addr string) {
+				defer wg.Done()
+				if n.storeWithAck(addr, chunk, msg) {
+					mutex.Lock()
+					confirmed = append(confirmed, addr)
+					mutex.Unlock()
+				}
+			}(addr)
+		}
+		wg.Wait()
+	}
+
+	n.recordReplicas(chunk, confirmed)
+	return confirmed
+}
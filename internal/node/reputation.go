@@ -0,0 +1,309 @@
+package node
+
+import (
+	"math"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tanmaydeobhankar/nebulafs/internal/dht"
+	"github.com/tanmaydeobhankar/nebulafs/internal/p2p"
+)
+
+// Defaults for peer reputation
+const (
+	DefaultBanThreshold    = 10.0
+	DefaultBanDuration     = 15 * time.Minute
+	DefaultPenaltyHalfLife = 10 * time.Minute
+	DefaultMessageRate     = 1000 // messages per second from one peer, twice that in a burst
+
+	// recordExpiry is how long the record of a peer that isn't banned is
+	// kept after its last message or event; by then its penalty has
+	// decayed away with the default half-life
+	recordExpiry = time.Hour
+)
+
+// peerEvent is something a peer did that affects its reputation
+type peerEvent int
+
+const (
+	eventSuccess   peerEvent = iota // answered a request in time
+	eventTimeout                    // didn't answer a request
+	eventCorrupt                    // sent data that doesn't match its hash or a wrong storage proof
+	eventViolation                  // sent a malformed message
+	eventFlood                      // sent a message over its rate limit
+)
+
+// penalties per event; a success takes some penalty off instead
+var eventPenalty = map[peerEvent]float64{
+	eventSuccess:   -0.5,
+	eventTimeout:   1,
+	eventCorrupt:   5,
+	eventViolation: 3,
+	eventFlood:     0.1,
+}
+
+// PeerReputation is what the node thinks of one peer
+type PeerReputation struct {
+	Address     string    `json:"address"` // host, or host:port on loopback, see peerKey
+	Score       float64   `json:"score"`   // 1 for a clean record, towards 0 as penalties pile up
+	Successes   int       `json:"successes"`
+	Timeouts    int       `json:"timeouts"`
+	Corrupt     int       `json:"corrupt"`
+	Violations  int       `json:"violations"`
+	Flooded     int       `json:"flooded"` // messages dropped over the rate limit
+	BannedUntil time.Time `json:"banned_until,omitempty"`
+}
+
+// peerRecord holds a peer's penalty, which halves every half-life, and its
+// message allowance
+type peerRecord struct {
+	PeerReputation
+	penalty     float64
+	decayed     time.Time
+	tokens      float64
+	refilled    time.Time
+	bannedUntil time.Time
+	seen        time.Time
+}
+
+// reputation scores peers by what they did recently. A peer whose penalty
+// reaches the threshold is banned for a while: its messages are dropped and
+// it isn't picked for fetches or replicas. Records are kept per peerKey.
+type reputation struct {
+	peers     map[string]*peerRecord
+	threshold float64
+	banFor    time.Duration
+	halfLife  time.Duration
+	rate      float64
+	expiry    time.Duration
+	pruned    time.Time
+	mutex     sync.Mutex
+}
+
+func newReputation(config NodeConfig) *reputation {
+	r := &reputation{
+		peers:     make(map[string]*peerRecord),
+		threshold: config.BanThreshold,
+		banFor:    config.BanDuration,
+		halfLife:  config.PenaltyHalfLife,
+		rate:      float64(config.MessageRate),
+		expiry:    recordExpiry,
+		pruned:    time.Now(),
+	}
+	if r.threshold <= 0 {
+		r.threshold = DefaultBanThreshold
+	}
+	if r.banFor <= 0 {
+		r.banFor = DefaultBanDuration
+	}
+	if r.halfLife <= 0 {
+		r.halfLife = DefaultPenaltyHalfLife
+	}
+	if r.rate <= 0 {
+		r.rate = DefaultMessageRate
+	}
+	return r
+}
+
+// peerKey is what a peer's record is kept under: the host of its address,
+// so a peer can't shed a ban or its message allowance by reconnecting from
+// a new port, and its inbound and outbound connections share one record.
+// Loopback addresses keep their port, since a local network runs many
+// nodes on one host.
+func peerKey(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return addr
+	}
+	return host
+}
+
+// get returns the record of addr with its penalty decayed to now; callers
+// hold the mutex
+func (r *reputation) get(addr string, now time.Time) *peerRecord {
+	key := peerKey(addr)
+	p := r.peers[key]
+	if p == nil {
+		p = &peerRecord{
+			PeerReputation: PeerReputation{Address: key},
+			decayed:        now,
+			tokens:         2 * r.rate,
+			refilled:       now,
+		}
+		r.peers[key] = p
+		return p
+	}
+	if elapsed := now.Sub(p.decayed); elapsed > 0 {
+		p.penalty *= math.Pow(0.5, float64(elapsed)/float64(r.halfLife))
+		p.decayed = now
+	}
+	return p
+}
+
+// prune drops the records of peers idle for longer than the expiry, unless
+// they are banned, so addresses seen once don't pile up. It scans at most
+// once every tenth of the expiry; callers hold the mutex.
+func (r *reputation) prune(now time.Time) {
+	if now.Sub(r.pruned) < r.expiry/10 {
+		return
+	}
+	r.pruned = now
+	for addr, p := range r.peers {
+		if now.Sub(p.seen) > r.expiry && !now.Before(p.bannedUntil) {
+			delete(r.peers, addr)
+		}
+	}
+}
+
+// record applies event to addr and reports whether it got the peer banned
+func (r *reputation) record(addr string, event peerEvent) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := time.Now()
+	r.prune(now)
+	p := r.get(addr, now)
+	p.seen = now
+	switch event {
+	case eventSuccess:
+		p.Successes++
+	case eventTimeout:
+		p.Timeouts++
+	case eventCorrupt:
+		p.Corrupt++
+	case eventViolation:
+		p.Violations++
+	case eventFlood:
+		p.Flooded++
+	}
+	p.penalty = math.Max(0, p.penalty+eventPenalty[event])
+
+	if p.penalty < r.threshold || now.Before(p.bannedUntil) {
+		return false
+	}
+	p.bannedUntil = now.Add(r.banFor)
+	p.penalty /= 2 // so a single slip after the ban doesn't renew it
+	return true
+}
+
+// admit takes one message from addr off its allowance. Messages from banned
+// peers, or beyond the allowance, are refused.
+func (r *reputation) admit(addr string) (ok, flooding bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := time.Now()
+	r.prune(now)
+	p := r.get(addr, now)
+	p.seen = now
+	if now.Before(p.bannedUntil) {
+		return false, false
+	}
+	p.tokens = math.Min(2*r.rate, p.tokens+now.Sub(p.refilled).Seconds()*r.rate)
+	p.refilled = now
+	if p.tokens < 1 {
+		return false, true
+	}
+	p.tokens--
+	return true, false
+}
+
+func (r *reputation) banned(addr string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	p := r.peers[peerKey(addr)]
+	return p != nil && time.Now().Before(p.bannedUntil)
+}
+
+// score is 1 for peers with no recent penalty, falling towards 0
+func (r *reputation) score(addr string) float64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, ok := r.peers[peerKey(addr)]; !ok {
+		return 1
+	}
+	return 1 / (1 + r.get(addr, time.Now()).penalty)
+}
+
+// report records event against addr, dropping every contact of the peer
+// from the routing table if that gets it banned
+func (n *Node) report(addr string, event peerEvent) {
+	if !n.reputation.record(addr, event) {
+		return
+	}
+	key := peerKey(addr)
+	n.logf("[%d] Banned %s for %v\n", n.Config.Port, key, n.reputation.banFor)
+	for _, c := range n.Peers() {
+		if peerKey(c.Address) == key {
+			n.DHT.RemoveNode(c.Address)
+		}
+	}
+}
+
+// PeerScore returns the reputation score of addr, 1 for a clean record
+func (n *Node) PeerScore(addr string) float64 {
+	return n.reputation.score(addr)
+}
+
+// Reputation returns the record of every peer seen, lowest score first
+func (n *Node) Reputation() []PeerReputation {
+	r := n.reputation
+	r.mutex.Lock()
+	now := time.Now()
+	list := make([]PeerReputation, 0, len(r.peers))
+	for addr := range r.peers {
+		p := r.get(addr, now)
+		rep := p.PeerReputation
+		rep.Score = 1 / (1 + p.penalty)
+		if now.Before(p.bannedUntil) {
+			rep.BannedUntil = p.bannedUntil
+		}
+		list = append(list, rep)
+	}
+	r.mutex.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Score != list[j].Score {
+			return list[i].Score < list[j].Score
+		}
+		return list[i].Address < list[j].Address
+	})
+	return list
+}
+
+// byReputation orders contacts best score first, keeping the existing
+// order among equal scores, so clean peers stay in distance order
+func (n *Node) byReputation(contacts []dht.Contact) []dht.Contact {
+	scores := make(map[string]float64, len(contacts))
+	for _, c := range contacts {
+		scores[c.Address] = n.reputation.score(c.Address)
+	}
+	sort.SliceStable(contacts, func(i, j int) bool {
+		return scores[contacts[i].Address] > scores[contacts[j].Address]
+	})
+	return contacts
+}
+
+// screenedTransport drops messages from banned peers and from peers over
+// their rate limit before they reach a handler
+type screenedTransport struct {
+	p2p.Transport
+	node *Node
+}
+
+func (t screenedTransport) RegisterHandler(msgType p2p.MessageType, handler func(*p2p.Peer, p2p.Message)) {
+	t.Transport.RegisterHandler(msgType, func(p *p2p.Peer, msg p2p.Message) {
+		ok, flooding := t.node.reputation.admit(p.Address)
+		if flooding {
+			t.node.report(p.Address, eventFlood)
+		}
+		if ok {
+			handler(p, msg)
+		}
+	})
+}
@@ -0,0 +1,75 @@
+package node
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/tanmaydeobhankar/nebulafs/internal/p2p"
+)
+
+var errReplyTimeout = errors.New("timed out waiting for reply")
+
+// replyKey matches a response to the request that caused it. Replies are
+// correlated by message type, the chunk hash they concern and the peer
+// they come from.
+type replyKey struct {
+	kind    p2p.MessageType
+	hash    string
+	address string
+}
+
+// expectReply registers interest in a reply of the given kind
+func (n *Node) expectReply(kind p2p.MessageType, hash, address string) (<-chan json.RawMessage, func()) {
+	key := replyKey{kind: kind, hash: hash, address: address}
+	ch := make(chan json.RawMessage, 1)
+
+	n.replyMutex.Lock()
+	n.replies[key] = ch
+	n.replyMutex.Unlock()
+
+	return ch, func() {
+		n.replyMutex.Lock()
+		if n.replies[key] == ch {
+			delete(n.replies, key)
+		}
+		n.replyMutex.Unlock()
+	}
+}
+
+// replyReceived hands an incoming reply to whoever is waiting for it.
+// Unsolicited replies are dropped.
+func (n *Node) replyReceived(kind p2p.MessageType, hash, address string, payload json.RawMessage) {
+	key := replyKey{kind: kind, hash: hash, address: address}
+
+	n.replyMutex.Lock()
+	ch, ok := n.replies[key]
+	delete(n.replies, key)
+	n.replyMutex.Unlock()
+
+	if ok {
+		ch <- payload
+	}
+}
+
+// request sends msg and waits up to timeout for the matching reply. A send
+// failure means the peer is gone, so it is dropped from the routing table.
+// Replies and timeouts count towards the peer's reputation.
+func (n *Node) request(address string, msg p2p.Message, replyKind p2p.MessageType, hash string, timeout time.Duration) (json.RawMessage, error) {
+	reply, cancel := n.expectReply(replyKind, hash, address)
+	defer cancel()
+
+	if err := n.Transport.SendMessage(address, msg); err != nil {
+		n.DHT.RemoveNode(address)
+		return nil, err
+	}
+
+	select {
+	case payload := <-reply:
+		n.report(address, eventSuccess)
+		return payload, nil
+	case <-time.After(timeout):
+		n.report(address, eventTimeout)
+		return nil, errReplyTimeout
+	}
+}
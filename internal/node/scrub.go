@@ -0,0 +1,176 @@
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/tanmaydeobhankar/nebulafs/internal/crypto"
+	"github.com/tanmaydeobhankar/nebulafs/internal/files"
+	"github.com/tanmaydeobhankar/nebulafs/internal/storage"
+)
+
+const scrubReportFile = "scrub.json"
+
+// Scrub outcomes for a corrupt chunk
+const (
+	ScrubRepaired = "repaired"    // quarantined and a good copy re-fetched from peers
+	ScrubLost     = "quarantined" // quarantined, no peer had a good copy
+	ScrubFailed   = "failed"      // could not be read or quarantined
+)
+
+// ScrubChunkResult describes a chunk that failed verification
+type ScrubChunkResult struct {
+	Hash   string `json:"hash"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ScrubReport summarises one pass over the local store
+type ScrubReport struct {
+	Started    time.Time          `json:"started"`
+	DurationMs int64              `json:"duration_ms"`
+	Checked    int                `json:"checked"`
+	Bytes      int64              `json:"bytes"`
+	Corrupt    []ScrubChunkResult `json:"corrupt"`
+}
+
+// Healthy reports whether every corrupt chunk found was repaired
+func (r ScrubReport) Healthy() bool {
+	for _, c := range r.Corrupt {
+		if c.Status != ScrubRepaired {
+			return false
+		}
+	}
+	return true
+}
+
+// Scrub re-hashes every stored chunk, reading at most rate bytes per second
+// (0 = unlimited). Corrupt chunks are moved to quarantine and re-fetched
+// from peers.
+func (n *Node) Scrub(rate int64) ScrubReport {
+	report := ScrubReport{Started: time.Now(), Corrupt: []ScrubChunkResult{}}
+
+	hashes, err := n.Store.ListChunks()
+	if err != nil {
+		report.Corrupt = append(report.Corrupt, ScrubChunkResult{Status: ScrubFailed, Error: err.Error()})
+		return report
+	}
+
+	for _, hash := range hashes {
+		chunk, err := storage.PeekChunk(n.Store, hash)
+		if err != nil {
+			if !n.Store.HasChunk(hash) {
+				continue // Deleted while we were scrubbing
+			}
+			report.Corrupt = append(report.Corrupt, ScrubChunkResult{Hash: hash, Status: ScrubFailed, Error: err.Error()})
+			continue
+		}
+
+		report.Checked++
+		report.Bytes += int64(len(chunk.Content))
+
+		if strings.HasPrefix(hash, storage.UnreadablePrefix) {
+			// A sealed blob that doesn't open; its chunk is unknown, so
+			// there is nothing to re-fetch
+			n.logf("[%d] Scrub: blob %s cannot be opened\n", n.Config.Port, shortHash(strings.TrimPrefix(hash, storage.UnreadablePrefix)))
+			result := n.quarantineChunk(chunk)
+			if result.Status == "" {
+				result.Status = ScrubLost
+				result.Error = "sealed blob cannot be opened"
+			}
+			report.Corrupt = append(report.Corrupt, result)
+		} else if crypto.HashSHA1(chunk.Content) != hash {
+			n.logf("[%d] Scrub: chunk %s is corrupt\n", n.Config.Port, shortHash(hash))
+			report.Corrupt = append(report.Corrupt, n.repairChunk(chunk))
+		}
+
+		// Throttle to the configured I/O rate
+		if rate > 0 {
+			expected := time.Duration(float64(report.Bytes) / float64(rate) * float64(time.Second))
+			if elapsed := time.Since(report.Started); elapsed < expected {
+				time.Sleep(expected - elapsed)
+			}
+		}
+	}
+
+	if len(report.Corrupt) > 0 {
+		n.compactStore()
+	}
+	report.DurationMs = time.Since(report.Started).Milliseconds()
+	return report
+}
+
+// quarantineChunk moves chunk out of the store, leaving Status empty when
+// that worked
+func (n *Node) quarantineChunk(chunk files.Chunk) ScrubChunkResult {
+	result := ScrubChunkResult{Hash: chunk.Hash}
+
+	if err := n.Quarantine.WriteChunk(chunk); err != nil {
+		result.Status = ScrubFailed
+		result.Error = fmt.Sprintf("quarantine: %v", err)
+		return result
+	}
+	if err := n.Store.DeleteChunk(chunk.Hash); err != nil {
+		result.Status = ScrubFailed
+		result.Error = fmt.Sprintf("delete: %v", err)
+	}
+	return result
+}
+
+// repairChunk quarantines a corrupt chunk and tries to fetch a good copy
+func (n *Node) repairChunk(chunk files.Chunk) ScrubChunkResult {
+	result := n.quarantineChunk(chunk)
+	if result.Status != "" {
+		return result
+	}
+
+	if _, err := n.fetchChunk(chunk.Hash); err != nil {
+		result.Status = ScrubLost
+		result.Error = err.Error()
+		return result
+	}
+
+	result.Status = ScrubRepaired
+	return result
+}
+
+// scrubLoop runs Scrub every ScrubInterval and persists the latest report
+func (n *Node) scrubLoop() {
+	ticker := time.NewTicker(n.Config.ScrubInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		report := n.Scrub(n.Config.ScrubRate)
+		n.logf("[%d] Scrub: checked %d chunks, %d corrupt\n", n.Config.Port, report.Checked, len(report.Corrupt))
+
+		data, _ := json.MarshalIndent(report, "", "  ")
+		if err := n.SaveState(scrubReportFile, data); err != nil {
+			n.logf("[%d] Scrub: failed to save report: %v\n", n.Config.Port, err)
+		}
+	}
+}
+
+// LastScrubReport loads the report written by the background scrubber.
+// masterKey must be given if the node encrypts its state at rest.
+func LastScrubReport(storageDir string, masterKey []byte) (ScrubReport, error) {
+	var report ScrubReport
+	key, err := stateKey(masterKey)
+	if err != nil {
+		return report, err
+	}
+	data, err := readState(storageDir, key, scrubReportFile)
+	if err != nil {
+		return report, err
+	}
+	err = json.Unmarshal(data, &report)
+	return report, err
+}
+
+func shortHash(hash string) string {
+	if len(hash) > 8 {
+		return hash[:8]
+	}
+	return hash
+}
@@ -0,0 +1,158 @@
+package node
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/tanmaydeobhankar/nebulafs/internal/crypto"
+	"github.com/tanmaydeobhankar/nebulafs/internal/files"
+)
+
+// RecipientKey returns the node's X25519 key for receiving shared files. It
+// is derived from the identity seed, so it needs no state of its own.
+func (n *Node) RecipientKey() (*ecdh.PrivateKey, error) {
+	identity, err := n.Identity()
+	if err != nil {
+		return nil, err
+	}
+	raw, err := crypto.SubKey(identity.Seed(), "x25519 recipient")
+	if err != nil {
+		return nil, err
+	}
+	return ecdh.X25519().NewPrivateKey(raw)
+}
+
+// fileKey returns the key given as hex or, when keyHex is empty, unwraps
+// the entry for this node from the manifest's recipients
+func (n *Node) fileKey(meta files.FileMetadata, keyHex string) ([]byte, error) {
+	if keyHex != "" {
+		key, err := hexDecode(keyHex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key: %v", err)
+		}
+		return key, nil
+	}
+	if len(meta.Recipients) == 0 {
+		return nil, errors.New("no key given and the file is not shared with any recipient")
+	}
+	priv, err := n.RecipientKey()
+	if err != nil {
+		return nil, err
+	}
+	key, err := crypto.UnwrapKey(meta.Recipients, priv)
+	if err != nil {
+		return nil, fmt.Errorf("no key given: %v", err)
+	}
+	return key, nil
+}
+
+// wrapFor adds an entry for each recipient (hex X25519 public keys) not
+// already in meta.Recipients
+func wrapFor(meta *files.FileMetadata, key []byte, recipients []string) error {
+	for _, r := range recipients {
+		pub, err := crypto.ParseRecipient(r)
+		if err != nil {
+			return err
+		}
+		if hasRecipient(meta.Recipients, pub.Bytes()) {
+			continue
+		}
+		wrapped, err := crypto.WrapKey(key, pub)
+		if err != nil {
+			return err
+		}
+		meta.Recipients = append(meta.Recipients, wrapped)
+	}
+	return nil
+}
+
+func hasRecipient(wrapped []crypto.WrappedKey, pub []byte) bool {
+	for _, w := range wrapped {
+		if bytes.Equal(w.Recipient, pub) {
+			return true
+		}
+	}
+	return false
+}
+
+// withSelf adds this node's recipient key to a non-empty recipient list, so
+// the uploader can read back what it shared without keeping the raw key
+func (n *Node) withSelf(recipients []string) ([]string, error) {
+	if len(recipients) == 0 {
+		return nil, nil
+	}
+	priv, err := n.RecipientKey()
+	if err != nil {
+		return nil, err
+	}
+	return append(recipients, hex.EncodeToString(priv.PublicKey().Bytes())), nil
+}
+
+// Share writes a new manifest for root whose recipients are the current
+// ones plus add, minus revoke, and pins it. The file key is keyHex or, if
+// empty, unwrapped with this node's recipient key; a given key must open
+// the file. Revoking a key that isn't a recipient is an error. The new
+// manifest is signed by this node.
+//
+// The old manifest and the chunks don't change: a revoked recipient can
+// still use a root or key it already has; only re-encrypting the file
+// under a new key cuts that off.
+func (n *Node) Share(root, keyHex string, add, revoke []string, replicas int) (string, error) {
+	meta, err := n.GetManifest(root)
+	if err != nil {
+		return "", err
+	}
+	key, err := n.fileKey(meta, keyHex)
+	if err != nil {
+		return "", err
+	}
+	if err := meta.Unseal(key); err != nil {
+		return "", err
+	}
+	// Version 0 manifests seal nothing the key could be checked against, so
+	// a given key is tried on the first chunk before anyone gets it wrapped
+	if keyHex != "" && len(meta.Private) == 0 {
+		r, err := n.OpenFile(meta, keyHex)
+		if err == nil {
+			err = r.Verify()
+		}
+		if err != nil {
+			return "", fmt.Errorf("key does not open %s: %v", root, err)
+		}
+	}
+
+	revoked := make([][]byte, 0, len(revoke))
+	for _, r := range revoke {
+		pub, err := crypto.ParseRecipient(r)
+		if err != nil {
+			return "", fmt.Errorf("cannot revoke %q: %v", r, err)
+		}
+		if !hasRecipient(meta.Recipients, pub.Bytes()) {
+			return "", fmt.Errorf("cannot revoke %s: not a recipient of %s", r, root)
+		}
+		revoked = append(revoked, pub.Bytes())
+	}
+	kept := make([]crypto.WrappedKey, 0, len(meta.Recipients))
+	for _, w := range meta.Recipients {
+		if !slices.ContainsFunc(revoked, func(pub []byte) bool { return bytes.Equal(pub, w.Recipient) }) {
+			kept = append(kept, w)
+		}
+	}
+	meta.Recipients = kept
+	if err := wrapFor(&meta, key, add); err != nil {
+		return "", err
+	}
+	if err := n.signManifest(&meta); err != nil {
+		return "", err
+	}
+
+	newRoot, err := n.PutManifest(meta, replicas)
+	if err != nil {
+		return newRoot, err
+	}
+	return newRoot, n.addPin(newRoot, meta)
+}
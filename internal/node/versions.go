@@ -0,0 +1,122 @@
+package node
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+)
+
+const historyFile = "history.json"
+
+// ErrNoHistory is returned for a path no version was recorded for
+var ErrNoHistory = errors.New("no versions recorded for path")
+
+// ErrVersionsNeedEncryption is returned by AddVersion on a node without
+// encryption at rest, which would keep the history in the clear
+var ErrVersionsNeedEncryption = errors.New("versioned uploads need encryption at rest: the version history holds file keys")
+
+// Version is one upload of a logical path
+type Version struct {
+	Version int       `json:"version"`
+	Root    string    `json:"root"`
+	Key     string    `json:"key"`
+	Size    int64     `json:"size"`
+	Chunks  int       `json:"chunks"`
+	Reused  int       `json:"reused"` // chunks unchanged since the previous version
+	Added   time.Time `json:"added"`
+}
+
+// AddVersion adds a file as the next version of the logical path name. The
+// new manifest points at the previous version as its parent. With
+// opts.Convergent the previous version's key is reused, so chunks that
+// didn't change keep their hash and aren't uploaded again. The history
+// holds every version's key, so it is only kept sealed.
+func (n *Node) AddVersion(path, name string, opts UploadOptions) (AddResult, error) {
+	if n.stateKey == nil {
+		return AddResult{}, ErrVersionsNeedEncryption
+	}
+
+	n.historyMutex.Lock()
+	defer n.historyMutex.Unlock()
+
+	history := n.loadHistory()
+	versions := history[name]
+	var prev *Version
+	if len(versions) > 0 {
+		prev = &versions[len(versions)-1]
+		opts.Parent = prev.Root
+		if opts.Convergent && opts.Key == "" {
+			opts.Key = prev.Key
+		}
+	}
+
+	parentChunks := n.parentChunks(opts.Parent)
+	result, err := n.Add(path, opts)
+	if err != nil {
+		return result, err
+	}
+
+	v := Version{
+		Version: len(versions) + 1,
+		Root:    result.Root,
+		Key:     result.Key,
+		Size:    result.Metadata.Size,
+		Chunks:  len(result.Metadata.Chunks),
+		Added:   time.Now(),
+	}
+	for _, c := range result.Metadata.Chunks {
+		if parentChunks[c.Hash] {
+			v.Reused++
+		}
+	}
+	history[name] = append(versions, v)
+	if err := n.saveHistory(history); err != nil {
+		return result, err
+	}
+	result.Version = v.Version
+	return result, nil
+}
+
+// History lists the versions of a logical path, oldest first
+func (n *Node) History(name string) ([]Version, error) {
+	n.historyMutex.Lock()
+	defer n.historyMutex.Unlock()
+
+	versions, ok := n.loadHistory()[name]
+	if !ok {
+		return nil, ErrNoHistory
+	}
+	return append([]Version(nil), versions...), nil
+}
+
+// loadHistory returns the versions of every logical path; callers hold
+// historyMutex. Without a state dir the history lives in memory only.
+func (n *Node) loadHistory() map[string][]Version {
+	if n.history != nil {
+		return n.history
+	}
+	n.history = make(map[string][]Version)
+	data, err := n.LoadState(historyFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			n.logf("[%d] Cannot read version history: %v\n", n.Config.Port, err)
+		}
+		return n.history
+	}
+	if err := json.Unmarshal(data, &n.history); err != nil {
+		n.logf("[%d] Invalid version history: %v\n", n.Config.Port, err)
+	}
+	if n.history == nil {
+		n.history = make(map[string][]Version)
+	}
+	return n.history
+}
+
+func (n *Node) saveHistory(history map[string][]Version) error {
+	data, err := json.MarshalIndent(history, "", "  ")
+	if err != nil {
+		return err
+	}
+	return n.SaveState(historyFile, data)
+}
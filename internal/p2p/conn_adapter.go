@@ -3,15 +3,18 @@ package p2p
 import (
 	"io"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
-// WSConnAdapter adapts a websocket.Conn to net.Conn
+// WSConnAdapter adapts a websocket.Conn to net.Conn. Writes may come from
+// any goroutine; websocket allows one writer at a time, so they take turns.
 type WSConnAdapter struct {
-	conn   *websocket.Conn
-	reader io.Reader
+	conn       *websocket.Conn
+	reader     io.Reader
+	writeMutex sync.Mutex
 }
 
 func NewWSConnAdapter(conn *websocket.Conn) *WSConnAdapter {
@@ -42,6 +45,8 @@ func (a *WSConnAdapter) Read(b []byte) (n int, err error) {
 }
 
 func (a *WSConnAdapter) Write(b []byte) (n int, err error) {
+	a.writeMutex.Lock()
+	defer a.writeMutex.Unlock()
 	err = a.conn.WriteMessage(websocket.BinaryMessage, b)
 	if err != nil {
 		return 0, err
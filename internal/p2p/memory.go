@@ -0,0 +1,195 @@
+package p2p
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// MemoryNetwork connects MemoryTransports in-process. It can simulate
+// latency, packet loss and network partitions, which makes it suitable for
+// multi-node tests that would otherwise need real sockets.
+type MemoryNetwork struct {
+	Latency  time.Duration // base delivery delay
+	Jitter   time.Duration // random extra delay in [0, Jitter)
+	LossRate float64       // probability in [0, 1] that a message is dropped
+
+	transports map[string]*MemoryTransport
+	partitions map[string]int // address -> partition group (0 = default)
+	rand       *rand.Rand
+	mutex      sync.Mutex
+}
+
+// NewMemoryNetwork creates an empty network. The seed drives loss and jitter
+// so a simulation can be replayed.
+func NewMemoryNetwork(seed int64) *MemoryNetwork {
+	return &MemoryNetwork{
+		transports: make(map[string]*MemoryTransport),
+		partitions: make(map[string]int),
+		rand:       rand.New(rand.NewSource(seed)),
+	}
+}
+
+// NewTransport creates a transport reachable at address
+func (net *MemoryNetwork) NewTransport(address string) *MemoryTransport {
+	t := &MemoryTransport{
+		Address:  address,
+		network:  net,
+		Handlers: make(map[string]func(*Peer, Message)),
+		inbox:    make(chan delivery, 1024),
+		done:     make(chan struct{}),
+	}
+
+	net.mutex.Lock()
+	net.transports[address] = t
+	net.mutex.Unlock()
+	return t
+}
+
+// Partition splits the network so that only addresses in the same group can
+// reach each other. Addresses not listed stay in the default group.
+func (net *MemoryNetwork) Partition(groups ...[]string) {
+	net.mutex.Lock()
+	defer net.mutex.Unlock()
+
+	net.partitions = make(map[string]int)
+	for i, group := range groups {
+		for _, addr := range group {
+			net.partitions[addr] = i + 1
+		}
+	}
+}
+
+// Heal removes all partitions
+func (net *MemoryNetwork) Heal() {
+	net.Partition()
+}
+
+// route decides whether a message from -> to is delivered and with what delay
+func (net *MemoryNetwork) route(from, to string) (*MemoryTransport, time.Duration, bool, error) {
+	net.mutex.Lock()
+	defer net.mutex.Unlock()
+
+	dst, ok := net.transports[to]
+	if !ok {
+		return nil, 0, false, fmt.Errorf("peer %s unreachable", to)
+	}
+	if net.partitions[from] != net.partitions[to] {
+		return nil, 0, false, fmt.Errorf("peer %s unreachable (partitioned)", to)
+	}
+
+	if net.LossRate > 0 && net.rand.Float64() < net.LossRate {
+		return dst, 0, false, nil
+	}
+
+	delay := net.Latency
+	if net.Jitter > 0 {
+		delay += time.Duration(net.rand.Int63n(int64(net.Jitter)))
+	}
+	return dst, delay, true, nil
+}
+
+type delivery struct {
+	from string
+	msg  Message
+}
+
+// MemoryTransport implements Transport on top of a MemoryNetwork
+type MemoryTransport struct {
+	Address  string
+	Handlers map[string]func(*Peer, Message)
+	Mutex    sync.RWMutex
+
+	network   *MemoryNetwork
+	listening bool
+	inbox     chan delivery
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Listen starts delivering messages to the registered handlers. Messages sent
+// before Listen are queued. The address argument is ignored; the transport is
+// reachable at the address it was created with.
+func (t *MemoryTransport) Listen(address string) error {
+	t.Mutex.Lock()
+	if t.listening {
+		t.Mutex.Unlock()
+		return nil
+	}
+	t.listening = true
+	t.Mutex.Unlock()
+
+	go t.readLoop()
+	return nil
+}
+
+// Dial checks that the address is currently reachable
+func (t *MemoryTransport) Dial(address string) error {
+	_, _, _, err := t.network.route(t.Address, address)
+	return err
+}
+
+func (t *MemoryTransport) SendMessage(address string, msg Message) error {
+	dst, delay, ok, err := t.network.route(t.Address, address)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return nil // Dropped silently, like a lost packet
+	}
+
+	d := delivery{from: t.Address, msg: msg}
+	if delay == 0 {
+		dst.enqueue(d)
+		return nil
+	}
+	time.AfterFunc(delay, func() { dst.enqueue(d) })
+	return nil
+}
+
+func (t *MemoryTransport) enqueue(d delivery) {
+	select {
+	case t.inbox <- d:
+	case <-t.done:
+	}
+}
+
+func (t *MemoryTransport) RegisterHandler(msgType MessageType, handler func(*Peer, Message)) {
+	t.Mutex.Lock()
+	defer t.Mutex.Unlock()
+	t.Handlers[string(msgType)] = handler
+}
+
+// readLoop runs handlers one message at a time, like a single connection
+func (t *MemoryTransport) readLoop() {
+	for {
+		select {
+		case d := <-t.inbox:
+			t.Mutex.RLock()
+			handler, exists := t.Handlers[string(d.msg.Type)]
+			t.Mutex.RUnlock()
+
+			if exists {
+				handler(&Peer{ID: d.msg.Sender, Address: d.from, LastSeen: time.Now()}, d.msg)
+			}
+		case <-t.done:
+			return
+		}
+	}
+}
+
+// Close stops delivery and removes the transport from the network
+func (t *MemoryTransport) Close() error {
+	t.closeOnce.Do(func() {
+		t.network.mutex.Lock()
+		delete(t.network.transports, t.Address)
+		t.network.mutex.Unlock()
+
+		t.Mutex.Lock()
+		t.listening = false
+		t.Mutex.Unlock()
+		close(t.done)
+	})
+	return nil
+}
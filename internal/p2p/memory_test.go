@@ -0,0 +1,64 @@
+package p2p
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryTransport(t *testing.T) {
+	net := NewMemoryNetwork(7)
+	net.Latency = 5 * time.Millisecond
+
+	a := net.NewTransport("a")
+	b := net.NewTransport("b")
+	a.Listen("")
+	b.Listen("")
+	defer a.Close()
+	defer b.Close()
+
+	received := make(chan Message, 10)
+	b.RegisterHandler(MsgDHTPing, func(p *Peer, msg Message) {
+		if p.Address != "a" {
+			t.Errorf("Expected sender address a, got %s", p.Address)
+		}
+		received <- msg
+	})
+
+	start := time.Now()
+	if err := a.SendMessage("b", Message{Type: MsgDHTPing, Sender: "a"}); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	select {
+	case <-received:
+		if time.Since(start) < net.Latency {
+			t.Errorf("Message delivered before simulated latency")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Message not delivered")
+	}
+
+	// Partitioned peers can't reach each other
+	net.Partition([]string{"a"}, []string{"b"})
+	if err := a.SendMessage("b", Message{Type: MsgDHTPing}); err == nil {
+		t.Errorf("Expected send across partition to fail")
+	}
+	net.Heal()
+
+	// Full loss drops everything silently
+	net.LossRate = 1
+	net.Latency = 0
+	for i := 0; i < 5; i++ {
+		a.SendMessage("b", Message{Type: MsgDHTPing})
+	}
+	select {
+	case <-received:
+		t.Errorf("Expected lossy network to drop messages")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// Closed transports are unreachable
+	b.Close()
+	if err := a.Dial("b"); err == nil {
+		t.Errorf("Expected closed transport to be unreachable")
+	}
+}
@@ -10,11 +10,19 @@ const (
 	MsgDHTPing      MessageType = "DHT_PING"
 	MsgDHTPong      MessageType = "DHT_PONG"
 	MsgDHTStore     MessageType = "DHT_STORE"
+	MsgDHTStoreAck  MessageType = "DHT_STORE_ACK"
 	MsgDHTFindNode  MessageType = "DHT_FIND_NODE"
 	MsgDHTFindValue MessageType = "DHT_FIND_VALUE"
+	MsgDHTValue     MessageType = "DHT_VALUE"
 	MsgStoreChunk   MessageType = "STORE_CHUNK"
+	MsgStoreAck     MessageType = "STORE_ACK"
 	MsgRequestChunk MessageType = "REQUEST_CHUNK"
+	MsgHasChunk     MessageType = "HAS_CHUNK"
+	MsgHasChunkResp MessageType = "HAS_CHUNK_RESP"
 	MsgFileTransfer MessageType = "FILE_TRANSFER"
+	MsgDeleteChunk  MessageType = "DELETE_CHUNK"
+	MsgChallenge    MessageType = "CHALLENGE"
+	MsgProof        MessageType = "PROOF"
 )
 
 // Message represents a general P2P message
@@ -36,3 +44,31 @@ type DHTPayload struct {
 type ChunkRequestPayload struct {
 	Hash string `json:"hash"`
 }
+
+// StoreAckPayload confirms (or refuses) a STORE_CHUNK
+type StoreAckPayload struct {
+	Hash  string `json:"hash"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// HasChunkPayload answers a HAS_CHUNK query
+type HasChunkPayload struct {
+	Hash string `json:"hash"`
+	Has  bool   `json:"has"`
+}
+
+// ChallengePayload asks a peer to prove it stores a chunk
+type ChallengePayload struct {
+	Hash  string `json:"hash"`
+	Nonce []byte `json:"nonce"`
+}
+
+// ProofPayload answers a CHALLENGE with HMAC-SHA256(nonce, chunk content),
+// or Has false if the chunk is missing
+type ProofPayload struct {
+	Hash  string `json:"hash"`
+	Nonce []byte `json:"nonce"`
+	Has   bool   `json:"has"`
+	Proof []byte `json:"proof,omitempty"`
+}
@@ -27,5 +27,6 @@ type Transport interface {
 	Listen(address string) error
 	Dial(address string) error
 	SendMessage(address string, msg Message) error
+	RegisterHandler(msgType MessageType, handler func(*Peer, Message))
 	Close() error
 }
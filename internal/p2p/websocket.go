@@ -110,6 +110,12 @@ func (t *WebSocketTransport) handleNewConnection(conn *websocket.Conn, address s
 	}
 
 	t.Mutex.Lock()
+	if _, exists := t.Peers[address]; exists && outbound {
+		// Concurrent sends dialed the same peer; keep the first connection
+		t.Mutex.Unlock()
+		conn.Close()
+		return
+	}
 	t.Peers[address] = peer
 	t.Mutex.Unlock()
 
@@ -120,7 +126,9 @@ func (t *WebSocketTransport) readLoop(peer *Peer, conn *websocket.Conn) {
 	defer func() {
 		conn.Close()
 		t.Mutex.Lock()
-		delete(t.Peers, peer.Address)
+		if t.Peers[peer.Address] == peer {
+			delete(t.Peers, peer.Address)
+		}
 		t.Mutex.Unlock()
 	}()
 
@@ -0,0 +1,54 @@
+package p2p
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebSocketConcurrentSends(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := l.Addr().String()
+	l.Close()
+
+	server := NewWebSocketTransport(address)
+	const senders, perSender = 8, 50
+	received := make(chan Message, senders*perSender)
+	server.RegisterHandler(MsgRequestChunk, func(p *Peer, msg Message) {
+		received <- msg
+	})
+	go server.Listen("")
+	time.Sleep(50 * time.Millisecond)
+
+	// Many goroutines writing to one peer share a single connection, as
+	// parallel chunk fetches from one provider do
+	client := NewWebSocketTransport("127.0.0.1:0")
+	var wg sync.WaitGroup
+	for s := 0; s < senders; s++ {
+		wg.Add(1)
+		go func(s int) {
+			defer wg.Done()
+			for i := 0; i < perSender; i++ {
+				msg := Message{Type: MsgRequestChunk, Sender: fmt.Sprintf("%d-%d", s, i)}
+				if err := client.SendMessage(address, msg); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(s)
+	}
+	wg.Wait()
+
+	for i := 0; i < senders*perSender; i++ {
+		select {
+		case <-received:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Received %d of %d messages", i, senders*perSender)
+		}
+	}
+}
@@ -0,0 +1,379 @@
+package s3gw
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxClockSkew is how far x-amz-date may be from our clock, as on AWS
+const maxClockSkew = 15 * time.Minute
+
+// Payload hashes with a special meaning in x-amz-content-sha256
+const (
+	unsignedPayload  = "UNSIGNED-PAYLOAD"
+	streamingPayload = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+)
+
+// emptySHA256 is the hash of no data, part of every chunk string to sign
+var emptySHA256 = sha256Hex(nil)
+
+// signature is what a verified request was signed with; streaming bodies
+// chain their chunk signatures from it
+type signature struct {
+	key   []byte // derived signing key
+	date  string // x-amz-date
+	scope string // date/region/s3/aws4_request
+	seed  string // signature of the request headers
+}
+
+// verifySignature checks an AWS Signature V4 Authorization header. The
+// header must sign x-amz-date, which must be within maxClockSkew, and
+// x-amz-content-sha256, which verifiedBody then holds the body to.
+func (s *Server) verifySignature(r *http.Request) (*signature, error) {
+	auth := r.Header.Get("Authorization")
+	rest, ok := strings.CutPrefix(auth, "AWS4-HMAC-SHA256 ")
+	if !ok {
+		return nil, errAccessDenied // anonymous, presigned or SigV2 requests
+	}
+
+	fields := make(map[string]string)
+	for _, part := range strings.Split(rest, ",") {
+		if k, v, ok := strings.Cut(strings.TrimSpace(part), "="); ok {
+			fields[k] = v
+		}
+	}
+	scope := strings.SplitN(fields["Credential"], "/", 2)
+	if len(scope) != 2 || scope[0] != s.config.AccessKey {
+		return nil, errAccessDenied
+	}
+	scopeParts := strings.Split(scope[1], "/") // date/region/s3/aws4_request
+	if len(scopeParts) != 4 {
+		return nil, errAccessDenied
+	}
+
+	signedHeaders := strings.Split(fields["SignedHeaders"], ";")
+	if !containsString(signedHeaders, "x-amz-date") || !containsString(signedHeaders, "x-amz-content-sha256") {
+		return nil, errAccessDenied
+	}
+	amzDate := r.Header.Get("x-amz-date")
+	signed, err := time.Parse("20060102T150405Z", amzDate)
+	if err != nil || !strings.HasPrefix(amzDate, scopeParts[0]) {
+		return nil, errAccessDenied
+	}
+	if skew := time.Since(signed); skew > maxClockSkew || skew < -maxClockSkew {
+		return nil, errRequestTimeTooSkewed
+	}
+	var headers strings.Builder
+	for _, h := range signedHeaders {
+		value := r.Header.Get(h)
+		if h == "host" {
+			value = r.Host
+		} else if h == "content-length" {
+			value = strconv.FormatInt(r.ContentLength, 10)
+		}
+		headers.WriteString(h + ":" + strings.TrimSpace(value) + "\n")
+	}
+
+	payloadHash := r.Header.Get("x-amz-content-sha256")
+
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		canonicalURI(r.URL),
+		canonicalQuery(r.URL.Query()),
+		headers.String(),
+		fields["SignedHeaders"],
+		payloadHash,
+	}, "\n")
+
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope[1] + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+s.config.SecretKey), scopeParts[0])
+	key = hmacSHA256(key, scopeParts[1])
+	key = hmacSHA256(key, scopeParts[2])
+	key = hmacSHA256(key, scopeParts[3])
+	expected := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	if !hmac.Equal([]byte(expected), []byte(fields["Signature"])) {
+		return nil, errSignatureMismatch
+	}
+	return &signature{key: key, date: amzDate, scope: scope[1], seed: expected}, nil
+}
+
+// verifiedBody holds the body of a signed request to its payload hash:
+// a SHA-256 of the data, checked when the body ends, or a chain of chunk
+// signatures for aws-chunked streams. Unsigned payloads are only accepted
+// without a body. Small bodies, which handlers may not read to the end,
+// are checked up front.
+func verifiedBody(r *http.Request, sig *signature) (io.ReadCloser, error) {
+	payloadHash := r.Header.Get("x-amz-content-sha256")
+	switch {
+	case payloadHash == streamingPayload:
+		return struct {
+			io.Reader
+			io.Closer
+		}{&chunkedReader{r: bufio.NewReader(r.Body), sig: sig, prev: sig.seed}, r.Body}, nil
+	case payloadHash == unsignedPayload || strings.HasPrefix(payloadHash, "STREAMING-"):
+		if r.ContentLength != 0 {
+			return nil, errContentSHA256Mismatch
+		}
+		return http.NoBody, nil
+	}
+	want, err := hex.DecodeString(payloadHash)
+	if err != nil || len(want) != sha256.Size {
+		return nil, errContentSHA256Mismatch
+	}
+	body := &hashedReader{r: r.Body, hash: sha256.New(), want: want}
+	if r.Method == http.MethodPut {
+		return struct {
+			io.Reader
+			io.Closer
+		}{body, r.Body}, nil
+	}
+	data, err := io.ReadAll(io.LimitReader(body, 1<<20+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > 1<<20 {
+		return nil, errInvalidArgument
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// hashedReader fails at the end of the data if it doesn't hash to want
+type hashedReader struct {
+	r    io.Reader
+	hash hash.Hash
+	want []byte
+}
+
+func (h *hashedReader) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	h.hash.Write(p[:n])
+	if err == io.EOF && !hmac.Equal(h.hash.Sum(nil), h.want) {
+		return n, errContentSHA256Mismatch
+	}
+	return n, err
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// canonicalURI is the path with every segment escaped the AWS way
+func canonicalURI(u *url.URL) string {
+	segments := strings.Split(u.Path, "/")
+	for i, seg := range segments {
+		segments[i] = awsEscape(seg)
+	}
+	return strings.Join(segments, "/")
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		values := query[k]
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, awsEscape(k)+"="+awsEscape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// awsEscape percent-encodes everything but unreserved characters
+func awsEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// requestBody returns the object data of a PUT, decoding the aws-chunked
+// framing SDKs use for streaming uploads. Bodies of signed requests are
+// already decoded and verified by verifiedBody.
+func requestBody(r *http.Request) io.Reader {
+	if _, signed := r.Body.(verified); signed {
+		return r.Body
+	}
+	streaming := strings.HasPrefix(r.Header.Get("x-amz-content-sha256"), "STREAMING-")
+	if !streaming && !strings.Contains(r.Header.Get("Content-Encoding"), "aws-chunked") {
+		return r.Body
+	}
+	return &chunkedReader{r: bufio.NewReader(r.Body)}
+}
+
+// verified marks a request body checked against its signature
+type verified struct {
+	io.ReadCloser
+}
+
+// maxSignedChunk bounds the chunks of a signed stream, which are buffered
+// until their signature is checked
+const maxSignedChunk = 16 << 20
+
+// chunkedReader decodes aws-chunked bodies:
+//
+//	<hex size>[;chunk-signature=...]\r\n<data>\r\n ... 0[;...]\r\n[trailers]\r\n
+//
+// With sig set, each chunk is read whole and its signature, chained from
+// the previous one, checked before any of it is returned.
+type chunkedReader struct {
+	r       *bufio.Reader
+	left    int64 // bytes left in the current chunk
+	started bool
+	done    bool
+
+	sig     *signature
+	prev    string // previous chunk signature
+	pending []byte // verified data not yet returned
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	if c.sig != nil {
+		return c.readSigned(p)
+	}
+	if c.done {
+		return 0, io.EOF
+	}
+	if c.left == 0 {
+		if c.started {
+			if err := c.expectCRLF(); err != nil {
+				return 0, err
+			}
+		}
+		c.started = true
+
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return 0, err
+		}
+		sizeHex, _, _ := strings.Cut(strings.TrimRight(line, "\r\n"), ";")
+		size, err := strconv.ParseInt(sizeHex, 16, 64)
+		if err != nil || size < 0 {
+			return 0, errors.New("malformed aws-chunked body")
+		}
+		if size == 0 {
+			// Skip trailers up to the final empty line
+			for {
+				line, err := c.r.ReadString('\n')
+				if strings.TrimRight(line, "\r\n") == "" || err != nil {
+					break
+				}
+			}
+			c.done = true
+			return 0, io.EOF
+		}
+		c.left = size
+	}
+
+	if int64(len(p)) > c.left {
+		p = p[:c.left]
+	}
+	n, err := c.r.Read(p)
+	c.left -= int64(n)
+	if err == io.EOF && c.left > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (c *chunkedReader) readSigned(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		if err := c.nextSignedChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// nextSignedChunk reads and verifies one chunk into pending
+func (c *chunkedReader) nextSignedChunk() error {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	sizeHex, ext, _ := strings.Cut(strings.TrimRight(line, "\r\n"), ";")
+	size, err := strconv.ParseInt(sizeHex, 16, 64)
+	if err != nil || size < 0 || size > maxSignedChunk {
+		return errors.New("malformed aws-chunked body")
+	}
+	claimed, ok := strings.CutPrefix(ext, "chunk-signature=")
+	if !ok {
+		return errSignatureMismatch
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return err
+	}
+	if err := c.expectCRLF(); err != nil {
+		return err
+	}
+
+	stringToSign := "AWS4-HMAC-SHA256-PAYLOAD\n" + c.sig.date + "\n" + c.sig.scope + "\n" +
+		c.prev + "\n" + emptySHA256 + "\n" + sha256Hex(data)
+	expected := hex.EncodeToString(hmacSHA256(c.sig.key, stringToSign))
+	if !hmac.Equal([]byte(expected), []byte(claimed)) {
+		return errSignatureMismatch
+	}
+	c.prev = expected
+	c.pending = data
+	c.done = size == 0
+	return nil
+}
+
+func (c *chunkedReader) expectCRLF() error {
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(c.r, b); err != nil {
+		return err
+	}
+	if string(b) != "\r\n" {
+		return errors.New("malformed aws-chunked body")
+	}
+	return nil
+}
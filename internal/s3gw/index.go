@@ -0,0 +1,227 @@
+package s3gw
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tanmaydeobhankar/nebulafs/internal/node"
+)
+
+const indexFile = "s3index.json"
+
+// Object maps an S3 key to a stored file. It holds the file key, so the
+// index is only as private as the node state dir (sealed with
+// encryption at rest).
+type Object struct {
+	Root        string            `json:"root"`
+	Key         string            `json:"key"` // file encryption key, hex
+	Size        int64             `json:"size"`
+	ETag        string            `json:"etag"`
+	ContentType string            `json:"content_type"`
+	Modified    time.Time         `json:"modified"`
+	UserMeta    map[string]string `json:"user_meta,omitempty"` // x-amz-meta-* headers
+}
+
+// Bucket is a flat namespace of objects
+type Bucket struct {
+	Created time.Time          `json:"created"`
+	Objects map[string]*Object `json:"objects"`
+}
+
+// Index is the node-local, mutable bucket/key -> root mapping. Every change
+// is written through to the node state dir.
+type Index struct {
+	node    *node.Node
+	Buckets map[string]*Bucket `json:"buckets"`
+	mutex   sync.RWMutex
+}
+
+// LoadIndex reads the index from the node state dir
+func LoadIndex(n *node.Node) (*Index, error) {
+	idx := &Index{node: n, Buckets: make(map[string]*Bucket)}
+	data, err := n.LoadState(indexFile)
+	if os.IsNotExist(err) {
+		return idx, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, idx); err != nil {
+		return nil, err
+	}
+	if idx.Buckets == nil {
+		idx.Buckets = make(map[string]*Bucket)
+	}
+	return idx, nil
+}
+
+// save writes the index; callers hold the write lock
+func (idx *Index) save() error {
+	data, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	return idx.node.SaveState(indexFile, data)
+}
+
+// CreateBucket adds an empty bucket; it reports false if it already existed
+func (idx *Index) CreateBucket(name string) (bool, error) {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+
+	if _, ok := idx.Buckets[name]; ok {
+		return false, nil
+	}
+	idx.Buckets[name] = &Bucket{Created: time.Now().UTC(), Objects: make(map[string]*Object)}
+	return true, idx.save()
+}
+
+// DeleteBucket removes an empty bucket
+func (idx *Index) DeleteBucket(name string) error {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+
+	b, ok := idx.Buckets[name]
+	if !ok {
+		return errNoSuchBucket
+	}
+	if len(b.Objects) > 0 {
+		return errBucketNotEmpty
+	}
+	delete(idx.Buckets, name)
+	return idx.save()
+}
+
+// BucketNames lists bucket names with their creation times, sorted by name
+func (idx *Index) BucketNames() ([]string, map[string]time.Time) {
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+
+	names := make([]string, 0, len(idx.Buckets))
+	created := make(map[string]time.Time, len(idx.Buckets))
+	for name, b := range idx.Buckets {
+		names = append(names, name)
+		created[name] = b.Created
+	}
+	sort.Strings(names)
+	return names, created
+}
+
+// HasBucket reports whether a bucket exists
+func (idx *Index) HasBucket(name string) bool {
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+	_, ok := idx.Buckets[name]
+	return ok
+}
+
+// Get returns a copy of an object entry
+func (idx *Index) Get(bucket, key string) (Object, error) {
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+
+	b, ok := idx.Buckets[bucket]
+	if !ok {
+		return Object{}, errNoSuchBucket
+	}
+	obj, ok := b.Objects[key]
+	if !ok {
+		return Object{}, errNoSuchKey
+	}
+	return *obj, nil
+}
+
+// Put sets an object entry and returns the entry it replaced, if any
+func (idx *Index) Put(bucket, key string, obj Object) (*Object, error) {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+
+	b, ok := idx.Buckets[bucket]
+	if !ok {
+		return nil, errNoSuchBucket
+	}
+	old := b.Objects[key]
+	b.Objects[key] = &obj
+	return old, idx.save()
+}
+
+// Delete removes an object entry and returns it; deleting a missing key is
+// not an error, as in S3
+func (idx *Index) Delete(bucket, key string) (*Object, error) {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+
+	b, ok := idx.Buckets[bucket]
+	if !ok {
+		return nil, errNoSuchBucket
+	}
+	old, ok := b.Objects[key]
+	if !ok {
+		return nil, nil
+	}
+	delete(b.Objects, key)
+	return old, idx.save()
+}
+
+// listing is one page of a bucket listing
+type listing struct {
+	Keys           []string
+	Objects        []Object
+	CommonPrefixes []string
+	Truncated      bool
+	NextAfter      string // resume listing after this key or prefix
+}
+
+// List returns up to max keys (and common prefixes) after the given key,
+// in lexical order, grouping keys that contain delimiter after prefix
+func (idx *Index) List(bucket, prefix, delimiter, after string, max int) (listing, error) {
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+
+	b, ok := idx.Buckets[bucket]
+	if !ok {
+		return listing{}, errNoSuchBucket
+	}
+
+	keys := make([]string, 0, len(b.Objects))
+	for k := range b.Objects {
+		if strings.HasPrefix(k, prefix) && k > after {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var page listing
+	for _, k := range keys {
+		if delimiter != "" {
+			if i := strings.Index(k[len(prefix):], delimiter); i >= 0 {
+				common := k[:len(prefix)+i+len(delimiter)]
+				if n := len(page.CommonPrefixes); n > 0 && page.CommonPrefixes[n-1] == common {
+					continue
+				}
+				if common <= after {
+					continue // continuing after this prefix
+				}
+				if len(page.Keys)+len(page.CommonPrefixes) == max {
+					page.Truncated = true
+					break
+				}
+				page.CommonPrefixes = append(page.CommonPrefixes, common)
+				page.NextAfter = common
+				continue
+			}
+		}
+		if len(page.Keys)+len(page.CommonPrefixes) == max {
+			page.Truncated = true
+			break
+		}
+		page.Keys = append(page.Keys, k)
+		page.Objects = append(page.Objects, *b.Objects[k])
+		page.NextAfter = k
+	}
+	return page, nil
+}
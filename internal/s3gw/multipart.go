@@ -0,0 +1,331 @@
+package s3gw
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxParts is the S3 limit on parts per upload
+const maxParts = 10000
+
+// multipartUpload is an upload in progress. Parts are staged as files in
+// dir; uploads don't survive a gateway restart.
+type multipartUpload struct {
+	Bucket    string
+	Key       string
+	Initiated time.Time
+	dir       string
+	header    http.Header       // Content-Type and user metadata from initiation
+	parts     map[int]partEntry // part number -> staged part
+}
+
+type partEntry struct {
+	ETag     string
+	Size     int64
+	Modified time.Time
+}
+
+type initiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadID string   `xml:"UploadId"`
+}
+
+func (s *Server) createUpload(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	if !s.index.HasBucket(bucket) {
+		writeError(w, r, errNoSuchBucket)
+		return
+	}
+
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	id := hex.EncodeToString(idBytes)
+
+	dir := filepath.Join(s.config.TempDir, "upload-"+id)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	s.mutex.Lock()
+	s.uploads[id] = &multipartUpload{
+		Bucket:    bucket,
+		Key:       key,
+		Initiated: time.Now().UTC(),
+		dir:       dir,
+		header:    r.Header.Clone(),
+		parts:     make(map[int]partEntry),
+	}
+	s.mutex.Unlock()
+
+	writeXML(w, http.StatusOK, initiateMultipartUploadResult{
+		Xmlns:    s3Namespace,
+		Bucket:   bucket,
+		Key:      key,
+		UploadID: id,
+	})
+}
+
+func (s *Server) upload(id string) (*multipartUpload, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	u, ok := s.uploads[id]
+	return u, ok
+}
+
+func (s *Server) uploadPart(w http.ResponseWriter, r *http.Request, id string) {
+	u, ok := s.upload(id)
+	if !ok {
+		writeError(w, r, errNoSuchUpload)
+		return
+	}
+	number, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if err != nil || number < 1 || number > maxParts {
+		writeError(w, r, errInvalidArgument)
+		return
+	}
+
+	// Stage under a temporary name so a concurrent retry of the same part
+	// never sees a half-written file
+	tmp, err := os.CreateTemp(u.dir, "part-")
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	hash := md5.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), requestBody(r))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), u.partPath(number))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		writeError(w, r, err)
+		return
+	}
+
+	etag := hex.EncodeToString(hash.Sum(nil))
+	s.mutex.Lock()
+	u.parts[number] = partEntry{ETag: etag, Size: size, Modified: time.Now().UTC()}
+	s.mutex.Unlock()
+
+	w.Header().Set("ETag", `"`+etag+`"`)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (u *multipartUpload) partPath(number int) string {
+	return filepath.Join(u.dir, fmt.Sprintf("%05d", number))
+}
+
+type completeMultipartUpload struct {
+	Parts []struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	} `xml:"Part"`
+}
+
+type completeMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Location string   `xml:"Location"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	ETag     string   `xml:"ETag"`
+}
+
+// completeUpload joins the listed parts into one file and stores it like a
+// PutObject. The ETag follows S3: the MD5 of the part MD5s, "-" and the
+// number of parts.
+func (s *Server) completeUpload(w http.ResponseWriter, r *http.Request, bucket, key, id string) {
+	u, ok := s.upload(id)
+	if !ok || u.Bucket != bucket || u.Key != key {
+		writeError(w, r, errNoSuchUpload)
+		return
+	}
+
+	var req completeMultipartUpload
+	if err := xml.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil || len(req.Parts) == 0 {
+		writeError(w, r, errMalformedXML)
+		return
+	}
+
+	s.mutex.Lock()
+	parts := make(map[int]partEntry, len(u.parts))
+	for k, v := range u.parts {
+		parts[k] = v
+	}
+	s.mutex.Unlock()
+
+	var readers []io.Reader
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	etagHash := md5.New()
+	last := 0
+	for _, p := range req.Parts {
+		if p.PartNumber <= last {
+			writeError(w, r, errInvalidPartOrder)
+			return
+		}
+		last = p.PartNumber
+
+		entry, ok := parts[p.PartNumber]
+		if !ok || strings.Trim(p.ETag, `"`) != entry.ETag {
+			writeError(w, r, errInvalidPart)
+			return
+		}
+		f, err := os.Open(u.partPath(p.PartNumber))
+		if err != nil {
+			writeError(w, r, errInvalidPart)
+			return
+		}
+		files = append(files, f)
+		readers = append(readers, f)
+
+		sum, _ := hex.DecodeString(entry.ETag)
+		etagHash.Write(sum)
+	}
+
+	path, _, cleanup, err := s.stage(key, io.MultiReader(readers...))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer cleanup()
+
+	// Content type and metadata were given when the upload was initiated
+	init := &http.Request{Header: u.header}
+	etag := fmt.Sprintf("%s-%d", hex.EncodeToString(etagHash.Sum(nil)), len(req.Parts))
+	if _, err := s.store(init, bucket, key, path, etag); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	s.dropUpload(id)
+	writeXML(w, http.StatusOK, completeMultipartUploadResult{
+		Xmlns:    s3Namespace,
+		Location: "/" + bucket + "/" + key,
+		Bucket:   bucket,
+		Key:      key,
+		ETag:     `"` + etag + `"`,
+	})
+}
+
+func (s *Server) abortUpload(w http.ResponseWriter, r *http.Request, id string) {
+	if _, ok := s.upload(id); !ok {
+		writeError(w, r, errNoSuchUpload)
+		return
+	}
+	s.dropUpload(id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) dropUpload(id string) {
+	s.mutex.Lock()
+	u := s.uploads[id]
+	delete(s.uploads, id)
+	s.mutex.Unlock()
+	if u != nil {
+		os.RemoveAll(u.dir)
+	}
+}
+
+type listPartsResult struct {
+	XMLName  xml.Name `xml:"ListPartsResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadID string   `xml:"UploadId"`
+	Parts    []struct {
+		PartNumber   int    `xml:"PartNumber"`
+		LastModified string `xml:"LastModified"`
+		ETag         string `xml:"ETag"`
+		Size         int64  `xml:"Size"`
+	} `xml:"Part"`
+}
+
+func (s *Server) listParts(w http.ResponseWriter, r *http.Request, bucket, key, id string) {
+	u, ok := s.upload(id)
+	if !ok || u.Bucket != bucket || u.Key != key {
+		writeError(w, r, errNoSuchUpload)
+		return
+	}
+
+	result := listPartsResult{Xmlns: s3Namespace, Bucket: bucket, Key: key, UploadID: id}
+	s.mutex.Lock()
+	numbers := make([]int, 0, len(u.parts))
+	for number := range u.parts {
+		numbers = append(numbers, number)
+	}
+	sort.Ints(numbers)
+	for _, number := range numbers {
+		p := u.parts[number]
+		result.Parts = append(result.Parts, struct {
+			PartNumber   int    `xml:"PartNumber"`
+			LastModified string `xml:"LastModified"`
+			ETag         string `xml:"ETag"`
+			Size         int64  `xml:"Size"`
+		}{number, s3Time(p.Modified), `"` + p.ETag + `"`, p.Size})
+	}
+	s.mutex.Unlock()
+
+	writeXML(w, http.StatusOK, result)
+}
+
+type listMultipartUploadsResult struct {
+	XMLName xml.Name `xml:"ListMultipartUploadsResult"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Bucket  string   `xml:"Bucket"`
+	Uploads []struct {
+		Key       string `xml:"Key"`
+		UploadID  string `xml:"UploadId"`
+		Initiated string `xml:"Initiated"`
+	} `xml:"Upload"`
+}
+
+func (s *Server) listUploads(w http.ResponseWriter, r *http.Request, bucket string) {
+	if !s.index.HasBucket(bucket) {
+		writeError(w, r, errNoSuchBucket)
+		return
+	}
+
+	result := listMultipartUploadsResult{Xmlns: s3Namespace, Bucket: bucket}
+	s.mutex.Lock()
+	for id, u := range s.uploads {
+		if u.Bucket == bucket {
+			result.Uploads = append(result.Uploads, struct {
+				Key       string `xml:"Key"`
+				UploadID  string `xml:"UploadId"`
+				Initiated string `xml:"Initiated"`
+			}{u.Key, id, s3Time(u.Initiated)})
+		}
+	}
+	s.mutex.Unlock()
+
+	sort.Slice(result.Uploads, func(i, j int) bool {
+		return result.Uploads[i].Key < result.Uploads[j].Key
+	})
+	writeXML(w, http.StatusOK, result)
+}
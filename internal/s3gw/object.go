@@ -0,0 +1,301 @@
+package s3gw
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const s3Namespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+type owner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+var nodeOwner = owner{ID: "nebulafs", DisplayName: "nebulafs"}
+
+type listAllMyBucketsResult struct {
+	XMLName xml.Name `xml:"ListAllMyBucketsResult"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Owner   owner    `xml:"Owner"`
+	Buckets []struct {
+		Name         string `xml:"Name"`
+		CreationDate string `xml:"CreationDate"`
+	} `xml:"Buckets>Bucket"`
+}
+
+func (s *Server) listBuckets(w http.ResponseWriter, r *http.Request) {
+	names, created := s.index.BucketNames()
+	result := listAllMyBucketsResult{Xmlns: s3Namespace, Owner: nodeOwner}
+	for _, name := range names {
+		result.Buckets = append(result.Buckets, struct {
+			Name         string `xml:"Name"`
+			CreationDate string `xml:"CreationDate"`
+		}{name, s3Time(created[name])})
+	}
+	writeXML(w, http.StatusOK, result)
+}
+
+func (s *Server) createBucket(w http.ResponseWriter, r *http.Request, bucket string) {
+	if !bucketName.MatchString(bucket) {
+		writeError(w, r, errInvalidBucketName)
+		return
+	}
+	// Re-creating an owned bucket succeeds, as in us-east-1
+	if _, err := s.index.CreateBucket(bucket); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.Header().Set("Location", "/"+bucket)
+	w.WriteHeader(http.StatusOK)
+}
+
+type locationConstraint struct {
+	XMLName xml.Name `xml:"LocationConstraint"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Region  string   `xml:",chardata"`
+}
+
+func (s *Server) bucketLocation(w http.ResponseWriter, r *http.Request, bucket string) {
+	if !s.index.HasBucket(bucket) {
+		writeError(w, r, errNoSuchBucket)
+		return
+	}
+	region := s.config.Region
+	if region == "us-east-1" {
+		region = ""
+	}
+	writeXML(w, http.StatusOK, locationConstraint{Xmlns: s3Namespace, Region: region})
+}
+
+type objectEntry struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type commonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type listBucketResult struct {
+	XMLName               xml.Name       `xml:"ListBucketResult"`
+	Xmlns                 string         `xml:"xmlns,attr"`
+	Name                  string         `xml:"Name"`
+	Prefix                string         `xml:"Prefix"`
+	Delimiter             string         `xml:"Delimiter,omitempty"`
+	MaxKeys               int            `xml:"MaxKeys"`
+	KeyCount              int            `xml:"KeyCount"`
+	IsTruncated           bool           `xml:"IsTruncated"`
+	ContinuationToken     string         `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string         `xml:"NextContinuationToken,omitempty"`
+	StartAfter            string         `xml:"StartAfter,omitempty"`
+	Contents              []objectEntry  `xml:"Contents"`
+	CommonPrefixes        []commonPrefix `xml:"CommonPrefixes"`
+}
+
+// listObjects implements ListObjectsV2. Continuation tokens are the last
+// key or common prefix returned, base64 encoded.
+func (s *Server) listObjects(w http.ResponseWriter, r *http.Request, bucket string) {
+	query := r.URL.Query()
+	if query.Get("list-type") != "2" {
+		writeError(w, r, errNotImplemented) // ListObjects (v1)
+		return
+	}
+
+	maxKeys := 1000
+	if v := query.Get("max-keys"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeError(w, r, errInvalidArgument)
+			return
+		}
+		if n < maxKeys {
+			maxKeys = n
+		}
+	}
+
+	after := query.Get("start-after")
+	token := query.Get("continuation-token")
+	if token != "" {
+		decoded, err := base64.StdEncoding.DecodeString(token)
+		if err != nil {
+			writeError(w, r, errInvalidArgument)
+			return
+		}
+		after = string(decoded)
+	}
+
+	page, err := s.index.List(bucket, query.Get("prefix"), query.Get("delimiter"), after, maxKeys)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	result := listBucketResult{
+		Xmlns:             s3Namespace,
+		Name:              bucket,
+		Prefix:            query.Get("prefix"),
+		Delimiter:         query.Get("delimiter"),
+		MaxKeys:           maxKeys,
+		KeyCount:          len(page.Keys) + len(page.CommonPrefixes),
+		IsTruncated:       page.Truncated,
+		ContinuationToken: token,
+		StartAfter:        query.Get("start-after"),
+	}
+	if page.Truncated {
+		result.NextContinuationToken = base64.StdEncoding.EncodeToString([]byte(page.NextAfter))
+	}
+	for i, key := range page.Keys {
+		obj := page.Objects[i]
+		result.Contents = append(result.Contents, objectEntry{
+			Key:          key,
+			LastModified: s3Time(obj.Modified),
+			ETag:         `"` + obj.ETag + `"`,
+			Size:         obj.Size,
+			StorageClass: "STANDARD",
+		})
+	}
+	for _, p := range page.CommonPrefixes {
+		result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{p})
+	}
+	writeXML(w, http.StatusOK, result)
+}
+
+type deleteRequest struct {
+	Quiet   bool `xml:"Quiet"`
+	Objects []struct {
+		Key string `xml:"Key"`
+	} `xml:"Object"`
+}
+
+type deleteResult struct {
+	XMLName xml.Name `xml:"DeleteResult"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Deleted []struct {
+		Key string `xml:"Key"`
+	} `xml:"Deleted"`
+}
+
+// deleteObjects implements DeleteObjects (multi-object delete)
+func (s *Server) deleteObjects(w http.ResponseWriter, r *http.Request, bucket string) {
+	var req deleteRequest
+	if err := xml.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil {
+		writeError(w, r, errMalformedXML)
+		return
+	}
+
+	result := deleteResult{Xmlns: s3Namespace}
+	for _, o := range req.Objects {
+		old, err := s.index.Delete(bucket, o.Key)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if old != nil {
+			s.node.Unpin(old.Root)
+		}
+		if !req.Quiet {
+			result.Deleted = append(result.Deleted, struct {
+				Key string `xml:"Key"`
+			}{o.Key})
+		}
+	}
+	writeXML(w, http.StatusOK, result)
+}
+
+func (s *Server) putObject(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	if !s.index.HasBucket(bucket) {
+		writeError(w, r, errNoSuchBucket)
+		return
+	}
+
+	path, etag, cleanup, err := s.stage(key, requestBody(r))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer cleanup()
+
+	obj, err := s.store(r, bucket, key, path, etag)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.Header().Set("ETag", `"`+obj.ETag+`"`)
+	w.WriteHeader(http.StatusOK)
+}
+
+// setObjectHeaders writes the headers shared by GET and HEAD
+func setObjectHeaders(w http.ResponseWriter, obj Object) {
+	w.Header().Set("ETag", `"`+obj.ETag+`"`)
+	w.Header().Set("Last-Modified", obj.Modified.UTC().Format(http.TimeFormat))
+	w.Header().Set("Content-Type", obj.ContentType)
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("x-amz-meta-nebula-root", obj.Root)
+	for name, value := range obj.UserMeta {
+		w.Header().Set(name, value)
+	}
+}
+
+// getObject streams the object, fetching chunks from the network as needed.
+// Range and conditional requests are handled by http.ServeContent.
+func (s *Server) getObject(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	obj, err := s.index.Get(bucket, key)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	meta, err := s.node.GetManifest(obj.Root)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	reader, err := s.node.OpenFile(meta, obj.Key)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	setObjectHeaders(w, obj)
+	http.ServeContent(w, r, "", obj.Modified, reader)
+}
+
+func (s *Server) headObject(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	obj, err := s.index.Get(bucket, key)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	setObjectHeaders(w, obj)
+	if match := r.Header.Get("If-None-Match"); match == `"`+obj.ETag+`"` || match == "*" {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if since, err := time.Parse(http.TimeFormat, r.Header.Get("If-Modified-Since")); err == nil && !obj.Modified.Truncate(time.Second).After(since) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(obj.Size, 10))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) deleteObject(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	old, err := s.index.Delete(bucket, key)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if old != nil {
+		s.node.Unpin(old.Root)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
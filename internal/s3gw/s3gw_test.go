@@ -0,0 +1,270 @@
+package s3gw
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tanmaydeobhankar/nebulafs/internal/files"
+	"github.com/tanmaydeobhankar/nebulafs/internal/node"
+	"github.com/tanmaydeobhankar/nebulafs/internal/p2p"
+	"github.com/tanmaydeobhankar/nebulafs/internal/storage"
+)
+
+func newTestServer(t *testing.T, config Config) (*Server, *httptest.Server) {
+	tmpDir := t.TempDir()
+	n, err := node.NewNode(node.NodeConfig{
+		Port:       8300,
+		StorageDir: filepath.Join(tmpDir, "node"),
+		Store:      storage.NewMemoryStore(),
+		Transport:  p2p.NewMemoryNetwork(1).NewTransport("127.0.0.1:8300"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go n.Start()
+
+	config.TempDir = filepath.Join(tmpDir, "s3tmp")
+	srv, err := NewServer(n, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(srv)
+	t.Cleanup(ts.Close)
+	return srv, ts
+}
+
+// TestSignedClient drives the gateway with the SigV4 client used for cold
+// storage tiers
+func TestSignedClient(t *testing.T) {
+	srv, ts := newTestServer(t, Config{AccessKey: "nebula", SecretKey: "s3cr3t"})
+	srv.index.CreateBucket("chunks")
+
+	client, _ := storage.NewS3Store(storage.S3Config{
+		Endpoint: ts.URL, Bucket: "chunks", Prefix: "cold/",
+		AccessKey: "nebula", SecretKey: "s3cr3t",
+	})
+	chunk := files.Chunk{Hash: "abc123", Content: []byte("chunk via s3")}
+	if err := client.WriteChunk(chunk); err != nil {
+		t.Fatalf("PutObject failed: %v", err)
+	}
+	got, err := client.ReadChunk("abc123")
+	if err != nil || !bytes.Equal(got.Content, chunk.Content) {
+		t.Fatalf("GetObject failed: %v", err)
+	}
+	if !client.HasChunk("abc123") || client.HasChunk("missing") {
+		t.Errorf("HeadObject gave wrong answers")
+	}
+	if hashes, err := client.ListChunks(); err != nil || len(hashes) != 1 || hashes[0] != "abc123" {
+		t.Errorf("ListObjectsV2 returned %v (%v)", hashes, err)
+	}
+	if err := client.DeleteChunk("abc123"); err != nil || client.HasChunk("abc123") {
+		t.Errorf("DeleteObject failed: %v", err)
+	}
+
+	client.Config.SecretKey = "wrong"
+	if err := client.WriteChunk(chunk); err == nil {
+		t.Errorf("Request with a bad signature was accepted")
+	}
+}
+
+func TestObjectsAndMultipart(t *testing.T) {
+	_, ts := newTestServer(t, Config{Anonymous: true})
+
+	do := func(method, path string, body []byte, header ...string) (*http.Response, []byte) {
+		req, _ := http.NewRequest(method, ts.URL+path, bytes.NewReader(body))
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp, data
+	}
+
+	if resp, _ := do("PUT", "/photos", nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("CreateBucket: %d", resp.StatusCode)
+	}
+	if resp, _ := do("PUT", "/nope/key", []byte("x")); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("PutObject into a missing bucket: %d", resp.StatusCode)
+	}
+
+	// aws-chunked streaming body as sent by SDKs
+	chunked := "5;chunk-signature=aa\r\nhello\r\n6;chunk-signature=bb\r\n world\r\n0;chunk-signature=cc\r\n\r\n"
+	resp, _ := do("PUT", "/photos/2024/a.txt", []byte(chunked),
+		"x-amz-content-sha256", "STREAMING-AWS4-HMAC-SHA256-PAYLOAD",
+		"Content-Type", "text/plain", "x-amz-meta-author", "ada")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("PutObject: %d", resp.StatusCode)
+	}
+	resp, body := do("GET", "/photos/2024/a.txt", nil)
+	if string(body) != "hello world" || resp.Header.Get("Content-Type") != "text/plain" || resp.Header.Get("x-amz-meta-author") != "ada" {
+		t.Errorf("GetObject: %q %v", body, resp.Header)
+	}
+	if resp, body = do("GET", "/photos/2024/a.txt", nil, "Range", "bytes=6-"); resp.StatusCode != http.StatusPartialContent || string(body) != "world" {
+		t.Errorf("Range GetObject: %d %q", resp.StatusCode, body)
+	}
+	if resp, _ = do("HEAD", "/photos/2024/a.txt", nil); resp.ContentLength != 11 {
+		t.Errorf("HeadObject length %d", resp.ContentLength)
+	}
+	do("PUT", "/photos/2024/b.txt", []byte("b"))
+	do("PUT", "/photos/top.txt", []byte("t"))
+
+	// Multipart: two parts, the first spanning more than one chunk
+	resp, body = do("POST", "/photos/big.bin?uploads", nil)
+	var initResult initiateMultipartUploadResult
+	if err := xml.Unmarshal(body, &initResult); err != nil || initResult.UploadID == "" {
+		t.Fatalf("CreateMultipartUpload: %d %s", resp.StatusCode, body)
+	}
+	part1 := make([]byte, files.ChunkSize+5000)
+	rand.Read(part1)
+	part2 := []byte("tail")
+	var complete strings.Builder
+	complete.WriteString("<CompleteMultipartUpload>")
+	for i, part := range [][]byte{part1, part2} {
+		resp, _ := do("PUT", fmt.Sprintf("/photos/big.bin?partNumber=%d&uploadId=%s", i+1, initResult.UploadID), part)
+		fmt.Fprintf(&complete, "<Part><PartNumber>%d</PartNumber><ETag>%s</ETag></Part>", i+1, resp.Header.Get("ETag"))
+	}
+	complete.WriteString("</CompleteMultipartUpload>")
+	resp, body = do("POST", "/photos/big.bin?uploadId="+initResult.UploadID, []byte(complete.String()))
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "-2&#34;") {
+		t.Fatalf("CompleteMultipartUpload: %d %s", resp.StatusCode, body)
+	}
+	if _, body = do("GET", "/photos/big.bin", nil); !bytes.Equal(body, append(part1, part2...)) {
+		t.Errorf("Multipart object content mismatch (%d bytes)", len(body))
+	}
+
+	// Delimited listing, one key per page
+	var keys []string
+	token := ""
+	for {
+		_, body = do("GET", "/photos?list-type=2&delimiter=/&max-keys=1&continuation-token="+token, nil)
+		var page listBucketResult
+		if err := xml.Unmarshal(body, &page); err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range page.Contents {
+			keys = append(keys, c.Key)
+		}
+		for _, p := range page.CommonPrefixes {
+			keys = append(keys, p.Prefix)
+		}
+		if !page.IsTruncated {
+			break
+		}
+		token = page.NextContinuationToken
+	}
+	if strings.Join(keys, ",") != "2024/,big.bin,top.txt" {
+		t.Errorf("Unexpected listing %v", keys)
+	}
+
+	if resp, _ = do("DELETE", "/photos", nil); resp.StatusCode != http.StatusConflict {
+		t.Errorf("Deleting a non-empty bucket: %d", resp.StatusCode)
+	}
+	do("DELETE", "/photos/top.txt", nil)
+	if resp, _ = do("GET", "/photos/top.txt", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GetObject after delete: %d", resp.StatusCode)
+	}
+}
+
+// signRequest signs r for access key "nebula" and secret "s3cr3t" at date
+// and returns the seed signature for streaming chunks
+func signRequest(r *http.Request, payloadHash string, date time.Time) (*signature, string) {
+	amzDate := date.UTC().Format("20060102T150405Z")
+	scope := amzDate[:8] + "/us-east-1/s3/aws4_request"
+	r.Header.Set("x-amz-date", amzDate)
+	r.Header.Set("x-amz-content-sha256", payloadHash)
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		r.Method, canonicalURI(r.URL), canonicalQuery(r.URL.Query()),
+		"host:" + r.URL.Host + "\nx-amz-content-sha256:" + payloadHash + "\nx-amz-date:" + amzDate + "\n",
+		signedHeaders, payloadHash,
+	}, "\n")
+	key := hmacSHA256([]byte("AWS4s3cr3t"), amzDate[:8])
+	for _, part := range []string{"us-east-1", "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	sig := hex.EncodeToString(hmacSHA256(key, "AWS4-HMAC-SHA256\n"+amzDate+"\n"+scope+"\n"+sha256Hex([]byte(canonicalRequest))))
+	r.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=nebula/%s, SignedHeaders=%s, Signature=%s", scope, signedHeaders, sig))
+	return &signature{key: key, date: amzDate, scope: scope}, sig
+}
+
+func TestSignedPayloads(t *testing.T) {
+	if _, err := NewServer(nil, Config{}); err == nil {
+		t.Error("Gateway started without credentials or --anonymous")
+	}
+
+	srv, ts := newTestServer(t, Config{AccessKey: "nebula", SecretKey: "s3cr3t"})
+	srv.index.CreateBucket("docs")
+	send := func(r *http.Request) int {
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	put := func(body []byte, payloadHash string, date time.Time) *http.Request {
+		r, _ := http.NewRequest("PUT", ts.URL+"/docs/a.txt", bytes.NewReader(body))
+		signRequest(r, payloadHash, date)
+		return r
+	}
+
+	body := []byte("the real contents")
+	if status := send(put(body, sha256Hex(body), time.Now())); status != http.StatusOK {
+		t.Fatalf("Signed PutObject: %d", status)
+	}
+
+	// A captured request replayed with another body
+	captured := put(body, sha256Hex(body), time.Now())
+	replay, _ := http.NewRequest("PUT", captured.URL.String(), strings.NewReader("something else entirely"))
+	replay.Header = captured.Header
+	if status := send(replay); status != http.StatusBadRequest {
+		t.Errorf("Replayed request with a different body: %d", status)
+	}
+	if status := send(put(body, unsignedPayload, time.Now())); status != http.StatusBadRequest {
+		t.Errorf("Unsigned payload with a body: %d", status)
+	}
+	if status := send(put(body, sha256Hex(body), time.Now().Add(-20*time.Minute))); status != http.StatusForbidden {
+		t.Errorf("Request 20 minutes old: %d", status)
+	}
+
+	// Streaming upload with chained chunk signatures
+	streamed := func(tamper bool) *http.Request {
+		r, _ := http.NewRequest("PUT", ts.URL+"/docs/b.txt", nil)
+		sig, prev := signRequest(r, streamingPayload, time.Now())
+		var stream bytes.Buffer
+		for _, chunk := range []string{"hello", " world", ""} {
+			toSign := "AWS4-HMAC-SHA256-PAYLOAD\n" + sig.date + "\n" + sig.scope + "\n" + prev + "\n" + emptySHA256 + "\n" + sha256Hex([]byte(chunk))
+			prev = hex.EncodeToString(hmacSHA256(sig.key, toSign))
+			if tamper && chunk == " world" {
+				chunk = " WORLD"
+			}
+			fmt.Fprintf(&stream, "%x;chunk-signature=%s\r\n%s\r\n", len(chunk), prev, chunk)
+		}
+		r.Body = io.NopCloser(&stream)
+		r.ContentLength = int64(stream.Len())
+		return r
+	}
+	if status := send(streamed(false)); status != http.StatusOK {
+		t.Fatalf("Streaming PutObject: %d", status)
+	}
+	if obj, err := srv.index.Get("docs", "b.txt"); err != nil || obj.Size != 11 {
+		t.Errorf("Streamed object not stored as 11 bytes: %+v", obj)
+	}
+	if status := send(streamed(true)); status != http.StatusForbidden {
+		t.Errorf("Streaming PutObject with a tampered chunk: %d", status)
+	}
+}
@@ -0,0 +1,273 @@
+// Package s3gw serves a subset of the Amazon S3 API on top of a node, so
+// standard S3 clients and tools can store files in NebulaFS.
+//
+// Requests must use path-style addressing (http://host/bucket/key). Each
+// object is uploaded as its own file; buckets and keys live in a node-local
+// Index mapping them to manifest roots and file keys.
+package s3gw
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tanmaydeobhankar/nebulafs/internal/node"
+)
+
+// Config configures the S3 gateway
+type Config struct {
+	// AccessKey and SecretKey enable Signature V4 verification. Without
+	// them NewServer fails unless Anonymous is set.
+	AccessKey string
+	SecretKey string
+	// Anonymous accepts every request unsigned
+	Anonymous bool
+	Region    string // reported by GetBucketLocation, default us-east-1
+
+	Replicas int    // confirmed replicas required per chunk, as for upload
+	TempDir  string // staging area for object bodies and multipart parts
+}
+
+// Server is an http.Handler implementing the S3 API
+type Server struct {
+	node   *node.Node
+	index  *Index
+	config Config
+
+	uploads map[string]*multipartUpload
+	mutex   sync.Mutex
+}
+
+// NewServer loads the index from n's state dir and creates the gateway
+func NewServer(n *node.Node, config Config) (*Server, error) {
+	if config.AccessKey == "" && !config.Anonymous {
+		return nil, errors.New("s3 gateway needs an access key and secret key, or anonymous access")
+	}
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	if config.TempDir == "" {
+		config.TempDir = os.TempDir()
+	}
+	if err := os.MkdirAll(config.TempDir, 0700); err != nil {
+		return nil, err
+	}
+
+	index, err := LoadIndex(n)
+	if err != nil {
+		return nil, fmt.Errorf("loading s3 index: %v", err)
+	}
+	return &Server{
+		node:    n,
+		index:   index,
+		config:  config,
+		uploads: make(map[string]*multipartUpload),
+	}, nil
+}
+
+var bucketName = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Server", "NebulaFS")
+	if s.config.AccessKey != "" {
+		sig, err := s.verifySignature(r)
+		if err == nil {
+			var body io.ReadCloser
+			if body, err = verifiedBody(r, sig); err == nil {
+				r.Body = verified{body}
+			}
+		}
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	switch {
+	case bucket == "":
+		if r.Method != http.MethodGet {
+			writeError(w, r, errMethodNotAllowed)
+			return
+		}
+		s.listBuckets(w, r)
+	case key == "":
+		s.serveBucket(w, r, bucket)
+	default:
+		s.serveObject(w, r, bucket, key)
+	}
+}
+
+func (s *Server) serveBucket(w http.ResponseWriter, r *http.Request, bucket string) {
+	query := r.URL.Query()
+	switch r.Method {
+	case http.MethodPut:
+		s.createBucket(w, r, bucket)
+	case http.MethodHead:
+		if !s.index.HasBucket(bucket) {
+			writeError(w, r, errNoSuchBucket)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	case http.MethodDelete:
+		if err := s.index.DeleteBucket(bucket); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodGet:
+		switch {
+		case query.Has("location"):
+			s.bucketLocation(w, r, bucket)
+		case query.Has("uploads"):
+			s.listUploads(w, r, bucket)
+		default:
+			s.listObjects(w, r, bucket)
+		}
+	case http.MethodPost:
+		if !query.Has("delete") {
+			writeError(w, r, errNotImplemented)
+			return
+		}
+		s.deleteObjects(w, r, bucket)
+	default:
+		writeError(w, r, errMethodNotAllowed)
+	}
+}
+
+func (s *Server) serveObject(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	query := r.URL.Query()
+	uploadID := query.Get("uploadId")
+
+	switch r.Method {
+	case http.MethodPut:
+		switch {
+		case r.Header.Get("x-amz-copy-source") != "":
+			writeError(w, r, errNotImplemented)
+		case uploadID != "":
+			s.uploadPart(w, r, uploadID)
+		default:
+			s.putObject(w, r, bucket, key)
+		}
+	case http.MethodGet:
+		if uploadID != "" {
+			s.listParts(w, r, bucket, key, uploadID)
+			return
+		}
+		s.getObject(w, r, bucket, key)
+	case http.MethodHead:
+		s.headObject(w, r, bucket, key)
+	case http.MethodDelete:
+		if uploadID != "" {
+			s.abortUpload(w, r, uploadID)
+			return
+		}
+		s.deleteObject(w, r, bucket, key)
+	case http.MethodPost:
+		switch {
+		case query.Has("uploads"):
+			s.createUpload(w, r, bucket, key)
+		case uploadID != "":
+			s.completeUpload(w, r, bucket, key, uploadID)
+		default:
+			writeError(w, r, errNotImplemented)
+		}
+	default:
+		writeError(w, r, errMethodNotAllowed)
+	}
+}
+
+// store adds the staged file at path to the network and records it under
+// bucket/key, releasing whatever the key pointed to before
+func (s *Server) store(r *http.Request, bucket, key, path, etag string) (Object, error) {
+	result, err := s.node.Add(path, node.UploadOptions{Replicas: s.config.Replicas})
+	if err != nil {
+		return Object{}, err
+	}
+
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "binary/octet-stream"
+	}
+	obj := Object{
+		Root:        result.Root,
+		Key:         result.Key,
+		Size:        result.Metadata.Size,
+		ETag:        etag,
+		ContentType: contentType,
+		Modified:    time.Now().UTC(),
+		UserMeta:    userMeta(r.Header),
+	}
+
+	old, err := s.index.Put(bucket, key, obj)
+	if err != nil {
+		s.node.Unpin(result.Root)
+		return Object{}, err
+	}
+	if old != nil && old.Root != obj.Root {
+		s.node.Unpin(old.Root)
+	}
+	return obj, nil
+}
+
+// stage writes body to a fresh temp directory under the key's base name, so
+// the stored file keeps a meaningful name and type. It returns the file
+// path, the hex MD5 of the data and a cleanup func.
+func (s *Server) stage(key string, body io.Reader) (string, string, func(), error) {
+	dir, err := os.MkdirTemp(s.config.TempDir, "put-")
+	if err != nil {
+		return "", "", nil, err
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+
+	name := path.Base(key)
+	if name == "/" || name == "." || name == ".." {
+		name = "object"
+	}
+	filePath := filepath.Join(dir, name)
+	f, err := os.Create(filePath)
+	if err != nil {
+		cleanup()
+		return "", "", nil, err
+	}
+
+	hash := md5.New()
+	_, err = io.Copy(io.MultiWriter(f, hash), body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		cleanup()
+		return "", "", nil, err
+	}
+	return filePath, hex.EncodeToString(hash.Sum(nil)), cleanup, nil
+}
+
+// userMeta collects x-amz-meta-* headers
+func userMeta(h http.Header) map[string]string {
+	var meta map[string]string
+	for name, values := range h {
+		if strings.HasPrefix(strings.ToLower(name), "x-amz-meta-") {
+			if meta == nil {
+				meta = make(map[string]string)
+			}
+			meta[strings.ToLower(name)] = values[0]
+		}
+	}
+	return meta
+}
+
+// s3Time is the timestamp format of S3 XML documents
+func s3Time(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
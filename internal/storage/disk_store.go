@@ -42,3 +42,27 @@ func (s *DiskStore) HasChunk(hash string) bool {
 	_, err := os.Stat(path)
 	return err == nil
 }
+
+func (s *DiskStore) DeleteChunk(hash string) error {
+	path := filepath.Join(s.BaseDir, hash)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *DiskStore) ListChunks() ([]string, error) {
+	entries, err := os.ReadDir(s.BaseDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var hashes []string
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		hashes = append(hashes, e.Name())
+	}
+	return hashes, nil
+}
@@ -0,0 +1,171 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+
+	"github.com/tanmaydeobhankar/nebulafs/internal/crypto"
+	"github.com/tanmaydeobhankar/nebulafs/internal/files"
+)
+
+// EncryptedStore wraps another Store, encrypting chunk contents and hiding
+// chunk hashes behind keyed hashes so that the files on disk reveal neither
+// what is stored nor which public chunks the node holds.
+//
+// Each sealed blob is AES-256-GCM over: hashLen(2) | hash | content
+type EncryptedStore struct {
+	Inner Store
+
+	dataKey []byte
+	nameKey []byte
+}
+
+// NewEncryptedStore derives independent content and name keys from the
+// node master key
+func NewEncryptedStore(inner Store, masterKey []byte) (*EncryptedStore, error) {
+	dataKey, err := crypto.SubKey(masterKey, "store data")
+	if err != nil {
+		return nil, err
+	}
+	nameKey, err := crypto.SubKey(masterKey, "store names")
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptedStore{Inner: inner, dataKey: dataKey, nameKey: nameKey}, nil
+}
+
+// name maps a hash to its blob name; unreadable entries already are one
+func (s *EncryptedStore) name(hash string) string {
+	if blob, ok := strings.CutPrefix(hash, UnreadablePrefix); ok {
+		return blob
+	}
+	return crypto.KeyedHash(s.nameKey, hash)
+}
+
+// seal turns chunk into the blob stored in the inner store
+func (s *EncryptedStore) seal(chunk files.Chunk) (files.Chunk, error) {
+	plain := binary.BigEndian.AppendUint16(nil, uint16(len(chunk.Hash)))
+	plain = append(plain, chunk.Hash...)
+	plain = append(plain, chunk.Content...)
+
+	sealed, err := crypto.EncryptAES256(plain, s.dataKey)
+	if err != nil {
+		return files.Chunk{}, err
+	}
+
+	return files.Chunk{
+		Hash:    s.name(chunk.Hash),
+		Content: sealed,
+		Size:    len(sealed),
+	}, nil
+}
+
+func (s *EncryptedStore) WriteChunk(chunk files.Chunk) error {
+	sealed, err := s.seal(chunk)
+	if err != nil {
+		return err
+	}
+	return s.Inner.WriteChunk(sealed)
+}
+
+// WriteBatch seals every chunk and writes them to the inner store together
+func (s *EncryptedStore) WriteBatch(chunks []files.Chunk) error {
+	blobs := make([]files.Chunk, 0, len(chunks))
+	for _, chunk := range chunks {
+		sealed, err := s.seal(chunk)
+		if err != nil {
+			return err
+		}
+		blobs = append(blobs, sealed)
+	}
+	return WriteChunks(s.Inner, blobs)
+}
+
+// open decrypts a sealed blob and returns the original hash and content
+func (s *EncryptedStore) open(sealed []byte) (string, []byte, error) {
+	plain, err := crypto.DecryptAES256(sealed, s.dataKey)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(plain) < 2 {
+		return "", nil, errors.New("malformed sealed chunk")
+	}
+	hashLen := int(binary.BigEndian.Uint16(plain))
+	if len(plain) < 2+hashLen {
+		return "", nil, errors.New("malformed sealed chunk")
+	}
+	return string(plain[2 : 2+hashLen]), plain[2+hashLen:], nil
+}
+
+func (s *EncryptedStore) ReadChunk(hash string) (files.Chunk, error) {
+	return s.read(hash, s.Inner.ReadChunk)
+}
+
+// PeekChunk reads hash through the inner store's PeekChunk
+func (s *EncryptedStore) PeekChunk(hash string) (files.Chunk, error) {
+	return s.read(hash, func(name string) (files.Chunk, error) {
+		return PeekChunk(s.Inner, name)
+	})
+}
+
+// read opens the blob of hash, fetched from the inner store with readBlob
+func (s *EncryptedStore) read(hash string, readBlob func(string) (files.Chunk, error)) (files.Chunk, error) {
+	sealed, err := readBlob(s.name(hash))
+	if err != nil {
+		return files.Chunk{}, err
+	}
+	if strings.HasPrefix(hash, UnreadablePrefix) {
+		return files.Chunk{Hash: hash, Content: sealed.Content, Size: len(sealed.Content)}, nil
+	}
+
+	storedHash, content, err := s.open(sealed.Content)
+	if err != nil {
+		return files.Chunk{}, err
+	}
+	if storedHash != hash {
+		return files.Chunk{}, errors.New("sealed chunk belongs to a different hash")
+	}
+
+	return files.Chunk{
+		Hash:    hash,
+		Content: content,
+		Size:    len(content),
+	}, nil
+}
+
+func (s *EncryptedStore) HasChunk(hash string) bool {
+	return s.Inner.HasChunk(s.name(hash))
+}
+
+func (s *EncryptedStore) DeleteChunk(hash string) error {
+	return s.Inner.DeleteChunk(s.name(hash))
+}
+
+// ListChunks has to open every blob to recover the real hashes, so it costs
+// a full read of the store. Blobs that can't be opened are listed by name
+// behind UnreadablePrefix so the scrubber can set them aside.
+func (s *EncryptedStore) ListChunks() ([]string, error) {
+	names, err := s.Inner.ListChunks()
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := make([]string, 0, len(names))
+	for _, name := range names {
+		sealed, err := PeekChunk(s.Inner, name)
+		if err != nil {
+			if s.Inner.HasChunk(name) {
+				hashes = append(hashes, UnreadablePrefix+name)
+			}
+			continue
+		}
+		hash, _, err := s.open(sealed.Content)
+		if err != nil || s.name(hash) != name {
+			hashes = append(hashes, UnreadablePrefix+name)
+			continue
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes, nil
+}
@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"sync"
+
+	"github.com/tanmaydeobhankar/nebulafs/internal/files"
+)
+
+// MemoryStore keeps chunks in a map. It is meant for tests and simulations.
+type MemoryStore struct {
+	chunks map[string][]byte
+	mutex  sync.RWMutex
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{chunks: make(map[string][]byte)}
+}
+
+func (s *MemoryStore) WriteChunk(chunk files.Chunk) error {
+	content := make([]byte, len(chunk.Content))
+	copy(content, chunk.Content)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.chunks[chunk.Hash] = content
+	return nil
+}
+
+func (s *MemoryStore) ReadChunk(hash string) (files.Chunk, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	content, ok := s.chunks[hash]
+	if !ok {
+		return files.Chunk{}, ErrChunkNotFound
+	}
+
+	out := make([]byte, len(content))
+	copy(out, content)
+	return files.Chunk{
+		Hash:    hash,
+		Content: out,
+		Size:    len(out),
+	}, nil
+}
+
+func (s *MemoryStore) HasChunk(hash string) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	_, ok := s.chunks[hash]
+	return ok
+}
+
+func (s *MemoryStore) DeleteChunk(hash string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.chunks, hash)
+	return nil
+}
+
+func (s *MemoryStore) ListChunks() ([]string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	hashes := make([]string, 0, len(s.chunks))
+	for hash := range s.chunks {
+		hashes = append(hashes, hash)
+	}
+	return hashes, nil
+}
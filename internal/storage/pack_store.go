@@ -0,0 +1,460 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/tanmaydeobhankar/nebulafs/internal/files"
+)
+
+const (
+	packFileName  = "chunks.pack"
+	indexFileName = "chunks.idx"
+
+	recordPut        byte = 1
+	recordDelete     byte = 2
+	recordGeneration byte = 3 // first record of a compacted pack
+
+	// maxRecordContent guards against allocating garbage lengths from a
+	// corrupt tail
+	maxRecordContent = 64 * 1024 * 1024
+
+	// CompactRatio is the fraction of dead bytes in the packfile above which
+	// NeedsCompaction reports true
+	CompactRatio = 0.5
+)
+
+// ChunkInfo is the per-chunk metadata kept in the pack index
+type ChunkInfo struct {
+	Hash     string `json:"hash"`
+	Offset   int64  `json:"offset"` // offset of the content inside the packfile
+	Size     int    `json:"size"`
+	StoredAt int64  `json:"stored_at"` // unix seconds
+}
+
+// packIndex is the on-disk form of the in-memory index. It only describes
+// the packfile of the same generation.
+type packIndex struct {
+	Generation uint64               `json:"generation"`
+	PackSize   int64                `json:"pack_size"`
+	Entries    map[string]ChunkInfo `json:"entries"`
+}
+
+// PackStore keeps every chunk in a single append-only packfile with an index
+// mapping hashes to offsets. Deletes append tombstones; Compact rewrites the
+// packfile with only the live records.
+//
+// Record layout:
+//
+//	op(1) | hashLen(2) | hash | contentLen(4) | content | crc32(4)
+//
+// Delete records carry no content (contentLen = 0). Compact starts the new
+// packfile with a generation record, whose content is the 8-byte generation,
+// so an index written for an older packfile is never trusted.
+type PackStore struct {
+	BaseDir string
+
+	file       *os.File
+	generation uint64
+	size       int64
+	deadBytes  int64
+	index      map[string]ChunkInfo
+	mutex      sync.RWMutex
+}
+
+func NewPackStore(baseDir string) (*PackStore, error) {
+	if err := os.MkdirAll(baseDir, 0755); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(filepath.Join(baseDir, packFileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &PackStore{
+		BaseDir: baseDir,
+		file:    file,
+		index:   make(map[string]ChunkInfo),
+	}
+
+	if err := s.load(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// load restores the index from chunks.idx when it belongs to this packfile
+// and replays any records appended after it was written
+func (s *PackStore) load() error {
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	var header int64
+	if op, _, content, n, err := readRecord(bufio.NewReader(s.file)); err == nil && op == recordGeneration {
+		s.generation = binary.BigEndian.Uint64(content)
+		header = n
+	}
+
+	var from int64
+	if data, err := os.ReadFile(filepath.Join(s.BaseDir, indexFileName)); err == nil {
+		var idx packIndex
+		if err := json.Unmarshal(data, &idx); err == nil && idx.Entries != nil {
+			stat, err := s.file.Stat()
+			if err != nil {
+				return err
+			}
+			if idx.Generation == s.generation && idx.PackSize <= stat.Size() {
+				s.index = idx.Entries
+				from = idx.PackSize
+				s.deadBytes = idx.PackSize - header
+				for _, e := range s.index {
+					s.deadBytes -= recordSize(e.Hash, e.Size)
+				}
+			}
+		}
+	}
+
+	end, err := s.replay(from)
+	if err != nil {
+		return err
+	}
+
+	// Drop a torn record left behind by a crash mid-append
+	if err := s.file.Truncate(end); err != nil {
+		return err
+	}
+	s.size = end
+	return nil
+}
+
+// replay scans records starting at offset and applies them to the index.
+// It returns the offset just past the last intact record.
+func (s *PackStore) replay(offset int64) (int64, error) {
+	if _, err := s.file.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	r := bufio.NewReader(s.file)
+
+	for {
+		op, hash, content, n, err := readRecord(r)
+		if err != nil {
+			// EOF or a torn/corrupt tail: everything before offset is good
+			return offset, nil
+		}
+
+		switch op {
+		case recordPut:
+			// Records carry no timestamp, so replayed chunks are dated from
+			// when the store was opened
+			if old, ok := s.index[hash]; ok {
+				s.deadBytes += recordSize(old.Hash, old.Size)
+			}
+			s.index[hash] = ChunkInfo{
+				Hash:     hash,
+				Offset:   offset + n - int64(len(content)) - 4,
+				Size:     len(content),
+				StoredAt: time.Now().Unix(),
+			}
+		case recordDelete:
+			if old, ok := s.index[hash]; ok {
+				s.deadBytes += recordSize(old.Hash, old.Size)
+				delete(s.index, hash)
+			}
+			s.deadBytes += n
+		}
+		offset += n
+	}
+}
+
+func readRecord(r io.Reader) (byte, string, []byte, int64, error) {
+	var header [3]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, "", nil, 0, err
+	}
+	op := header[0]
+	if op != recordPut && op != recordDelete && op != recordGeneration {
+		return 0, "", nil, 0, fmt.Errorf("unknown record op %d", op)
+	}
+
+	hash := make([]byte, binary.BigEndian.Uint16(header[1:]))
+	if _, err := io.ReadFull(r, hash); err != nil {
+		return 0, "", nil, 0, err
+	}
+
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+		return 0, "", nil, 0, err
+	}
+	contentLen := binary.BigEndian.Uint32(lenBuf[:])
+	if contentLen > maxRecordContent {
+		return 0, "", nil, 0, fmt.Errorf("record too large: %d bytes", contentLen)
+	}
+	content := make([]byte, contentLen)
+	if _, err := io.ReadFull(r, content); err != nil {
+		return 0, "", nil, 0, err
+	}
+
+	var sumBuf [4]byte
+	if _, err := io.ReadFull(r, sumBuf[:]); err != nil {
+		return 0, "", nil, 0, err
+	}
+
+	crc := crc32.NewIEEE()
+	crc.Write(header[:])
+	crc.Write(hash)
+	crc.Write(lenBuf[:])
+	crc.Write(content)
+	if crc.Sum32() != binary.BigEndian.Uint32(sumBuf[:]) {
+		return 0, "", nil, 0, errors.New("record checksum mismatch")
+	}
+	if op == recordGeneration && len(content) != 8 {
+		return 0, "", nil, 0, errors.New("malformed generation record")
+	}
+
+	return op, string(hash), content, recordSize(string(hash), len(content)), nil
+}
+
+func encodeRecord(op byte, hash string, content []byte) []byte {
+	buf := make([]byte, 0, recordSize(hash, len(content)))
+	buf = append(buf, op)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(hash)))
+	buf = append(buf, hash...)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(content)))
+	buf = append(buf, content...)
+	return binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+}
+
+func recordSize(hash string, contentLen int) int64 {
+	return int64(1 + 2 + len(hash) + 4 + contentLen + 4)
+}
+
+func (s *PackStore) WriteChunk(chunk files.Chunk) error {
+	return s.WriteBatch([]files.Chunk{chunk})
+}
+
+// WriteBatch appends all chunks with a single write and a single fsync
+func (s *PackStore) WriteBatch(chunks []files.Chunk) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var buf []byte
+	entries := make([]ChunkInfo, 0, len(chunks))
+	offset := s.size
+	now := time.Now().Unix()
+
+	for _, chunk := range chunks {
+		if len(chunk.Hash) > 0xFFFF {
+			return fmt.Errorf("chunk hash too long: %d bytes", len(chunk.Hash))
+		}
+		rec := encodeRecord(recordPut, chunk.Hash, chunk.Content)
+		entries = append(entries, ChunkInfo{
+			Hash:     chunk.Hash,
+			Offset:   offset + int64(len(rec)) - int64(len(chunk.Content)) - 4,
+			Size:     len(chunk.Content),
+			StoredAt: now,
+		})
+		buf = append(buf, rec...)
+		offset += int64(len(rec))
+	}
+
+	if _, err := s.file.WriteAt(buf, s.size); err != nil {
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if old, ok := s.index[e.Hash]; ok {
+			s.deadBytes += recordSize(old.Hash, old.Size)
+		}
+		s.index[e.Hash] = e
+	}
+	s.size = offset
+	return nil
+}
+
+func (s *PackStore) ReadChunk(hash string) (files.Chunk, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	info, ok := s.index[hash]
+	if !ok {
+		return files.Chunk{}, ErrChunkNotFound
+	}
+
+	content := make([]byte, info.Size)
+	if _, err := s.file.ReadAt(content, info.Offset); err != nil {
+		return files.Chunk{}, err
+	}
+
+	return files.Chunk{
+		Hash:    hash,
+		Content: content,
+		Size:    len(content),
+	}, nil
+}
+
+func (s *PackStore) HasChunk(hash string) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	_, ok := s.index[hash]
+	return ok
+}
+
+func (s *PackStore) DeleteChunk(hash string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	old, ok := s.index[hash]
+	if !ok {
+		return nil
+	}
+
+	rec := encodeRecord(recordDelete, hash, nil)
+	if _, err := s.file.WriteAt(rec, s.size); err != nil {
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+
+	delete(s.index, hash)
+	s.size += int64(len(rec))
+	s.deadBytes += recordSize(old.Hash, old.Size) + int64(len(rec))
+	return nil
+}
+
+func (s *PackStore) ListChunks() ([]string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	hashes := make([]string, 0, len(s.index))
+	for hash := range s.index {
+		hashes = append(hashes, hash)
+	}
+	return hashes, nil
+}
+
+// Stat returns the index metadata for a chunk
+func (s *PackStore) Stat(hash string) (ChunkInfo, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	info, ok := s.index[hash]
+	if !ok {
+		return ChunkInfo{}, ErrChunkNotFound
+	}
+	return info, nil
+}
+
+// NeedsCompaction reports whether dead records make up more than
+// CompactRatio of the packfile
+func (s *PackStore) NeedsCompaction() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.size > 0 && float64(s.deadBytes)/float64(s.size) > CompactRatio
+}
+
+// Compact rewrites the packfile keeping only live chunks, then swaps it in
+// place of the old one
+func (s *PackStore) Compact() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	tmpPath := filepath.Join(s.BaseDir, packFileName+".tmp")
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	newIndex := make(map[string]ChunkInfo, len(s.index))
+	w := bufio.NewWriter(tmp)
+	gen := encodeRecord(recordGeneration, "", binary.BigEndian.AppendUint64(nil, s.generation+1))
+	w.Write(gen)
+	offset := int64(len(gen))
+
+	for hash, info := range s.index {
+		content := make([]byte, info.Size)
+		if _, err := s.file.ReadAt(content, info.Offset); err != nil {
+			tmp.Close()
+			os.Remove(tmpPath)
+			return err
+		}
+
+		rec := encodeRecord(recordPut, hash, content)
+		if _, err := w.Write(rec); err != nil {
+			tmp.Close()
+			os.Remove(tmpPath)
+			return err
+		}
+
+		info.Offset = offset + int64(len(rec)) - int64(len(content)) - 4
+		newIndex[hash] = info
+		offset += int64(len(rec))
+	}
+
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := os.Rename(tmpPath, filepath.Join(s.BaseDir, packFileName)); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	s.file.Close()
+	s.file = tmp
+	s.generation++
+	s.index = newIndex
+	s.size = offset
+	s.deadBytes = 0
+
+	return s.writeIndex()
+}
+
+// Sync persists the index so the next open doesn't have to scan the whole pack
+func (s *PackStore) Sync() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.writeIndex()
+}
+
+func (s *PackStore) writeIndex() error {
+	data, err := json.Marshal(packIndex{Generation: s.generation, PackSize: s.size, Entries: s.index})
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(s.BaseDir, indexFileName)
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (s *PackStore) Close() error {
+	if err := s.Sync(); err != nil {
+		return err
+	}
+	return s.file.Close()
+}
@@ -0,0 +1,242 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/tanmaydeobhankar/nebulafs/internal/files"
+)
+
+// S3Config describes an S3-compatible bucket used as a chunk store
+type S3Config struct {
+	Endpoint  string // e.g. http://127.0.0.1:9000
+	Bucket    string
+	Prefix    string // prepended to every chunk hash
+	Region    string
+	AccessKey string
+	SecretKey string
+}
+
+// S3Store keeps chunks as objects in an S3-compatible bucket using
+// path-style requests signed with AWS Signature V4
+type S3Store struct {
+	Config S3Config
+	Client *http.Client
+}
+
+func NewS3Store(config S3Config) (*S3Store, error) {
+	if config.Endpoint == "" || config.Bucket == "" {
+		return nil, fmt.Errorf("s3 store needs an endpoint and a bucket")
+	}
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	return &S3Store{
+		Config: config,
+		Client: &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// ParseS3URL parses s3://bucket/prefix?endpoint=...&region=... The
+// credentials are passed separately, usually from AWS_ACCESS_KEY_ID and
+// AWS_SECRET_ACCESS_KEY.
+func ParseS3URL(raw string, accessKey, secretKey string) (S3Config, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return S3Config{}, err
+	}
+	if u.Scheme != "s3" || u.Host == "" {
+		return S3Config{}, fmt.Errorf("invalid s3 url %q", raw)
+	}
+
+	prefix := strings.TrimPrefix(u.Path, "/")
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	return S3Config{
+		Endpoint:  u.Query().Get("endpoint"),
+		Bucket:    u.Host,
+		Prefix:    prefix,
+		Region:    u.Query().Get("region"),
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+	}, nil
+}
+
+func (s *S3Store) objectURL(key string) string {
+	return fmt.Sprintf("%s/%s/%s", strings.TrimRight(s.Config.Endpoint, "/"), s.Config.Bucket, s.Config.Prefix+key)
+}
+
+func (s *S3Store) do(method, rawURL string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, rawURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req, body, time.Now().UTC())
+	return s.Client.Do(req)
+}
+
+func (s *S3Store) WriteChunk(chunk files.Chunk) error {
+	resp, err := s.do(http.MethodPut, s.objectURL(chunk.Hash), chunk.Content)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("s3 put %s: %s", chunk.Hash, resp.Status)
+	}
+	return nil
+}
+
+func (s *S3Store) ReadChunk(hash string) (files.Chunk, error) {
+	resp, err := s.do(http.MethodGet, s.objectURL(hash), nil)
+	if err != nil {
+		return files.Chunk{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return files.Chunk{}, ErrChunkNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return files.Chunk{}, fmt.Errorf("s3 get %s: %s", hash, resp.Status)
+	}
+
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return files.Chunk{}, err
+	}
+	return files.Chunk{
+		Hash:    hash,
+		Content: content,
+		Size:    len(content),
+	}, nil
+}
+
+func (s *S3Store) HasChunk(hash string) bool {
+	resp, err := s.do(http.MethodHead, s.objectURL(hash), nil)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+func (s *S3Store) DeleteChunk(hash string) error {
+	resp, err := s.do(http.MethodDelete, s.objectURL(hash), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("s3 delete %s: %s", hash, resp.Status)
+	}
+	return nil
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (s *S3Store) ListChunks() ([]string, error) {
+	var hashes []string
+	token := ""
+
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		if s.Config.Prefix != "" {
+			query.Set("prefix", s.Config.Prefix)
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		rawURL := fmt.Sprintf("%s/%s?%s", strings.TrimRight(s.Config.Endpoint, "/"), s.Config.Bucket, query.Encode())
+		resp, err := s.do(http.MethodGet, rawURL, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var result listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("s3 list: %s", resp.Status)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for _, obj := range result.Contents {
+			hashes = append(hashes, strings.TrimPrefix(obj.Key, s.Config.Prefix))
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return hashes, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// sign adds AWS Signature V4 headers to req
+func (s *S3Store) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	// url.Values.Encode sorts by key but escapes spaces as '+'
+	canonicalQuery := strings.ReplaceAll(req.URL.Query().Encode(), "+", "%20")
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.Config.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+s.Config.SecretKey), date)
+	key = hmacSHA256(key, s.Config.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.Config.AccessKey, scope, signedHeaders, signature))
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
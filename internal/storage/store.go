@@ -1,9 +1,18 @@
 package storage
 
 import (
+	"errors"
+
 	"github.com/tanmaydeobhankar/nebulafs/internal/files"
 )
 
+var ErrChunkNotFound = errors.New("chunk not found")
+
+// UnreadablePrefix marks ListChunks entries that name a stored blob which
+// can't be opened, so the chunk it held is unknown. Reading such an entry
+// returns the raw blob and deleting it removes the blob.
+const UnreadablePrefix = "unreadable:"
+
 // an interface to store chunks locally
 type Store interface {
 	WriteChunk(chunk files.Chunk) error
@@ -11,4 +20,43 @@ type Store interface {
 	ReadChunk(hash string) (files.Chunk, error)
 
 	HasChunk(hash string) bool
+
+	DeleteChunk(hash string) error
+
+	// ListChunks returns the hashes of all chunks currently held
+	ListChunks() ([]string, error)
+}
+
+// Peeker is implemented by stores whose ReadChunk has side effects, such as
+// promoting the chunk to a faster tier, to read without them
+type Peeker interface {
+	PeekChunk(hash string) (files.Chunk, error)
+}
+
+// PeekChunk reads hash from store without the side effects of a client read,
+// for scrubbing, listing and audits
+func PeekChunk(store Store, hash string) (files.Chunk, error) {
+	if p, ok := store.(Peeker); ok {
+		return p.PeekChunk(hash)
+	}
+	return store.ReadChunk(hash)
+}
+
+// BatchWriter is implemented by stores that can write several chunks with a
+// single sync
+type BatchWriter interface {
+	WriteBatch(chunks []files.Chunk) error
+}
+
+// WriteChunks writes chunks to store, as one batch when the store supports it
+func WriteChunks(store Store, chunks []files.Chunk) error {
+	if b, ok := store.(BatchWriter); ok {
+		return b.WriteBatch(chunks)
+	}
+	for _, chunk := range chunks {
+		if err := store.WriteChunk(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -1,8 +1,18 @@
 package storage
 
 import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/tanmaydeobhankar/nebulafs/internal/files"
 )
@@ -45,3 +55,277 @@ func TestDiskStore(t *testing.T) {
 		t.Errorf("Content mismatch. Got %s", readChunk.Content)
 	}
 }
+
+func TestPackStore(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "nebulafs_pack_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	store, err := NewPackStore(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	batch := []files.Chunk{
+		{Hash: "hash-a", Content: []byte("content-a")},
+		{Hash: "hash-b", Content: []byte("content-b")},
+		{Hash: "hash-c", Content: []byte("content-c")},
+	}
+	if err := store.WriteBatch(batch); err != nil {
+		t.Fatalf("Failed to write batch: %v", err)
+	}
+	if err := store.DeleteChunk("hash-b"); err != nil {
+		t.Fatalf("Failed to delete chunk: %v", err)
+	}
+
+	// Reopen without an index file to force a full replay
+	store.file.Close()
+	store, err = NewPackStore(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if store.HasChunk("hash-b") {
+		t.Errorf("Deleted chunk survived replay")
+	}
+	readChunk, err := store.ReadChunk("hash-c")
+	if err != nil {
+		t.Fatalf("Failed to read chunk: %v", err)
+	}
+	if string(readChunk.Content) != "content-c" {
+		t.Errorf("Content mismatch. Got %s", readChunk.Content)
+	}
+
+	// Keep the pre-compaction index to simulate a crash before Compact
+	// writes the new one
+	if err := store.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	stale, _ := os.ReadFile(filepath.Join(tmpDir, indexFileName))
+
+	if err := store.Compact(); err != nil {
+		t.Fatalf("Compaction failed: %v", err)
+	}
+
+	hashes, _ := store.ListChunks()
+	if len(hashes) != 2 {
+		t.Errorf("Expected 2 live chunks after compaction, got %d", len(hashes))
+	}
+	readChunk, err = store.ReadChunk("hash-a")
+	if err != nil || string(readChunk.Content) != "content-a" {
+		t.Errorf("Chunk unreadable after compaction: %v", err)
+	}
+
+	// An index from before the compaction is ignored
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(tmpDir, indexFileName), stale, 0644)
+	store, err = NewPackStore(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []files.Chunk{batch[0], batch[2]} {
+		if readChunk, err := store.ReadChunk(c.Hash); err != nil || !bytes.Equal(readChunk.Content, c.Content) {
+			t.Errorf("Stale index used after compaction: %q, %v", readChunk.Content, err)
+		}
+	}
+	if store.NeedsCompaction() {
+		t.Errorf("Compacted pack reported as needing compaction")
+	}
+
+	// Reopen using the index written by Compact
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	store, err = NewPackStore(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if !store.HasChunk("hash-a") || store.HasChunk("hash-b") {
+		t.Errorf("Index mismatch after reopen")
+	}
+}
+
+func TestEncryptedStore(t *testing.T) {
+	inner := NewMemoryStore()
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	store, err := NewEncryptedStore(inner, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chunk := files.Chunk{Hash: "public-hash", Content: []byte("secret-content")}
+	if err := store.WriteChunk(chunk); err != nil {
+		t.Fatalf("Failed to write chunk: %v", err)
+	}
+
+	// Neither the hash nor the content may appear in the inner store
+	if inner.HasChunk("public-hash") {
+		t.Errorf("Inner store is keyed by the plain hash")
+	}
+	names, _ := inner.ListChunks()
+	if len(names) != 1 {
+		t.Fatalf("Expected 1 sealed blob, got %d", len(names))
+	}
+	sealed, _ := inner.ReadChunk(names[0])
+	if bytes.Contains(sealed.Content, []byte("secret-content")) {
+		t.Errorf("Content stored in the clear")
+	}
+
+	readChunk, err := store.ReadChunk("public-hash")
+	if err != nil {
+		t.Fatalf("Failed to read chunk: %v", err)
+	}
+	if string(readChunk.Content) != "secret-content" {
+		t.Errorf("Content mismatch. Got %s", readChunk.Content)
+	}
+
+	hashes, _ := store.ListChunks()
+	if len(hashes) != 1 || hashes[0] != "public-hash" {
+		t.Errorf("ListChunks returned %v", hashes)
+	}
+
+	// A different master key sees nothing
+	other := make([]byte, 32)
+	rand.Read(other)
+	wrongStore, _ := NewEncryptedStore(inner, other)
+	if wrongStore.HasChunk("public-hash") {
+		t.Errorf("Chunk visible under the wrong key")
+	}
+
+	// A blob that doesn't open is listed by name so it can be set aside
+	sealed.Content[len(sealed.Content)-1] ^= 0xFF
+	inner.WriteChunk(sealed)
+	hashes, _ = store.ListChunks()
+	if len(hashes) != 1 || hashes[0] != UnreadablePrefix+names[0] {
+		t.Fatalf("Expected the corrupt blob to be listed, got %v", hashes)
+	}
+	raw, err := store.ReadChunk(hashes[0])
+	if err != nil || !bytes.Equal(raw.Content, sealed.Content) {
+		t.Errorf("Failed to read the raw blob: %v", err)
+	}
+	if err := store.DeleteChunk(hashes[0]); err != nil || inner.HasChunk(names[0]) {
+		t.Errorf("Failed to delete the corrupt blob: %v", err)
+	}
+}
+
+// fakeS3 is a minimal in-memory stand-in for an S3-compatible endpoint
+func fakeS3(t *testing.T) *httptest.Server {
+	objects := make(map[string][]byte)
+	var mutex sync.Mutex
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=test-key/") {
+			t.Errorf("Request not signed: %q", r.Header.Get("Authorization"))
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		key := strings.TrimPrefix(r.URL.Path, "/cold/")
+		switch {
+		case r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2":
+			fmt.Fprint(w, "<ListBucketResult>")
+			for k := range objects {
+				if strings.HasPrefix(k, r.URL.Query().Get("prefix")) {
+					fmt.Fprintf(w, "<Contents><Key>%s</Key></Contents>", k)
+				}
+			}
+			fmt.Fprint(w, "<IsTruncated>false</IsTruncated></ListBucketResult>")
+		case r.Method == http.MethodPut:
+			objects[key], _ = io.ReadAll(r.Body)
+		case r.Method == http.MethodGet || r.Method == http.MethodHead:
+			data, ok := objects[key]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write(data)
+		case r.Method == http.MethodDelete:
+			delete(objects, key)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+}
+
+func TestTieredStore(t *testing.T) {
+	server := fakeS3(t)
+	defer server.Close()
+
+	conf, err := ParseS3URL("s3://cold/chunks?endpoint="+server.URL, "test-key", "test-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cold, err := NewS3Store(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hot := NewMemoryStore()
+	store, err := NewTieredStore(hot, cold)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store.WriteChunk(files.Chunk{Hash: "old", Content: []byte("rarely read")})
+	time.Sleep(20 * time.Millisecond)
+	store.WriteChunk(files.Chunk{Hash: "new", Content: []byte("freshly written")})
+
+	moved, err := store.Demote(10 * time.Millisecond)
+	if err != nil {
+		t.Fatalf("Demote failed: %v", err)
+	}
+	if moved != 1 || hot.HasChunk("old") || !cold.HasChunk("old") {
+		t.Fatalf("Expected only the old chunk to move to the cold tier (moved %d)", moved)
+	}
+	if !hot.HasChunk("new") {
+		t.Errorf("Recently written chunk was demoted")
+	}
+
+	hashes, _ := store.ListChunks()
+	if len(hashes) != 2 {
+		t.Errorf("Expected 2 chunks across tiers, got %v", hashes)
+	}
+
+	// Peeking, as the scrubber and audits do, leaves it cold, also through
+	// an encrypted store
+	if chunk, err := store.PeekChunk("old"); err != nil || string(chunk.Content) != "rarely read" {
+		t.Fatalf("Failed to peek at cold chunk: %v", err)
+	}
+	if hot.HasChunk("old") {
+		t.Errorf("Chunk was promoted by a peek")
+	}
+	key := make([]byte, 32)
+	rand.Read(key)
+	sealedHot := NewMemoryStore()
+	sealedTiers, _ := NewTieredStore(sealedHot, NewMemoryStore())
+	sealed, _ := NewEncryptedStore(sealedTiers, key)
+	sealed.WriteChunk(files.Chunk{Hash: "sealed", Content: []byte("sealed and cold")})
+	sealedTiers.Demote(0)
+	if hashes, _ := sealed.ListChunks(); len(hashes) != 1 || hashes[0] != "sealed" {
+		t.Errorf("Expected the sealed chunk to be listed, got %v", hashes)
+	}
+	if _, err := PeekChunk(sealed, "sealed"); err != nil {
+		t.Errorf("Failed to peek through the encrypted store: %v", err)
+	}
+	if names, _ := sealedHot.ListChunks(); len(names) != 0 {
+		t.Errorf("Listing or peeking promoted cold chunks: hot tier holds %v", names)
+	}
+
+	// Reading promotes the chunk back to the hot tier
+	chunk, err := store.ReadChunk("old")
+	if err != nil || string(chunk.Content) != "rarely read" {
+		t.Fatalf("Failed to read cold chunk: %v", err)
+	}
+	if !hot.HasChunk("old") || cold.HasChunk("old") {
+		t.Errorf("Chunk was not promoted on read")
+	}
+}
@@ -0,0 +1,173 @@
+package storage
+
+import (
+	"sync"
+	"time"
+
+	"github.com/tanmaydeobhankar/nebulafs/internal/files"
+)
+
+// TieredStore writes new chunks to a fast hot tier and moves chunks that
+// haven't been accessed for a while to a large cold tier. Reading a cold
+// chunk promotes it back to the hot tier; PeekChunk doesn't.
+type TieredStore struct {
+	Hot  Store
+	Cold Store
+
+	lastAccess map[string]time.Time
+	mutex      sync.Mutex
+}
+
+// NewTieredStore treats every chunk already in the hot tier as accessed now
+func NewTieredStore(hot, cold Store) (*TieredStore, error) {
+	hashes, err := hot.ListChunks()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &TieredStore{
+		Hot:        hot,
+		Cold:       cold,
+		lastAccess: make(map[string]time.Time, len(hashes)),
+	}
+	now := time.Now()
+	for _, hash := range hashes {
+		s.lastAccess[hash] = now
+	}
+	return s, nil
+}
+
+func (s *TieredStore) touch(hash string) {
+	s.mutex.Lock()
+	s.lastAccess[hash] = time.Now()
+	s.mutex.Unlock()
+}
+
+func (s *TieredStore) WriteChunk(chunk files.Chunk) error {
+	if err := s.Hot.WriteChunk(chunk); err != nil {
+		return err
+	}
+	s.touch(chunk.Hash)
+	return nil
+}
+
+// WriteBatch writes chunks to the hot tier together
+func (s *TieredStore) WriteBatch(chunks []files.Chunk) error {
+	if err := WriteChunks(s.Hot, chunks); err != nil {
+		return err
+	}
+	for _, chunk := range chunks {
+		s.touch(chunk.Hash)
+	}
+	return nil
+}
+
+func (s *TieredStore) ReadChunk(hash string) (files.Chunk, error) {
+	chunk, err := s.Hot.ReadChunk(hash)
+	if err == nil {
+		s.touch(hash)
+		return chunk, nil
+	}
+
+	chunk, err = s.Cold.ReadChunk(hash)
+	if err != nil {
+		return files.Chunk{}, err
+	}
+
+	// Promote; a failure here still leaves the cold copy readable
+	if err := s.Hot.WriteChunk(chunk); err == nil {
+		s.touch(hash)
+		s.Cold.DeleteChunk(hash)
+	}
+	return chunk, nil
+}
+
+// PeekChunk reads hash from whichever tier holds it, leaving it there and
+// its access time alone
+func (s *TieredStore) PeekChunk(hash string) (files.Chunk, error) {
+	if chunk, err := PeekChunk(s.Hot, hash); err == nil {
+		return chunk, nil
+	}
+	return PeekChunk(s.Cold, hash)
+}
+
+func (s *TieredStore) HasChunk(hash string) bool {
+	return s.Hot.HasChunk(hash) || s.Cold.HasChunk(hash)
+}
+
+func (s *TieredStore) DeleteChunk(hash string) error {
+	s.mutex.Lock()
+	delete(s.lastAccess, hash)
+	s.mutex.Unlock()
+
+	if err := s.Hot.DeleteChunk(hash); err != nil {
+		return err
+	}
+	return s.Cold.DeleteChunk(hash)
+}
+
+func (s *TieredStore) ListChunks() ([]string, error) {
+	hot, err := s.Hot.ListChunks()
+	if err != nil {
+		return nil, err
+	}
+	cold, err := s.Cold.ListChunks()
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool, len(hot))
+	for _, hash := range hot {
+		seen[hash] = true
+	}
+	for _, hash := range cold {
+		if !seen[hash] {
+			hot = append(hot, hash)
+		}
+	}
+	return hot, nil
+}
+
+// Demote moves hot chunks not accessed within maxAge to the cold tier and
+// returns how many were moved
+func (s *TieredStore) Demote(maxAge time.Duration) (int, error) {
+	cutoff := time.Now().Add(-maxAge)
+
+	s.mutex.Lock()
+	var stale []string
+	for hash, at := range s.lastAccess {
+		if at.Before(cutoff) {
+			stale = append(stale, hash)
+		}
+	}
+	s.mutex.Unlock()
+
+	moved := 0
+	for _, hash := range stale {
+		chunk, err := s.Hot.ReadChunk(hash)
+		if err != nil {
+			s.mutex.Lock()
+			delete(s.lastAccess, hash)
+			s.mutex.Unlock()
+			continue
+		}
+		if err := s.Cold.WriteChunk(chunk); err != nil {
+			return moved, err
+		}
+
+		s.mutex.Lock()
+		// Skip if the chunk was read while we were copying it
+		if at, ok := s.lastAccess[hash]; !ok || !at.Before(cutoff) {
+			s.mutex.Unlock()
+			continue
+		}
+		delete(s.lastAccess, hash)
+		s.mutex.Unlock()
+
+		if err := s.Hot.DeleteChunk(hash); err != nil {
+			return moved, err
+		}
+		moved++
+	}
+	return moved, nil
+}